@@ -6,18 +6,22 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"slices"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/LZUOSS/gh-proxy/internal/config"
+	"github.com/LZUOSS/gh-proxy/internal/policy"
 	"github.com/LZUOSS/gh-proxy/internal/server"
 	"github.com/LZUOSS/gh-proxy/internal/ssh"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 func main() {
 	// Parse command-line flags
 	configPath := flag.String("config", getEnvOrDefault("CONFIG_PATH", "./configs/config.yaml"), "path to config file")
+	rotateHostKeys := flag.Bool("rotate-ssh-host-keys", false, "replace the configured SSH host keys with new ones and exit (clients see a host key change on the next start)")
 	flag.Parse()
 
 	// Load configuration
@@ -28,21 +32,91 @@ func main() {
 
 	log.Printf("Configuration loaded successfully from: %s", *configPath)
 
+	if *rotateHostKeys {
+		rotateSSHHostKeys(cfg.SSH.HostKeyPaths)
+		return
+	}
+
 	// Create HTTP server
 	httpServer, err := server.NewHTTPServer(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create HTTP server: %v", err)
 	}
 
-	// Create SSH server with a simple config
-	// Using default SSH settings since SSH config is not in main config yet
-	sshServer, err := ssh.NewServer(&ssh.Config{
-		Address:        ":2222",
-		EnablePassword: true,
-		EnablePubKey:   true,
-	})
-	if err != nil {
-		log.Fatalf("Failed to create SSH server: %v", err)
+	// Create SSH server if enabled
+	var sshServer *ssh.Server
+	if cfg.SSH.Enabled {
+		var keyAuthorizers ssh.KeyAuthorizers
+		if cfg.SSH.AuthorizedKeysFile != "" {
+			authorizedKeys, err := ssh.NewAuthorizedKeysFile(cfg.SSH.AuthorizedKeysFile)
+			if err != nil {
+				log.Fatalf("Failed to load SSH authorized keys: %v", err)
+			}
+			keyAuthorizers = append(keyAuthorizers, authorizedKeys)
+		}
+		if cfg.SSH.GitHubKeys {
+			keyAuthorizers = append(keyAuthorizers, ssh.NewGitHubKeys(httpServer.ProxyClient(), cfg.SSH.GitHubKeysTTL))
+		}
+
+		upstreamConfig := &ssh.UpstreamConfig{
+			Address:        cfg.SSH.Upstream.Address,
+			User:           cfg.SSH.Upstream.User,
+			KnownHostsFile: cfg.SSH.Upstream.KnownHostsFile,
+			Dial:           httpServer.ProxyClient().DialContext,
+			Logger:         httpServer.Logger(),
+
+			HandshakeTimeout: cfg.SSH.Upstream.HandshakeTimeout,
+		}
+		for _, key := range cfg.SSH.Upstream.UserKeys {
+			upstreamConfig.UserKeys = append(upstreamConfig.UserKeys, ssh.UserKey{
+				Login:     key.Login,
+				KeySource: ssh.KeySource{KeyFile: key.KeyFile, AgentSocket: key.AgentSocket},
+			})
+		}
+		for _, key := range cfg.SSH.Upstream.DeployKeys {
+			upstreamConfig.DeployKeys = append(upstreamConfig.DeployKeys, ssh.DeployKey{
+				Repo:      key.Repo,
+				Logins:    key.Logins,
+				KeySource: ssh.KeySource{KeyFile: key.KeyFile, AgentSocket: key.AgentSocket},
+			})
+		}
+		var upstream *ssh.Upstream
+		var bridge *ssh.Bridge
+		if cfg.SSH.Upstream.Mode == "https" {
+			// Git over SSH is served through the HTTP handlers and proxy client
+			bridge = ssh.NewBridge(httpServer.Handler(), cfg.Server.BasePath, httpServer.Logger())
+		} else {
+			upstream, err = ssh.NewUpstream(upstreamConfig)
+			if err != nil {
+				log.Fatalf("Failed to configure SSH upstream: %v", err)
+			}
+		}
+
+		sshServer, err = ssh.NewServer(&ssh.Config{
+			Address:        cfg.SSH.Address,
+			HostKeyPaths:   cfg.SSH.HostKeyPaths,
+			EnablePassword: slices.Contains(cfg.SSH.AuthMethods, "password"),
+			EnablePubKey:   slices.Contains(cfg.SSH.AuthMethods, "publickey"),
+			LoginTimeout:   cfg.SSH.LoginTimeout,
+			IdleTimeout:    cfg.SSH.IdleTimeout,
+			MaxDuration:    cfg.SSH.MaxSessionDuration,
+
+			KeepaliveInterval: cfg.SSH.KeepaliveInterval,
+			KeepaliveCountMax: cfg.SSH.KeepaliveCountMax,
+
+			MaxConnections:      cfg.SSH.MaxConnections,
+			MaxConnectionsPerIP: cfg.SSH.MaxConnectionsPerIP,
+
+			KeyAuthorizer: keyAuthorizers,
+			Upstream:      upstream,
+			Bridge:        bridge,
+			Archiver:      ssh.NewArchiver(httpServer.Handler(), cfg.Server.BasePath, httpServer.Logger()),
+			PushPolicy:    policy.NewPushPolicy(&cfg.Git.Push, httpServer.Logger()),
+			Logger:        httpServer.Logger(),
+		})
+		if err != nil {
+			log.Fatalf("Failed to create SSH server: %v", err)
+		}
 	}
 
 	// Use WaitGroup to track server goroutines
@@ -60,14 +134,18 @@ func main() {
 	}()
 
 	// Start SSH server in goroutine
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		log.Println("Starting SSH server...")
-		if err := sshServer.Start(); err != nil {
-			errChan <- err
-		}
-	}()
+	if sshServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Println("Starting SSH server...")
+			if err := sshServer.Start(); err != nil {
+				errChan <- err
+			}
+		}()
+	} else {
+		log.Println("SSH server disabled")
+	}
 
 	// Setup signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -103,13 +181,15 @@ func main() {
 	}()
 
 	// Shutdown SSH server
-	shutdownWg.Add(1)
-	go func() {
-		defer shutdownWg.Done()
-		if err := sshServer.Stop(); err != nil {
-			log.Printf("SSH server shutdown error: %v", err)
-		}
-	}()
+	if sshServer != nil {
+		shutdownWg.Add(1)
+		go func() {
+			defer shutdownWg.Done()
+			if err := sshServer.Stop(ctx); err != nil {
+				log.Printf("SSH server shutdown error: %v", err)
+			}
+		}()
+	}
 
 	// Wait for all shutdowns to complete or timeout
 	done := make(chan struct{})
@@ -128,6 +208,23 @@ func main() {
 	log.Println("Application exited")
 }
 
+// rotateSSHHostKeys generates new SSH host keys, keeping the previous ones
+// next to them with an ".old" suffix. The ".old" keys are not offered to
+// clients; they only allow rolling back.
+func rotateSSHHostKeys(paths []string) {
+	if len(paths) == 0 {
+		log.Fatal("No SSH host keys configured (ssh.host_key_paths)")
+	}
+	for _, path := range paths {
+		hostKey, err := ssh.RotateHostKey(path)
+		if err != nil {
+			log.Fatalf("Failed to rotate SSH host key: %v", err)
+		}
+		log.Printf("Rotated SSH host key %s: %s", path, gossh.FingerprintSHA256(hostKey.PublicKey()))
+	}
+	log.Println("Restart the server to use the new host keys; clients will see a host key change")
+}
+
 // getEnvOrDefault returns the value of an environment variable or a default value
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -0,0 +1,19 @@
+package auth
+
+import "context"
+
+// contextKey is the type of the context key for authenticated tokens.
+type contextKey struct{}
+
+// NewContext returns a context carrying a token that was authenticated
+// outside the HTTP server, e.g. by the SSH front end. Requests bridged
+// in-process carry it so HTTP handlers see the same identity.
+func NewContext(ctx context.Context, token *Token) context.Context {
+	return context.WithValue(ctx, contextKey{}, token)
+}
+
+// FromContext returns the token stored in ctx by NewContext, if any.
+func FromContext(ctx context.Context) (*Token, bool) {
+	token, ok := ctx.Value(contextKey{}).(*Token)
+	return token, ok && token != nil
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
@@ -17,6 +18,9 @@ type Config struct {
 	Security  SecurityConfig  `mapstructure:"security"`
 	Metrics   MetricsConfig   `mapstructure:"metrics"`
 	Logging   LoggingConfig   `mapstructure:"logging"`
+	Git       GitConfig       `mapstructure:"git"`
+	Rewrite   RewriteConfig   `mapstructure:"rewrite"`
+	SSH       SSHConfig       `mapstructure:"ssh"`
 }
 
 // ServerConfig contains HTTP/HTTPS server settings
@@ -34,21 +38,78 @@ type ServerConfig struct {
 	MaxHeaderBytes   int           `mapstructure:"max_header_bytes"`
 	ShutdownTimeout  time.Duration `mapstructure:"shutdown_timeout"`
 	EnableGracefulShutdown bool     `mapstructure:"enable_graceful_shutdown"`
+	RewriteRedirects bool          `mapstructure:"rewrite_redirects"` // Rewrite GitHub Location/Link headers to proxy URLs
+	TrustedProxies   []string      `mapstructure:"trusted_proxies"`   // IPs or CIDRs whose X-Forwarded-Host/Proto headers are honoured
 }
 
 // ProxyConfig contains proxy client settings
 type ProxyConfig struct {
 	Enabled          bool          `mapstructure:"enabled"`
-	Type             string        `mapstructure:"type"` // "socks5" or "http"
+	Type             string        `mapstructure:"type"` // "socks5", "socks5h", "http" or "https"
 	Address          string        `mapstructure:"address"`
 	Username         string        `mapstructure:"username"`
 	Password         string        `mapstructure:"password"`
+	LocalDNS         bool          `mapstructure:"local_dns"` // Resolve host names locally for socks5 proxies instead of on the proxy
 	Timeout          time.Duration `mapstructure:"timeout"`
 	DialTimeout      time.Duration `mapstructure:"dial_timeout"`
 	KeepAlive        time.Duration `mapstructure:"keep_alive"`
 	MaxIdleConns     int           `mapstructure:"max_idle_conns"`
 	MaxIdleConnsPerHost int        `mapstructure:"max_idle_conns_per_host"`
 	IdleConnTimeout  time.Duration `mapstructure:"idle_conn_timeout"`
+
+	Upstreams      []ProxyUpstreamConfig  `mapstructure:"upstreams"`       // Pool of egress proxies, used instead of type and address
+	Strategy       string                 `mapstructure:"strategy"`        // "round_robin", "least_connections" or "latency"
+	FallbackDirect bool                   `mapstructure:"fallback_direct"` // Connect directly when no upstream proxy is available
+	HealthCheck    ProxyHealthCheckConfig `mapstructure:"health_check"`
+	Routes         []ProxyRouteConfig     `mapstructure:"routes"` // Ordered rules; the first match picks direct, reject or a named upstream
+
+	Retry     ProxyRetryConfig     `mapstructure:"retry"`     // Applies with and without a proxy
+	Segmented ProxySegmentedConfig `mapstructure:"segmented"` // Applies with and without a proxy
+}
+
+// ProxyRetryConfig controls retries of idempotent upstream requests
+type ProxyRetryConfig struct {
+	MaxAttempts    int           `mapstructure:"max_attempts"`    // Tries per request, including the first; 0 or 1 disables retries
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"` // Wait before the first retry, doubled for each further one
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`     // Longest wait between retries
+	Resume         bool          `mapstructure:"resume"`          // Resume interrupted downloads with Range requests
+}
+
+// ProxySegmentedConfig controls parallel ranged downloads of large release
+// assets and archives on cache misses
+type ProxySegmentedConfig struct {
+	Segments int    `mapstructure:"segments"` // Ranges fetched in parallel; 0 or 1 disables
+	MinSize  int64  `mapstructure:"min_size"` // Smallest download in bytes that is split
+	TempDir  string `mapstructure:"temp_dir"` // Holds ranges while they download; defaults to the system temp directory
+}
+
+// ProxyUpstreamConfig is an egress proxy of the upstream pool
+type ProxyUpstreamConfig struct {
+	Name      string `mapstructure:"name"` // Label in metrics; defaults to the address
+	Type      string `mapstructure:"type"` // "socks5", "socks5h", "http" or "https"
+	Address   string `mapstructure:"address"`
+	Username  string `mapstructure:"username"`
+	Password  string `mapstructure:"password"`
+	Weight    int    `mapstructure:"weight"`     // Relative share of new connections (default 1)
+	RouteOnly bool   `mapstructure:"route_only"` // Only used by routes naming it, never in the rotation
+}
+
+// ProxyRouteConfig sends matching upstream connections to a target. Each
+// non-empty condition must match; within a condition any entry may match.
+type ProxyRouteConfig struct {
+	Hosts    []string `mapstructure:"hosts"`    // Destination host globs, e.g. "*.githubusercontent.com"
+	Paths    []string `mapstructure:"paths"`    // URL path prefixes; never match SSH connections
+	Handlers []string `mapstructure:"handlers"` // api, raw, archive, releases, gist, git, lfs, ssh or keys
+	Target   string   `mapstructure:"target"`   // "direct", "reject" or the name of an upstream
+}
+
+// ProxyHealthCheckConfig controls when upstream proxies leave the rotation
+type ProxyHealthCheckConfig struct {
+	Interval    time.Duration `mapstructure:"interval"`     // Active probe interval; 0 disables active checks
+	Timeout     time.Duration `mapstructure:"timeout"`      // Probe timeout
+	Target      string        `mapstructure:"target"`       // host:port each proxy is asked to connect to
+	MaxFails    int           `mapstructure:"max_fails"`    // Consecutive failed connections before a proxy is ejected; 0 disables
+	FailTimeout time.Duration `mapstructure:"fail_timeout"` // How long an ejected proxy stays out of rotation
 }
 
 // CacheConfig contains caching settings
@@ -120,6 +181,147 @@ type LoggingConfig struct {
 	Compress    bool   `mapstructure:"compress"`
 }
 
+// GitConfig contains Git smart HTTP settings
+type GitConfig struct {
+	Mirror      MirrorConfig      `mapstructure:"mirror"`
+	FetchLimits FetchLimitsConfig `mapstructure:"fetch_limits"`
+	Push        PushConfig        `mapstructure:"push"`
+	Credentials CredentialsConfig `mapstructure:"credentials"`
+}
+
+// MirrorConfig contains settings for serving repositories from local bare mirrors
+type MirrorConfig struct {
+	Enabled         bool               `mapstructure:"enabled"`
+	Path            string             `mapstructure:"path"`             // Directory holding the bare mirrors
+	GitBinary       string             `mapstructure:"git_binary"`       // Path to the git executable
+	RefreshInterval time.Duration      `mapstructure:"refresh_interval"` // Default refresh interval for all mirrors
+	CommandTimeout  time.Duration      `mapstructure:"command_timeout"`  // Maximum duration of a clone or fetch
+	RefreshUsers    []string           `mapstructure:"refresh_users"`    // GitHub logins allowed to trigger a refresh over HTTP (empty = nobody)
+	Repos           []MirrorRepoConfig `mapstructure:"repos"`
+}
+
+// MirrorRepoConfig describes a single mirrored repository
+type MirrorRepoConfig struct {
+	Repo            string         `mapstructure:"repo"`             // "owner/repo"
+	Upstream        string         `mapstructure:"upstream"`         // Defaults to https://github.com/owner/repo.git
+	RefreshInterval *time.Duration `mapstructure:"refresh_interval"` // Overrides the default refresh interval; 0 refreshes only on startup and on demand
+	Public          bool           `mapstructure:"public"`           // Serve the mirror to every client; otherwise clients need read access on GitHub
+}
+
+// FetchLimitsConfig contains policies applied to git-upload-pack requests
+type FetchLimitsConfig struct {
+	Enabled      bool                    `mapstructure:"enabled"`
+	SizeCacheTTL time.Duration           `mapstructure:"size_cache_ttl"` // How long repository sizes from the GitHub API are cached
+	Default      FetchPolicyConfig       `mapstructure:"default"`        // Policy for repositories without a specific entry
+	Repos        []RepoFetchPolicyConfig `mapstructure:"repos"`          // Per-repository policies, first match wins
+}
+
+// FetchPolicyConfig limits what a single fetch or clone may request
+type FetchPolicyConfig struct {
+	MaxDepth       int      `mapstructure:"max_depth"`       // Requested depth is capped to this value; clones without a depth are rejected (0 = unlimited)
+	RequireShallow int      `mapstructure:"require_shallow"` // Full clones are rejected with a hint to use --depth N (0 = off)
+	MaxCloneSize   int64    `mapstructure:"max_clone_size"`  // Full clones of larger repositories without a reducing filter are rejected, in bytes (0 = unlimited)
+	RequireFilter  bool     `mapstructure:"require_filter"`  // Clones must use a partial-clone filter
+	AllowedFilters []string `mapstructure:"allowed_filters"` // Filters accepted when require_filter is set (empty = any)
+}
+
+// RepoFetchPolicyConfig is a fetch policy for repositories matching a pattern
+type RepoFetchPolicyConfig struct {
+	Repo              string `mapstructure:"repo"` // "owner/repo", or a glob such as "owner/*"
+	FetchPolicyConfig `mapstructure:",squash"`
+}
+
+// PushConfig controls git-receive-pack over HTTP and SSH
+type PushConfig struct {
+	Enabled      bool     `mapstructure:"enabled"`       // Pushes are denied unless enabled
+	AllowedRepos []string `mapstructure:"allowed_repos"` // "owner/repo" names or globs that may be pushed to
+	AllowedUsers []string `mapstructure:"allowed_users"` // GitHub logins allowed to push (empty = any authenticated user)
+}
+
+// CredentialsConfig controls the credentials sent to GitHub on Git smart HTTP requests
+type CredentialsConfig struct {
+	ForwardClient bool     `mapstructure:"forward_client"` // Forward the client's Authorization header upstream
+	Token         string   `mapstructure:"token"`          // Server-side token used for fetches from TokenRepos
+	TokenRepos    []string `mapstructure:"token_repos"`    // "owner/repo" names or globs that may use Token
+}
+
+// RewriteConfig controls rewriting of GitHub URLs inside proxied responses
+type RewriteConfig struct {
+	Content ContentRewriteConfig `mapstructure:"content"`
+	API     APIRewriteConfig     `mapstructure:"api"`
+}
+
+// ContentRewriteConfig controls rewriting of GitHub URLs in text responses.
+// Rewriting is opt-in: a request is rewritten if it carries QueryParam, its
+// path starts with one of PathPrefixes, or the response has one of ContentTypes.
+type ContentRewriteConfig struct {
+	Enabled      bool     `mapstructure:"enabled"`
+	QueryParam   string   `mapstructure:"query_param"`   // e.g. "rewrite" for ?rewrite=1 (empty = disabled)
+	PathPrefixes []string `mapstructure:"path_prefixes"` // Request paths always rewritten, relative to base_path
+	ContentTypes []string `mapstructure:"content_types"` // Media types always rewritten, e.g. text/x-shellscript or text/*
+}
+
+// APIRewriteConfig controls rewriting of download URL fields in GitHub API JSON responses
+type APIRewriteConfig struct {
+	Enabled bool     `mapstructure:"enabled"`
+	Fields  []string `mapstructure:"fields"` // JSON field names whose URL values are rewritten
+}
+
+// SSHConfig contains SSH front end settings
+type SSHConfig struct {
+	Enabled      bool     `mapstructure:"enabled"`
+	Address      string   `mapstructure:"address"`        // Listen address (e.g., ":2222")
+	HostKeyPaths []string `mapstructure:"host_key_paths"` // Host private key files, generated if missing
+	AuthMethods  []string `mapstructure:"auth_methods"`   // "password" and/or "publickey"
+
+	AuthorizedKeysFile string        `mapstructure:"authorized_keys_file"` // authorized_keys-style file mapping keys to GitHub logins
+	GitHubKeys         bool          `mapstructure:"github_keys"`          // Accept the keys the SSH user publishes on GitHub
+	GitHubKeysTTL      time.Duration `mapstructure:"github_keys_ttl"`      // How long published keys are cached
+
+	LoginTimeout       time.Duration `mapstructure:"login_timeout"`        // Maximum time to complete the handshake and authentication
+	IdleTimeout        time.Duration `mapstructure:"idle_timeout"`         // Close connections without channel traffic for this long (0 = never)
+	MaxSessionDuration time.Duration `mapstructure:"max_session_duration"` // Close connections open for this long (0 = never)
+	KeepaliveInterval  time.Duration `mapstructure:"keepalive_interval"`   // Send keepalives this often (0 = never)
+	KeepaliveCountMax  int           `mapstructure:"keepalive_count_max"`  // Close connections after this many unanswered keepalives
+
+	MaxConnections      int `mapstructure:"max_connections"`        // Concurrent connections (0 = unlimited)
+	MaxConnectionsPerIP int `mapstructure:"max_connections_per_ip"` // Concurrent connections per source IP (0 = unlimited)
+
+	Upstream SSHUpstreamConfig `mapstructure:"upstream"`
+}
+
+// SSHUpstreamConfig configures the SSH connection from the proxy to GitHub
+type SSHUpstreamConfig struct {
+	Mode           string `mapstructure:"mode"`             // "ssh" to dial Address, or "https" to bridge to smart HTTP through the proxy client
+	Address        string `mapstructure:"address"`          // e.g. github.com:22, ssh.github.com:443 or a GHES host
+	User           string `mapstructure:"user"`             // SSH user name on the upstream server
+	KnownHostsFile string `mapstructure:"known_hosts_file"` // Pinned host keys; GitHub's published keys if empty
+
+	HandshakeTimeout time.Duration `mapstructure:"handshake_timeout"` // Maximum time for the upstream SSH handshake
+
+	UserKeys   []SSHUserKeyConfig   `mapstructure:"user_keys"`   // Keys used on behalf of authenticated users, tried first
+	DeployKeys []SSHDeployKeyConfig `mapstructure:"deploy_keys"` // Keys used per repository, first match wins
+}
+
+// SSHKeySourceConfig names where upstream SSH keys come from; exactly one is set
+type SSHKeySourceConfig struct {
+	KeyFile     string `mapstructure:"key_file"`     // Unencrypted private key file
+	AgentSocket string `mapstructure:"agent_socket"` // ssh-agent socket offering the keys
+}
+
+// SSHUserKeyConfig maps an authenticated GitHub login to its upstream keys
+type SSHUserKeyConfig struct {
+	Login              string `mapstructure:"login"`
+	SSHKeySourceConfig `mapstructure:",squash"`
+}
+
+// SSHDeployKeyConfig maps repositories to deploy keys
+type SSHDeployKeyConfig struct {
+	Repo               string   `mapstructure:"repo"`   // "owner/repo", or a glob such as "owner/*"
+	Logins             []string `mapstructure:"logins"` // Logins allowed to use the key; "*" allows every authenticated session
+	SSHKeySourceConfig `mapstructure:",squash"`
+}
+
 // Load reads configuration from file and environment variables
 func Load(configPath string) (*Config, error) {
 	v := viper.New()
@@ -137,8 +339,9 @@ func Load(configPath string) (*Config, error) {
 		v.AddConfigPath(".")
 	}
 
-	// Enable environment variable overrides
+	// Enable environment variable overrides, e.g. GITHUB_PROXY_SSH_ADDRESS for ssh.address
 	v.SetEnvPrefix("GITHUB_PROXY")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	v.AutomaticEnv()
 
 	// Read configuration file
@@ -177,16 +380,32 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("server.max_header_bytes", 1<<20) // 1MB
 	v.SetDefault("server.shutdown_timeout", 30*time.Second)
 	v.SetDefault("server.enable_graceful_shutdown", true)
+	v.SetDefault("server.rewrite_redirects", true)
+	v.SetDefault("server.trusted_proxies", []string{"127.0.0.1", "::1"})
 
 	// Proxy defaults
 	v.SetDefault("proxy.enabled", false)
 	v.SetDefault("proxy.type", "socks5")
+	v.SetDefault("proxy.local_dns", false)
 	v.SetDefault("proxy.timeout", 30*time.Second)
 	v.SetDefault("proxy.dial_timeout", 10*time.Second)
 	v.SetDefault("proxy.keep_alive", 30*time.Second)
 	v.SetDefault("proxy.max_idle_conns", 100)
 	v.SetDefault("proxy.max_idle_conns_per_host", 10)
 	v.SetDefault("proxy.idle_conn_timeout", 90*time.Second)
+	v.SetDefault("proxy.strategy", "round_robin")
+	v.SetDefault("proxy.fallback_direct", false)
+	v.SetDefault("proxy.health_check.interval", 30*time.Second)
+	v.SetDefault("proxy.health_check.timeout", 5*time.Second)
+	v.SetDefault("proxy.health_check.target", "github.com:443")
+	v.SetDefault("proxy.health_check.max_fails", 3)
+	v.SetDefault("proxy.health_check.fail_timeout", 30*time.Second)
+	v.SetDefault("proxy.retry.max_attempts", 3)
+	v.SetDefault("proxy.retry.initial_backoff", 200*time.Millisecond)
+	v.SetDefault("proxy.retry.max_backoff", 5*time.Second)
+	v.SetDefault("proxy.retry.resume", true)
+	v.SetDefault("proxy.segmented.segments", 4)
+	v.SetDefault("proxy.segmented.min_size", 64*1024*1024)
 
 	// Cache defaults
 	v.SetDefault("cache.enabled", true)
@@ -238,6 +457,48 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("logging.max_backups", 3)
 	v.SetDefault("logging.max_age", 28) // days
 	v.SetDefault("logging.compress", true)
+
+	// Git defaults
+	v.SetDefault("git.mirror.enabled", false)
+	v.SetDefault("git.mirror.path", "./mirrors")
+	v.SetDefault("git.mirror.git_binary", "git")
+	v.SetDefault("git.mirror.refresh_interval", 10*time.Minute)
+	v.SetDefault("git.mirror.command_timeout", 30*time.Minute)
+	v.SetDefault("git.fetch_limits.enabled", false)
+	v.SetDefault("git.fetch_limits.size_cache_ttl", 1*time.Hour)
+	v.SetDefault("git.push.enabled", false)
+	v.SetDefault("git.credentials.forward_client", true)
+
+	// Rewrite defaults
+	v.SetDefault("rewrite.content.enabled", true)
+	v.SetDefault("rewrite.content.query_param", "rewrite")
+	v.SetDefault("rewrite.api.enabled", false)
+	v.SetDefault("rewrite.api.fields", []string{"browser_download_url", "tarball_url", "zipball_url", "clone_url", "download_url"})
+
+	// SSH defaults
+	v.SetDefault("ssh.enabled", true)
+	v.SetDefault("ssh.address", ":2222")
+	v.SetDefault("ssh.host_key_paths", []string{
+		"./ssh/ssh_host_ed25519_key",
+		"./ssh/ssh_host_ecdsa_key",
+		"./ssh/ssh_host_rsa_key",
+	})
+	v.SetDefault("ssh.auth_methods", []string{"password", "publickey"})
+	v.SetDefault("ssh.authorized_keys_file", "")
+	v.SetDefault("ssh.github_keys", false)
+	v.SetDefault("ssh.github_keys_ttl", 10*time.Minute)
+	v.SetDefault("ssh.login_timeout", 30*time.Second)
+	v.SetDefault("ssh.idle_timeout", 15*time.Minute)
+	v.SetDefault("ssh.max_session_duration", 2*time.Hour)
+	v.SetDefault("ssh.keepalive_interval", 30*time.Second)
+	v.SetDefault("ssh.keepalive_count_max", 3)
+	v.SetDefault("ssh.max_connections", 256)
+	v.SetDefault("ssh.max_connections_per_ip", 16)
+	v.SetDefault("ssh.upstream.mode", "ssh")
+	v.SetDefault("ssh.upstream.address", "github.com:22")
+	v.SetDefault("ssh.upstream.user", "git")
+	v.SetDefault("ssh.upstream.known_hosts_file", "")
+	v.SetDefault("ssh.upstream.handshake_timeout", 30*time.Second)
 }
 
 // Get returns a copy of the configuration value
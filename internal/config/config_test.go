@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -106,6 +107,18 @@ func TestValidateServerConfig(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "invalid trusted proxy",
+			cfg: ServerConfig{
+				HTTPPort:       8080,
+				ReadTimeout:    30 * time.Second,
+				WriteTimeout:   30 * time.Second,
+				IdleTimeout:    120 * time.Second,
+				MaxHeaderBytes: 1 << 20,
+				TrustedProxies: []string{"10.0.0.0/8", "proxy.local"},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -172,6 +185,142 @@ func TestValidateProxyConfig(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name:    "valid upstream pool",
+			cfg:     validPool(func(c *ProxyConfig) {}),
+			wantErr: false,
+		},
+		{
+			name: "pool without active health checks",
+			cfg: validPool(func(c *ProxyConfig) {
+				c.HealthCheck.Interval = 0
+				c.HealthCheck.Target = ""
+			}),
+			wantErr: false,
+		},
+		{
+			name:    "pool with invalid strategy",
+			cfg:     validPool(func(c *ProxyConfig) { c.Strategy = "random" }),
+			wantErr: true,
+		},
+		{
+			name:    "pool member with invalid type",
+			cfg:     validPool(func(c *ProxyConfig) { c.Upstreams[1].Type = "ftp" }),
+			wantErr: true,
+		},
+		{
+			name:    "pool member with invalid address",
+			cfg:     validPool(func(c *ProxyConfig) { c.Upstreams[0].Address = "proxy-a" }),
+			wantErr: true,
+		},
+		{
+			name:    "pool member with negative weight",
+			cfg:     validPool(func(c *ProxyConfig) { c.Upstreams[0].Weight = -1 }),
+			wantErr: true,
+		},
+		{
+			name:    "pool with duplicate names",
+			cfg:     validPool(func(c *ProxyConfig) { c.Upstreams[1].Name = "a" }),
+			wantErr: true,
+		},
+		{
+			name:    "pool with invalid health check target",
+			cfg:     validPool(func(c *ProxyConfig) { c.HealthCheck.Target = "github.com" }),
+			wantErr: true,
+		},
+		{
+			name:    "pool with max_fails and no fail_timeout",
+			cfg:     validPool(func(c *ProxyConfig) { c.HealthCheck.FailTimeout = 0 }),
+			wantErr: true,
+		},
+		{
+			name: "valid routes",
+			cfg: validPool(func(c *ProxyConfig) {
+				c.Routes = []ProxyRouteConfig{
+					{Hosts: []string{"api.github.com"}, Target: "a"},
+					{Hosts: []string{"*.githubusercontent.com"}, Paths: []string{"/github/"}, Target: "direct"},
+					{Handlers: []string{"ssh", "archive"}, Target: "reject"},
+				}
+			}),
+			wantErr: false,
+		},
+		{
+			name:    "route with unknown target",
+			cfg:     validPool(func(c *ProxyConfig) { c.Routes = []ProxyRouteConfig{{Target: "c"}} }),
+			wantErr: true,
+		},
+		{
+			name:    "route with invalid host pattern",
+			cfg:     validPool(func(c *ProxyConfig) { c.Routes = []ProxyRouteConfig{{Hosts: []string{"[github.com"}, Target: "a"}} }),
+			wantErr: true,
+		},
+		{
+			name:    "route with relative path",
+			cfg:     validPool(func(c *ProxyConfig) { c.Routes = []ProxyRouteConfig{{Paths: []string{"repos/"}, Target: "a"}} }),
+			wantErr: true,
+		},
+		{
+			name:    "route with unknown handler",
+			cfg:     validPool(func(c *ProxyConfig) { c.Routes = []ProxyRouteConfig{{Handlers: []string{"web"}, Target: "a"}} }),
+			wantErr: true,
+		},
+		{
+			name: "route-only pool with proxy endpoint",
+			cfg: validPool(func(c *ProxyConfig) {
+				c.Type = "socks5"
+				c.Address = "127.0.0.1:1080"
+				c.Upstreams[0].RouteOnly = true
+				c.Upstreams[1].RouteOnly = true
+			}),
+			wantErr: false,
+		},
+		{
+			name: "valid retries",
+			cfg: validPool(func(c *ProxyConfig) {
+				c.Retry = ProxyRetryConfig{MaxAttempts: 3, InitialBackoff: 200 * time.Millisecond, MaxBackoff: 5 * time.Second, Resume: true}
+			}),
+			wantErr: false,
+		},
+		{
+			name:    "retries checked with proxy disabled",
+			cfg:     ProxyConfig{Retry: ProxyRetryConfig{MaxAttempts: -1}},
+			wantErr: true,
+		},
+		{
+			name:    "retries without backoff",
+			cfg:     validPool(func(c *ProxyConfig) { c.Retry = ProxyRetryConfig{MaxAttempts: 3, MaxBackoff: time.Second} }),
+			wantErr: true,
+		},
+		{
+			name: "retries with max_backoff below initial_backoff",
+			cfg: validPool(func(c *ProxyConfig) {
+				c.Retry = ProxyRetryConfig{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Millisecond}
+			}),
+			wantErr: true,
+		},
+		{
+			name:    "valid segmented downloads",
+			cfg:     validPool(func(c *ProxyConfig) { c.Segmented = ProxySegmentedConfig{Segments: 4, MinSize: 64 << 20} }),
+			wantErr: false,
+		},
+		{
+			name:    "too many segments",
+			cfg:     ProxyConfig{Segmented: ProxySegmentedConfig{Segments: 33}},
+			wantErr: true,
+		},
+		{
+			name:    "negative segment min_size",
+			cfg:     validPool(func(c *ProxyConfig) { c.Segmented = ProxySegmentedConfig{Segments: 4, MinSize: -1} }),
+			wantErr: true,
+		},
+		{
+			name: "route-only pool without proxy endpoint",
+			cfg: validPool(func(c *ProxyConfig) {
+				c.Upstreams[0].RouteOnly = true
+				c.Upstreams[1].RouteOnly = true
+			}),
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -184,6 +333,33 @@ func TestValidateProxyConfig(t *testing.T) {
 	}
 }
 
+// validPool returns a valid proxy config with an upstream pool, modified
+// by modify.
+func validPool(modify func(c *ProxyConfig)) ProxyConfig {
+	c := ProxyConfig{
+		Enabled:             true,
+		Timeout:             30 * time.Second,
+		DialTimeout:         10 * time.Second,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		Upstreams: []ProxyUpstreamConfig{
+			{Name: "a", Type: "socks5", Address: "10.0.0.1:1080", Weight: 2},
+			{Name: "b", Type: "http", Address: "10.0.0.2:3128"},
+		},
+		Strategy: "least_connections",
+		HealthCheck: ProxyHealthCheckConfig{
+			Interval:    30 * time.Second,
+			Timeout:     5 * time.Second,
+			Target:      "github.com:443",
+			MaxFails:    3,
+			FailTimeout: 30 * time.Second,
+		},
+	}
+	modify(&c)
+	return c
+}
+
 func TestValidateCacheConfig(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -341,3 +517,339 @@ func TestValidateAuthConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateGitConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     GitConfig
+		wantErr bool
+	}{
+		{
+			name:    "mirror disabled",
+			cfg:     GitConfig{},
+			wantErr: false,
+		},
+		{
+			name: "valid mirror",
+			cfg: GitConfig{
+				Mirror: MirrorConfig{
+					Enabled:         true,
+					Path:            "./mirrors",
+					GitBinary:       "git",
+					RefreshInterval: 10 * time.Minute,
+					Repos:           []MirrorRepoConfig{{Repo: "owner/repo"}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "mirror without path",
+			cfg: GitConfig{
+				Mirror: MirrorConfig{
+					Enabled:   true,
+					GitBinary: "git",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid mirror repo",
+			cfg: GitConfig{
+				Mirror: MirrorConfig{
+					Enabled:   true,
+					Path:      "./mirrors",
+					GitBinary: "git",
+					Repos:     []MirrorRepoConfig{{Repo: "owner"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "empty mirror refresh user",
+			cfg: GitConfig{
+				Mirror: MirrorConfig{
+					Enabled:      true,
+					Path:         "./mirrors",
+					GitBinary:    "git",
+					RefreshUsers: []string{""},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate mirror repo",
+			cfg: GitConfig{
+				Mirror: MirrorConfig{
+					Enabled:   true,
+					Path:      "./mirrors",
+					GitBinary: "git",
+					Repos:     []MirrorRepoConfig{{Repo: "owner/repo"}, {Repo: "Owner/Repo"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid fetch limits",
+			cfg: GitConfig{
+				FetchLimits: FetchLimitsConfig{
+					Enabled: true,
+					Default: FetchPolicyConfig{MaxDepth: 100},
+					Repos: []RepoFetchPolicyConfig{
+						{Repo: "owner/*", FetchPolicyConfig: FetchPolicyConfig{RequireFilter: true, AllowedFilters: []string{"blob:none"}}},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "negative max depth",
+			cfg: GitConfig{
+				FetchLimits: FetchLimitsConfig{
+					Enabled: true,
+					Default: FetchPolicyConfig{MaxDepth: -1},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "require shallow deeper than max depth",
+			cfg: GitConfig{
+				FetchLimits: FetchLimitsConfig{
+					Enabled: true,
+					Default: FetchPolicyConfig{MaxDepth: 10, RequireShallow: 50},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid fetch limit repo pattern",
+			cfg: GitConfig{
+				FetchLimits: FetchLimitsConfig{
+					Enabled: true,
+					Repos:   []RepoFetchPolicyConfig{{Repo: "owner/[repo"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "push enabled with allowlist",
+			cfg: GitConfig{
+				Push: PushConfig{Enabled: true, AllowedRepos: []string{"owner/*"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "push enabled without allowlist",
+			cfg: GitConfig{
+				Push: PushConfig{Enabled: true},
+			},
+			wantErr: true,
+		},
+		{
+			name: "credentials token with repos",
+			cfg: GitConfig{
+				Credentials: CredentialsConfig{Token: "ghp_test", TokenRepos: []string{"owner/private"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "credentials token without repos",
+			cfg: GitConfig{
+				Credentials: CredentialsConfig{Token: "ghp_test"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "credentials repos without token",
+			cfg: GitConfig{
+				Credentials: CredentialsConfig{TokenRepos: []string{"owner/private"}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateGit(&tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateGit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRewrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RewriteConfig
+		wantErr bool
+	}{
+		{
+			name: "valid content rewriting",
+			cfg: RewriteConfig{Content: ContentRewriteConfig{
+				Enabled:      true,
+				QueryParam:   "rewrite",
+				PathPrefixes: []string{"/owner/repo/raw/"},
+				ContentTypes: []string{"text/x-shellscript", "text/*"},
+			}},
+			wantErr: false,
+		},
+		{
+			name:    "relative path prefix",
+			cfg:     RewriteConfig{Content: ContentRewriteConfig{PathPrefixes: []string{"owner/repo"}}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid content type",
+			cfg:     RewriteConfig{Content: ContentRewriteConfig{ContentTypes: []string{"shell"}}},
+			wantErr: true,
+		},
+		{
+			name:    "api rewriting without fields",
+			cfg:     RewriteConfig{API: APIRewriteConfig{Enabled: true}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRewrite(&tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateRewrite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateSSHConfig(t *testing.T) {
+	valid := SSHConfig{
+		Enabled:      true,
+		Address:      ":2222",
+		AuthMethods:  []string{"password", "publickey"},
+		LoginTimeout: 30 * time.Second,
+		IdleTimeout:  15 * time.Minute,
+		Upstream:     SSHUpstreamConfig{Mode: "ssh", Address: "github.com:22", User: "git", HandshakeTimeout: 30 * time.Second},
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*SSHConfig)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(c *SSHConfig) {}, wantErr: false},
+		{name: "disabled ignores other fields", modify: func(c *SSHConfig) { *c = SSHConfig{} }, wantErr: false},
+		{name: "missing port", modify: func(c *SSHConfig) { c.Address = "localhost" }, wantErr: true},
+		{name: "no auth methods", modify: func(c *SSHConfig) { c.AuthMethods = nil }, wantErr: true},
+		{name: "unknown auth method", modify: func(c *SSHConfig) { c.AuthMethods = []string{"keyboard-interactive"} }, wantErr: true},
+		{name: "github keys without ttl", modify: func(c *SSHConfig) { c.GitHubKeys = true }, wantErr: true},
+		{name: "github keys with ttl", modify: func(c *SSHConfig) { c.GitHubKeys = true; c.GitHubKeysTTL = time.Minute }, wantErr: false},
+		{name: "zero login timeout", modify: func(c *SSHConfig) { c.LoginTimeout = 0 }, wantErr: true},
+		{name: "negative idle timeout", modify: func(c *SSHConfig) { c.IdleTimeout = -time.Second }, wantErr: true},
+		{name: "negative session duration", modify: func(c *SSHConfig) { c.MaxSessionDuration = -time.Second }, wantErr: true},
+		{name: "keepalive without count", modify: func(c *SSHConfig) { c.KeepaliveInterval = 30 * time.Second }, wantErr: true},
+		{name: "keepalive with count", modify: func(c *SSHConfig) { c.KeepaliveInterval = 30 * time.Second; c.KeepaliveCountMax = 3 }, wantErr: false},
+		{name: "negative max connections", modify: func(c *SSHConfig) { c.MaxConnections = -1 }, wantErr: true},
+		{name: "negative max connections per ip", modify: func(c *SSHConfig) { c.MaxConnectionsPerIP = -1 }, wantErr: true},
+		{name: "zero upstream handshake timeout", modify: func(c *SSHConfig) { c.Upstream.HandshakeTimeout = 0 }, wantErr: true},
+		{name: "unknown upstream mode", modify: func(c *SSHConfig) { c.Upstream.Mode = "tcp" }, wantErr: true},
+		{name: "https bridge ignores ssh upstream", modify: func(c *SSHConfig) {
+			c.Upstream = SSHUpstreamConfig{Mode: "https", Address: "ghe.example.com:22"}
+		}, wantErr: false},
+		{name: "upstream over 443", modify: func(c *SSHConfig) { c.Upstream.Address = "ssh.github.com:443" }, wantErr: false},
+		{name: "upstream without port", modify: func(c *SSHConfig) { c.Upstream.Address = "github.com" }, wantErr: true},
+		{name: "upstream without user", modify: func(c *SSHConfig) { c.Upstream.User = "" }, wantErr: true},
+		{name: "ghes without known hosts", modify: func(c *SSHConfig) { c.Upstream.Address = "ghe.example.com:22" }, wantErr: true},
+		{name: "deploy key file", modify: func(c *SSHConfig) {
+			c.Upstream.DeployKeys = []SSHDeployKeyConfig{{Repo: "owner/*", Logins: []string{"octocat"}, SSHKeySourceConfig: SSHKeySourceConfig{KeyFile: "/keys/owner"}}}
+		}, wantErr: false},
+		{name: "deploy key without logins", modify: func(c *SSHConfig) {
+			c.Upstream.DeployKeys = []SSHDeployKeyConfig{{Repo: "owner/*", SSHKeySourceConfig: SSHKeySourceConfig{KeyFile: "/keys/owner"}}}
+		}, wantErr: true},
+		{name: "deploy key with invalid repo", modify: func(c *SSHConfig) {
+			c.Upstream.DeployKeys = []SSHDeployKeyConfig{{Repo: "owner", Logins: []string{"*"}, SSHKeySourceConfig: SSHKeySourceConfig{KeyFile: "/keys/owner"}}}
+		}, wantErr: true},
+		{name: "deploy key with two sources", modify: func(c *SSHConfig) {
+			c.Upstream.DeployKeys = []SSHDeployKeyConfig{{Repo: "owner/repo", Logins: []string{"*"}, SSHKeySourceConfig: SSHKeySourceConfig{KeyFile: "/keys/owner", AgentSocket: "/run/agent.sock"}}}
+		}, wantErr: true},
+		{name: "user key from agent", modify: func(c *SSHConfig) {
+			c.Upstream.UserKeys = []SSHUserKeyConfig{{Login: "octocat", SSHKeySourceConfig: SSHKeySourceConfig{AgentSocket: "/run/agent.sock"}}}
+		}, wantErr: false},
+		{name: "user key without source", modify: func(c *SSHConfig) {
+			c.Upstream.UserKeys = []SSHUserKeyConfig{{Login: "octocat"}}
+		}, wantErr: true},
+		{name: "ghes with known hosts", modify: func(c *SSHConfig) {
+			c.Upstream.Address = "ghe.example.com:22"
+			c.Upstream.KnownHostsFile = "/etc/gh-proxy/known_hosts"
+		}, wantErr: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.modify(&cfg)
+			err := validateSSH(&cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateSSH() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadSSHEnvOverride(t *testing.T) {
+	t.Setenv("GITHUB_PROXY_SSH_ADDRESS", ":2200")
+	t.Setenv("GITHUB_PROXY_SSH_ENABLED", "false")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("server:\n  http_port: 8080\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.SSH.Address != ":2200" {
+		t.Errorf("Expected SSH.Address :2200, got %q", cfg.SSH.Address)
+	}
+	if cfg.SSH.Enabled {
+		t.Errorf("Expected SSH.Enabled false from environment")
+	}
+}
+
+func TestLoadMirrorRefreshInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+git:
+  mirror:
+    refresh_interval: 10m
+    repos:
+      - repo: owner/default
+      - repo: owner/manual
+        refresh_interval: 0s
+      - repo: owner/fast
+        refresh_interval: 1m
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	repos := cfg.Git.Mirror.Repos
+	if len(repos) != 3 {
+		t.Fatalf("Expected 3 mirror repos, got %d", len(repos))
+	}
+	if repos[0].RefreshInterval != nil {
+		t.Errorf("Expected no interval override for %s, got %v", repos[0].Repo, *repos[0].RefreshInterval)
+	}
+	if repos[1].RefreshInterval == nil || *repos[1].RefreshInterval != 0 {
+		t.Errorf("Expected an explicit 0 interval for %s", repos[1].Repo)
+	}
+	if repos[2].RefreshInterval == nil || *repos[2].RefreshInterval != time.Minute {
+		t.Errorf("Expected a 1m interval for %s", repos[2].Repo)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path"
 	"strings"
 )
 
@@ -41,6 +42,18 @@ func Validate(cfg *Config) error {
 		return fmt.Errorf("logging config: %w", err)
 	}
 
+	if err := validateGit(&cfg.Git); err != nil {
+		return fmt.Errorf("git config: %w", err)
+	}
+
+	if err := validateRewrite(&cfg.Rewrite); err != nil {
+		return fmt.Errorf("rewrite config: %w", err)
+	}
+
+	if err := validateSSH(&cfg.SSH); err != nil {
+		return fmt.Errorf("ssh config: %w", err)
+	}
+
 	return nil
 }
 
@@ -96,36 +109,51 @@ func validateServer(cfg *ServerConfig) error {
 		return fmt.Errorf("max_header_bytes must be greater than 0")
 	}
 
+	for _, trusted := range cfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(trusted); err != nil && net.ParseIP(trusted) == nil {
+			return fmt.Errorf("invalid trusted proxy %q (expected an IP or CIDR)", trusted)
+		}
+	}
+
 	return nil
 }
 
 // validateProxy validates proxy configuration
 func validateProxy(cfg *ProxyConfig) error {
-	if !cfg.Enabled {
-		return nil
+	// Retries and segmented downloads apply to direct connections as well
+	if err := validateProxyRetry(&cfg.Retry); err != nil {
+		return err
 	}
-
-	// Validate proxy type
-	validTypes := []string{"socks5", "http", "https"}
-	if !contains(validTypes, cfg.Type) {
-		return fmt.Errorf("proxy type must be one of %v, got %s", validTypes, cfg.Type)
+	if cfg.Segmented.Segments < 0 || cfg.Segmented.Segments > 32 {
+		return fmt.Errorf("proxy segmented.segments must be between 0 and 32")
+	}
+	if cfg.Segmented.MinSize < 0 {
+		return fmt.Errorf("proxy segmented.min_size cannot be negative")
 	}
 
-	// Validate proxy address
-	if cfg.Address == "" {
-		return fmt.Errorf("proxy address is required when proxy is enabled")
+	if !cfg.Enabled {
+		return nil
 	}
 
-	// Validate address format (host:port)
-	host, port, err := net.SplitHostPort(cfg.Address)
-	if err != nil {
-		return fmt.Errorf("invalid proxy address format (expected host:port): %w", err)
+	// A pool of upstream proxies replaces type and address, unless all of
+	// them are reserved for routes
+	rotating := false
+	for _, upstream := range cfg.Upstreams {
+		rotating = rotating || !upstream.RouteOnly
 	}
-	if host == "" {
-		return fmt.Errorf("proxy host cannot be empty")
+	if len(cfg.Upstreams) > 0 {
+		if err := validateProxyPool(cfg); err != nil {
+			return err
+		}
 	}
-	if port == "" {
-		return fmt.Errorf("proxy port cannot be empty")
+	if !rotating {
+		if err := validateProxyEndpoint(cfg.Type, cfg.Address); err != nil {
+			return err
+		}
+	}
+
+	if err := validateProxyRoutes(cfg); err != nil {
+		return err
 	}
 
 	// Validate timeouts
@@ -156,6 +184,135 @@ func validateProxy(cfg *ProxyConfig) error {
 	return nil
 }
 
+// validateProxyEndpoint validates the type and address of a proxy
+func validateProxyEndpoint(proxyType, address string) error {
+	// Validate proxy type
+	validTypes := []string{"socks5", "socks5h", "http", "https"}
+	if !contains(validTypes, proxyType) {
+		return fmt.Errorf("proxy type must be one of %v, got %s", validTypes, proxyType)
+	}
+
+	// Validate proxy address
+	if address == "" {
+		return fmt.Errorf("proxy address is required when proxy is enabled")
+	}
+
+	// Validate address format (host:port)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid proxy address format (expected host:port): %w", err)
+	}
+	if host == "" {
+		return fmt.Errorf("proxy host cannot be empty")
+	}
+	if port == "" {
+		return fmt.Errorf("proxy port cannot be empty")
+	}
+
+	return nil
+}
+
+// validateProxyPool validates the upstream proxy pool
+func validateProxyPool(cfg *ProxyConfig) error {
+	validStrategies := []string{"round_robin", "least_connections", "latency"}
+	if !contains(validStrategies, cfg.Strategy) {
+		return fmt.Errorf("proxy strategy must be one of %v, got %s", validStrategies, cfg.Strategy)
+	}
+
+	names := make(map[string]bool)
+	for i, upstream := range cfg.Upstreams {
+		if err := validateProxyEndpoint(upstream.Type, upstream.Address); err != nil {
+			return fmt.Errorf("upstreams[%d]: %w", i, err)
+		}
+		if upstream.Weight < 0 {
+			return fmt.Errorf("upstreams[%d]: weight cannot be negative", i)
+		}
+
+		name := upstream.Name
+		if name == "" {
+			name = upstream.Address
+		}
+		if names[name] {
+			return fmt.Errorf("upstreams[%d]: duplicate name %q", i, name)
+		}
+		names[name] = true
+	}
+
+	check := &cfg.HealthCheck
+	if check.Interval < 0 {
+		return fmt.Errorf("health_check.interval cannot be negative")
+	}
+	if check.Interval > 0 {
+		if check.Timeout <= 0 {
+			return fmt.Errorf("health_check.timeout must be greater than 0")
+		}
+		if host, port, err := net.SplitHostPort(check.Target); err != nil || host == "" || port == "" {
+			return fmt.Errorf("invalid health_check.target %q (expected host:port)", check.Target)
+		}
+	}
+	if check.MaxFails < 0 {
+		return fmt.Errorf("health_check.max_fails cannot be negative")
+	}
+	if check.MaxFails > 0 && check.FailTimeout <= 0 {
+		return fmt.Errorf("health_check.fail_timeout must be greater than 0 when max_fails is set")
+	}
+
+	return nil
+}
+
+// validateProxyRoutes validates routing rules against the upstream names
+func validateProxyRoutes(cfg *ProxyConfig) error {
+	targets := []string{"direct", "reject"}
+	for _, upstream := range cfg.Upstreams {
+		name := upstream.Name
+		if name == "" {
+			name = upstream.Address
+		}
+		targets = append(targets, name)
+	}
+	validHandlers := []string{"api", "raw", "archive", "releases", "gist", "git", "lfs", "ssh", "keys"}
+
+	for i, route := range cfg.Routes {
+		if !contains(targets, route.Target) {
+			return fmt.Errorf("routes[%d]: target must be direct, reject or an upstream name, got %q", i, route.Target)
+		}
+		for _, pattern := range route.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("routes[%d]: invalid host pattern %q", i, pattern)
+			}
+		}
+		for _, prefix := range route.Paths {
+			if !strings.HasPrefix(prefix, "/") {
+				return fmt.Errorf("routes[%d]: path prefix %q must start with /", i, prefix)
+			}
+		}
+		for _, handler := range route.Handlers {
+			if !contains(validHandlers, handler) {
+				return fmt.Errorf("routes[%d]: handler must be one of %v, got %s", i, validHandlers, handler)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateProxyRetry validates the retry policy of upstream requests
+func validateProxyRetry(cfg *ProxyRetryConfig) error {
+	if cfg.MaxAttempts < 0 {
+		return fmt.Errorf("proxy retry.max_attempts cannot be negative")
+	}
+	if cfg.MaxAttempts <= 1 {
+		return nil
+	}
+	if cfg.InitialBackoff <= 0 {
+		return fmt.Errorf("proxy retry.initial_backoff must be greater than 0")
+	}
+	if cfg.MaxBackoff < cfg.InitialBackoff {
+		return fmt.Errorf("proxy retry.max_backoff cannot be less than initial_backoff")
+	}
+	return nil
+}
+
 // validateCache validates cache configuration
 func validateCache(cfg *CacheConfig) error {
 	if !cfg.Enabled {
@@ -366,6 +523,186 @@ func validateLogging(cfg *LoggingConfig) error {
 	return nil
 }
 
+// validateGit validates Git smart HTTP configuration
+func validateGit(cfg *GitConfig) error {
+	if err := validateMirror(&cfg.Mirror); err != nil {
+		return fmt.Errorf("mirror: %w", err)
+	}
+
+	if err := validateFetchLimits(&cfg.FetchLimits); err != nil {
+		return fmt.Errorf("fetch_limits: %w", err)
+	}
+
+	if err := validatePush(&cfg.Push); err != nil {
+		return fmt.Errorf("push: %w", err)
+	}
+
+	if err := validateCredentials(&cfg.Credentials); err != nil {
+		return fmt.Errorf("credentials: %w", err)
+	}
+
+	return nil
+}
+
+// validatePush validates the push policy
+func validatePush(cfg *PushConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	if len(cfg.AllowedRepos) == 0 {
+		return fmt.Errorf("allowed_repos must not be empty when push is enabled")
+	}
+	for _, repo := range cfg.AllowedRepos {
+		if !isRepoPattern(repo) {
+			return fmt.Errorf("invalid repo pattern %q (expected owner/repo or a glob such as owner/*)", repo)
+		}
+	}
+	for _, user := range cfg.AllowedUsers {
+		if user == "" {
+			return fmt.Errorf("allowed_users cannot contain empty names")
+		}
+	}
+
+	return nil
+}
+
+// validateCredentials validates the upstream credential settings
+func validateCredentials(cfg *CredentialsConfig) error {
+	if cfg.Token == "" {
+		if len(cfg.TokenRepos) > 0 {
+			return fmt.Errorf("token_repos requires token to be set")
+		}
+		return nil
+	}
+
+	if len(cfg.TokenRepos) == 0 {
+		return fmt.Errorf("token_repos must not be empty when token is set")
+	}
+	for _, repo := range cfg.TokenRepos {
+		if !isRepoPattern(repo) {
+			return fmt.Errorf("invalid repo pattern %q (expected owner/repo or a glob such as owner/*)", repo)
+		}
+	}
+
+	return nil
+}
+
+// validateFetchLimits validates git-upload-pack policies
+func validateFetchLimits(cfg *FetchLimitsConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	if cfg.SizeCacheTTL < 0 {
+		return fmt.Errorf("size_cache_ttl cannot be negative")
+	}
+
+	if err := validateFetchPolicy(&cfg.Default); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+
+	for _, repo := range cfg.Repos {
+		if !isRepoPattern(repo.Repo) {
+			return fmt.Errorf("invalid repo pattern %q (expected owner/repo or a glob such as owner/*)", repo.Repo)
+		}
+		if err := validateFetchPolicy(&repo.FetchPolicyConfig); err != nil {
+			return fmt.Errorf("%s: %w", repo.Repo, err)
+		}
+	}
+
+	return nil
+}
+
+// validateFetchPolicy validates a single fetch policy
+func validateFetchPolicy(cfg *FetchPolicyConfig) error {
+	if cfg.MaxDepth < 0 {
+		return fmt.Errorf("max_depth cannot be negative")
+	}
+	if cfg.RequireShallow < 0 {
+		return fmt.Errorf("require_shallow cannot be negative")
+	}
+	if cfg.MaxDepth > 0 && cfg.RequireShallow > cfg.MaxDepth {
+		return fmt.Errorf("require_shallow cannot be greater than max_depth")
+	}
+	if cfg.MaxCloneSize < 0 {
+		return fmt.Errorf("max_clone_size cannot be negative")
+	}
+	for _, filter := range cfg.AllowedFilters {
+		if filter == "" || strings.ContainsAny(filter, " \t\n") {
+			return fmt.Errorf("invalid filter spec %q", filter)
+		}
+	}
+
+	return nil
+}
+
+// validateMirror validates local bare-mirror configuration
+func validateMirror(cfg *MirrorConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	if cfg.Path == "" {
+		return fmt.Errorf("path is required when mirroring is enabled")
+	}
+	if cfg.GitBinary == "" {
+		return fmt.Errorf("git_binary cannot be empty")
+	}
+	if cfg.RefreshInterval < 0 {
+		return fmt.Errorf("refresh_interval cannot be negative")
+	}
+	if cfg.CommandTimeout < 0 {
+		return fmt.Errorf("command_timeout cannot be negative")
+	}
+	for _, user := range cfg.RefreshUsers {
+		if user == "" {
+			return fmt.Errorf("refresh_users cannot contain empty names")
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, repo := range cfg.Repos {
+		if !isRepoName(repo.Repo) {
+			return fmt.Errorf("invalid repo %q (expected owner/repo)", repo.Repo)
+		}
+		key := strings.ToLower(repo.Repo)
+		if seen[key] {
+			return fmt.Errorf("duplicate repo %q", repo.Repo)
+		}
+		seen[key] = true
+
+		if repo.RefreshInterval != nil && *repo.RefreshInterval < 0 {
+			return fmt.Errorf("refresh_interval for %s cannot be negative", repo.Repo)
+		}
+	}
+
+	return nil
+}
+
+// isRepoName checks if a string has the form "owner/repo"
+func isRepoName(s string) bool {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// isRepoPattern checks if a string is an "owner/repo" name or glob
+func isRepoPattern(s string) bool {
+	if !isRepoName(s) {
+		return false
+	}
+	_, err := path.Match(s, "")
+	return err == nil
+}
+
 // contains checks if a slice contains a string
 func contains(slice []string, item string) bool {
 	for _, s := range slice {
@@ -375,3 +712,144 @@ func contains(slice []string, item string) bool {
 	}
 	return false
 }
+
+// validateRewrite validates response rewriting settings
+func validateRewrite(cfg *RewriteConfig) error {
+	for _, prefix := range cfg.Content.PathPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("content.path_prefixes entry %q must start with /", prefix)
+		}
+	}
+	for _, contentType := range cfg.Content.ContentTypes {
+		if !strings.Contains(contentType, "/") {
+			return fmt.Errorf("content.content_types entry %q is not a media type", contentType)
+		}
+	}
+
+	if cfg.API.Enabled && len(cfg.API.Fields) == 0 {
+		return fmt.Errorf("api.fields must not be empty when api rewriting is enabled")
+	}
+
+	return nil
+}
+
+// validateSSH validates SSH front end settings
+func validateSSH(cfg *SSHConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	if _, port, err := net.SplitHostPort(cfg.Address); err != nil || port == "" {
+		return fmt.Errorf("invalid address %q (expected host:port or :port)", cfg.Address)
+	}
+
+	if len(cfg.AuthMethods) == 0 {
+		return fmt.Errorf("auth_methods must not be empty")
+	}
+	for _, method := range cfg.AuthMethods {
+		if method != "password" && method != "publickey" {
+			return fmt.Errorf("unsupported auth method %q (must be password or publickey)", method)
+		}
+	}
+
+	for _, path := range cfg.HostKeyPaths {
+		if path == "" {
+			return fmt.Errorf("host_key_paths cannot contain empty paths")
+		}
+	}
+
+	if cfg.GitHubKeys && cfg.GitHubKeysTTL <= 0 {
+		return fmt.Errorf("github_keys_ttl must be greater than 0 when github_keys is enabled")
+	}
+
+	if cfg.LoginTimeout <= 0 {
+		return fmt.Errorf("login_timeout must be greater than 0")
+	}
+	if cfg.IdleTimeout < 0 {
+		return fmt.Errorf("idle_timeout cannot be negative")
+	}
+	if cfg.MaxSessionDuration < 0 {
+		return fmt.Errorf("max_session_duration cannot be negative")
+	}
+	if cfg.KeepaliveInterval < 0 {
+		return fmt.Errorf("keepalive_interval cannot be negative")
+	}
+	if cfg.KeepaliveInterval > 0 && cfg.KeepaliveCountMax <= 0 {
+		return fmt.Errorf("keepalive_count_max must be greater than 0 when keepalive_interval is set")
+	}
+
+	if cfg.MaxConnections < 0 {
+		return fmt.Errorf("max_connections cannot be negative")
+	}
+	if cfg.MaxConnectionsPerIP < 0 {
+		return fmt.Errorf("max_connections_per_ip cannot be negative")
+	}
+
+	return validateSSHUpstream(&cfg.Upstream)
+}
+
+// validateSSHUpstream validates the upstream SSH connection settings
+func validateSSHUpstream(cfg *SSHUpstreamConfig) error {
+	switch cfg.Mode {
+	case "ssh":
+	case "https":
+		// Git commands go through the HTTP side; the SSH settings are unused
+		return nil
+	default:
+		return fmt.Errorf("invalid upstream.mode %q (must be ssh or https)", cfg.Mode)
+	}
+
+	host, port, err := net.SplitHostPort(cfg.Address)
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("invalid upstream.address %q (expected host:port)", cfg.Address)
+	}
+
+	if cfg.User == "" {
+		return fmt.Errorf("upstream.user cannot be empty")
+	}
+
+	if cfg.HandshakeTimeout <= 0 {
+		return fmt.Errorf("upstream.handshake_timeout must be greater than 0")
+	}
+
+	// GitHub's published host keys only verify GitHub's own SSH servers
+	if cfg.KnownHostsFile == "" && host != "github.com" && host != "ssh.github.com" {
+		return fmt.Errorf("upstream.known_hosts_file is required for upstream host %q", host)
+	}
+
+	for i, key := range cfg.UserKeys {
+		if key.Login == "" {
+			return fmt.Errorf("upstream.user_keys[%d]: login cannot be empty", i)
+		}
+		if err := validateSSHKeySource(&key.SSHKeySourceConfig); err != nil {
+			return fmt.Errorf("upstream.user_keys[%d]: %w", i, err)
+		}
+	}
+	for i, key := range cfg.DeployKeys {
+		if !isRepoPattern(key.Repo) {
+			return fmt.Errorf("upstream.deploy_keys[%d]: invalid repo pattern %q (expected owner/repo or a glob such as owner/*)", i, key.Repo)
+		}
+		if len(key.Logins) == 0 {
+			return fmt.Errorf("upstream.deploy_keys[%d]: logins cannot be empty (use [\"*\"] to allow every login)", i)
+		}
+		for _, login := range key.Logins {
+			if login == "" {
+				return fmt.Errorf("upstream.deploy_keys[%d]: logins cannot contain an empty login", i)
+			}
+		}
+		if err := validateSSHKeySource(&key.SSHKeySourceConfig); err != nil {
+			return fmt.Errorf("upstream.deploy_keys[%d]: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validateSSHKeySource validates that exactly one key source is set
+func validateSSHKeySource(cfg *SSHKeySourceConfig) error {
+	if (cfg.KeyFile == "") == (cfg.AgentSocket == "") {
+		return fmt.Errorf("exactly one of key_file and agent_socket must be set")
+	}
+
+	return nil
+}
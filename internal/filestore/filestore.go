@@ -0,0 +1,174 @@
+// Package filestore keeps complete downloads on disk so that files too large
+// to hold in memory can still be cached.
+//
+// A download is written to a file from Create, or assembled at Path by a
+// segmented download, while it streams to the client. Only once it is
+// complete, and verified where the caller can, is it committed and served
+// by Open. Files expire after their TTL, and the files that expire first
+// are removed when the store grows past its size limit.
+//
+// The index of committed files is kept in memory. Files left in the store
+// directory by an earlier run are removed by New.
+package filestore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partSuffix marks files that are still being written.
+const partSuffix = ".part"
+
+// Store is a size-bounded directory of complete downloads.
+type Store struct {
+	dir     string
+	maxSize int64 // 0 = unlimited
+
+	mu    sync.Mutex
+	files map[string]file // keyed by file name
+	size  int64
+}
+
+// file is a committed download.
+type file struct {
+	size    int64
+	headers map[string]string
+	expires time.Time
+}
+
+// Entry is a committed download returned by Open.
+type Entry struct {
+	Path    string
+	Size    int64
+	Headers map[string]string
+}
+
+// New creates a store in dir that holds up to maxSize bytes (0 = unlimited).
+func New(dir string, maxSize int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create file store %s: %w", dir, err)
+	}
+
+	// Files of an earlier run are not in the index
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file store %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if isStoreFile(entry.Name()) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	return &Store{dir: dir, maxSize: maxSize, files: make(map[string]file)}, nil
+}
+
+// Path returns where the download of key is kept once committed.
+func (s *Store) Path(key string) string {
+	return filepath.Join(s.dir, fileName(key))
+}
+
+// Create creates a file for the download of key. The caller commits it with
+// Commit, or removes it if the download fails.
+func (s *Store) Create(key string) (*os.File, error) {
+	return os.CreateTemp(s.dir, fileName(key)+".*"+partSuffix)
+}
+
+// Commit adds the complete download of key at name, a file from Create or
+// Path, to the store. headers are returned with it by Open until ttl passes.
+func (s *Store) Commit(key, name string, headers map[string]string, ttl time.Duration) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fmt.Errorf("failed to commit %s: %w", key, err)
+	}
+	path := s.Path(key)
+	if name != path {
+		if err := os.Rename(name, path); err != nil {
+			return fmt.Errorf("failed to commit %s: %w", key, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fname := fileName(key)
+	s.size -= s.files[fname].size
+	s.files[fname] = file{size: info.Size(), headers: headers, expires: time.Now().Add(ttl)}
+	s.size += info.Size()
+	s.evictLocked(fname)
+	return nil
+}
+
+// Open returns the committed download of key, if it has not expired.
+func (s *Store) Open(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fname := fileName(key)
+	f, ok := s.files[fname]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(f.expires) {
+		s.removeLocked(fname)
+		return nil, false
+	}
+	return &Entry{Path: filepath.Join(s.dir, fname), Size: f.size, Headers: f.headers}, true
+}
+
+// evictLocked removes expired files and, while the store is over its size
+// limit, the files that expire first, keeping the file just committed.
+// s.mu must be held.
+func (s *Store) evictLocked(keep string) {
+	if s.maxSize <= 0 || s.size <= s.maxSize {
+		return
+	}
+
+	now := time.Now()
+	for name, f := range s.files {
+		if !now.Before(f.expires) {
+			s.removeLocked(name)
+		}
+	}
+	for s.size > s.maxSize {
+		oldest := ""
+		for name, f := range s.files {
+			if name != keep && (oldest == "" || f.expires.Before(s.files[oldest].expires)) {
+				oldest = name
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		s.removeLocked(oldest)
+	}
+}
+
+// removeLocked removes a committed file. s.mu must be held.
+func (s *Store) removeLocked(name string) {
+	s.size -= s.files[name].size
+	delete(s.files, name)
+	os.Remove(filepath.Join(s.dir, name))
+}
+
+// fileName maps a key to a file name, so any key is safe to use.
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// isStoreFile reports whether name is a committed or partial file of a store.
+func isStoreFile(name string) bool {
+	base, _, _ := strings.Cut(name, ".")
+	if len(base) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(base)
+	return err == nil && (base == name || strings.HasSuffix(name, partSuffix))
+}
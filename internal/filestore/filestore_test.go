@@ -0,0 +1,98 @@
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, s *Store, key, content string) string {
+	t.Helper()
+	f, err := s.Create(key)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatalf("WriteString() error = %v", err)
+	}
+	return f.Name()
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, 10)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if _, ok := s.Open("a"); ok {
+		t.Error("Open() found a file that was never committed")
+	}
+
+	name := writeFile(t, s, "a", "aaaa")
+	if _, ok := s.Open("a"); ok {
+		t.Error("Open() found a file before it was committed")
+	}
+	headers := map[string]string{"Content-Type": "application/octet-stream"}
+	if err := s.Commit("a", name, headers, time.Hour); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	entry, ok := s.Open("a")
+	if !ok {
+		t.Fatal("Open() did not find the committed file")
+	}
+	if data, err := os.ReadFile(entry.Path); err != nil || string(data) != "aaaa" {
+		t.Errorf("file = %q, %v, want aaaa", data, err)
+	}
+	if entry.Size != 4 || entry.Headers["Content-Type"] != "application/octet-stream" {
+		t.Errorf("entry = %+v, want 4 bytes with the committed headers", entry)
+	}
+
+	// Files assembled at Path are committed in place
+	if err := os.WriteFile(s.Path("b"), []byte("bbbb"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := s.Commit("b", s.Path("b"), nil, 2*time.Hour); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+
+	// Over the size limit, the file that expires first goes
+	if err := s.Commit("c", writeFile(t, s, "c", "cccc"), nil, 3*time.Hour); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if _, ok := s.Open("a"); ok {
+		t.Error("expected the file expiring first to be evicted")
+	}
+	if _, err := os.Stat(entry.Path); !os.IsNotExist(err) {
+		t.Errorf("evicted file still exists: %v", err)
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, ok := s.Open(key); !ok {
+			t.Errorf("Open(%q) did not find the file", key)
+		}
+	}
+
+	// Expired files are not served
+	if err := s.Commit("d", writeFile(t, s, "d", "d"), nil, -time.Second); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if _, ok := s.Open("d"); ok {
+		t.Error("Open() returned an expired file")
+	}
+
+	// A new store removes what an earlier run left, but nothing else
+	writeFile(t, s, "e", "partial")
+	other := filepath.Join(dir, "other")
+	if err := os.WriteFile(other, nil, 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := New(dir, 10); err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "other" {
+		t.Errorf("directory holds %v, want only other", entries)
+	}
+}
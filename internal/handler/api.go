@@ -11,22 +11,35 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/LZUOSS/gh-proxy/internal/cache"
 	"github.com/LZUOSS/gh-proxy/internal/proxy"
+	"github.com/LZUOSS/gh-proxy/internal/rewrite"
 )
 
+// maxAPICacheSize is the largest API response that is cached or rewritten.
+const maxAPICacheSize = 5 * 1024 * 1024
+
 // APIHandler handles GitHub API requests.
 // Route: /api/*path
+//
+// If a rewriter is configured, URL fields such as browser_download_url in
+// JSON responses are rewritten to proxy URLs. Rewritten bodies depend on the
+// proxy URL the client used and are cached separately from the raw body.
 type APIHandler struct {
-	cache  *cache.Cache
-	client *proxy.ProxyClient
-	token  string // GitHub API token for authentication
+	cache    *cache.Cache
+	client   *proxy.ProxyClient
+	token    string            // GitHub API token for authentication
+	rewriter *rewrite.Rewriter // Rewrites URL fields (optional)
+	fields   []string          // JSON fields rewritten by rewriter
 }
 
 // NewAPIHandler creates a new API handler.
-func NewAPIHandler(cache *cache.Cache, client *proxy.ProxyClient, token string) *APIHandler {
+// rewriter may be nil to return API responses unchanged.
+func NewAPIHandler(cache *cache.Cache, client *proxy.ProxyClient, token string, rewriter *rewrite.Rewriter, fields []string) *APIHandler {
 	return &APIHandler{
-		cache:  cache,
-		client: client,
-		token:  token,
+		cache:    cache,
+		client:   client,
+		token:    token,
+		rewriter: rewriter,
+		fields:   fields,
 	}
 }
 
@@ -58,6 +71,11 @@ func (h *APIHandler) Handle(c *gin.Context) {
 	if shouldCache {
 		cacheKey = cache.GenerateKey("api", path, c.Request.URL.RawQuery, "", "", "")
 
+		if h.rewriter != nil {
+			h.handleRewritten(c, upstreamURL, cacheKey, path)
+			return
+		}
+
 		// Try memory cache first
 		if entry, ok := h.cache.Get(cacheKey); ok {
 			h.serveFromCache(c, entry)
@@ -69,6 +87,142 @@ func (h *APIHandler) Handle(c *gin.Context) {
 	h.forwardRequest(c, upstreamURL, shouldCache, cacheKey)
 }
 
+// handleRewritten serves a GET request with URL fields rewritten, using the
+// rewritten cache entry, the raw cache entry or GitHub, in that order.
+func (h *APIHandler) handleRewritten(c *gin.Context, upstreamURL, cacheKey, path string) {
+	base := h.rewriter.ProxyBase(c.Request)
+	rewrittenKey := cache.GenerateKey("api-rewritten", path, c.Request.URL.RawQuery, base, "", "")
+
+	if entry, ok := h.cache.Get(rewrittenKey); ok {
+		h.serveFromCache(c, entry)
+		return
+	}
+
+	if entry, ok := h.cache.Get(cacheKey); ok {
+		if rewritten, ok := h.rewriteEntry(entry, base); ok {
+			h.cache.Set(rewrittenKey, rewritten, h.determineTTL(c.Request.URL.Path))
+			h.serveFromCache(c, rewritten)
+			return
+		}
+		h.serveFromCache(c, entry)
+		return
+	}
+
+	h.fetchAndRewrite(c, upstreamURL, cacheKey, rewrittenKey, base)
+}
+
+// fetchAndRewrite fetches a GET request from GitHub and rewrites its JSON
+// body. Both the raw and the rewritten body are cached.
+func (h *APIHandler) fetchAndRewrite(c *gin.Context, upstreamURL, cacheKey, rewrittenKey, base string) {
+	req, err := http.NewRequestWithContext(proxy.WithHandler(c.Request.Context(), proxy.HandlerAPI), http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
+		return
+	}
+
+	h.copyHeaders(c, req)
+
+	// The body is parsed, so it must arrive uncompressed
+	req.Header.Del("Accept-Encoding")
+
+	if h.token != "" {
+		req.Header.Set("Authorization", "token "+h.token)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to forward request to GitHub API"})
+		return
+	}
+	defer resp.Body.Close()
+
+	headers := make(map[string]string)
+	for key, values := range resp.Header {
+		if len(values) > 0 {
+			headers[key] = values[0]
+		}
+	}
+
+	// Only successful, reasonably small JSON responses are rewritten
+	if resp.StatusCode != http.StatusOK || !isJSON(resp.Header.Get("Content-Type")) ||
+		resp.ContentLength > maxAPICacheSize {
+		for key, value := range headers {
+			c.Header(key, value)
+		}
+		c.Status(resp.StatusCode)
+		io.Copy(c.Writer, resp.Body)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAPICacheSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to read response from GitHub API"})
+		return
+	}
+	if len(data) > maxAPICacheSize {
+		// Too large to rewrite; stream it unchanged
+		for key, value := range headers {
+			c.Header(key, value)
+		}
+		c.Status(resp.StatusCode)
+		c.Writer.Write(data)
+		io.Copy(c.Writer, resp.Body)
+		return
+	}
+
+	entry := &cache.CacheEntry{
+		Data:    data,
+		Headers: headers,
+		ETag:    resp.Header.Get("ETag"),
+	}
+	ttl := h.determineTTL(c.Request.URL.Path)
+	h.cache.Set(cacheKey, entry, ttl)
+
+	rewritten, ok := h.rewriteEntry(entry, base)
+	if !ok {
+		c.Header("X-Cache", "MISS")
+		h.writeEntry(c, entry)
+		return
+	}
+	h.cache.Set(rewrittenKey, rewritten, ttl)
+
+	c.Header("X-Cache", "MISS")
+	h.writeEntry(c, rewritten)
+}
+
+// rewriteEntry returns a copy of a cached JSON response with URL fields
+// rewritten, or false if the body is not valid JSON.
+func (h *APIHandler) rewriteEntry(entry *cache.CacheEntry, base string) (*cache.CacheEntry, bool) {
+	data, err := h.rewriter.RewriteJSON(entry.Data, base, h.fields)
+	if err != nil {
+		return nil, false
+	}
+
+	headers := make(map[string]string, len(entry.Headers))
+	for key, value := range entry.Headers {
+		headers[key] = value
+	}
+	delete(headers, "Content-Length")
+	delete(headers, "Etag")
+
+	return &cache.CacheEntry{
+		Data:    data,
+		Headers: headers,
+		ETag:    rewrite.ETag(entry.ETag, base),
+	}, true
+}
+
+// writeEntry writes a response from a cache entry that was just fetched.
+func (h *APIHandler) writeEntry(c *gin.Context, entry *cache.CacheEntry) {
+	for key, value := range entry.Headers {
+		c.Header(key, value)
+	}
+	if entry.ETag != "" {
+		c.Header("ETag", entry.ETag)
+	}
+	c.Data(http.StatusOK, entry.Headers["Content-Type"], entry.Data)
+}
+
 // serveFromCache serves a response from memory cache.
 func (h *APIHandler) serveFromCache(c *gin.Context, entry *cache.CacheEntry) {
 	// Set headers
@@ -92,7 +246,7 @@ func (h *APIHandler) forwardRequest(c *gin.Context, upstreamURL string, shouldCa
 		body = c.Request.Body
 	}
 
-	req, err := http.NewRequest(c.Request.Method, upstreamURL, body)
+	req, err := http.NewRequestWithContext(proxy.WithHandler(c.Request.Context(), proxy.HandlerAPI), c.Request.Method, upstreamURL, body)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
 		return
@@ -144,7 +298,7 @@ func (h *APIHandler) forwardRequest(c *gin.Context, upstreamURL string, shouldCa
 		}
 
 		// Cache the data
-		if written > 0 && written < 5*1024*1024 { // Only cache responses < 5MB
+		if written > 0 && written < maxAPICacheSize {
 			entry := &cache.CacheEntry{
 				Data:    buf.Bytes(),
 				Headers: headers,
@@ -162,6 +316,13 @@ func (h *APIHandler) forwardRequest(c *gin.Context, upstreamURL string, shouldCa
 	}
 }
 
+// isJSON reports whether a Content-Type header value describes JSON.
+func isJSON(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
 // copyHeaders copies relevant headers from the client request to the upstream request.
 func (h *APIHandler) copyHeaders(c *gin.Context, req *http.Request) {
 	// API-specific headers
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/LZUOSS/gh-proxy/internal/auth"
 	"github.com/LZUOSS/gh-proxy/internal/cache"
 	"github.com/LZUOSS/gh-proxy/internal/proxy"
 )
@@ -66,7 +67,54 @@ func (h *ArchiveHandler) Handle(c *gin.Context) {
 	}
 
 	// Cache miss - fetch from GitHub
-	h.fetchAndStream(c, upstreamURL, cacheKey)
+	resp, err := h.fetch(c, upstreamURL, "")
+
+	// Private repositories are not found anonymously; SSH sessions retry
+	// with their token through the API endpoint, the only one accepting it
+	if err == nil && resp.StatusCode == http.StatusNotFound {
+		if apiURL, authorization := archiveUpstream(c, owner, repo, ref, format); authorization != "" {
+			resp.Body.Close()
+			upstreamURL = apiURL
+			resp, err = h.fetch(c, apiURL, authorization)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to fetch from GitHub"})
+		return
+	}
+	defer resp.Body.Close()
+
+	h.stream(c, upstreamURL, resp)
+}
+
+// serveURL streams an archive from an upstream URL, such as a codeload
+// download, without looking it up in the cache.
+func (h *ArchiveHandler) serveURL(c *gin.Context, upstreamURL string) {
+	resp, err := h.fetch(c, upstreamURL, "")
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to fetch from GitHub"})
+		return
+	}
+	defer resp.Body.Close()
+
+	h.stream(c, upstreamURL, resp)
+}
+
+// archiveUpstream returns the API URL of an archive and the Authorization
+// header to fetch it with when the request was bridged from an SSH session
+// with a token. It returns an empty authorization otherwise, so tokens of
+// HTTP clients are not spent on archives.
+func archiveUpstream(c *gin.Context, owner, repo, ref, format string) (string, string) {
+	token, ok := auth.FromContext(c.Request.Context())
+	if !ok || token == nil || token.Value == "" {
+		return "", ""
+	}
+
+	endpoint := "tarball"
+	if format == "zip" {
+		endpoint = "zipball"
+	}
+	return fmt.Sprintf("https://api.github.com/repos/%s/%s/%s/%s", owner, repo, endpoint, ref), "token " + token.Value
 }
 
 // serveFromDisk serves a response from disk cache.
@@ -84,14 +132,13 @@ func (h *ArchiveHandler) serveFromDisk(c *gin.Context, dataPath string, meta *ca
 	c.File(dataPath)
 }
 
-// fetchAndStream fetches from GitHub and streams the archive.
-// Archives are typically large, so we don't cache them in memory.
-func (h *ArchiveHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey string) {
+// fetch requests an archive from GitHub. authorization, if set, is sent
+// as the Authorization header.
+func (h *ArchiveHandler) fetch(c *gin.Context, upstreamURL, authorization string) (*http.Response, error) {
 	// Create request
-	req, err := http.NewRequest(http.MethodGet, upstreamURL, nil)
+	req, err := http.NewRequestWithContext(proxy.WithHandler(c.Request.Context(), proxy.HandlerArchive), http.MethodGet, upstreamURL, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
-		return
+		return nil, err
 	}
 
 	// Set headers
@@ -102,17 +149,19 @@ func (h *ArchiveHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey st
 
 	// Handle redirects (GitHub often redirects to AWS S3)
 	req.Header.Set("Accept", "application/octet-stream")
-
-	// Execute request
-	resp, err := h.client.Do(req)
-	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to fetch from GitHub"})
-		return
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
 	}
-	defer resp.Body.Close()
 
+	return h.client.Do(req)
+}
+
+// stream sends an archive response to the client.
+// Archives are typically large, so we don't cache them in memory.
+func (h *ArchiveHandler) stream(c *gin.Context, upstreamURL string, resp *http.Response) {
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
+		copyLocation(c, resp)
 		c.Status(resp.StatusCode)
 		io.Copy(c.Writer, resp.Body)
 		return
@@ -133,11 +182,22 @@ func (h *ArchiveHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey st
 	// Archives are typically too large to cache efficiently
 	c.Status(resp.StatusCode)
 
+	// Archives generated on the fly have no length and are never split
+	body := io.Reader(resp.Body)
+	if segmented := h.client.SegmentedBody(resp.Request.Context(), resp, ""); segmented != nil {
+		defer segmented.Close()
+		body = segmented
+	}
+
 	// Stream directly to client
-	written, err := io.Copy(c.Writer, resp.Body)
+	written, err := io.Copy(c.Writer, body)
+	if err != nil {
+		c.Error(fmt.Errorf("streaming %s failed: %w", upstreamURL, err))
+		return
+	}
 
 	// Log the bytes transferred (optional)
-	if err == nil && written > 0 {
+	if written > 0 {
 		c.Set("bytes_transferred", written)
 	}
 }
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/LZUOSS/gh-proxy/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func TestArchiveUpstream(t *testing.T) {
+	token := &auth.Token{Value: "ghp_test"}
+	tests := []struct {
+		name      string
+		sshToken  *auth.Token // bridged from an SSH session
+		httpToken *auth.Token // validated by the Auth middleware
+		format    string
+		wantURL   string
+		wantAuth  string
+	}{
+		{name: "anonymous", format: "tar.gz"},
+		{name: "empty token", sshToken: &auth.Token{}, format: "tar.gz"},
+		{name: "http client token", httpToken: token, format: "tar.gz"},
+		{name: "tarball", sshToken: token, format: "tar.gz", wantURL: "https://api.github.com/repos/owner/repo/tarball/v1.0.0", wantAuth: "token ghp_test"},
+		{name: "zipball", sshToken: token, format: "zip", wantURL: "https://api.github.com/repos/owner/repo/zipball/v1.0.0", wantAuth: "token ghp_test"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/owner/repo/archive/v1.0.0."+tt.format, nil)
+			if tt.sshToken != nil {
+				c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), tt.sshToken))
+				c.Set("auth_token", tt.sshToken)
+			}
+			if tt.httpToken != nil {
+				c.Set("auth_token", tt.httpToken)
+			}
+			gotURL, gotAuth := archiveUpstream(c, "owner", "repo", "v1.0.0", tt.format)
+			if gotURL != tt.wantURL || gotAuth != tt.wantAuth {
+				t.Errorf("archiveUpstream() = %q, %q, want %q, %q", gotURL, gotAuth, tt.wantURL, tt.wantAuth)
+			}
+		})
+	}
+}
@@ -12,6 +12,7 @@
 //   - RawHandler: Proxies raw file content from repositories
 //   - ArchiveHandler: Streams repository archives (zip/tar.gz)
 //   - GitHandler: Implements Git smart HTTP protocol for clone/fetch/push
+//   - LFSHandler: Proxies the Git LFS batch API and caches LFS objects
 //   - GistHandler: Proxies Gist raw file content
 //   - APIHandler: Generic proxy for GitHub API requests
 //
@@ -27,10 +28,11 @@
 //	// Create handlers
 //	cache := cache.NewCache(cacheConfig)
 //	client := proxy.NewProxyClient(proxyConfig)
+//	files := filestore.New(filepath.Join(diskPath, "files"), maxDiskSize)
 //
-//	releasesHandler := handler.NewReleasesHandler(cache, client)
+//	releasesHandler := handler.NewReleasesHandler(cache, files, client)
 //	rawHandler := handler.NewRawHandler(cache, client)
-//	apiHandler := handler.NewAPIHandler(cache, client, token)
+//	apiHandler := handler.NewAPIHandler(cache, client, token, nil, nil)
 //
 //	// Register with Gin router
 //	router.GET("/:owner/:repo/releases/download/:tag/:filename", releasesHandler.Handle)
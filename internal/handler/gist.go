@@ -96,7 +96,7 @@ func (h *GistHandler) serveFromDisk(c *gin.Context, dataPath string, meta *cache
 // fetchAndStream fetches from GitHub and streams while caching.
 func (h *GistHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey string) {
 	// Create request
-	req, err := http.NewRequest(http.MethodGet, upstreamURL, nil)
+	req, err := http.NewRequestWithContext(proxy.WithHandler(c.Request.Context(), proxy.HandlerGist), http.MethodGet, upstreamURL, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
 		return
@@ -118,6 +118,7 @@ func (h *GistHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey strin
 
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
+		copyLocation(c, resp)
 		c.Status(resp.StatusCode)
 		io.Copy(c.Writer, resp.Body)
 		return
@@ -151,6 +152,7 @@ func (h *GistHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey strin
 		written, err := io.Copy(c.Writer, teeReader)
 		if err != nil {
 			// Stream was interrupted, don't cache
+			c.Error(fmt.Errorf("streaming %s failed: %w", upstreamURL, err))
 			return
 		}
 
@@ -169,6 +171,8 @@ func (h *GistHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey strin
 	} else {
 		// Just stream without caching
 		c.Status(resp.StatusCode)
-		io.Copy(c.Writer, resp.Body)
+		if _, err := io.Copy(c.Writer, resp.Body); err != nil {
+			c.Error(fmt.Errorf("streaming %s failed: %w", upstreamURL, err))
+		}
 	}
 }
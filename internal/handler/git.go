@@ -1,31 +1,79 @@
 package handler
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/LZUOSS/gh-proxy/internal/auth"
+	"github.com/LZUOSS/gh-proxy/internal/config"
+	"github.com/LZUOSS/gh-proxy/internal/mirror"
+	"github.com/LZUOSS/gh-proxy/internal/pktline"
+	"github.com/LZUOSS/gh-proxy/internal/policy"
 	"github.com/LZUOSS/gh-proxy/internal/proxy"
 )
 
+// maxInspectSize bounds how much of an upload-pack request body is buffered
+// for parsing. Larger requests (long have lists) are forwarded uninspected.
+const maxInspectSize = 8 * 1024 * 1024
+
 // GitHandler handles Git smart HTTP protocol requests.
 // Routes:
 //   - /:owner/:repo.git/info/refs (GET)
 //   - /:owner/:repo.git/git-upload-pack (POST)
 //   - /:owner/:repo.git/git-receive-pack (POST)
+//   - /:owner/:repo/mirror/refresh (POST)
+//
+// Repositories with a ready local mirror have info/refs and git-upload-pack
+// served from disk, to every client if the mirror is public and otherwise only
+// to clients GitHub grants read access; everything else is forwarded to
+// GitHub. Fetch limits, when configured, are enforced on the parsed
+// upload-pack request in both cases.
+// Pushes are only forwarded when the push policy allows them.
 type GitHandler struct {
-	client *proxy.ProxyClient
-	token  string // GitHub token for authentication
+	client  *proxy.ProxyClient
+	token   string             // GitHub token for authentication
+	mirrors *mirror.Manager    // Local bare mirrors (optional)
+	limits  *fetchLimiter      // Fetch policies (optional)
+	push    *policy.PushPolicy // Push policy; denies everything if not configured
+	creds   *gitCredentials    // Upstream credential selection
+	users   *auth.Cache        // Validates client credentials for the push policy
+	access  *mirrorAccess      // Confirmed client access to non-public mirrors
+	// GitHub logins allowed to refresh mirrors on demand
+	refreshUsers []string
 }
 
 // NewGitHandler creates a new git protocol handler.
-func NewGitHandler(client *proxy.ProxyClient, token string) *GitHandler {
-	return &GitHandler{
-		client: client,
-		token:  token,
+// cfg and mirrors may be nil to disable the corresponding features; a nil
+// push policy denies all pushes. users validates the credentials of clients
+// the Auth middleware did not authenticate; if nil, they count as anonymous.
+func NewGitHandler(client *proxy.ProxyClient, token string, cfg *config.GitConfig, mirrors *mirror.Manager, push *policy.PushPolicy, users *auth.Cache) *GitHandler {
+	if push == nil {
+		push = policy.NewPushPolicy(nil, nil)
+	}
+
+	h := &GitHandler{
+		client:  client,
+		token:   token,
+		mirrors: mirrors,
+		push:    push,
+		users:   users,
+		access:  newMirrorAccess(),
+	}
+	var credentials *config.CredentialsConfig
+	if cfg != nil {
+		credentials = &cfg.Credentials
+		h.limits = newFetchLimiter(&cfg.FetchLimits, client, token)
+		h.refreshUsers = cfg.Mirror.RefreshUsers
 	}
+	h.creds = newGitCredentials(credentials)
+	return h
 }
 
 // HandleInfoRefs handles the git info/refs request.
@@ -55,11 +103,25 @@ func (h *GitHandler) HandleInfoRefs(c *gin.Context) {
 		return
 	}
 
+	// Pushes must pass the push policy before anything is sent upstream
+	if service == "git-receive-pack" && !h.authorizePush(c, owner, repo, "info/refs") {
+		return
+	}
+
+	// Serve fetches from the local mirror when one is available
+	if service == "git-upload-pack" {
+		if m, ok := h.mirrors.Lookup(owner, repo); ok && h.mayServeMirror(c, m) {
+			if h.serveMirrorInfoRefs(c, m) {
+				return
+			}
+		}
+	}
+
 	// Generate upstream URL
 	upstreamURL := fmt.Sprintf("https://github.com/%s/%s.git/info/refs?service=%s", owner, repo, service)
 
 	// Forward the request
-	h.forwardRequest(c, upstreamURL, http.MethodGet, nil)
+	h.forwardRequest(c, upstreamURL, http.MethodGet, nil, h.upstreamAuth(c, owner, repo, service), nil)
 }
 
 // HandleUploadPack handles the git-upload-pack request (fetch/clone).
@@ -76,11 +138,54 @@ func (h *GitHandler) HandleUploadPack(c *gin.Context) {
 		return
 	}
 
+	// Parse the request so wants, haves, depth and filter are visible
+	uploadReq, body, err := inspectUploadPack(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+		return
+	}
+	// Limits fail closed: a request too large or malformed to parse could
+	// otherwise hide a clone the policy forbids
+	if uploadReq == nil && h.limits != nil && h.limits.enforced(owner, repo) {
+		writeGitError(c, "git-upload-pack", fmt.Sprintf(
+			"the fetch request for %s/%s could not be inspected for the proxy's fetch limits", owner, repo))
+		return
+	}
+	if uploadReq != nil {
+		c.Set("git_request", uploadReq)
+
+		// Enforce fetch limits
+		if h.limits != nil {
+			decision := h.limits.check(c.Request.Context(), owner, repo, uploadReq)
+			if decision.reject != "" {
+				writeGitError(c, "git-upload-pack", decision.reject)
+				return
+			}
+			if decision.depth > 0 {
+				body, err = h.rewriteDepth(c, body, decision.depth)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+					return
+				}
+				uploadReq.Depth = decision.depth
+			}
+		}
+	}
+
+	tap := pktline.NewResponseTap()
+	c.Set("git_response", tap)
+
+	// Serve from the local mirror when one is available
+	if m, ok := h.mirrors.Lookup(owner, repo); ok && h.mayServeMirror(c, m) {
+		h.serveMirrorUploadPack(c, m, body, tap)
+		return
+	}
+
 	// Generate upstream URL
 	upstreamURL := fmt.Sprintf("https://github.com/%s/%s.git/git-upload-pack", owner, repo)
 
 	// Forward the request with body
-	h.forwardRequest(c, upstreamURL, http.MethodPost, c.Request.Body)
+	h.forwardRequest(c, upstreamURL, http.MethodPost, body, h.upstreamAuth(c, owner, repo, "git-upload-pack"), tap)
 }
 
 // HandleReceivePack handles the git-receive-pack request (push).
@@ -97,17 +202,276 @@ func (h *GitHandler) HandleReceivePack(c *gin.Context) {
 		return
 	}
 
+	if !h.authorizePush(c, owner, repo, "receive-pack") {
+		return
+	}
+
 	// Generate upstream URL
 	upstreamURL := fmt.Sprintf("https://github.com/%s/%s.git/git-receive-pack", owner, repo)
 
 	// Forward the request with body
-	h.forwardRequest(c, upstreamURL, http.MethodPost, c.Request.Body)
+	h.forwardRequest(c, upstreamURL, http.MethodPost, c.Request.Body, h.upstreamAuth(c, owner, repo, "git-receive-pack"), nil)
+}
+
+// authorizePush applies the push policy to the current request. If the push
+// is denied, it writes the response and returns false.
+func (h *GitHandler) authorizePush(c *gin.Context, owner, repo, stage string) bool {
+	clientIP := c.GetString("client_ip")
+	if clientIP == "" {
+		clientIP = c.ClientIP()
+	}
+
+	user, err := h.requestUser(c)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Basic realm="gh-proxy"`)
+		c.String(http.StatusUnauthorized, "%s\n", err.Error())
+		return false
+	}
+
+	err = h.push.Authorize(policy.PushAttempt{
+		Transport:  "http",
+		Stage:      stage,
+		User:       user,
+		Owner:      owner,
+		Repo:       repo,
+		RemoteAddr: clientIP,
+	})
+	if err == nil {
+		return true
+	}
+
+	// Ask for credentials so git credential helpers can supply them
+	if errors.Is(err, policy.ErrAuthenticationRequired) {
+		c.Header("WWW-Authenticate", `Basic realm="gh-proxy"`)
+		c.String(http.StatusUnauthorized, "%s\n", err.Error())
+		return false
+	}
+
+	if stage == "info/refs" {
+		writeGitAdvertisementError(c, "git-receive-pack", err.Error())
+	} else {
+		writeGitError(c, "git-receive-pack", err.Error())
+	}
+	return false
+}
+
+// authenticatedUser returns the GitHub login validated by the Auth middleware,
+// or an empty string for anonymous requests.
+func authenticatedUser(c *gin.Context) string {
+	v, ok := c.Get("auth_token")
+	if !ok {
+		return ""
+	}
+	token, ok := v.(*auth.Token)
+	if !ok || token == nil {
+		return ""
+	}
+	if token.Login != "" {
+		return token.Login
+	}
+	return token.Username
+}
+
+// HandleMirrorRefresh refreshes a local mirror from its upstream on demand.
+// Only the GitHub users listed in git.mirror.refresh_users may trigger it.
+func (h *GitHandler) HandleMirrorRefresh(c *gin.Context) {
+	owner := c.Param("owner")
+	repo := strings.TrimSuffix(c.Param("repo"), ".git")
+
+	if owner == "" || repo == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing required parameters"})
+		return
+	}
+
+	user, err := h.requestUser(c)
+	if err != nil || user == "" {
+		c.Header("WWW-Authenticate", `Basic realm="gh-proxy"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+		return
+	}
+	if !h.mayRefresh(user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "user is not allowed to refresh mirrors"})
+		return
+	}
+
+	m, ok := h.mirrors.Get(owner, repo)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "repository is not mirrored"})
+		return
+	}
+
+	if err := h.mirrors.Refresh(c.Request.Context(), owner, repo); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "mirror refresh failed", "status": m.Status()})
+		return
+	}
+
+	c.JSON(http.StatusOK, m.Status())
+}
+
+// mayRefresh reports whether a GitHub login may refresh mirrors on demand.
+func (h *GitHandler) mayRefresh(user string) bool {
+	for _, allowed := range h.refreshUsers {
+		if strings.EqualFold(allowed, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveMirrorInfoRefs answers an upload-pack info/refs request from a local mirror.
+// It returns false if the advertisement could not be produced, so the caller
+// can fall back to GitHub.
+func (h *GitHandler) serveMirrorInfoRefs(c *gin.Context, m *mirror.Repo) bool {
+	gitProtocol := c.GetHeader("Git-Protocol")
+
+	// The advertisement is small; buffer it so a failure can still fall back upstream
+	var buf bytes.Buffer
+	if err := h.mirrors.AdvertiseRefs(c.Request.Context(), m, &buf, gitProtocol); err != nil {
+		return false
+	}
+
+	c.Header("Content-Type", "application/x-git-upload-pack-advertisement")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Cache", "HIT-MIRROR")
+	c.Status(http.StatusOK)
+
+	// Protocol v2 responses carry no service preamble
+	if pktline.ProtocolVersion(gitProtocol) != 2 {
+		enc := pktline.NewEncoder(c.Writer)
+		enc.EncodeString("# service=git-upload-pack\n")
+		enc.Flush()
+	}
+	c.Writer.Write(buf.Bytes())
+	return true
+}
+
+// serveMirrorUploadPack answers a git-upload-pack request from a local mirror.
+func (h *GitHandler) serveMirrorUploadPack(c *gin.Context, m *mirror.Repo, rawBody io.Reader, tap *pktline.ResponseTap) {
+	body, err := decodeGitBody(rawBody, c.GetHeader("Content-Encoding"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	defer body.Close()
+
+	c.Header("Content-Type", "application/x-git-upload-pack-result")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Cache", "HIT-MIRROR")
+	c.Status(http.StatusOK)
+
+	start := time.Now()
+	out := io.MultiWriter(c.Writer, tap)
+	err = h.mirrors.UploadPack(c.Request.Context(), m, body, out, c.GetHeader("Git-Protocol"))
+	if err != nil && !errors.Is(err, c.Request.Context().Err()) {
+		c.Error(fmt.Errorf("mirror upload-pack for %s/%s failed after %s: %w", m.Owner, m.Name, time.Since(start), err))
+	}
+}
+
+// rewriteDepth replaces the depth of a buffered upload-pack request.
+// The rewritten body is sent uncompressed.
+func (h *GitHandler) rewriteDepth(c *gin.Context, body io.Reader, depth int) (io.Reader, error) {
+	decoded, err := decodeGitBody(body, c.GetHeader("Content-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	defer decoded.Close()
+
+	raw, err := io.ReadAll(decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	rewritten, err := pktline.RewriteDepth(raw, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Request.Header.Del("Content-Encoding")
+	c.Request.ContentLength = int64(len(rewritten))
+	return bytes.NewReader(rewritten), nil
+}
+
+// writeGitError answers a Git request with an ERR pkt-line, which the git
+// client shows as "remote error: <msg>".
+func writeGitError(c *gin.Context, service, msg string) {
+	c.Header("Content-Type", "application/x-"+service+"-result")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	pktline.NewEncoder(c.Writer).Error(msg)
+}
+
+// writeGitAdvertisementError answers an info/refs request with an ERR
+// pkt-line after the service preamble, so the git client reports it as a
+// remote error instead of an HTTP failure.
+func writeGitAdvertisementError(c *gin.Context, service, msg string) {
+	c.Header("Content-Type", "application/x-"+service+"-advertisement")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+
+	enc := pktline.NewEncoder(c.Writer)
+	enc.EncodeString("# service=" + service + "\n")
+	enc.Flush()
+	enc.Error(msg)
+}
+
+// decodeGitBody returns a reader for the request body, decompressing it if
+// the client sent it gzipped.
+func decodeGitBody(body io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	if contentEncoding == "gzip" {
+		return gzip.NewReader(body)
+	}
+	return io.NopCloser(body), nil
+}
+
+// inspectUploadPack buffers and parses an upload-pack request body.
+// It returns the parsed request (nil if the body was too large or could not
+// be parsed) and a reader that replays the original, still-encoded body.
+func inspectUploadPack(c *gin.Context) (*pktline.UploadPackRequest, io.Reader, error) {
+	raw, err := io.ReadAll(io.LimitReader(c.Request.Body, maxInspectSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(raw) > maxInspectSize {
+		return nil, io.MultiReader(bytes.NewReader(raw), c.Request.Body), nil
+	}
+
+	replay := bytes.NewReader(raw)
+
+	decoded, err := decodeGitBody(bytes.NewReader(raw), c.GetHeader("Content-Encoding"))
+	if err != nil {
+		return nil, replay, nil
+	}
+	defer decoded.Close()
+
+	req, err := pktline.ParseUploadPackRequest(decoded, c.GetHeader("Git-Protocol"))
+	if err != nil {
+		return nil, replay, nil
+	}
+
+	return req, replay, nil
+}
+
+// upstreamAuth returns the Authorization header to send to GitHub for a Git
+// service request, falling back to the handler token if no other credentials
+// apply.
+func (h *GitHandler) upstreamAuth(c *gin.Context, owner, repo, service string) string {
+	if authorization := h.creds.authorization(c, owner, repo, service); authorization != "" {
+		return authorization
+	}
+	if h.token != "" {
+		return "token " + h.token
+	}
+	return ""
 }
 
 // forwardRequest forwards a Git protocol request to GitHub.
-func (h *GitHandler) forwardRequest(c *gin.Context, upstreamURL, method string, body io.Reader) {
+// authorization, if set, is sent as the Authorization header. GitHub's
+// responses, including 401 challenges, are passed back unchanged so git
+// credential helpers can respond to them. If tap is not nil, the response
+// body is also fed to it.
+func (h *GitHandler) forwardRequest(c *gin.Context, upstreamURL, method string, body io.Reader, authorization string, tap *pktline.ResponseTap) {
 	// Create request
-	req, err := http.NewRequest(method, upstreamURL, body)
+	req, err := http.NewRequestWithContext(proxy.WithHandler(c.Request.Context(), proxy.HandlerGit), method, upstreamURL, body)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
 		return
@@ -116,9 +480,9 @@ func (h *GitHandler) forwardRequest(c *gin.Context, upstreamURL, method string,
 	// Copy relevant headers
 	h.copyHeaders(c, req)
 
-	// Add authentication if token is provided
-	if h.token != "" {
-		req.Header.Set("Authorization", "token "+h.token)
+	// Add authentication if credentials are available
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
 	}
 
 	// Execute request
@@ -138,6 +502,10 @@ func (h *GitHandler) forwardRequest(c *gin.Context, upstreamURL, method string,
 
 	// Stream response
 	c.Status(resp.StatusCode)
+	if tap != nil {
+		io.Copy(c.Writer, io.TeeReader(resp.Body, tap))
+		return
+	}
 	io.Copy(c.Writer, resp.Body)
 }
 
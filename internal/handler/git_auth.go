@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/auth"
+	"github.com/LZUOSS/gh-proxy/internal/config"
+	"github.com/LZUOSS/gh-proxy/internal/mirror"
+	"github.com/LZUOSS/gh-proxy/internal/proxy"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// mirrorAccessTTL is how long a client's confirmed read access to a
+	// non-public mirror is remembered.
+	mirrorAccessTTL = 5 * time.Minute
+
+	// maxMirrorGrants bounds the number of remembered access checks.
+	maxMirrorGrants = 4096
+)
+
+// errInvalidCredentials is returned when a client sends credentials that
+// GitHub does not accept.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// gitCredentials selects the Authorization header sent to GitHub on Git
+// smart HTTP requests.
+type gitCredentials struct {
+	forwardClient bool
+	token         string
+	tokenRepos    []string
+}
+
+// newGitCredentials creates the credential selector. A nil config forwards
+// client credentials and never injects a server token.
+func newGitCredentials(cfg *config.CredentialsConfig) *gitCredentials {
+	if cfg == nil {
+		return &gitCredentials{forwardClient: true}
+	}
+
+	creds := &gitCredentials{
+		forwardClient: cfg.ForwardClient,
+		token:         cfg.Token,
+	}
+	for _, repo := range cfg.TokenRepos {
+		creds.tokenRepos = append(creds.tokenRepos, strings.ToLower(repo))
+	}
+	return creds
+}
+
+// authorization returns the Authorization header for an upstream request, or
+// an empty string to send it anonymously.
+//
+// Client credentials take precedence: the token validated by the Auth
+// middleware, then the raw Authorization header. The server token is only
+// used for fetches from allowlisted repositories, so pushes are always made
+// with the client's own identity.
+func (g *gitCredentials) authorization(c *gin.Context, owner, repo, service string) string {
+	if g.forwardClient {
+		if v, ok := c.Get("auth_token"); ok {
+			if token, ok := v.(*auth.Token); ok && token != nil && token.Value != "" {
+				return basicToken(token.Value)
+			}
+		}
+
+		if header := c.GetHeader("Authorization"); header != "" {
+			// Git over HTTPS only accepts Basic credentials; wrap bearer tokens
+			if value, ok := strings.CutPrefix(header, "Bearer "); ok {
+				return basicToken(value)
+			}
+			return header
+		}
+	}
+
+	if service == "git-upload-pack" && g.token != "" && g.tokenAllowed(owner, repo) {
+		return basicToken(g.token)
+	}
+
+	return ""
+}
+
+// tokenAllowed reports whether the server token may be used for a repository.
+func (g *gitCredentials) tokenAllowed(owner, repo string) bool {
+	name := strings.ToLower(owner + "/" + repo)
+	for _, pattern := range g.tokenRepos {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// basicToken encodes a GitHub token as Basic credentials.
+func basicToken(token string) string {
+	creds := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+	return "Basic " + creds
+}
+
+// requestUser returns the GitHub login of the client, or an empty string for
+// anonymous requests. Credentials the Auth middleware did not check, as when
+// server authentication is disabled, are validated here so the push policy
+// sees the real user; rejected credentials return errInvalidCredentials.
+func (h *GitHandler) requestUser(c *gin.Context) (string, error) {
+	if user := authenticatedUser(c); user != "" || h.users == nil {
+		return user, nil
+	}
+
+	var username, password string
+	header := c.GetHeader("Authorization")
+	if value, ok := strings.CutPrefix(header, "Bearer "); ok {
+		password = value
+	} else if strings.HasPrefix(header, "Basic ") {
+		if username, password, ok = c.Request.BasicAuth(); !ok {
+			return "", errInvalidCredentials
+		}
+	} else {
+		return "", nil
+	}
+
+	token, err := h.users.GetOrValidateWithContext(c.Request.Context(), username, password)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidCredentials, err)
+	}
+
+	// Later steps, such as forwarding credentials upstream, use the same token
+	c.Set("auth_token", token)
+	return authenticatedUser(c), nil
+}
+
+// mirrorAccess remembers which credentials GitHub accepted for reading a
+// non-public mirrored repository.
+type mirrorAccess struct {
+	mu     sync.Mutex
+	grants map[string]time.Time // hash of repository and credentials -> expiry
+}
+
+// newMirrorAccess creates an empty access cache.
+func newMirrorAccess() *mirrorAccess {
+	return &mirrorAccess{grants: make(map[string]time.Time)}
+}
+
+// allowed reports whether access was confirmed recently.
+func (a *mirrorAccess) allowed(key string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return time.Now().Before(a.grants[key])
+}
+
+// grant records confirmed access, dropping expired entries once the cache is
+// full and starting over if none have expired.
+func (a *mirrorAccess) grant(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if len(a.grants) >= maxMirrorGrants {
+		for k, expires := range a.grants {
+			if !now.Before(expires) {
+				delete(a.grants, k)
+			}
+		}
+		if len(a.grants) >= maxMirrorGrants {
+			a.grants = make(map[string]time.Time)
+		}
+	}
+	a.grants[key] = now.Add(mirrorAccessTTL)
+}
+
+// mayServeMirror reports whether a mirror may answer the current request.
+// Mirrors of public repositories are served to everyone. For the others, the
+// client needs the authorization the request would need upstream: the
+// credentials upstreamAuth selects must be accepted by GitHub for the
+// repository. Otherwise the request is forwarded, so GitHub can challenge
+// the client for credentials.
+func (h *GitHandler) mayServeMirror(c *gin.Context, m *mirror.Repo) bool {
+	if m.Public {
+		return true
+	}
+
+	authorization := h.upstreamAuth(c, m.Owner, m.Name, "git-upload-pack")
+	if authorization == "" {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(strings.ToLower(m.Owner+"/"+m.Name) + "\x00" + authorization))
+	key := hex.EncodeToString(sum[:])
+	if h.access.allowed(key) {
+		return true
+	}
+
+	upstreamURL := fmt.Sprintf("https://github.com/%s/%s.git/info/refs?service=git-upload-pack", m.Owner, m.Name)
+	req, err := http.NewRequestWithContext(proxy.WithHandler(c.Request.Context(), proxy.HandlerGit), http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("User-Agent", "git/github-reverse-proxy")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	h.access.grant(key)
+	return true
+}
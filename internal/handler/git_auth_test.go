@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/auth"
+	"github.com/LZUOSS/gh-proxy/internal/config"
+	"github.com/LZUOSS/gh-proxy/internal/mirror"
+	"github.com/LZUOSS/gh-proxy/internal/policy"
+	"github.com/LZUOSS/gh-proxy/internal/proxy"
+	"github.com/gin-gonic/gin"
+)
+
+// roundTripFunc adapts a function to http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newUpstreamClient creates a proxy client with cfg, or the default
+// configuration if nil, that sends every request, whatever its host, to a
+// test server running upstream. The server sees the original host in r.Host.
+func newUpstreamClient(t *testing.T, cfg *proxy.ProxyConfig, upstream http.Handler) *proxy.ProxyClient {
+	t.Helper()
+
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+	target, _ := url.Parse(server.URL)
+
+	client, err := proxy.NewProxyClient(cfg)
+	if err != nil {
+		t.Fatalf("NewProxyClient() error = %v", err)
+	}
+	transport := client.Client().Transport
+	client.Client().Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		out := req.Clone(req.Context())
+		out.Host = req.URL.Host
+		out.URL.Scheme = target.Scheme
+		out.URL.Host = target.Host
+		resp, err := transport.RoundTrip(out)
+		if resp != nil {
+			resp.Request = req
+		}
+		return resp, err
+	})
+	t.Cleanup(client.Close)
+	return client
+}
+
+func TestGitCredentialsAuthorization(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	creds := newGitCredentials(&config.CredentialsConfig{
+		ForwardClient: true,
+		Token:         "server",
+		TokenRepos:    []string{"owner/private", "team/*"},
+	})
+
+	tests := []struct {
+		name    string
+		creds   *gitCredentials
+		header  string
+		token   *auth.Token
+		repo    string
+		service string
+		want    string
+	}{
+		{name: "anonymous public repo", creds: creds, repo: "owner/public", service: "git-upload-pack", want: ""},
+		{name: "basic forwarded", creds: creds, header: "Basic dXNlcjpwYXNz", repo: "owner/public", service: "git-upload-pack", want: "Basic dXNlcjpwYXNz"},
+		{name: "bearer wrapped", creds: creds, header: "Bearer client", repo: "owner/public", service: "git-upload-pack", want: basicToken("client")},
+		{name: "validated token preferred", creds: creds, header: "Bearer other", token: &auth.Token{Value: "client"}, repo: "owner/public", service: "git-upload-pack", want: basicToken("client")},
+		{name: "server token for allowlisted repo", creds: creds, repo: "owner/private", service: "git-upload-pack", want: basicToken("server")},
+		{name: "server token for glob", creds: creds, repo: "Team/Repo", service: "git-upload-pack", want: basicToken("server")},
+		{name: "client credentials win over server token", creds: creds, header: "Bearer client", repo: "owner/private", service: "git-upload-pack", want: basicToken("client")},
+		{name: "server token never used for push", creds: creds, repo: "owner/private", service: "git-receive-pack", want: ""},
+		{name: "forwarding disabled", creds: newGitCredentials(&config.CredentialsConfig{}), header: "Bearer client", repo: "owner/public", service: "git-upload-pack", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				c.Request.Header.Set("Authorization", tt.header)
+			}
+			if tt.token != nil {
+				c.Set("auth_token", tt.token)
+			}
+
+			owner, repo, _ := strings.Cut(tt.repo, "/")
+			if got := tt.creds.authorization(c, owner, repo, tt.service); got != tt.want {
+				t.Errorf("authorization() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAuthorizePushWithoutAuthMiddleware checks the push policy when server
+// authentication is disabled and the handler validates credentials itself.
+func TestAuthorizePushWithoutAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	users := auth.NewCache(time.Hour)
+	users.Set("octocat", "secret", &auth.Token{Value: "secret", Login: "octocat", ExpiresAt: time.Now().Add(time.Hour)})
+	users.Set("", "secret", &auth.Token{Value: "secret", Login: "octocat", ExpiresAt: time.Now().Add(time.Hour)})
+	push := policy.NewPushPolicy(&config.PushConfig{
+		Enabled:      true,
+		AllowedRepos: []string{"owner/repo"},
+		AllowedUsers: []string{"octocat"},
+	}, nil)
+	h := NewGitHandler(nil, "", nil, nil, push, users)
+
+	tests := []struct {
+		name       string
+		header     string
+		want       bool
+		wantStatus int
+	}{
+		{name: "anonymous", want: false, wantStatus: http.StatusUnauthorized},
+		{name: "malformed basic", header: "Basic !!!", want: false, wantStatus: http.StatusUnauthorized},
+		{name: "basic", header: "Basic b2N0b2NhdDpzZWNyZXQ=", want: true, wantStatus: http.StatusOK},
+		{name: "bearer", header: "Bearer secret", want: true, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/owner/repo.git/git-receive-pack", nil)
+			if tt.header != "" {
+				c.Request.Header.Set("Authorization", tt.header)
+			}
+
+			if got := h.authorizePush(c, "owner", "repo", "receive-pack"); got != tt.want {
+				t.Fatalf("authorizePush() = %v, want %v", got, tt.want)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("missing WWW-Authenticate challenge")
+			}
+			if tt.want && authenticatedUser(c) != "octocat" {
+				t.Errorf("authenticated user = %q, want octocat", authenticatedUser(c))
+			}
+		})
+	}
+}
+
+func TestMirrorRefreshRequiresListedUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	users := auth.NewCache(time.Hour)
+	users.Set("", "admin", &auth.Token{Value: "admin", Login: "admin", ExpiresAt: time.Now().Add(time.Hour)})
+	users.Set("", "other", &auth.Token{Value: "other", Login: "other", ExpiresAt: time.Now().Add(time.Hour)})
+	h := NewGitHandler(nil, "", &config.GitConfig{Mirror: config.MirrorConfig{RefreshUsers: []string{"Admin"}}}, nil, nil, users)
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+	}{
+		{name: "anonymous", wantStatus: http.StatusUnauthorized},
+		{name: "unlisted user", header: "Bearer other", wantStatus: http.StatusForbidden},
+		// The listed user gets past authorization to the mirror lookup
+		{name: "listed user", header: "Bearer admin", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/owner/repo/mirror/refresh", nil)
+			c.Params = gin.Params{{Key: "owner", Value: "owner"}, {Key: "repo", Value: "repo"}}
+			if tt.header != "" {
+				c.Request.Header.Set("Authorization", tt.header)
+			}
+
+			h.HandleMirrorRefresh(c)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMayServeMirror(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	requests := 0
+	client := newUpstreamClient(t, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/owner/private.git/info/refs" || r.Header.Get("Authorization") != basicToken("reader") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("001e# service=git-upload-pack\n0000"))
+	}))
+	h := NewGitHandler(client, "", &config.GitConfig{Credentials: config.CredentialsConfig{ForwardClient: true}}, nil, nil, nil)
+
+	private := &mirror.Repo{Owner: "owner", Name: "private"}
+	public := &mirror.Repo{Owner: "owner", Name: "public", Public: true}
+
+	tests := []struct {
+		name   string
+		repo   *mirror.Repo
+		header string
+		want   bool
+	}{
+		{name: "public anonymous", repo: public, want: true},
+		{name: "private anonymous", repo: private},
+		{name: "private rejected credentials", repo: private, header: "Bearer other"},
+		{name: "private reader", repo: private, header: "Bearer reader", want: true},
+		{name: "private reader cached", repo: private, header: "Bearer reader", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/owner/repo.git/info/refs?service=git-upload-pack", nil)
+			if tt.header != "" {
+				c.Request.Header.Set("Authorization", tt.header)
+			}
+			if got := h.mayServeMirror(c, tt.repo); got != tt.want {
+				t.Errorf("mayServeMirror() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Anonymous clients and public mirrors need no check; the reader's access is remembered
+	if requests != 2 {
+		t.Errorf("upstream requests = %d, want 2", requests)
+	}
+}
@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/config"
+	"github.com/LZUOSS/gh-proxy/internal/pktline"
+	"github.com/LZUOSS/gh-proxy/internal/proxy"
+)
+
+// maxRepoSizes bounds the number of repository sizes cached. Clients choose
+// the repositories, so the cache must not grow with every name they try.
+const maxRepoSizes = 10000
+
+// fetchLimiter applies the configured fetch policies to upload-pack requests.
+type fetchLimiter struct {
+	cfg    *config.FetchLimitsConfig
+	client *proxy.ProxyClient
+	token  string
+
+	mu    sync.Mutex
+	sizes map[string]repoSize
+}
+
+// repoSize is a cached repository size from the GitHub API.
+type repoSize struct {
+	bytes   int64
+	fetched time.Time
+}
+
+// fetchDecision is the outcome of checking a request against a policy.
+type fetchDecision struct {
+	reject string // if set, the request is refused with this message
+	depth  int    // if set, the request depth is rewritten to this value
+}
+
+// newFetchLimiter creates a fetch limiter, or returns nil if limits are disabled.
+func newFetchLimiter(cfg *config.FetchLimitsConfig, client *proxy.ProxyClient, token string) *fetchLimiter {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	return &fetchLimiter{
+		cfg:    cfg,
+		client: client,
+		token:  token,
+		sizes:  make(map[string]repoSize),
+	}
+}
+
+// policyFor returns the policy for a repository: the first matching
+// per-repository entry, or the default policy.
+func (l *fetchLimiter) policyFor(owner, repo string) *config.FetchPolicyConfig {
+	name := strings.ToLower(owner + "/" + repo)
+	for i := range l.cfg.Repos {
+		if matched, _ := path.Match(strings.ToLower(l.cfg.Repos[i].Repo), name); matched {
+			return &l.cfg.Repos[i].FetchPolicyConfig
+		}
+	}
+	return &l.cfg.Default
+}
+
+// enforced reports whether the policy for a repository limits anything, so
+// requests that cannot be inspected must not be forwarded.
+func (l *fetchLimiter) enforced(owner, repo string) bool {
+	policy := l.policyFor(owner, repo)
+	return policy.MaxDepth > 0 || policy.RequireShallow > 0 || policy.MaxCloneSize > 0 || policy.RequireFilter
+}
+
+// check evaluates an upload-pack request against the repository's policy.
+func (l *fetchLimiter) check(ctx context.Context, owner, repo string, req *pktline.UploadPackRequest) fetchDecision {
+	// ls-refs and object-info transfer no history
+	if req.Command != "fetch" {
+		return fetchDecision{}
+	}
+
+	policy := l.policyFor(owner, repo)
+	clone := req.IsClone()
+
+	if clone && policy.RequireFilter {
+		if req.Filter == "" {
+			return fetchDecision{reject: fmt.Sprintf(
+				"%s/%s must be cloned as a partial clone, e.g. git clone --filter=%s",
+				owner, repo, suggestedFilter(policy))}
+		}
+		if len(policy.AllowedFilters) > 0 && !containsString(policy.AllowedFilters, req.Filter) {
+			return fetchDecision{reject: fmt.Sprintf(
+				"filter %q is not allowed for %s/%s; use one of: %s",
+				req.Filter, owner, repo, strings.Join(policy.AllowedFilters, ", "))}
+		}
+	}
+
+	// Only a filter that leaves out most objects stands in for a shallow clone
+	reduced := filterShrinksClone(policy, req.Filter)
+
+	if clone && policy.RequireShallow > 0 && !req.IsShallow() && !reduced {
+		return fetchDecision{reject: fmt.Sprintf(
+			"%s/%s must be cloned shallow, e.g. git clone --depth=%d",
+			owner, repo, policy.RequireShallow)}
+	}
+
+	if clone && policy.MaxCloneSize > 0 && !req.IsShallow() && !reduced {
+		if size, ok := l.repoSize(ctx, owner, repo); ok && size > policy.MaxCloneSize {
+			return fetchDecision{reject: fmt.Sprintf(
+				"%s/%s is %s, above the %s limit for full clones; use git clone --filter=%s or --depth=1",
+				owner, repo, formatBytes(size), formatBytes(policy.MaxCloneSize), suggestedFilter(policy))}
+		}
+	}
+
+	if policy.MaxDepth > 0 {
+		// A client that did not ask for a shallow clone does not expect the
+		// shallow-info a deepen would add, so unlimited clones are refused
+		if clone && req.Depth == 0 {
+			return fetchDecision{reject: fmt.Sprintf(
+				"%s/%s may only be cloned with a limited history, e.g. git clone --depth=%d",
+				owner, repo, policy.MaxDepth)}
+		}
+		if req.Depth > policy.MaxDepth {
+			return fetchDecision{depth: policy.MaxDepth}
+		}
+	}
+
+	return fetchDecision{}
+}
+
+// repoSize returns the repository size reported by the GitHub API.
+// Lookups that fail report ok=false so the request is not blocked.
+func (l *fetchLimiter) repoSize(ctx context.Context, owner, repo string) (int64, bool) {
+	key := strings.ToLower(owner + "/" + repo)
+
+	l.mu.Lock()
+	cached, found := l.sizes[key]
+	l.mu.Unlock()
+	if found && time.Since(cached.fetched) < l.cfg.SizeCacheTTL {
+		return cached.bytes, true
+	}
+
+	req, err := http.NewRequestWithContext(proxy.WithHandler(ctx, proxy.HandlerAPI), http.MethodGet,
+		fmt.Sprintf("https://api.github.com/repos/%s/%s", owner, repo), nil)
+	if err != nil {
+		return 0, false
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("User-Agent", "github-reverse-proxy/1.0")
+	if l.token != "" {
+		req.Header.Set("Authorization", "token "+l.token)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return 0, false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, false
+	}
+
+	var info struct {
+		Size int64 `json:"size"` // kilobytes
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return 0, false
+	}
+
+	size := info.Size * 1024
+	l.storeSize(key, size)
+	return size, true
+}
+
+// storeSize caches the size of a repository. When the cache reaches
+// maxRepoSizes, expired sizes are dropped, and if none have expired, the
+// oldest.
+func (l *fetchLimiter) storeSize(key string, size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.sizes[key]; !ok && len(l.sizes) >= maxRepoSizes {
+		for k, s := range l.sizes {
+			if time.Since(s.fetched) >= l.cfg.SizeCacheTTL {
+				delete(l.sizes, k)
+			}
+		}
+		if len(l.sizes) >= maxRepoSizes {
+			var oldest string
+			for k, s := range l.sizes {
+				if oldest == "" || s.fetched.Before(l.sizes[oldest].fetched) {
+					oldest = k
+				}
+			}
+			delete(l.sizes, oldest)
+		}
+	}
+	l.sizes[key] = repoSize{bytes: size, fetched: time.Now()}
+}
+
+// reducingFilters are the filters accepted in place of a shallow or
+// size-checked clone when a policy does not list its own allowed filters.
+var reducingFilters = []string{"blob:none", "tree:0"}
+
+// filterShrinksClone reports whether a partial-clone filter leaves out enough
+// of a repository to exempt a clone from require_shallow and max_clone_size.
+// Filters such as blob:limit=100g are accepted by GitHub but still transfer
+// almost everything, so only the policy's allowed filters, or the built-in
+// reducing filters, qualify.
+func filterShrinksClone(policy *config.FetchPolicyConfig, filter string) bool {
+	if filter == "" {
+		return false
+	}
+	if len(policy.AllowedFilters) > 0 {
+		return containsString(policy.AllowedFilters, filter)
+	}
+	return containsString(reducingFilters, filter)
+}
+
+// suggestedFilter returns the filter to recommend in error messages.
+func suggestedFilter(policy *config.FetchPolicyConfig) string {
+	if len(policy.AllowedFilters) > 0 {
+		return policy.AllowedFilters[0]
+	}
+	return "blob:none"
+}
+
+// containsString checks if a slice contains a string.
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// formatBytes formats a byte count for user-facing messages.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/config"
+	"github.com/LZUOSS/gh-proxy/internal/pktline"
+	"github.com/gin-gonic/gin"
+)
+
+func TestFetchLimiterCheck(t *testing.T) {
+	limiter := newFetchLimiter(&config.FetchLimitsConfig{
+		Enabled:      true,
+		SizeCacheTTL: time.Hour,
+		Default:      config.FetchPolicyConfig{MaxCloneSize: 1024 * 1024},
+		Repos: []config.RepoFetchPolicyConfig{
+			{Repo: "big/*", FetchPolicyConfig: config.FetchPolicyConfig{RequireFilter: true, AllowedFilters: []string{"blob:none"}}},
+			{Repo: "owner/shallow", FetchPolicyConfig: config.FetchPolicyConfig{RequireShallow: 1}},
+			{Repo: "owner/capped", FetchPolicyConfig: config.FetchPolicyConfig{MaxDepth: 50}},
+		},
+	}, nil, "")
+
+	// Pre-populate sizes so no API request is made
+	limiter.sizes["owner/huge"] = repoSize{bytes: 2 * 1024 * 1024, fetched: time.Now()}
+	limiter.sizes["owner/small"] = repoSize{bytes: 1024, fetched: time.Now()}
+
+	clone := &pktline.UploadPackRequest{Command: "fetch", Wants: []string{"a"}}
+	deep := &pktline.UploadPackRequest{Command: "fetch", Wants: []string{"a"}, Depth: 500}
+	shallow := &pktline.UploadPackRequest{Command: "fetch", Wants: []string{"a"}, Depth: 1}
+	filtered := &pktline.UploadPackRequest{Command: "fetch", Wants: []string{"a"}, Filter: "blob:none"}
+	blobLimit := &pktline.UploadPackRequest{Command: "fetch", Wants: []string{"a"}, Filter: "blob:limit=100g"}
+	fetch := &pktline.UploadPackRequest{Command: "fetch", Wants: []string{"a"}, Haves: []string{"b"}}
+	treeless := &pktline.UploadPackRequest{Command: "fetch", Wants: []string{"a"}, Filter: "tree:0"}
+	lsRefs := &pktline.UploadPackRequest{Command: "ls-refs"}
+
+	tests := []struct {
+		name       string
+		repo       string
+		req        *pktline.UploadPackRequest
+		wantReject string
+		wantDepth  int
+	}{
+		{name: "small clone allowed", repo: "owner/small", req: clone},
+		{name: "huge unfiltered clone rejected", repo: "owner/huge", req: clone, wantReject: "above the 1.0 MiB limit"},
+		{name: "huge filtered clone allowed", repo: "owner/huge", req: filtered},
+		{name: "huge clone with large blob limit rejected", repo: "owner/huge", req: blobLimit, wantReject: "--filter=blob:none"},
+		{name: "depth capped", repo: "owner/capped", req: deep, wantDepth: 50},
+		{name: "shallow clone under max depth allowed", repo: "owner/capped", req: shallow},
+		{name: "full clone under max depth rejected", repo: "owner/capped", req: clone, wantReject: "--depth=50"},
+		{name: "filtered clone under max depth rejected", repo: "owner/capped", req: filtered, wantReject: "--depth=50"},
+		{name: "incremental fetch under max depth allowed", repo: "owner/capped", req: fetch},
+		{name: "filter required", repo: "big/repo", req: clone, wantReject: "--filter=blob:none"},
+		{name: "filter not allowed", repo: "BIG/repo", req: treeless, wantReject: `filter "tree:0" is not allowed`},
+		{name: "allowed filter", repo: "big/repo", req: filtered},
+		{name: "shallow required", repo: "owner/shallow", req: clone, wantReject: "--depth=1"},
+		{name: "shallow required with reducing filter", repo: "owner/shallow", req: treeless},
+		{name: "shallow required with large blob limit", repo: "owner/shallow", req: blobLimit, wantReject: "--depth=1"},
+		{name: "ls-refs ignored", repo: "big/repo", req: lsRefs},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner, repo, _ := strings.Cut(tt.repo, "/")
+			got := limiter.check(context.Background(), owner, repo, tt.req)
+			if tt.wantReject == "" && got.reject != "" {
+				t.Errorf("check() rejected: %s", got.reject)
+			}
+			if tt.wantReject != "" && !strings.Contains(got.reject, tt.wantReject) {
+				t.Errorf("check() reject = %q, want it to contain %q", got.reject, tt.wantReject)
+			}
+			if got.depth != tt.wantDepth {
+				t.Errorf("check() depth = %d, want %d", got.depth, tt.wantDepth)
+			}
+		})
+	}
+}
+
+func TestFetchLimiterSizesBounded(t *testing.T) {
+	limiter := newFetchLimiter(&config.FetchLimitsConfig{Enabled: true, SizeCacheTTL: time.Hour}, nil, "")
+
+	now := time.Now()
+	limiter.sizes["owner/expired"] = repoSize{fetched: now.Add(-2 * time.Hour)}
+	for i := 1; i < maxRepoSizes; i++ {
+		limiter.sizes[fmt.Sprintf("owner/repo%d", i)] = repoSize{fetched: now.Add(time.Duration(i-maxRepoSizes) * time.Millisecond)}
+	}
+
+	limiter.storeSize("owner/first", 1)
+	if _, ok := limiter.sizes["owner/expired"]; ok {
+		t.Error("expected the expired size to be dropped")
+	}
+	if len(limiter.sizes) != maxRepoSizes {
+		t.Errorf("sizes = %d, want %d", len(limiter.sizes), maxRepoSizes)
+	}
+
+	limiter.storeSize("owner/second", 1)
+	if _, ok := limiter.sizes["owner/repo1"]; ok {
+		t.Error("expected the oldest size to be dropped")
+	}
+	if _, ok := limiter.sizes["owner/second"]; !ok || len(limiter.sizes) != maxRepoSizes {
+		t.Errorf("sizes = %d with the new size cached = %v, want %d", len(limiter.sizes), ok, maxRepoSizes)
+	}
+}
+
+func TestUploadPackUninspectable(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := NewGitHandler(nil, "", &config.GitConfig{
+		FetchLimits: config.FetchLimitsConfig{
+			Enabled: true,
+			Default: config.FetchPolicyConfig{RequireFilter: true},
+		},
+	}, nil, nil, nil)
+
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+	}{
+		{name: "oversized body", body: bytes.Repeat([]byte("0032have 0000000000000000000000000000000000000000\n"), maxInspectSize/50+1)},
+		{name: "bad encoding", body: []byte("not gzip"), encoding: "gzip"},
+		{name: "bad pkt-line", body: []byte("zzzz")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/owner/repo.git/git-upload-pack", bytes.NewReader(tt.body))
+			c.Params = gin.Params{{Key: "owner", Value: "owner"}, {Key: "repo", Value: "repo.git"}}
+			if tt.encoding != "" {
+				c.Request.Header.Set("Content-Encoding", tt.encoding)
+			}
+
+			// The handler has no client, so forwarding the request would panic
+			h.HandleUploadPack(c)
+			if !strings.Contains(w.Body.String(), "ERR the fetch request for owner/repo could not be inspected") {
+				t.Errorf("response = %q, want a fetch limit error", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,491 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/auth"
+	"github.com/LZUOSS/gh-proxy/internal/filestore"
+	"github.com/LZUOSS/gh-proxy/internal/policy"
+	"github.com/LZUOSS/gh-proxy/internal/proxy"
+	"github.com/LZUOSS/gh-proxy/internal/rewrite"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// lfsMediaType is the media type of Git LFS batch API requests and responses.
+	lfsMediaType = "application/vnd.git-lfs+json"
+
+	// maxLFSBatchSize bounds batch request and response bodies.
+	maxLFSBatchSize = 10 * 1024 * 1024
+
+	// maxLFSGrants bounds the number of download actions remembered.
+	// Once it is reached, the grant that expires first is dropped.
+	maxLFSGrants = 50000
+
+	// lfsCacheTTL is how long objects are cached. Objects are content
+	// addressed, so they never go stale.
+	lfsCacheTTL = 7 * 24 * time.Hour
+
+	// defaultLFSGrantTTL applies when GitHub does not say when an action expires.
+	defaultLFSGrantTTL = time.Hour
+)
+
+// LFSHandler proxies the Git LFS batch API and serves LFS objects.
+// Routes:
+//
+//	POST /:owner/:repo/info/lfs/objects/batch
+//	GET  /:owner/:repo/info/lfs/objects/:oid
+//
+// Download actions in batch responses are rewritten to point at the object
+// route. Objects are fetched from GitHub's LFS storage and written to the
+// file store while they stream to the client; an object is cached by oid
+// once its SHA-256 matches. Without a file store, objects are streamed on
+// every request. The object route only serves oids that a batch response
+// authorized for the same repository and the same client credentials,
+// including objects already in the cache.
+type LFSHandler struct {
+	files    *filestore.Store // nil disables caching
+	client   *proxy.ProxyClient
+	git      *GitHandler // Supplies upstream credentials and the push policy
+	rewriter *rewrite.Rewriter
+
+	mu     sync.Mutex
+	grants map[string]lfsGrant // keyed by owner/repo/oid/credentials hash
+}
+
+// lfsGrant is a download action issued by GitHub for one object.
+type lfsGrant struct {
+	href    string
+	header  map[string]string
+	expires time.Time
+}
+
+// lfsBatchRequest is the part of a batch request the proxy inspects.
+type lfsBatchRequest struct {
+	Operation string `json:"operation"`
+}
+
+// lfsAction is a single action in a batch response.
+type lfsAction struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresIn int               `json:"expires_in,omitempty"`
+	ExpiresAt string            `json:"expires_at,omitempty"`
+}
+
+// NewLFSHandler creates a new Git LFS handler that caches objects in files,
+// if not nil. rewriter supplies the proxy base URL used in rewritten hrefs.
+func NewLFSHandler(files *filestore.Store, client *proxy.ProxyClient, git *GitHandler, rewriter *rewrite.Rewriter) *LFSHandler {
+	return &LFSHandler{
+		files:    files,
+		client:   client,
+		git:      git,
+		rewriter: rewriter,
+		grants:   make(map[string]lfsGrant),
+	}
+}
+
+// HandleBatch proxies a batch API request and rewrites its download actions.
+func (h *LFSHandler) HandleBatch(c *gin.Context) {
+	owner := c.Param("owner")
+	repo := strings.TrimSuffix(c.Param("repo"), ".git")
+
+	if owner == "" || repo == "" {
+		writeLFSError(c, http.StatusBadRequest, "missing required parameters")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxLFSBatchSize+1))
+	if err != nil {
+		writeLFSError(c, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	if len(body) > maxLFSBatchSize {
+		writeLFSError(c, http.StatusRequestEntityTooLarge, "batch request too large")
+		return
+	}
+
+	var batch lfsBatchRequest
+	if err := json.Unmarshal(body, &batch); err != nil {
+		writeLFSError(c, http.StatusUnprocessableEntity, "invalid batch request")
+		return
+	}
+
+	// Uploads are pushes and follow the push policy
+	service := "git-upload-pack"
+	if batch.Operation == "upload" {
+		service = "git-receive-pack"
+		if err := h.authorizeUpload(c, owner, repo); err != nil {
+			if errors.Is(err, policy.ErrAuthenticationRequired) || errors.Is(err, errInvalidCredentials) {
+				c.Header("LFS-Authenticate", `Basic realm="gh-proxy"`)
+				writeLFSError(c, http.StatusUnauthorized, err.Error())
+				return
+			}
+			writeLFSError(c, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+
+	upstreamURL := fmt.Sprintf("https://github.com/%s/%s.git/info/lfs/objects/batch", owner, repo)
+	req, err := http.NewRequestWithContext(proxy.WithHandler(c.Request.Context(), proxy.HandlerLFS), http.MethodPost, upstreamURL, bytes.NewReader(body))
+	if err != nil {
+		writeLFSError(c, http.StatusInternalServerError, "failed to create request")
+		return
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	if userAgent := c.GetHeader("User-Agent"); userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	if authorization := h.git.upstreamAuth(c, owner, repo, service); authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		writeLFSError(c, http.StatusBadGateway, "failed to forward request to GitHub")
+		return
+	}
+	defer resp.Body.Close()
+
+	// Errors and authentication challenges are passed through unchanged
+	if resp.StatusCode != http.StatusOK {
+		for key, values := range resp.Header {
+			for _, value := range values {
+				c.Header(key, value)
+			}
+		}
+		c.Status(resp.StatusCode)
+		io.Copy(c.Writer, resp.Body)
+		return
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxLFSBatchSize+1))
+	if err != nil || len(raw) > maxLFSBatchSize {
+		writeLFSError(c, http.StatusBadGateway, "invalid batch response from GitHub")
+		return
+	}
+
+	if batch.Operation == "download" {
+		rewritten, err := h.rewriteBatch(raw, owner, repo, h.rewriter.ProxyBase(c.Request), c.GetHeader("Authorization"), lfsClientKey(c))
+		if err != nil {
+			writeLFSError(c, http.StatusBadGateway, "invalid batch response from GitHub")
+			return
+		}
+		raw = rewritten
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, lfsMediaType, raw)
+}
+
+// HandleObject serves an LFS object from the cache, or fetches it from the
+// href GitHub issued in an earlier batch response.
+func (h *LFSHandler) HandleObject(c *gin.Context) {
+	owner := c.Param("owner")
+	repo := strings.TrimSuffix(c.Param("repo"), ".git")
+	oid := c.Param("oid")
+
+	if owner == "" || repo == "" || !isLFSOid(oid) {
+		writeLFSError(c, http.StatusBadRequest, "invalid object request")
+		return
+	}
+
+	// Checked before the cache, so cached private objects stay private too
+	grant, ok := h.grant(owner, repo, oid, lfsClientKey(c))
+	if !ok {
+		writeLFSError(c, http.StatusNotFound, "object was not requested through the batch API, or the request expired")
+		return
+	}
+
+	cacheKey := "lfs/" + oid
+
+	if h.files != nil {
+		if entry, ok := h.files.Open(cacheKey); ok {
+			for key, value := range entry.Headers {
+				c.Header(key, value)
+			}
+			c.Header("X-Cache", "HIT-DISK")
+			c.File(entry.Path)
+			return
+		}
+	}
+
+	h.fetchObject(c, grant, oid, cacheKey)
+}
+
+// fetchObject streams an object from GitHub's LFS storage, caching it if its
+// content matches the oid.
+func (h *LFSHandler) fetchObject(c *gin.Context, grant lfsGrant, oid, cacheKey string) {
+	// Storage redirects are part of the download action, not for the client
+	ctx := proxy.FollowRedirects(proxy.WithHandler(c.Request.Context(), proxy.HandlerLFS))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, grant.href, nil)
+	if err != nil {
+		writeLFSError(c, http.StatusInternalServerError, "failed to create request")
+		return
+	}
+	for key, value := range grant.header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		writeLFSError(c, http.StatusBadGateway, "failed to fetch object from GitHub")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		c.Status(resp.StatusCode)
+		io.Copy(c.Writer, resp.Body)
+		return
+	}
+
+	headers := map[string]string{"Content-Type": "application/octet-stream"}
+	c.Header("Content-Type", "application/octet-stream")
+	if resp.ContentLength >= 0 {
+		c.Header("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
+	}
+	c.Header("X-Cache", "MISS")
+	c.Status(http.StatusOK)
+
+	if h.files == nil {
+		if _, err := io.Copy(c.Writer, resp.Body); err != nil {
+			c.Error(fmt.Errorf("streaming lfs object %s failed: %w", oid, err))
+		}
+		return
+	}
+
+	// Hash while writing to the store; only verified objects are committed
+	file, err := h.files.Create(cacheKey)
+	if err != nil {
+		c.Error(fmt.Errorf("caching lfs object %s failed: %w", oid, err))
+		if _, err := io.Copy(c.Writer, resp.Body); err != nil {
+			c.Error(fmt.Errorf("streaming lfs object %s failed: %w", oid, err))
+		}
+		return
+	}
+	// Nothing is left once the file is committed
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(c.Writer, file, hash), resp.Body); err != nil {
+		c.Error(fmt.Errorf("streaming lfs object %s failed: %w", oid, err))
+		return
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != oid {
+		c.Error(fmt.Errorf("lfs object %s failed verification, not caching", oid))
+		return
+	}
+	if err := file.Close(); err != nil {
+		c.Error(fmt.Errorf("caching lfs object %s failed: %w", oid, err))
+		return
+	}
+	if err := h.files.Commit(cacheKey, file.Name(), headers, lfsCacheTTL); err != nil {
+		c.Error(fmt.Errorf("caching lfs object %s failed: %w", oid, err))
+	}
+}
+
+// rewriteBatch points the download actions of a batch response at the
+// object route and records the original actions as grants for clientKey.
+// authorization, the client's Authorization header, is handed back in the
+// actions: git-lfs sends no credentials of its own for authenticated objects.
+func (h *LFSHandler) rewriteBatch(raw []byte, owner, repo, baseURL, authorization, clientKey string) ([]byte, error) {
+	var resp map[string]json.RawMessage
+	err := json.Unmarshal(raw, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the basic transfer adapter uses plain download hrefs
+	if t, ok := resp["transfer"]; ok {
+		var transfer string
+		if err := json.Unmarshal(t, &transfer); err == nil && transfer != "" && transfer != "basic" {
+			return raw, nil
+		}
+	}
+
+	var objects []map[string]json.RawMessage
+	if err := json.Unmarshal(resp["objects"], &objects); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, obj := range objects {
+		var oid string
+		if err := json.Unmarshal(obj["oid"], &oid); err != nil || !isLFSOid(oid) {
+			continue
+		}
+
+		var actions map[string]json.RawMessage
+		if err := json.Unmarshal(obj["actions"], &actions); err != nil || actions["download"] == nil {
+			continue
+		}
+
+		var download lfsAction
+		if err := json.Unmarshal(actions["download"], &download); err != nil || download.Href == "" {
+			continue
+		}
+
+		h.addGrant(owner, repo, oid, clientKey, lfsGrant{
+			href:    download.Href,
+			header:  download.Header,
+			expires: actionExpiry(download, now),
+		})
+
+		// The proxy adds GitHub's headers itself; the client only presents
+		// its own credentials again
+		proxied := lfsAction{
+			Href:      fmt.Sprintf("%s/%s/%s/info/lfs/objects/%s", baseURL, owner, repo, oid),
+			ExpiresIn: download.ExpiresIn,
+			ExpiresAt: download.ExpiresAt,
+		}
+		if authorization != "" {
+			proxied.Header = map[string]string{"Authorization": authorization}
+		}
+		if actions["download"], err = json.Marshal(proxied); err != nil {
+			return nil, err
+		}
+		if obj["actions"], err = json.Marshal(actions); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp["objects"], err = json.Marshal(objects); err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// authorizeUpload applies the push policy to an LFS upload.
+func (h *LFSHandler) authorizeUpload(c *gin.Context, owner, repo string) error {
+	clientIP := c.GetString("client_ip")
+	if clientIP == "" {
+		clientIP = c.ClientIP()
+	}
+
+	user, err := h.git.requestUser(c)
+	if err != nil {
+		return err
+	}
+
+	return h.git.push.Authorize(policy.PushAttempt{
+		Transport:  "http",
+		Stage:      "lfs-upload",
+		User:       user,
+		Owner:      owner,
+		Repo:       repo,
+		RemoteAddr: clientIP,
+	})
+}
+
+// addGrant records a download action for a client. When the grants reach
+// maxLFSGrants, expired ones are dropped, and if none have expired, the one
+// that expires first.
+func (h *LFSHandler) addGrant(owner, repo, oid, clientKey string, grant lfsGrant) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := lfsGrantKey(owner, repo, oid, clientKey)
+	if _, ok := h.grants[key]; !ok && len(h.grants) >= maxLFSGrants {
+		now := time.Now()
+		for k, g := range h.grants {
+			if now.After(g.expires) {
+				delete(h.grants, k)
+			}
+		}
+		if len(h.grants) >= maxLFSGrants {
+			var oldest string
+			for k, g := range h.grants {
+				if oldest == "" || g.expires.Before(h.grants[oldest].expires) {
+					oldest = k
+				}
+			}
+			delete(h.grants, oldest)
+		}
+	}
+	h.grants[key] = grant
+}
+
+// grant returns the unexpired download action for an object issued to a
+// client.
+func (h *LFSHandler) grant(owner, repo, oid, clientKey string) (lfsGrant, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	g, ok := h.grants[lfsGrantKey(owner, repo, oid, clientKey)]
+	if !ok || time.Now().After(g.expires) {
+		return lfsGrant{}, false
+	}
+	return g, true
+}
+
+// lfsGrantKey returns the grant map key for an object and client.
+func lfsGrantKey(owner, repo, oid, clientKey string) string {
+	return strings.ToLower(owner+"/"+repo) + "/" + oid + "/" + clientKey
+}
+
+// lfsClientKey identifies the credentials of a request by hash: its
+// Authorization header, or the token of a request bridged from SSH. It is
+// empty for anonymous requests.
+func lfsClientKey(c *gin.Context) string {
+	credential := c.GetHeader("Authorization")
+	if credential == "" {
+		if v, ok := c.Get("auth_token"); ok {
+			if token, ok := v.(*auth.Token); ok && token != nil {
+				credential = token.Value
+			}
+		}
+	}
+	if credential == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:])
+}
+
+// actionExpiry returns when a batch action expires.
+func actionExpiry(action lfsAction, now time.Time) time.Time {
+	if action.ExpiresAt != "" {
+		if t, err := time.Parse(time.RFC3339, action.ExpiresAt); err == nil {
+			return t
+		}
+	}
+	if action.ExpiresIn > 0 {
+		return now.Add(time.Duration(action.ExpiresIn) * time.Second)
+	}
+	return now.Add(defaultLFSGrantTTL)
+}
+
+// isLFSOid reports whether s is a lowercase hex SHA-256 object id.
+func isLFSOid(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, ch := range s {
+		if !((ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f')) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeLFSError writes an error in the Git LFS API format.
+func writeLFSError(c *gin.Context, status int, msg string) {
+	c.Header("Content-Type", lfsMediaType)
+	c.JSON(status, gin.H{"message": msg})
+}
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/filestore"
+	"github.com/LZUOSS/gh-proxy/internal/rewrite"
+	"github.com/gin-gonic/gin"
+)
+
+const testOid = "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+
+func TestLFSRewriteBatch(t *testing.T) {
+	h := NewLFSHandler(nil, nil, nil, rewrite.New("", rewrite.GitHubHosts, nil))
+
+	upstream := `{
+		"transfer": "basic",
+		"objects": [
+			{
+				"oid": "` + testOid + `",
+				"size": 12345,
+				"authenticated": true,
+				"actions": {
+					"download": {
+						"href": "https://github-cloud.githubusercontent.com/alambic/media/123?token=abc",
+						"header": {"Authorization": "RemoteAuth secret"},
+						"expires_in": 3600
+					}
+				}
+			},
+			{
+				"oid": "` + strings.Repeat("0", 64) + `",
+				"size": 1,
+				"error": {"code": 404, "message": "Object does not exist"}
+			}
+		],
+		"hash_algo": "sha256"
+	}`
+
+	out, err := h.rewriteBatch([]byte(upstream), "owner", "repo", "https://proxy.example.com/gh", "Bearer client", "client")
+	if err != nil {
+		t.Fatalf("rewriteBatch() error = %v", err)
+	}
+
+	var resp struct {
+		HashAlgo string `json:"hash_algo"`
+		Objects  []struct {
+			Oid     string               `json:"oid"`
+			Size    int64                `json:"size"`
+			Actions map[string]lfsAction `json:"actions"`
+			Error   *struct {
+				Code int `json:"code"`
+			} `json:"error"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		t.Fatalf("rewritten response is not valid JSON: %v", err)
+	}
+
+	if resp.HashAlgo != "sha256" {
+		t.Errorf("hash_algo = %q, want it preserved", resp.HashAlgo)
+	}
+	download := resp.Objects[0].Actions["download"]
+	wantHref := "https://proxy.example.com/gh/owner/repo/info/lfs/objects/" + testOid
+	if download.Href != wantHref {
+		t.Errorf("href = %q, want %q", download.Href, wantHref)
+	}
+	if len(download.Header) != 1 || download.Header["Authorization"] != "Bearer client" {
+		t.Errorf("header = %v, want only the client's own credentials", download.Header)
+	}
+	if download.ExpiresIn != 3600 {
+		t.Errorf("expires_in = %d, want 3600", download.ExpiresIn)
+	}
+	if resp.Objects[1].Error == nil || resp.Objects[1].Error.Code != 404 {
+		t.Errorf("object error was not preserved")
+	}
+
+	grant, ok := h.grant("Owner", "Repo", testOid, "client")
+	if !ok {
+		t.Fatal("grant was not recorded")
+	}
+	if !strings.HasPrefix(grant.href, "https://github-cloud.githubusercontent.com/") || grant.header["Authorization"] != "RemoteAuth secret" {
+		t.Errorf("grant = %+v, want the upstream action", grant)
+	}
+	if _, ok := h.grant("other", "repo", testOid, "client"); ok {
+		t.Error("grant must not apply to other repositories")
+	}
+	if _, ok := h.grant("owner", "repo", testOid, "other"); ok {
+		t.Error("grant must not apply to other clients")
+	}
+}
+
+func TestLFSObjectRequiresGrantForClient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := NewLFSHandler(nil, nil, nil, rewrite.New("", rewrite.GitHubHosts, nil))
+	h.addGrant("owner", "repo", testOid, lfsClientKeyFor(t, "Bearer client"), lfsGrant{
+		href:    "https://github-cloud.githubusercontent.com/alambic/media/123",
+		expires: time.Now().Add(time.Hour),
+	})
+
+	// The handler has no client, so getting past the grant check would panic
+	for _, header := range []string{"", "Bearer other"} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/owner/repo/info/lfs/objects/"+testOid, nil)
+		c.Params = gin.Params{{Key: "owner", Value: "owner"}, {Key: "repo", Value: "repo"}, {Key: "oid", Value: testOid}}
+		if header != "" {
+			c.Request.Header.Set("Authorization", header)
+		}
+
+		h.HandleObject(c)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("status with credentials %q = %d, want 404", header, w.Code)
+		}
+	}
+}
+
+func TestLFSGrantsBounded(t *testing.T) {
+	h := NewLFSHandler(nil, nil, nil, rewrite.New("", rewrite.GitHubHosts, nil))
+
+	now := time.Now()
+	h.addGrant("owner", "repo", testOid, "first", lfsGrant{expires: now.Add(time.Minute)})
+	for i := 1; i < maxLFSGrants; i++ {
+		h.addGrant("owner", "repo", testOid, fmt.Sprint(i), lfsGrant{expires: now.Add(time.Hour)})
+	}
+	h.addGrant("owner", "repo", testOid, "last", lfsGrant{expires: now.Add(time.Hour)})
+
+	if len(h.grants) != maxLFSGrants {
+		t.Errorf("grants = %d, want %d", len(h.grants), maxLFSGrants)
+	}
+	if _, ok := h.grant("owner", "repo", testOid, "first"); ok {
+		t.Error("the grant expiring first was not dropped")
+	}
+	if _, ok := h.grant("owner", "repo", testOid, "last"); !ok {
+		t.Error("the new grant was not recorded")
+	}
+}
+
+func TestLFSObjectCachedWhenVerified(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	object := strings.Repeat("large binary ", 1024)
+	sum := sha256.Sum256([]byte(object))
+	oid := hex.EncodeToString(sum[:])
+
+	requests := 0
+	client := newUpstreamClient(t, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/media/good":
+			w.Write([]byte(object))
+		case "/media/corrupt":
+			w.Write([]byte("not the object"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	files, err := filestore.New(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("filestore.New() error = %v", err)
+	}
+	h := NewLFSHandler(files, client, nil, rewrite.New("", rewrite.GitHubHosts, nil))
+
+	get := func(oid string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/owner/repo/info/lfs/objects/"+oid, nil)
+		c.Params = gin.Params{{Key: "owner", Value: "owner"}, {Key: "repo", Value: "repo"}, {Key: "oid", Value: oid}}
+		h.HandleObject(c)
+		return w
+	}
+
+	expires := time.Now().Add(time.Hour)
+	h.addGrant("owner", "repo", oid, "", lfsGrant{href: "https://lfs.example.com/media/good", expires: expires})
+	h.addGrant("owner", "repo", testOid, "", lfsGrant{href: "https://lfs.example.com/media/corrupt", expires: expires})
+
+	for i, want := range []string{"MISS", "HIT-DISK"} {
+		w := get(oid)
+		if w.Code != http.StatusOK || w.Body.String() != object || w.Header().Get("X-Cache") != want {
+			t.Errorf("request %d = %d %s with %d bytes, want the object from %s", i, w.Code, w.Header().Get("X-Cache"), w.Body.Len(), want)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("upstream requests = %d, want the verified object to be cached", requests)
+	}
+
+	// Objects that do not match their oid are passed on but not cached
+	for i := 0; i < 2; i++ {
+		if w := get(testOid); w.Header().Get("X-Cache") != "MISS" {
+			t.Errorf("request %d for a corrupt object = %s, want MISS", i, w.Header().Get("X-Cache"))
+		}
+	}
+	if _, ok := files.Open("lfs/" + testOid); ok {
+		t.Error("a corrupt object was cached")
+	}
+}
+
+// lfsClientKeyFor returns the client key of a request with an Authorization header.
+func lfsClientKeyFor(t *testing.T, authorization string) string {
+	t.Helper()
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	c.Request.Header.Set("Authorization", authorization)
+	return lfsClientKey(c)
+}
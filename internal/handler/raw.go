@@ -97,7 +97,7 @@ func (h *RawHandler) serveFromDisk(c *gin.Context, dataPath string, meta *cache.
 // fetchAndStream fetches from GitHub and streams while caching.
 func (h *RawHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey string) {
 	// Create request
-	req, err := http.NewRequest(http.MethodGet, upstreamURL, nil)
+	req, err := http.NewRequestWithContext(proxy.WithHandler(c.Request.Context(), proxy.HandlerRaw), http.MethodGet, upstreamURL, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
 		return
@@ -119,6 +119,7 @@ func (h *RawHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey string
 
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
+		copyLocation(c, resp)
 		c.Status(resp.StatusCode)
 		io.Copy(c.Writer, resp.Body)
 		return
@@ -152,6 +153,7 @@ func (h *RawHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey string
 		written, err := io.Copy(c.Writer, teeReader)
 		if err != nil {
 			// Stream was interrupted, don't cache
+			c.Error(fmt.Errorf("streaming %s failed: %w", upstreamURL, err))
 			return
 		}
 
@@ -170,6 +172,8 @@ func (h *RawHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey string
 	} else {
 		// Just stream without caching
 		c.Status(resp.StatusCode)
-		io.Copy(c.Writer, resp.Body)
+		if _, err := io.Copy(c.Writer, resp.Body); err != nil {
+			c.Error(fmt.Errorf("streaming %s failed: %w", upstreamURL, err))
+		}
 	}
 }
@@ -0,0 +1,17 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// copyLocation passes the Location header of an upstream redirect on to the
+// client, for the RewriteRedirects middleware to point back at the proxy.
+// It is made absolute first: a relative Location would resolve against the
+// proxy rather than the upstream host.
+func copyLocation(c *gin.Context, resp *http.Response) {
+	if location, err := resp.Location(); err == nil {
+		c.Header("Location", location.String())
+	}
+}
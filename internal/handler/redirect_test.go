@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/LZUOSS/gh-proxy/internal/cache"
+	"github.com/LZUOSS/gh-proxy/internal/middleware"
+	"github.com/LZUOSS/gh-proxy/internal/rewrite"
+	"github.com/gin-gonic/gin"
+)
+
+func TestUpstreamRedirectsReachClient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	client := newUpstreamClient(t, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host + r.URL.Path {
+		case "raw.githubusercontent.com/owner/repo/main/old.txt":
+			// A relative Location, as a moved file may have
+			http.Redirect(w, r, "/owner/repo/main/new.txt", http.StatusFound)
+		case "github.com/owner/repo/releases/download/v1/app.tar.gz":
+			http.Redirect(w, r, "https://release-assets.githubusercontent.com/asset/1", http.StatusFound)
+		case "release-assets.githubusercontent.com/asset/1":
+			w.Write([]byte("asset"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	assets, err := cache.NewCache(cache.Config{MemorySize: 100})
+	if err != nil {
+		t.Fatalf("NewCache() error = %v", err)
+	}
+
+	router := gin.New()
+	router.Use(middleware.RewriteRedirects(rewrite.New("", rewrite.GitHubHosts, nil)))
+	router.GET("/:owner/:repo/raw/:ref/*filepath", NewRawHandler(assets, client).Handle)
+	router.GET("/:owner/:repo/releases/download/:tag/:filename", NewReleasesHandler(assets, nil, client).Handle)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://proxy.example.com/owner/repo/raw/main/old.txt", nil))
+	want := "http://proxy.example.com/https://raw.githubusercontent.com/owner/repo/main/new.txt"
+	if w.Code != http.StatusFound || w.Header().Get("Location") != want {
+		t.Errorf("redirect = %d %q, want 302 %q", w.Code, w.Header().Get("Location"), want)
+	}
+
+	// Redirects to hosts the proxy cannot serve are followed upstream
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://proxy.example.com/owner/repo/releases/download/v1/app.tar.gz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "asset" {
+		t.Errorf("release download = %d %q, want the asset", w.Code, w.Body.String())
+	}
+}
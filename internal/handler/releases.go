@@ -9,6 +9,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/LZUOSS/gh-proxy/internal/cache"
+	"github.com/LZUOSS/gh-proxy/internal/filestore"
 	"github.com/LZUOSS/gh-proxy/internal/proxy"
 )
 
@@ -16,13 +17,16 @@ import (
 // Route: /:owner/:repo/releases/download/:tag/:filename
 type ReleasesHandler struct {
 	cache  *cache.Cache
+	files  *filestore.Store // Holds assets downloaded in segments; may be nil
 	client *proxy.ProxyClient
 }
 
-// NewReleasesHandler creates a new releases handler.
-func NewReleasesHandler(cache *cache.Cache, client *proxy.ProxyClient) *ReleasesHandler {
+// NewReleasesHandler creates a new releases handler. Assets downloaded in
+// segments are cached in files, if not nil.
+func NewReleasesHandler(cache *cache.Cache, files *filestore.Store, client *proxy.ProxyClient) *ReleasesHandler {
 	return &ReleasesHandler{
 		cache:  cache,
+		files:  files,
 		client: client,
 	}
 }
@@ -46,6 +50,11 @@ func (h *ReleasesHandler) Handle(c *gin.Context) {
 	// Generate cache key
 	cacheKey := cache.GenerateKey("releases", owner, repo, tag, filename, "")
 
+	h.serve(c, upstreamURL, cacheKey)
+}
+
+// serve serves a release asset from the cache, or fetches it from upstreamURL.
+func (h *ReleasesHandler) serve(c *gin.Context, upstreamURL, cacheKey string) {
 	// Try memory cache first
 	if entry, ok := h.cache.Get(cacheKey); ok {
 		h.serveFromCache(c, entry)
@@ -60,6 +69,14 @@ func (h *ReleasesHandler) Handle(c *gin.Context) {
 		return
 	}
 
+	// Assets assembled from segments are kept in the file store
+	if h.files != nil {
+		if entry, ok := h.files.Open(cacheKey); ok {
+			h.serveFromDisk(c, entry.Path, &cache.DiskCacheMetadata{Headers: entry.Headers})
+			return
+		}
+	}
+
 	// Cache miss - fetch from GitHub
 	h.fetchAndStream(c, upstreamURL, cacheKey)
 }
@@ -97,7 +114,7 @@ func (h *ReleasesHandler) serveFromDisk(c *gin.Context, dataPath string, meta *c
 // fetchAndStream fetches from GitHub and streams while caching.
 func (h *ReleasesHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey string) {
 	// Create request
-	req, err := http.NewRequest(http.MethodGet, upstreamURL, nil)
+	req, err := http.NewRequestWithContext(proxy.WithHandler(c.Request.Context(), proxy.HandlerReleases), http.MethodGet, upstreamURL, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
 		return
@@ -120,6 +137,7 @@ func (h *ReleasesHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey s
 
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
+		copyLocation(c, resp)
 		c.Status(resp.StatusCode)
 		io.Copy(c.Writer, resp.Body)
 		return
@@ -139,6 +157,33 @@ func (h *ReleasesHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey s
 	// Get ETag
 	etag := resp.Header.Get("ETag")
 
+	// Large assets are fetched in parallel ranges when upstream allows it.
+	// The ranges are assembled in the file store, which then caches the
+	// asset, so it is not also held in memory.
+	dataPath := ""
+	if h.files != nil {
+		dataPath = h.files.Path(cacheKey)
+	}
+	if segmented := h.client.SegmentedBody(req.Context(), resp, dataPath); segmented != nil {
+		defer segmented.Close()
+		c.Status(resp.StatusCode)
+		if _, err := io.Copy(c.Writer, segmented); err != nil {
+			c.Error(fmt.Errorf("streaming %s failed: %w", upstreamURL, err))
+			return
+		}
+		if err := segmented.Close(); err != nil {
+			c.Error(fmt.Errorf("caching %s failed: %w", upstreamURL, err))
+			return
+		}
+		if dataPath != "" {
+			if err := h.files.Commit(cacheKey, dataPath, headers, 24*time.Hour); err != nil {
+				c.Error(fmt.Errorf("caching %s failed: %w", upstreamURL, err))
+			}
+		}
+		return
+	}
+	body := io.Reader(resp.Body)
+
 	// Determine if we should cache based on content length
 	contentLength := resp.ContentLength
 	shouldCache := contentLength > 0 && contentLength < 500*1024*1024 // Cache files < 500MB
@@ -146,13 +191,14 @@ func (h *ReleasesHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey s
 	if shouldCache {
 		// Use TeeReader to cache while streaming
 		var buf bytes.Buffer
-		teeReader := io.TeeReader(resp.Body, &buf)
+		teeReader := io.TeeReader(body, &buf)
 
 		// Stream to client
 		c.Status(resp.StatusCode)
 		written, err := io.Copy(c.Writer, teeReader)
 		if err != nil {
 			// Stream was interrupted, don't cache
+			c.Error(fmt.Errorf("streaming %s failed: %w", upstreamURL, err))
 			return
 		}
 
@@ -171,6 +217,8 @@ func (h *ReleasesHandler) fetchAndStream(c *gin.Context, upstreamURL, cacheKey s
 	} else {
 		// Just stream without caching
 		c.Status(resp.StatusCode)
-		io.Copy(c.Writer, resp.Body)
+		if _, err := io.Copy(c.Writer, body); err != nil {
+			c.Error(fmt.Errorf("streaming %s failed: %w", upstreamURL, err))
+		}
 	}
 }
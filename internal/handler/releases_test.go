@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/cache"
+	"github.com/LZUOSS/gh-proxy/internal/filestore"
+	"github.com/LZUOSS/gh-proxy/internal/proxy"
+	"github.com/gin-gonic/gin"
+)
+
+func TestReleasesSegmentedDownload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	asset := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+	modified := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var mu sync.Mutex
+	var ranges []string
+	cfg := proxy.DefaultProxyConfig()
+	cfg.Segmented = proxy.SegmentConfig{Segments: 4, MinSize: 1024, TempDir: t.TempDir()}
+	client := newUpstreamClient(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host+r.URL.Path != "github.com/owner/repo/releases/download/v1/app.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "app.bin", modified, bytes.NewReader(asset))
+	}))
+	assets, err := cache.NewCache(cache.Config{MemorySize: 100})
+	if err != nil {
+		t.Fatalf("NewCache() error = %v", err)
+	}
+	files, err := filestore.New(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("filestore.New() error = %v", err)
+	}
+
+	router := gin.New()
+	router.GET("/:owner/:repo/releases/download/:tag/:filename", NewReleasesHandler(assets, files, client).Handle)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/owner/repo/releases/download/v1/app.bin", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), asset) {
+		t.Fatalf("download = %d with %d bytes, want 200 with the %d byte asset", w.Code, w.Body.Len(), len(asset))
+	}
+
+	mu.Lock()
+	rangeRequests := 0
+	for _, r := range ranges {
+		if r != "" {
+			rangeRequests++
+		}
+	}
+	if rangeRequests != cfg.Segmented.Segments-1 {
+		t.Errorf("upstream requests = %q, want %d Range requests after the first", ranges, cfg.Segmented.Segments-1)
+	}
+	ranges = nil
+	mu.Unlock()
+
+	// The assembled file is cached
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/owner/repo/releases/download/v1/app.bin", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), asset) || w.Header().Get("X-Cache") != "HIT-DISK" {
+		t.Errorf("second download = %d %s with %d bytes, want the asset from the file store", w.Code, w.Header().Get("X-Cache"), w.Body.Len())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ranges) != 0 {
+		t.Errorf("upstream requests = %q, want none for a cached asset", ranges)
+	}
+}
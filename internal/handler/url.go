@@ -8,6 +8,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/LZUOSS/gh-proxy/internal/cache"
+	"github.com/LZUOSS/gh-proxy/internal/filestore"
 	"github.com/LZUOSS/gh-proxy/internal/proxy"
 )
 
@@ -20,21 +21,25 @@ type URLHandler struct {
 	rawHandler      *RawHandler
 	archiveHandler  *ArchiveHandler
 	gitHandler      *GitHandler
+	lfsHandler      *LFSHandler
 	gistHandler     *GistHandler
 	apiHandler      *APIHandler
 }
 
 // NewURLHandler creates a new URL handler.
-func NewURLHandler(cache *cache.Cache, client *proxy.ProxyClient) *URLHandler {
+// Git, LFS and API requests are routed to the given handlers so they share
+// their mirrors, policies, grants and rewriting settings.
+func NewURLHandler(cache *cache.Cache, files *filestore.Store, client *proxy.ProxyClient, gitHandler *GitHandler, lfsHandler *LFSHandler, apiHandler *APIHandler) *URLHandler {
 	return &URLHandler{
 		cache:           cache,
 		client:          client,
-		releasesHandler: NewReleasesHandler(cache, client),
+		releasesHandler: NewReleasesHandler(cache, files, client),
 		rawHandler:      NewRawHandler(cache, client),
 		archiveHandler:  NewArchiveHandler(cache, client),
-		gitHandler:      NewGitHandler(client, ""),
+		gitHandler:      gitHandler,
+		lfsHandler:      lfsHandler,
 		gistHandler:     NewGistHandler(cache, client),
-		apiHandler:      NewAPIHandler(cache, client, ""),
+		apiHandler:      apiHandler,
 	}
 }
 
@@ -50,6 +55,7 @@ type GitHubURLInfo struct {
 	GistID   string
 	User     string
 	APIPath  string
+	URL      string // Upstream URL of "asset" and codeload "archive" downloads, without the query
 }
 
 // Handle processes full GitHub URL requests.
@@ -91,6 +97,8 @@ func (h *URLHandler) Handle(c *gin.Context) {
 		h.handleGist(c, info)
 	case "api":
 		h.handleAPI(c, info)
+	case "asset":
+		h.handleAsset(c, info)
 	default:
 		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported GitHub URL type"})
 	}
@@ -107,7 +115,8 @@ func (h *URLHandler) parseGitHubURL(fullURL string) (*GitHubURLInfo, error) {
 	// Handle URLs without scheme (e.g., github.com/owner/repo/...)
 	if parsedURL.Scheme == "" {
 		if strings.HasPrefix(fullURL, "github.com/") || strings.HasPrefix(fullURL, "raw.githubusercontent.com/") ||
-		   strings.HasPrefix(fullURL, "api.github.com/") || strings.HasPrefix(fullURL, "gist.github.com/") {
+		   strings.HasPrefix(fullURL, "api.github.com/") || strings.HasPrefix(fullURL, "gist.github.com/") ||
+		   strings.HasPrefix(fullURL, "codeload.github.com/") || strings.HasPrefix(fullURL, "objects.githubusercontent.com/") {
 			fullURL = "https://" + fullURL
 			parsedURL, err = url.Parse(fullURL)
 			if err != nil {
@@ -121,6 +130,10 @@ func (h *URLHandler) parseGitHubURL(fullURL string) (*GitHubURLInfo, error) {
 
 	// Parse based on host - check specific hosts first before falling back to github.com
 	switch {
+	case host == "codeload.github.com":
+		return h.parseCodeloadURL(path)
+	case host == "objects.githubusercontent.com":
+		return &GitHubURLInfo{Type: "asset", URL: "https://objects.githubusercontent.com/" + path}, nil
 	case strings.Contains(host, "raw.githubusercontent.com"):
 		return h.parseRawGitHubUserContentURL(path)
 	case strings.Contains(host, "api.github.com"):
@@ -210,7 +223,7 @@ func (h *URLHandler) parseGitHubComURL(path string) (*GitHubURLInfo, error) {
 	default:
 		// Check if it's a git operation (ends with .git or has git-* paths)
 		if strings.HasSuffix(parts[1], ".git") || strings.Contains(path, "/info/refs") ||
-		   strings.Contains(path, "/git-upload-pack") || strings.Contains(path, "/git-receive-pack") {
+		   strings.Contains(path, "/info/lfs/") || strings.Contains(path, "/git-upload-pack") || strings.Contains(path, "/git-receive-pack") {
 			info.Type = "git"
 		}
 	}
@@ -218,6 +231,24 @@ func (h *URLHandler) parseGitHubComURL(path string) (*GitHubURLInfo, error) {
 	return info, nil
 }
 
+// parseCodeloadURL parses codeload.github.com archive URLs, which github.com
+// archive downloads redirect to, into the equivalent archive request.
+func (h *URLHandler) parseCodeloadURL(path string) (*GitHubURLInfo, error) {
+	// codeload.github.com/owner/repo/tar.gz/refs/heads/main
+	parts := strings.SplitN(path, "/", 4)
+	if len(parts) < 4 || (parts[2] != "tar.gz" && parts[2] != "zip") {
+		return nil, &url.Error{Op: "parse", URL: path, Err: http.ErrNotSupported}
+	}
+
+	return &GitHubURLInfo{
+		Type:  "archive",
+		Owner: parts[0],
+		Repo:  parts[1],
+		Ref:   parts[3] + "." + parts[2],
+		URL:   "https://codeload.github.com/" + path,
+	}, nil
+}
+
 // parseRawGitHubUserContentURL parses raw.githubusercontent.com URLs
 func (h *URLHandler) parseRawGitHubUserContentURL(path string) (*GitHubURLInfo, error) {
 	// raw.githubusercontent.com/owner/repo/ref/filepath
@@ -295,8 +326,15 @@ func (h *URLHandler) handleRaw(c *gin.Context, info *GitHubURLInfo) {
 	h.rawHandler.Handle(c)
 }
 
-// handleArchive routes to the archive handler
+// handleArchive routes to the archive handler. Codeload URLs are fetched
+// as they are: github.com answers archive requests with a redirect to them,
+// which would send the client back here.
 func (h *URLHandler) handleArchive(c *gin.Context, info *GitHubURLInfo) {
+	if info.URL != "" {
+		h.archiveHandler.serveURL(c, info.URL)
+		return
+	}
+
 	c.Params = gin.Params{
 		{Key: "owner", Value: info.Owner},
 		{Key: "repo", Value: info.Repo},
@@ -305,12 +343,36 @@ func (h *URLHandler) handleArchive(c *gin.Context, info *GitHubURLInfo) {
 	h.archiveHandler.Handle(c)
 }
 
+// handleAsset streams a release asset from GitHub's object storage. The
+// URL is signed and expires, so the signed query goes upstream and is part
+// of the cache key: a cached asset is only served for the same signed URL.
+func (h *URLHandler) handleAsset(c *gin.Context, info *GitHubURLInfo) {
+	upstreamURL := info.URL
+	if c.Request.URL.RawQuery != "" {
+		upstreamURL += "?" + c.Request.URL.RawQuery
+	}
+	h.releasesHandler.serve(c, upstreamURL, cache.GenerateKey("asset", upstreamURL, "", "", "", ""))
+}
+
 // handleGit routes to the git handler
 func (h *URLHandler) handleGit(c *gin.Context, info *GitHubURLInfo) {
 	// Determine which git operation based on path
 	path := c.Request.URL.Path
 
-	if strings.Contains(path, "/info/refs") {
+	if strings.Contains(path, "/info/lfs/objects/batch") {
+		c.Params = gin.Params{
+			{Key: "owner", Value: info.Owner},
+			{Key: "repo", Value: info.Repo},
+		}
+		h.lfsHandler.HandleBatch(c)
+	} else if _, oid, ok := strings.Cut(path, "/info/lfs/objects/"); ok {
+		c.Params = gin.Params{
+			{Key: "owner", Value: info.Owner},
+			{Key: "repo", Value: info.Repo},
+			{Key: "oid", Value: oid},
+		}
+		h.lfsHandler.HandleObject(c)
+	} else if strings.Contains(path, "/info/refs") {
 		c.Params = gin.Params{
 			{Key: "owner", Value: info.Owner},
 			{Key: "repo", Value: info.Repo},
@@ -361,6 +423,8 @@ func isGitHubURL(path string) bool {
 	// - https://raw.githubusercontent.com/...
 	// - https://api.github.com/...
 	// - https://gist.github.com/...
+	// - https://codeload.github.com/...
+	// - https://objects.githubusercontent.com/...
 	patterns := []string{
 		`^https?://github\.com/`,
 		`^github\.com/`,
@@ -370,6 +434,10 @@ func isGitHubURL(path string) bool {
 		`^api\.github\.com/`,
 		`^https?://gist\.github\.com/`,
 		`^gist\.github\.com/`,
+		`^https?://codeload\.github\.com/`,
+		`^codeload\.github\.com/`,
+		`^https?://objects\.githubusercontent\.com/`,
+		`^objects\.githubusercontent\.com/`,
 	}
 
 	for _, pattern := range patterns {
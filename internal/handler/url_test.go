@@ -83,6 +83,31 @@ func TestParseGitHubURL(t *testing.T) {
 	}
 }
 
+func TestParseRedirectTargetURL(t *testing.T) {
+	handler := &URLHandler{}
+
+	info, err := handler.parseGitHubURL("https://codeload.github.com/owner/repo/tar.gz/refs/tags/v1.0.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Type != "archive" || info.Owner != "owner" || info.Repo != "repo" || info.Ref != "refs/tags/v1.0.0.tar.gz" ||
+		info.URL != "https://codeload.github.com/owner/repo/tar.gz/refs/tags/v1.0.0" {
+		t.Errorf("codeload URL parsed as %+v, want the archive refs/tags/v1.0.0.tar.gz of owner/repo", info)
+	}
+
+	if _, err := handler.parseGitHubURL("codeload.github.com/owner/repo/legacy.tar.gz/main"); err == nil {
+		t.Error("expected an error for an unsupported codeload format")
+	}
+
+	info, err = handler.parseGitHubURL("objects.githubusercontent.com/github-production-release-asset-2e65be/1/abc")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Type != "asset" || info.URL != "https://objects.githubusercontent.com/github-production-release-asset-2e65be/1/abc" {
+		t.Errorf("asset URL parsed as %+v", info)
+	}
+}
+
 func TestParseGitHubComURL_RawWithRefsHeads(t *testing.T) {
 	handler := &URLHandler{}
 
@@ -135,6 +160,11 @@ func TestIsGitHubURL(t *testing.T) {
 			path: "/https://api.github.com/repos/owner/repo",
 			want: true,
 		},
+		{
+			name: "codeload URL",
+			path: "/https://codeload.github.com/owner/repo/tar.gz/refs/heads/main",
+			want: true,
+		},
 		{
 			name: "Regular path-based URL",
 			path: "/owner/repo/raw/main/file.md",
@@ -69,6 +69,114 @@ var (
 			Help: "Number of active connections",
 		},
 	)
+
+	// SSHHostKeyMismatchesTotal counts upstream SSH connections refused because of an unexpected host key
+	SSHHostKeyMismatchesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_proxy_ssh_host_key_mismatches_total",
+			Help: "Total number of upstream SSH connections refused because the host key did not match",
+		},
+		[]string{"host"},
+	)
+
+	// SSHConnectionsTotal counts SSH connections by result (accepted, rejected, handshake_failed)
+	SSHConnectionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_proxy_ssh_connections_total",
+			Help: "Total number of SSH connections by result",
+		},
+		[]string{"result"},
+	)
+
+	// SSHActiveConnections tracks the number of authenticated SSH connections
+	SSHActiveConnections = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "github_proxy_ssh_active_connections",
+			Help: "Number of authenticated SSH connections",
+		},
+	)
+
+	// SSHAuthAttemptsTotal counts SSH authentication attempts by method and result
+	SSHAuthAttemptsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_proxy_ssh_auth_attempts_total",
+			Help: "Total number of SSH authentication attempts by method and result",
+		},
+		[]string{"method", "result"},
+	)
+
+	// SSHCommandsTotal counts git commands run over SSH by operation and result
+	SSHCommandsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_proxy_ssh_commands_total",
+			Help: "Total number of git commands run over SSH by operation and result",
+		},
+		[]string{"operation", "result"},
+	)
+
+	// SSHCommandDuration measures the duration of git commands run over SSH in seconds
+	SSHCommandDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "github_proxy_ssh_command_duration_seconds",
+			Help:    "Duration of git commands run over SSH in seconds",
+			Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600},
+		},
+		[]string{"operation"},
+	)
+
+	// SSHTransferredBytesTotal counts bytes of git command data by operation and direction (in, out)
+	SSHTransferredBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_proxy_ssh_transferred_bytes_total",
+			Help: "Total bytes of git command data transferred over SSH by operation and direction",
+		},
+		[]string{"operation", "direction"},
+	)
+
+	// UpstreamProxyUp reports whether an upstream proxy is in rotation (1) or not (0)
+	UpstreamProxyUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_proxy_upstream_proxy_up",
+			Help: "Whether the upstream proxy is in rotation",
+		},
+		[]string{"proxy"},
+	)
+
+	// UpstreamProxyActiveConnections tracks open connections by upstream proxy
+	UpstreamProxyActiveConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_proxy_upstream_proxy_active_connections",
+			Help: "Number of open connections through the upstream proxy",
+		},
+		[]string{"proxy"},
+	)
+
+	// UpstreamProxyDialsTotal counts connection attempts by upstream proxy and result (success, failure)
+	UpstreamProxyDialsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_proxy_upstream_proxy_dials_total",
+			Help: "Total number of connection attempts through the upstream proxy by result",
+		},
+		[]string{"proxy", "result"},
+	)
+
+	// UpstreamProxyLatency tracks the smoothed connect latency of an upstream proxy in seconds
+	UpstreamProxyLatency = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_proxy_upstream_proxy_latency_seconds",
+			Help: "Smoothed time to connect through the upstream proxy in seconds",
+		},
+		[]string{"proxy"},
+	)
+
+	// UpstreamRetriesTotal counts retried upstream requests and resumed bodies by reason (error, status, resume)
+	UpstreamRetriesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_proxy_upstream_retries_total",
+			Help: "Total number of retried upstream requests and resumed response bodies",
+		},
+		[]string{"reason"},
+	)
 )
 
 // RecordRequest records an HTTP request with its method, path, and status
@@ -115,3 +223,58 @@ func DecrementActiveConnections() {
 func SetActiveConnections(count float64) {
 	ActiveConnections.Set(count)
 }
+
+// RecordSSHHostKeyMismatch records an upstream SSH host key mismatch
+func RecordSSHHostKeyMismatch(host string) {
+	SSHHostKeyMismatchesTotal.WithLabelValues(host).Inc()
+}
+
+// RecordSSHConnection records an SSH connection with its result
+func RecordSSHConnection(result string) {
+	SSHConnectionsTotal.WithLabelValues(result).Inc()
+}
+
+// RecordSSHAuth records an SSH authentication attempt
+func RecordSSHAuth(method string, success bool) {
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+	SSHAuthAttemptsTotal.WithLabelValues(method, result).Inc()
+}
+
+// RecordSSHCommand records a finished git command with its duration and the
+// bytes received from and sent to the client
+func RecordSSHCommand(operation string, success bool, duration float64, bytesIn, bytesOut int64) {
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+	SSHCommandsTotal.WithLabelValues(operation, result).Inc()
+	SSHCommandDuration.WithLabelValues(operation).Observe(duration)
+	SSHTransferredBytesTotal.WithLabelValues(operation, "in").Add(float64(bytesIn))
+	SSHTransferredBytesTotal.WithLabelValues(operation, "out").Add(float64(bytesOut))
+}
+
+// SetUpstreamProxyUp records whether an upstream proxy is in rotation
+func SetUpstreamProxyUp(proxy string, up bool) {
+	value := 0.0
+	if up {
+		value = 1
+	}
+	UpstreamProxyUp.WithLabelValues(proxy).Set(value)
+}
+
+// RecordUpstreamProxyDial records a connection attempt through an upstream proxy
+func RecordUpstreamProxyDial(proxy string, success bool) {
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+	UpstreamProxyDialsTotal.WithLabelValues(proxy, result).Inc()
+}
+
+// RecordUpstreamRetry records a retried upstream request or resumed body
+func RecordUpstreamRetry(reason string) {
+	UpstreamRetriesTotal.WithLabelValues(reason).Inc()
+}
@@ -25,6 +25,18 @@ func InitPrometheus() {
 	Registry.MustRegister(ResponseSize)
 	Registry.MustRegister(CacheSize)
 	Registry.MustRegister(ActiveConnections)
+	Registry.MustRegister(SSHHostKeyMismatchesTotal)
+	Registry.MustRegister(SSHConnectionsTotal)
+	Registry.MustRegister(SSHActiveConnections)
+	Registry.MustRegister(SSHAuthAttemptsTotal)
+	Registry.MustRegister(SSHCommandsTotal)
+	Registry.MustRegister(SSHCommandDuration)
+	Registry.MustRegister(SSHTransferredBytesTotal)
+	Registry.MustRegister(UpstreamProxyUp)
+	Registry.MustRegister(UpstreamProxyActiveConnections)
+	Registry.MustRegister(UpstreamProxyDialsTotal)
+	Registry.MustRegister(UpstreamProxyLatency)
+	Registry.MustRegister(UpstreamRetriesTotal)
 
 	// Optionally register default Go metrics and process collectors
 	Registry.MustRegister(prometheus.NewGoCollector())
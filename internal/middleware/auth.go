@@ -14,6 +14,7 @@ import (
 // Auth returns a middleware that validates authentication.
 // It supports both Basic authentication and Bearer token authentication.
 // The middleware is optional and can be disabled via configuration.
+// Rejections carry a Basic challenge so git credential helpers prompt for a token.
 func Auth(cfg *config.AuthConfig, cache *auth.Cache, logger *zap.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Skip authentication if not enabled
@@ -22,6 +23,12 @@ func Auth(cfg *config.AuthConfig, cache *auth.Cache, logger *zap.Logger) gin.Han
 			return
 		}
 
+		// Requests bridged from another front end are already authenticated
+		if _, ok := c.Get("auth_token"); ok {
+			c.Next()
+			return
+		}
+
 		// Get Authorization header
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -31,6 +38,7 @@ func Auth(cfg *config.AuthConfig, cache *auth.Cache, logger *zap.Logger) gin.Han
 				return
 			}
 
+			c.Header("WWW-Authenticate", `Basic realm="gh-proxy"`)
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"error": "Unauthorized",
 				"message": "Authorization header required",
@@ -49,6 +57,7 @@ func Auth(cfg *config.AuthConfig, cache *auth.Cache, logger *zap.Logger) gin.Han
 			// Handle Bearer token authentication
 			token, err = handleBearerAuth(authHeader, cache, logger)
 		} else {
+			c.Header("WWW-Authenticate", `Basic realm="gh-proxy"`)
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"error": "Unauthorized",
 				"message": "Invalid Authorization header format",
@@ -61,6 +70,7 @@ func Auth(cfg *config.AuthConfig, cache *auth.Cache, logger *zap.Logger) gin.Han
 				zap.Error(err),
 				zap.String("ip", c.GetString("client_ip")),
 			)
+			c.Header("WWW-Authenticate", `Basic realm="gh-proxy"`)
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"error": "Unauthorized",
 				"message": "Invalid credentials",
@@ -75,6 +85,18 @@ func Auth(cfg *config.AuthConfig, cache *auth.Cache, logger *zap.Logger) gin.Han
 	}
 }
 
+// ContextAuth returns a middleware that adopts a token attached to the
+// request context with auth.NewContext, as set on requests bridged
+// in-process from the SSH front end. External requests cannot carry one.
+func ContextAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token, ok := auth.FromContext(c.Request.Context()); ok {
+			c.Set("auth_token", token)
+		}
+		c.Next()
+	}
+}
+
 // handleBasicAuth handles Basic authentication by treating the password as a GitHub PAT.
 func handleBasicAuth(authHeader string, cache *auth.Cache, logger *zap.Logger) (*auth.Token, error) {
 	// Remove "Basic " prefix
@@ -11,6 +11,7 @@
 //  5. Security      - Security headers (SSRF, headers, validation)
 //  6. RateLimit     - Per-IP rate limiting
 //  7. Auth          - Optional authentication (Basic/Bearer)
+//  8. Rewrite       - Rewrites GitHub Location/Link headers to proxy URLs
 //
 // Example usage:
 //
@@ -24,6 +25,7 @@
 //	router.Use(middleware.SecurityHeaders())
 //	router.Use(middleware.RateLimit(rateLimiter))
 //	router.Use(middleware.Auth(&cfg.Auth, authCache, logger))
+//	router.Use(middleware.RewriteRedirects(rewrite.New(cfg.Server.BasePath, rewrite.GitHubHosts, trusted)))
 //
 // Middleware Details:
 //
@@ -34,6 +36,7 @@
 // Security: Adds security headers (X-Content-Type-Options, CSP, etc.)
 // RateLimit: Enforces per-IP rate limiting using token bucket algorithm
 // Auth: Optional authentication via Basic or Bearer tokens, with caching
+// Rewrite: Maps redirects and pagination links on GitHub hosts back to the proxy
 //
 // Context Values:
 //
@@ -42,5 +45,10 @@
 //  - "client_ip"   (string)      - Real client IP address (set by RealIP)
 //  - "auth_token"  (*auth.Token) - Validated authentication token (set by Auth)
 //
+// Logging also reads values set by handlers:
+//
+//  - "git_request"  (*pktline.UploadPackRequest) - Parsed upload-pack request
+//  - "git_response" (*pktline.ResponseTap)       - Observed upload-pack response
+//
 // Handlers can retrieve these values using c.GetString("client_ip") or c.Get("auth_token").
 package middleware
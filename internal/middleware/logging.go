@@ -3,6 +3,7 @@ package middleware
 import (
 	"time"
 
+	"github.com/LZUOSS/gh-proxy/internal/pktline"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
@@ -32,8 +33,7 @@ func Logging(logger *zap.Logger) gin.HandlerFunc {
 			clientIP = c.ClientIP()
 		}
 
-		// Log request details
-		logger.Info("http request",
+		fields := []zap.Field{
 			zap.String("method", c.Request.Method),
 			zap.String("path", c.Request.URL.Path),
 			zap.Int("status", c.Writer.Status()),
@@ -42,6 +42,43 @@ func Logging(logger *zap.Logger) gin.HandlerFunc {
 			zap.String("user_agent", c.Request.UserAgent()),
 			zap.String("request_id", requestID),
 			zap.Int("response_size", c.Writer.Size()),
-		)
+		}
+		fields = append(fields, gitFields(c)...)
+		if len(c.Errors) > 0 {
+			fields = append(fields, zap.Strings("errors", c.Errors.Errors()))
+		}
+
+		// Log request details
+		logger.Info("http request", fields...)
+	}
+}
+
+// gitFields returns log fields describing a Git upload-pack exchange,
+// if the Git handler recorded one.
+func gitFields(c *gin.Context) []zap.Field {
+	var fields []zap.Field
+
+	if v, ok := c.Get("git_request"); ok {
+		if req, ok := v.(*pktline.UploadPackRequest); ok {
+			fields = append(fields,
+				zap.Int("git_protocol", req.Version),
+				zap.String("git_command", req.Command),
+				zap.Int("git_wants", len(req.Wants)+len(req.WantRefs)),
+				zap.Int("git_haves", len(req.Haves)),
+				zap.Int("git_depth", req.Depth),
+				zap.String("git_filter", req.Filter),
+			)
+		}
 	}
+
+	if v, ok := c.Get("git_response"); ok {
+		if tap, ok := v.(*pktline.ResponseTap); ok {
+			fields = append(fields, zap.Int64("git_pack_bytes", tap.PackBytes))
+			if tap.ErrorMessage != "" {
+				fields = append(fields, zap.String("git_error", tap.ErrorMessage))
+			}
+		}
+	}
+
+	return fields
 }
@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/LZUOSS/gh-proxy/internal/config"
+	"github.com/LZUOSS/gh-proxy/internal/proxy"
+	"github.com/LZUOSS/gh-proxy/internal/rewrite"
+	"github.com/gin-gonic/gin"
+)
+
+// RewriteRedirects returns a middleware that rewrites Location and Link
+// headers pointing at GitHub into proxy URLs, so clients following redirects
+// or pagination links stay on the proxy. Upstream redirects to URLs the
+// proxy can serve are passed on to the client instead of being followed;
+// others are still followed by the proxy. It must run before the full URL
+// middleware to cover both routing modes.
+func RewriteRedirects(rw *rewrite.Rewriter) gin.HandlerFunc {
+	served := func(target *url.URL) bool {
+		return rw.Matches(target.String())
+	}
+
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(proxy.ReturnRedirects(c.Request.Context(), served))
+
+		w := &headerRewriter{
+			ResponseWriter: c.Writer,
+			rewrite: func() {
+				rw.RewriteHeaders(c.Writer.Header(), rw.ProxyBase(c.Request))
+			},
+		}
+		c.Writer = w
+
+		c.Next()
+
+		// Responses without a body are written by gin after the chain returns
+		w.apply()
+	}
+}
+
+// headerRewriter applies a header rewrite once, just before the response
+// headers are sent.
+type headerRewriter struct {
+	gin.ResponseWriter
+	rewrite func()
+	done    bool
+}
+
+// apply runs the rewrite unless it already ran or the headers are sent.
+func (w *headerRewriter) apply() {
+	if w.done || w.ResponseWriter.Written() {
+		return
+	}
+	w.done = true
+	w.rewrite()
+}
+
+// WriteHeaderNow sends the rewritten headers.
+func (w *headerRewriter) WriteHeaderNow() {
+	w.apply()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// Write sends the rewritten headers before the first body bytes.
+func (w *headerRewriter) Write(data []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString sends the rewritten headers before the first body bytes.
+func (w *headerRewriter) WriteString(s string) (int, error) {
+	w.apply()
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Flush sends the rewritten headers before flushing.
+func (w *headerRewriter) Flush() {
+	w.apply()
+	w.ResponseWriter.Flush()
+}
+
+// RewriteContent returns a middleware that rewrites GitHub URLs inside text
+// responses into proxy URLs, so e.g. install scripts download through the
+// proxy as well. Rewriting is opt-in per request (query parameter or path
+// prefix) or per response content type. The body is streamed; Content-Length
+// is dropped and the ETag is replaced, since both describe the original.
+// Handlers keep caching the original content.
+func RewriteContent(rw *rewrite.Rewriter, cfg *config.ContentRewriteConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requested := contentRewriteRequested(c, rw, cfg)
+		if !requested && len(cfg.ContentTypes) == 0 {
+			c.Next()
+			return
+		}
+
+		w := &contentRewriter{ResponseWriter: c.Writer}
+		w.decide = func() {
+			h := w.ResponseWriter.Header()
+			if w.ResponseWriter.Status() != http.StatusOK || !rewrite.IsText(h.Get("Content-Type")) {
+				return
+			}
+			if enc := h.Get("Content-Encoding"); enc != "" && enc != "identity" {
+				return
+			}
+			if !requested && !matchesContentType(h.Get("Content-Type"), cfg.ContentTypes) {
+				return
+			}
+
+			base := rw.ProxyBase(c.Request)
+			h.Del("Content-Length")
+			if etag := h.Get("ETag"); etag != "" {
+				h.Set("ETag", rewrite.ETag(etag, base))
+			}
+			w.body = rw.NewWriter(w.ResponseWriter, base)
+		}
+		c.Writer = w
+
+		c.Next()
+
+		w.apply()
+		if w.body != nil {
+			w.body.Close()
+		}
+	}
+}
+
+// contentRewriteRequested reports whether the request opted in to content
+// rewriting by query parameter or path.
+func contentRewriteRequested(c *gin.Context, rw *rewrite.Rewriter, cfg *config.ContentRewriteConfig) bool {
+	if cfg.QueryParam != "" {
+		if value, ok := c.GetQuery(cfg.QueryParam); ok && value != "0" && value != "false" {
+			return true
+		}
+	}
+
+	requestPath := strings.TrimPrefix(c.Request.URL.Path, rw.BasePath())
+	for _, prefix := range cfg.PathPrefixes {
+		if strings.HasPrefix(requestPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesContentType reports whether contentType matches one of patterns,
+// which are media types or "type/*" wildcards.
+func matchesContentType(contentType string, patterns []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), mediaType); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// contentRewriter decides whether to rewrite the body just before the
+// response headers are sent, then routes body writes through the rewriter.
+type contentRewriter struct {
+	gin.ResponseWriter
+	decide  func()
+	decided bool
+	body    *rewrite.Writer
+}
+
+// apply makes the rewrite decision once, before the headers are sent.
+func (w *contentRewriter) apply() {
+	if w.decided || w.ResponseWriter.Written() {
+		return
+	}
+	w.decided = true
+	w.decide()
+}
+
+// WriteHeaderNow sends the response headers.
+func (w *contentRewriter) WriteHeaderNow() {
+	w.apply()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// Write rewrites the body if rewriting was chosen.
+func (w *contentRewriter) Write(data []byte) (int, error) {
+	w.apply()
+	if w.body != nil {
+		return w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString rewrites the body if rewriting was chosen.
+func (w *contentRewriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends the response headers before flushing.
+func (w *contentRewriter) Flush() {
+	w.apply()
+	w.ResponseWriter.Flush()
+}
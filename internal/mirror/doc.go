@@ -0,0 +1,30 @@
+// Package mirror maintains local bare mirrors of frequently cloned repositories.
+//
+// Each configured repository is cloned once with "git clone --mirror" and then
+// refreshed on a schedule (or on demand) with "git fetch --prune". Once a mirror
+// is ready, the Git handler answers info/refs and git-upload-pack requests for
+// that repository from disk by running "git upload-pack --stateless-rpc",
+// instead of forwarding them to github.com.
+//
+// A mirror is served to every client only if it is configured as public.
+// Otherwise the Git handler first checks, with the credentials it would send
+// upstream, that GitHub grants the client read access to the repository, and
+// forwards the request to GitHub if it does not. Mirrors of private
+// repositories therefore never leak to anonymous clients.
+//
+// Pushes are never served from a mirror; git-receive-pack is always forwarded
+// upstream.
+//
+// Example usage:
+//
+//	manager, err := mirror.NewManager(&cfg.Git.Mirror, logger)
+//	if err != nil {
+//		return err
+//	}
+//	manager.Start()
+//	defer manager.Stop()
+//
+//	if repo, ok := manager.Lookup("owner", "repo"); ok {
+//		manager.UploadPack(ctx, repo, body, w, gitProtocol)
+//	}
+package mirror
@@ -0,0 +1,89 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// clone creates a new bare mirror. The clone is made into a temporary
+// directory and renamed into place so that a half-finished clone is never served.
+func (m *Manager) clone(ctx context.Context, repo *Repo) error {
+	if err := os.MkdirAll(filepath.Dir(repo.Dir), 0755); err != nil {
+		return fmt.Errorf("failed to create mirror directory: %w", err)
+	}
+
+	tmpDir, err := os.MkdirTemp(filepath.Dir(repo.Dir), ".clone-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	target := filepath.Join(tmpDir, "repo.git")
+	if err := m.run(ctx, nil, nil, nil, "clone", "--mirror", "--quiet", repo.Upstream, target); err != nil {
+		return fmt.Errorf("git clone --mirror failed: %w", err)
+	}
+
+	if err := os.Rename(target, repo.Dir); err != nil {
+		return fmt.Errorf("failed to move mirror into place: %w", err)
+	}
+
+	return nil
+}
+
+// fetch updates an existing bare mirror from its upstream.
+func (m *Manager) fetch(ctx context.Context, repo *Repo) error {
+	if err := m.run(ctx, nil, nil, nil, "--git-dir", repo.Dir, "fetch", "--prune", "--quiet", "origin"); err != nil {
+		return fmt.Errorf("git fetch failed: %w", err)
+	}
+	return nil
+}
+
+// AdvertiseRefs writes the upload-pack reference advertisement for a mirror.
+// The "# service=" preamble of the smart HTTP protocol is not included.
+func (m *Manager) AdvertiseRefs(ctx context.Context, repo *Repo, w io.Writer, gitProtocol string) error {
+	return m.run(ctx, gitProtocolEnv(gitProtocol), nil, w,
+		"-c", "uploadpack.allowFilter=true",
+		"upload-pack", "--stateless-rpc", "--advertise-refs", repo.Dir)
+}
+
+// UploadPack serves a stateless git-upload-pack request from a mirror.
+func (m *Manager) UploadPack(ctx context.Context, repo *Repo, r io.Reader, w io.Writer, gitProtocol string) error {
+	return m.run(ctx, gitProtocolEnv(gitProtocol), r, w,
+		"-c", "uploadpack.allowFilter=true",
+		"upload-pack", "--stateless-rpc", repo.Dir)
+}
+
+// run executes a git command with the given environment additions and stdio.
+func (m *Manager) run(ctx context.Context, env []string, stdin io.Reader, stdout io.Writer, args ...string) error {
+	cmd := exec.CommandContext(ctx, m.git, args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// gitProtocolEnv passes the client's Git-Protocol header through to git.
+func gitProtocolEnv(gitProtocol string) []string {
+	if gitProtocol == "" {
+		return nil
+	}
+	return []string{"GIT_PROTOCOL=" + gitProtocol}
+}
@@ -0,0 +1,273 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/config"
+	"go.uber.org/zap"
+)
+
+// ErrNotMirrored is returned when a repository is not configured for mirroring.
+var ErrNotMirrored = errors.New("repository is not mirrored")
+
+// Repo is a single locally mirrored repository.
+type Repo struct {
+	Owner    string
+	Name     string
+	Upstream string
+	Dir      string
+	// Public mirrors are served without checking the client's access
+	Public bool
+
+	interval time.Duration
+
+	// syncMu serializes clone and fetch operations
+	syncMu sync.Mutex
+
+	mu          sync.RWMutex
+	ready       bool
+	lastRefresh time.Time
+	lastErr     error
+}
+
+// Status describes the state of a mirror.
+type Status struct {
+	Repo        string    `json:"repo"`
+	Ready       bool      `json:"ready"`
+	LastRefresh time.Time `json:"last_refresh,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Ready reports whether the mirror has been cloned and can serve requests.
+func (r *Repo) Ready() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ready
+}
+
+// Status returns a snapshot of the mirror state.
+func (r *Repo) Status() Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	status := Status{
+		Repo:        r.Owner + "/" + r.Name,
+		Ready:       r.ready,
+		LastRefresh: r.lastRefresh,
+	}
+	if r.lastErr != nil {
+		status.LastError = r.lastErr.Error()
+	}
+	return status
+}
+
+// Manager owns the set of configured mirrors and their refresh schedule.
+type Manager struct {
+	git     string
+	timeout time.Duration
+	repos   map[string]*Repo
+	logger  *zap.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewManager creates a mirror manager from configuration.
+// Mirrors that already exist on disk are usable immediately.
+func NewManager(cfg *config.MirrorConfig, logger *zap.Logger) (*Manager, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config cannot be nil")
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	root, err := filepath.Abs(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror path: %w", err)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create mirror directory: %w", err)
+	}
+
+	gitBinary := cfg.GitBinary
+	if gitBinary == "" {
+		gitBinary = "git"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		git:     gitBinary,
+		timeout: cfg.CommandTimeout,
+		repos:   make(map[string]*Repo),
+		logger:  logger,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	for _, rc := range cfg.Repos {
+		parts := strings.SplitN(rc.Repo, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			cancel()
+			return nil, fmt.Errorf("invalid mirror repo %q (expected owner/repo)", rc.Repo)
+		}
+		owner, name := parts[0], strings.TrimSuffix(parts[1], ".git")
+
+		upstream := rc.Upstream
+		if upstream == "" {
+			upstream = fmt.Sprintf("https://github.com/%s/%s.git", owner, name)
+		}
+
+		interval := cfg.RefreshInterval
+		if rc.RefreshInterval != nil {
+			interval = *rc.RefreshInterval
+		}
+
+		repo := &Repo{
+			Owner:    owner,
+			Name:     name,
+			Upstream: upstream,
+			Dir:      filepath.Join(root, owner, name+".git"),
+			Public:   rc.Public,
+			interval: interval,
+		}
+
+		// A mirror left behind by a previous run can serve right away
+		if _, err := os.Stat(filepath.Join(repo.Dir, "HEAD")); err == nil {
+			repo.ready = true
+		}
+
+		m.repos[repoKey(owner, name)] = repo
+	}
+
+	return m, nil
+}
+
+// Start performs the initial sync of every mirror and schedules periodic refreshes.
+func (m *Manager) Start() {
+	for _, repo := range m.repos {
+		m.wg.Add(1)
+		go m.refreshLoop(repo)
+	}
+}
+
+// Stop cancels in-flight git commands and waits for the refresh loops to exit.
+func (m *Manager) Stop() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// Lookup returns the mirror for owner/repo if it is configured and ready.
+func (m *Manager) Lookup(owner, repo string) (*Repo, bool) {
+	if m == nil {
+		return nil, false
+	}
+	r, ok := m.repos[repoKey(owner, repo)]
+	if !ok || !r.Ready() {
+		return nil, false
+	}
+	return r, true
+}
+
+// Get returns the mirror for owner/repo whether or not it is ready.
+func (m *Manager) Get(owner, repo string) (*Repo, bool) {
+	if m == nil {
+		return nil, false
+	}
+	r, ok := m.repos[repoKey(owner, repo)]
+	return r, ok
+}
+
+// Refresh synchronizes a mirror with its upstream immediately.
+func (m *Manager) Refresh(ctx context.Context, owner, repo string) error {
+	r, ok := m.Get(owner, repo)
+	if !ok {
+		return ErrNotMirrored
+	}
+	return m.sync(ctx, r)
+}
+
+// refreshLoop syncs a mirror on startup and then at its configured interval.
+func (m *Manager) refreshLoop(repo *Repo) {
+	defer m.wg.Done()
+
+	m.syncAndLog(repo)
+
+	if repo.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(repo.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.syncAndLog(repo)
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// syncAndLog runs a scheduled sync and logs its outcome.
+func (m *Manager) syncAndLog(repo *Repo) {
+	start := time.Now()
+	if err := m.sync(m.ctx, repo); err != nil {
+		if m.ctx.Err() != nil {
+			return
+		}
+		m.logger.Warn("mirror refresh failed",
+			zap.String("repo", repo.Owner+"/"+repo.Name),
+			zap.Error(err),
+		)
+		return
+	}
+	m.logger.Info("mirror refreshed",
+		zap.String("repo", repo.Owner+"/"+repo.Name),
+		zap.Duration("duration", time.Since(start)),
+	)
+}
+
+// sync clones the mirror if it does not exist yet, or fetches into it otherwise.
+func (m *Manager) sync(ctx context.Context, repo *Repo) error {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	var err error
+	if _, statErr := os.Stat(filepath.Join(repo.Dir, "HEAD")); statErr == nil {
+		err = m.fetch(ctx, repo)
+	} else {
+		err = m.clone(ctx, repo)
+	}
+
+	repo.mu.Lock()
+	repo.lastErr = err
+	if err == nil {
+		repo.ready = true
+		repo.lastRefresh = time.Now()
+	}
+	repo.mu.Unlock()
+
+	return err
+}
+
+// repoKey returns the lookup key for a repository.
+// GitHub owner and repository names are case-insensitive.
+func repoKey(owner, repo string) string {
+	return strings.ToLower(owner + "/" + strings.TrimSuffix(repo, ".git"))
+}
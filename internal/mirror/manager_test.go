@@ -0,0 +1,168 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/config"
+)
+
+// newUpstream creates a local bare repository with a single commit on main.
+func newUpstream(t *testing.T) (bareDir, workDir string) {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	root := t.TempDir()
+	bareDir = filepath.Join(root, "upstream.git")
+	workDir = filepath.Join(root, "work")
+
+	gitCmd(t, "", "init", "--quiet", "--bare", "--initial-branch=main", bareDir)
+	gitCmd(t, "", "init", "--quiet", "--initial-branch=main", workDir)
+	commitFile(t, workDir, "README.md", "hello\n")
+	gitCmd(t, workDir, "push", "--quiet", bareDir, "main")
+
+	return bareDir, workDir
+}
+
+func commitFile(t *testing.T, workDir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(workDir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	gitCmd(t, workDir, "add", name)
+	gitCmd(t, workDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "update "+name)
+}
+
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func newTestManager(t *testing.T, upstream string) *Manager {
+	t.Helper()
+	m, err := NewManager(&config.MirrorConfig{
+		Enabled:   true,
+		Path:      t.TempDir(),
+		GitBinary: "git",
+		Repos: []config.MirrorRepoConfig{
+			{Repo: "owner/repo", Upstream: upstream},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	return m
+}
+
+func TestManager_RefreshAndAdvertise(t *testing.T) {
+	upstream, workDir := newUpstream(t)
+	m := newTestManager(t, upstream)
+
+	if _, ok := m.Lookup("owner", "repo"); ok {
+		t.Fatal("Lookup() returned a mirror before the first refresh")
+	}
+
+	if err := m.Refresh(context.Background(), "owner", "repo"); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+
+	repo, ok := m.Lookup("Owner", "repo.git")
+	if !ok {
+		t.Fatal("Lookup() did not return the mirror after refresh")
+	}
+
+	var buf bytes.Buffer
+	if err := m.AdvertiseRefs(context.Background(), repo, &buf, ""); err != nil {
+		t.Fatalf("AdvertiseRefs() error = %v", err)
+	}
+	head := gitCmd(t, workDir, "rev-parse", "HEAD")
+	if !strings.Contains(buf.String(), head+" refs/heads/main") {
+		t.Errorf("advertisement does not contain %s refs/heads/main:\n%s", head, buf.String())
+	}
+
+	// A new upstream commit shows up after the next refresh
+	commitFile(t, workDir, "CHANGELOG.md", "v2\n")
+	gitCmd(t, workDir, "push", "--quiet", upstream, "main")
+	if err := m.Refresh(context.Background(), "owner", "repo"); err != nil {
+		t.Fatalf("second Refresh() error = %v", err)
+	}
+
+	buf.Reset()
+	if err := m.AdvertiseRefs(context.Background(), repo, &buf, ""); err != nil {
+		t.Fatalf("AdvertiseRefs() error = %v", err)
+	}
+	head = gitCmd(t, workDir, "rev-parse", "HEAD")
+	if !strings.Contains(buf.String(), head+" refs/heads/main") {
+		t.Errorf("advertisement does not contain updated head %s", head)
+	}
+}
+
+func TestManager_CloneFromMirror(t *testing.T) {
+	upstream, workDir := newUpstream(t)
+	m := newTestManager(t, upstream)
+
+	if err := m.Refresh(context.Background(), "owner", "repo"); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	repo, _ := m.Lookup("owner", "repo")
+
+	// Cloning straight from the mirror directory proves it is a complete bare repository
+	clone := filepath.Join(t.TempDir(), "clone")
+	gitCmd(t, "", "clone", "--quiet", repo.Dir, clone)
+
+	want := gitCmd(t, workDir, "rev-parse", "HEAD")
+	if got := gitCmd(t, clone, "rev-parse", "HEAD"); got != want {
+		t.Errorf("clone HEAD = %s, want %s", got, want)
+	}
+}
+
+func TestManager_RefreshUnknownRepo(t *testing.T) {
+	m, err := NewManager(&config.MirrorConfig{Path: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	if err := m.Refresh(context.Background(), "owner", "repo"); err != ErrNotMirrored {
+		t.Errorf("Refresh() error = %v, want ErrNotMirrored", err)
+	}
+}
+
+func TestNewManager_RefreshInterval(t *testing.T) {
+	off := time.Duration(0)
+	fast := time.Minute
+	m, err := NewManager(&config.MirrorConfig{
+		Enabled:         true,
+		Path:            t.TempDir(),
+		RefreshInterval: 10 * time.Minute,
+		Repos: []config.MirrorRepoConfig{
+			{Repo: "owner/default"},
+			{Repo: "owner/manual", RefreshInterval: &off},
+			{Repo: "owner/fast", RefreshInterval: &fast},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	want := map[string]time.Duration{"default": 10 * time.Minute, "manual": 0, "fast": time.Minute}
+	for name, interval := range want {
+		repo, _ := m.Get("owner", name)
+		if repo.interval != interval {
+			t.Errorf("interval of %s = %v, want %v", name, repo.interval, interval)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// Package pktline implements the pkt-line framing used by the Git wire protocol.
+//
+// A pkt-line is a four-digit hexadecimal length (including the four length
+// bytes themselves) followed by the payload. Three lengths are reserved for
+// special packets:
+//
+//   - 0000 flush-pkt:        end of a message (all protocol versions)
+//   - 0001 delim-pkt:        separates sections of a v2 request
+//   - 0002 response-end-pkt: end of a v2 response for stateless connections
+//
+// Besides the Encoder and Decoder, the package understands the content of
+// git-upload-pack requests for protocol v0/v1 and v2 (ls-refs, fetch and
+// object-info), so handlers can inspect wants, haves, depth and filters, and
+// a ResponseTap that observes upload-pack responses, including side-band
+// multiplexed packfiles, without modifying the stream.
+//
+// Example usage:
+//
+//	req, err := pktline.ParseUploadPackRequest(body, c.GetHeader("Git-Protocol"))
+//	if err != nil {
+//		return err
+//	}
+//	log.Printf("%s: %d wants, %d haves, depth %d, filter %q",
+//		req.Command, len(req.Wants), len(req.Haves), req.Depth, req.Filter)
+package pktline
@@ -0,0 +1,200 @@
+package pktline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	// MaxPacketSize is the largest pkt-line allowed, including the length prefix.
+	MaxPacketSize = 65520
+
+	// MaxPayloadSize is the largest payload that fits in a single pkt-line.
+	MaxPayloadSize = MaxPacketSize - 4
+
+	// maxSidebandData is the largest side-band payload, leaving room for the band byte.
+	maxSidebandData = MaxPayloadSize - 1
+)
+
+// Side-band channels used when side-band or side-band-64k is negotiated.
+const (
+	BandData     byte = 1 // packfile data
+	BandProgress byte = 2 // progress messages for stderr
+	BandError    byte = 3 // fatal error message
+)
+
+// PacketType identifies the kind of a decoded packet.
+type PacketType int
+
+const (
+	// Data is a regular packet carrying a payload.
+	Data PacketType = iota
+	// Flush is the 0000 flush-pkt.
+	Flush
+	// Delim is the 0001 delim-pkt (protocol v2).
+	Delim
+	// ResponseEnd is the 0002 response-end-pkt (protocol v2).
+	ResponseEnd
+)
+
+// String returns a readable name for the packet type.
+func (t PacketType) String() string {
+	switch t {
+	case Data:
+		return "data"
+	case Flush:
+		return "flush"
+	case Delim:
+		return "delim"
+	case ResponseEnd:
+		return "response-end"
+	default:
+		return fmt.Sprintf("PacketType(%d)", int(t))
+	}
+}
+
+var (
+	// ErrInvalidLength indicates a malformed pkt-line length prefix.
+	ErrInvalidLength = errors.New("pktline: invalid length")
+
+	// ErrPayloadTooLong indicates a payload that does not fit in a single pkt-line.
+	ErrPayloadTooLong = errors.New("pktline: payload too long")
+)
+
+// Packet is a single decoded pkt-line.
+type Packet struct {
+	Type    PacketType
+	Payload []byte
+}
+
+// parseLength parses a four-byte hexadecimal pkt-line length.
+func parseLength(hdr []byte) (int, error) {
+	n, err := strconv.ParseUint(string(hdr), 16, 16)
+	if err != nil {
+		return 0, ErrInvalidLength
+	}
+	if n == 3 || n > MaxPacketSize {
+		return 0, ErrInvalidLength
+	}
+	return int(n), nil
+}
+
+// Decoder reads pkt-lines from a stream.
+type Decoder struct {
+	r   io.Reader
+	hdr [4]byte
+	buf []byte
+}
+
+// NewDecoder returns a decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Next reads the next packet. The payload is only valid until the next call.
+// It returns io.EOF when the stream ends cleanly between packets.
+func (d *Decoder) Next() (Packet, error) {
+	if _, err := io.ReadFull(d.r, d.hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Packet{}, fmt.Errorf("pktline: truncated length: %w", err)
+		}
+		return Packet{}, err
+	}
+
+	n, err := parseLength(d.hdr[:])
+	if err != nil {
+		return Packet{}, err
+	}
+
+	switch n {
+	case 0:
+		return Packet{Type: Flush}, nil
+	case 1:
+		return Packet{Type: Delim}, nil
+	case 2:
+		return Packet{Type: ResponseEnd}, nil
+	}
+
+	size := n - 4
+	if cap(d.buf) < size {
+		d.buf = make([]byte, size)
+	}
+	d.buf = d.buf[:size]
+
+	if _, err := io.ReadFull(d.r, d.buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Packet{}, fmt.Errorf("pktline: truncated payload: %w", err)
+	}
+
+	return Packet{Type: Data, Payload: d.buf}, nil
+}
+
+// Encoder writes pkt-lines to a stream.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes payload as a single pkt-line.
+func (e *Encoder) Encode(payload []byte) error {
+	if len(payload) > MaxPayloadSize {
+		return ErrPayloadTooLong
+	}
+	if _, err := fmt.Fprintf(e.w, "%04x", len(payload)+4); err != nil {
+		return err
+	}
+	_, err := e.w.Write(payload)
+	return err
+}
+
+// EncodeString writes s as a single pkt-line.
+func (e *Encoder) EncodeString(s string) error {
+	return e.Encode([]byte(s))
+}
+
+// Flush writes a flush-pkt.
+func (e *Encoder) Flush() error {
+	_, err := io.WriteString(e.w, "0000")
+	return err
+}
+
+// Delim writes a delim-pkt.
+func (e *Encoder) Delim() error {
+	_, err := io.WriteString(e.w, "0001")
+	return err
+}
+
+// ResponseEnd writes a response-end-pkt.
+func (e *Encoder) ResponseEnd() error {
+	_, err := io.WriteString(e.w, "0002")
+	return err
+}
+
+// Error writes an "ERR" pkt-line, which git clients display as a fatal error.
+func (e *Encoder) Error(msg string) error {
+	return e.EncodeString("ERR " + msg + "\n")
+}
+
+// Sideband writes data on the given side-band channel, split across as many
+// pkt-lines as needed.
+func (e *Encoder) Sideband(band byte, data []byte) error {
+	buf := make([]byte, 0, min(len(data), maxSidebandData)+1)
+	for len(data) > 0 {
+		n := min(len(data), maxSidebandData)
+		buf = append(buf[:0], band)
+		buf = append(buf, data[:n]...)
+		if err := e.Encode(buf); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package pktline
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	oidA = "1111111111111111111111111111111111111111"
+	oidB = "2222222222222222222222222222222222222222"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeString("hello\n")
+	enc.Delim()
+	enc.Encode([]byte{})
+	enc.Flush()
+	enc.ResponseEnd()
+
+	if got := buf.String(); got != "000ahello\n000100040000"+"0002" {
+		t.Fatalf("encoded = %q", got)
+	}
+
+	dec := NewDecoder(&buf)
+	want := []Packet{
+		{Type: Data, Payload: []byte("hello\n")},
+		{Type: Delim},
+		{Type: Data, Payload: []byte{}},
+		{Type: Flush},
+		{Type: ResponseEnd},
+	}
+	for i, w := range want {
+		pkt, err := dec.Next()
+		if err != nil {
+			t.Fatalf("packet %d: Next() error = %v", i, err)
+		}
+		if pkt.Type != w.Type || !bytes.Equal(pkt.Payload, w.Payload) {
+			t.Errorf("packet %d = %v %q, want %v %q", i, pkt.Type, pkt.Payload, w.Type, w.Payload)
+		}
+	}
+	if _, err := dec.Next(); err != io.EOF {
+		t.Errorf("Next() at end error = %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "invalid hex", input: "zzzz"},
+		{name: "reserved length", input: "0003"},
+		{name: "truncated length", input: "00"},
+		{name: "truncated payload", input: "000ahel"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDecoder(strings.NewReader(tt.input)).Next(); err == nil || err == io.EOF {
+				t.Errorf("Next() error = %v, want a framing error", err)
+			}
+		})
+	}
+}
+
+func TestEncoderSidebandSplitsLargeData(t *testing.T) {
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("x"), maxSidebandData+10)
+	if err := NewEncoder(&buf).Sideband(BandData, data); err != nil {
+		t.Fatalf("Sideband() error = %v", err)
+	}
+
+	dec := NewDecoder(&buf)
+	var total int
+	for {
+		pkt, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if pkt.Payload[0] != BandData {
+			t.Fatalf("band = %d, want %d", pkt.Payload[0], BandData)
+		}
+		total += len(pkt.Payload) - 1
+	}
+	if total != len(data) {
+		t.Errorf("decoded %d bytes, want %d", total, len(data))
+	}
+}
+
+func TestParseUploadPackRequestV0(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeString("want " + oidA + " multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git/2.43.0\n")
+	enc.EncodeString("want " + oidB + "\n")
+	enc.EncodeString("shallow " + oidB + "\n")
+	enc.EncodeString("deepen 1\n")
+	enc.EncodeString("filter blob:none\n")
+	enc.Flush()
+	enc.EncodeString("have " + oidB + "\n")
+	enc.EncodeString("done\n")
+
+	req, err := ParseUploadPackRequest(&buf, "")
+	if err != nil {
+		t.Fatalf("ParseUploadPackRequest() error = %v", err)
+	}
+
+	if req.Version != 0 || req.Command != "fetch" {
+		t.Errorf("Version/Command = %d/%s, want 0/fetch", req.Version, req.Command)
+	}
+	if len(req.Wants) != 2 || req.Wants[0] != oidA || req.Wants[1] != oidB {
+		t.Errorf("Wants = %v", req.Wants)
+	}
+	if !req.HasCapability("side-band-64k") || !req.HasCapability("agent") || !req.UsesSideband() {
+		t.Errorf("Capabilities = %v", req.Capabilities)
+	}
+	if req.Depth != 1 || !req.IsShallow() {
+		t.Errorf("Depth = %d, want 1", req.Depth)
+	}
+	if req.Filter != "blob:none" {
+		t.Errorf("Filter = %q, want blob:none", req.Filter)
+	}
+	if len(req.Haves) != 1 || !req.Done || req.IsClone() {
+		t.Errorf("Haves = %v, Done = %v", req.Haves, req.Done)
+	}
+}
+
+func TestParseUploadPackRequestV2(t *testing.T) {
+	tests := []struct {
+		name        string
+		gitProtocol string
+		build       func(enc *Encoder)
+		check       func(t *testing.T, req *UploadPackRequest)
+	}{
+		{
+			name:        "fetch",
+			gitProtocol: "version=2",
+			build: func(enc *Encoder) {
+				enc.EncodeString("command=fetch\n")
+				enc.EncodeString("agent=git/2.43.0\n")
+				enc.EncodeString("object-format=sha1\n")
+				enc.Delim()
+				enc.EncodeString("thin-pack\n")
+				enc.EncodeString("want " + oidA + "\n")
+				enc.EncodeString("deepen-since 1700000000\n")
+				enc.EncodeString("deepen-not refs/heads/old\n")
+				enc.EncodeString("filter tree:0\n")
+				enc.EncodeString("done\n")
+				enc.Flush()
+			},
+			check: func(t *testing.T, req *UploadPackRequest) {
+				if req.Command != "fetch" || !req.IsV2() || !req.UsesSideband() {
+					t.Errorf("Command = %s, Version = %d", req.Command, req.Version)
+				}
+				if !req.HasCapability("object-format") {
+					t.Errorf("Capabilities = %v", req.Capabilities)
+				}
+				if len(req.Wants) != 1 || req.DeepenSince != 1700000000 || len(req.DeepenNot) != 1 {
+					t.Errorf("Wants = %v, DeepenSince = %d, DeepenNot = %v", req.Wants, req.DeepenSince, req.DeepenNot)
+				}
+				if req.Filter != "tree:0" || !req.Done || !req.IsClone() {
+					t.Errorf("Filter = %q, Done = %v", req.Filter, req.Done)
+				}
+				if len(req.Args) != 1 || req.Args[0] != "thin-pack" {
+					t.Errorf("Args = %v", req.Args)
+				}
+			},
+		},
+		{
+			name: "ls-refs detected without header",
+			build: func(enc *Encoder) {
+				enc.EncodeString("command=ls-refs\n")
+				enc.Delim()
+				enc.EncodeString("peel\n")
+				enc.EncodeString("symrefs\n")
+				enc.EncodeString("ref-prefix refs/heads/\n")
+				enc.EncodeString("ref-prefix HEAD\n")
+				enc.Flush()
+			},
+			check: func(t *testing.T, req *UploadPackRequest) {
+				if req.Command != "ls-refs" || req.Version != 2 {
+					t.Errorf("Command = %s, Version = %d", req.Command, req.Version)
+				}
+				if len(req.RefPrefixes) != 2 || req.RefPrefixes[1] != "HEAD" {
+					t.Errorf("RefPrefixes = %v", req.RefPrefixes)
+				}
+			},
+		},
+		{
+			name:        "object-info",
+			gitProtocol: "version=2",
+			build: func(enc *Encoder) {
+				enc.EncodeString("command=object-info\n")
+				enc.Delim()
+				enc.EncodeString("size\n")
+				enc.EncodeString("oid " + oidA + "\n")
+				enc.Flush()
+			},
+			check: func(t *testing.T, req *UploadPackRequest) {
+				if req.Command != "object-info" || len(req.ObjectIDs) != 1 || req.ObjectIDs[0] != oidA {
+					t.Errorf("Command = %s, ObjectIDs = %v", req.Command, req.ObjectIDs)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.build(NewEncoder(&buf))
+			req, err := ParseUploadPackRequest(&buf, tt.gitProtocol)
+			if err != nil {
+				t.Fatalf("ParseUploadPackRequest() error = %v", err)
+			}
+			tt.check(t, req)
+		})
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	tests := map[string]int{
+		"":                  0,
+		"version=1":         1,
+		"version=2":         2,
+		"foo=bar:version=2": 2,
+		"version=invalid":   0,
+		" version=2 ":       2,
+	}
+	for header, want := range tests {
+		if got := ProtocolVersion(header); got != want {
+			t.Errorf("ProtocolVersion(%q) = %d, want %d", header, got, want)
+		}
+	}
+}
+
+// writeInChunks feeds data to w a few bytes at a time to exercise partial writes.
+func writeInChunks(w io.Writer, data []byte, size int) {
+	for len(data) > 0 {
+		n := min(size, len(data))
+		w.Write(data[:n])
+		data = data[n:]
+	}
+}
+
+func TestResponseTapV2Sideband(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeString("shallow-info\n")
+	enc.EncodeString("shallow " + oidA + "\n")
+	enc.Delim()
+	enc.EncodeString("packfile\n")
+	enc.Sideband(BandProgress, []byte("Enumerating objects: 3\n"))
+	enc.Sideband(BandData, []byte("PACK0123456789"))
+	enc.Flush()
+
+	for _, chunk := range []int{1, 3, 4096} {
+		tap := NewResponseTap()
+		writeInChunks(tap, buf.Bytes(), chunk)
+
+		if tap.PackBytes != int64(len("PACK0123456789")) {
+			t.Errorf("chunk %d: PackBytes = %d", chunk, tap.PackBytes)
+		}
+		if tap.ProgressBytes != int64(len("Enumerating objects: 3\n")) {
+			t.Errorf("chunk %d: ProgressBytes = %d", chunk, tap.ProgressBytes)
+		}
+		if tap.Shallows != 1 || len(tap.Sections) != 2 || tap.Sections[1] != "packfile" {
+			t.Errorf("chunk %d: Shallows = %d, Sections = %v", chunk, tap.Shallows, tap.Sections)
+		}
+	}
+}
+
+func TestResponseTapRawPackAndErrors(t *testing.T) {
+	tap := NewResponseTap()
+	var buf bytes.Buffer
+	NewEncoder(&buf).EncodeString("NAK\n")
+	buf.WriteString("PACK\x00\x00\x00\x02rest-of-pack")
+	tap.Write(buf.Bytes())
+	if tap.PackBytes != int64(len("PACK\x00\x00\x00\x02rest-of-pack")) {
+		t.Errorf("raw PackBytes = %d", tap.PackBytes)
+	}
+
+	tap = NewResponseTap()
+	buf.Reset()
+	NewEncoder(&buf).Error("upload-pack: not our ref")
+	tap.Write(buf.Bytes())
+	if tap.ErrorMessage != "upload-pack: not our ref" {
+		t.Errorf("ErrorMessage = %q", tap.ErrorMessage)
+	}
+
+	tap = NewResponseTap()
+	buf.Reset()
+	NewEncoder(&buf).Sideband(BandError, []byte("fatal: repository not found\n"))
+	tap.Write(buf.Bytes())
+	if tap.ErrorMessage != "fatal: repository not found" {
+		t.Errorf("side-band ErrorMessage = %q", tap.ErrorMessage)
+	}
+}
+
+func TestRewriteDepth(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeString("command=fetch\n")
+	enc.Delim()
+	enc.EncodeString("want " + oidA + "\n")
+	enc.EncodeString("deepen 1000\n")
+	enc.EncodeString("done\n")
+	enc.Flush()
+
+	out, err := RewriteDepth(buf.Bytes(), 10)
+	if err != nil {
+		t.Fatalf("RewriteDepth() error = %v", err)
+	}
+
+	req, err := ParseUploadPackRequest(bytes.NewReader(out), "version=2")
+	if err != nil {
+		t.Fatalf("ParseUploadPackRequest() error = %v", err)
+	}
+	if req.Depth != 10 || len(req.Wants) != 1 || !req.Done {
+		t.Errorf("rewritten request: Depth = %d, Wants = %v, Done = %v", req.Depth, req.Wants, req.Done)
+	}
+}
@@ -0,0 +1,292 @@
+package pktline
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// UploadPackRequest is the parsed content of a git-upload-pack request body.
+type UploadPackRequest struct {
+	// Version is the protocol version (0 for v0/v1, 2 for v2)
+	Version int
+
+	// Command is "fetch" for v0/v1, or the v2 command ("fetch", "ls-refs", "object-info")
+	Command string
+
+	// Capabilities are the v0/v1 capabilities from the first want line,
+	// or the v2 capability lines sent before the arguments
+	Capabilities []string
+
+	Wants     []string // object IDs requested with "want"
+	WantRefs  []string // refs requested with "want-ref" (v2)
+	Haves     []string // object IDs the client already has
+	Shallows  []string // commits the client has as shallow boundaries
+	DeepenNot []string // refs excluded with "deepen-not"
+
+	Depth          int    // "deepen <n>"; 0 means no depth limit
+	DeepenSince    int64  // "deepen-since <timestamp>"; 0 if not set
+	DeepenRelative bool   // "deepen-relative"
+	Filter         string // partial clone filter spec, e.g. "blob:none"
+	Done           bool   // the client has finished negotiation
+
+	RefPrefixes []string // "ref-prefix" arguments (v2 ls-refs)
+	ObjectIDs   []string // "oid" arguments (v2 object-info)
+
+	// Args holds v2 arguments that are not represented by a field above
+	Args []string
+}
+
+// IsV2 reports whether the request uses protocol v2.
+func (r *UploadPackRequest) IsV2() bool {
+	return r.Version == 2
+}
+
+// HasCapability reports whether the client sent the given capability.
+// A capability with a value (e.g. "agent=git/2.43") matches by name.
+func (r *UploadPackRequest) HasCapability(name string) bool {
+	for _, c := range r.Capabilities {
+		if c == name || strings.HasPrefix(c, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsShallow reports whether the request limits history depth in any way.
+func (r *UploadPackRequest) IsShallow() bool {
+	return r.Depth > 0 || r.DeepenSince > 0 || len(r.DeepenNot) > 0
+}
+
+// IsClone reports whether this is a fetch without any haves, i.e. a full clone
+// or the first fetch into an empty repository.
+func (r *UploadPackRequest) IsClone() bool {
+	return r.Command == "fetch" && len(r.Haves) == 0 && len(r.Shallows) == 0
+}
+
+// UsesSideband reports whether the response packfile is side-band multiplexed.
+// Protocol v2 always multiplexes the packfile section.
+func (r *UploadPackRequest) UsesSideband() bool {
+	return r.IsV2() || r.HasCapability("side-band") || r.HasCapability("side-band-64k")
+}
+
+// ProtocolVersion extracts the requested version from a Git-Protocol header
+// (e.g. "version=2"). It returns 0 when no version is requested.
+func ProtocolVersion(gitProtocol string) int {
+	for _, field := range strings.Split(gitProtocol, ":") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(field), "version="); ok {
+			if n, err := strconv.Atoi(v); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// ParseUploadPackRequest parses a git-upload-pack request body.
+// gitProtocol is the value of the client's Git-Protocol header; a body that
+// starts with "command=" is treated as v2 regardless.
+func ParseUploadPackRequest(r io.Reader, gitProtocol string) (*UploadPackRequest, error) {
+	dec := NewDecoder(r)
+
+	pkt, err := dec.Next()
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("pktline: empty upload-pack request")
+		}
+		return nil, err
+	}
+
+	if ProtocolVersion(gitProtocol) == 2 || (pkt.Type == Data && bytes.HasPrefix(pkt.Payload, []byte("command="))) {
+		return parseV2Request(dec, pkt)
+	}
+	return parseV0Request(dec, pkt)
+}
+
+// parseV0Request parses a v0/v1 request: want lines (the first carrying
+// capabilities), shallow and deepen lines, a flush, then haves and "done".
+func parseV0Request(dec *Decoder, first Packet) (*UploadPackRequest, error) {
+	req := &UploadPackRequest{Version: 0, Command: "fetch"}
+
+	pkt := first
+	for {
+		if pkt.Type == Data {
+			line := strings.TrimSuffix(string(pkt.Payload), "\n")
+			if err := req.parseV0Line(line); err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		pkt, err = dec.Next()
+		if err == io.EOF {
+			return req, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseV0Line parses a single v0/v1 request line.
+func (r *UploadPackRequest) parseV0Line(line string) error {
+	cmd, arg, _ := strings.Cut(line, " ")
+
+	switch cmd {
+	case "want":
+		// The first want line carries the capability list after the object ID
+		oid, caps, hasCaps := strings.Cut(arg, " ")
+		r.Wants = append(r.Wants, oid)
+		if hasCaps && len(r.Wants) == 1 {
+			r.Capabilities = strings.Fields(caps)
+		}
+	case "have":
+		r.Haves = append(r.Haves, arg)
+	case "done":
+		r.Done = true
+	default:
+		return r.parseCommonArg(cmd, arg, line)
+	}
+
+	return nil
+}
+
+// parseV2Request parses a v2 request: the command line, capability lines,
+// a delim-pkt, the command arguments and a final flush-pkt.
+func parseV2Request(dec *Decoder, first Packet) (*UploadPackRequest, error) {
+	req := &UploadPackRequest{Version: 2}
+
+	if first.Type != Data {
+		return nil, fmt.Errorf("pktline: v2 request must start with a command, got %s", first.Type)
+	}
+	cmd, ok := strings.CutPrefix(strings.TrimSuffix(string(first.Payload), "\n"), "command=")
+	if !ok {
+		return nil, fmt.Errorf("pktline: v2 request must start with a command")
+	}
+	req.Command = cmd
+
+	inArgs := false
+	for {
+		pkt, err := dec.Next()
+		if err == io.EOF {
+			return req, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch pkt.Type {
+		case Delim:
+			inArgs = true
+		case Flush, ResponseEnd:
+			return req, nil
+		case Data:
+			line := strings.TrimSuffix(string(pkt.Payload), "\n")
+			if !inArgs {
+				req.Capabilities = append(req.Capabilities, line)
+				continue
+			}
+			if err := req.parseV2Arg(line); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// parseV2Arg parses a single v2 command argument.
+func (r *UploadPackRequest) parseV2Arg(line string) error {
+	cmd, arg, _ := strings.Cut(line, " ")
+
+	switch cmd {
+	case "want":
+		r.Wants = append(r.Wants, arg)
+	case "want-ref":
+		r.WantRefs = append(r.WantRefs, arg)
+	case "have":
+		r.Haves = append(r.Haves, arg)
+	case "done":
+		r.Done = true
+	case "ref-prefix":
+		r.RefPrefixes = append(r.RefPrefixes, arg)
+	case "oid":
+		r.ObjectIDs = append(r.ObjectIDs, arg)
+	default:
+		if err := r.parseCommonArg(cmd, arg, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseCommonArg parses the shallow, deepen and filter arguments shared by
+// v0/v1 and v2. Anything else is kept in Args.
+func (r *UploadPackRequest) parseCommonArg(cmd, arg, line string) error {
+	switch cmd {
+	case "shallow":
+		r.Shallows = append(r.Shallows, arg)
+	case "deepen":
+		depth, err := strconv.Atoi(arg)
+		if err != nil || depth < 0 {
+			return fmt.Errorf("pktline: invalid deepen value %q", arg)
+		}
+		r.Depth = depth
+	case "deepen-since":
+		since, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("pktline: invalid deepen-since value %q", arg)
+		}
+		r.DeepenSince = since
+	case "deepen-not":
+		r.DeepenNot = append(r.DeepenNot, arg)
+	case "deepen-relative":
+		r.DeepenRelative = true
+	case "filter":
+		r.Filter = arg
+	default:
+		if line != "" {
+			r.Args = append(r.Args, line)
+		}
+	}
+
+	return nil
+}
+
+// RewriteDepth re-encodes an upload-pack request with its "deepen" argument
+// set to depth. All other packets are copied unchanged. The input must be the
+// decoded (not gzipped) request body.
+func RewriteDepth(body []byte, depth int) ([]byte, error) {
+	var out bytes.Buffer
+	dec := NewDecoder(bytes.NewReader(body))
+	enc := NewEncoder(&out)
+
+	for {
+		pkt, err := dec.Next()
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch pkt.Type {
+		case Flush:
+			err = enc.Flush()
+		case Delim:
+			err = enc.Delim()
+		case ResponseEnd:
+			err = enc.ResponseEnd()
+		default:
+			if bytes.HasPrefix(pkt.Payload, []byte("deepen ")) {
+				err = enc.EncodeString(fmt.Sprintf("deepen %d\n", depth))
+			} else {
+				err = enc.Encode(pkt.Payload)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package pktline
+
+import (
+	"bytes"
+	"strings"
+)
+
+// maxTextPayload bounds how much of a non-packfile payload the tap keeps.
+const maxTextPayload = 1024
+
+// ResponseTap observes a git-upload-pack response as it streams past.
+// It is an io.Writer meant to sit behind an io.TeeReader or io.MultiWriter;
+// it never fails and never alters the stream, so a parse problem only stops
+// the tap from collecting more information.
+//
+// The tap handles v0/v1 responses (ACK/NAK and shallow lines followed by a
+// side-band multiplexed or raw packfile) and v2 responses (sections such as
+// "acknowledgments", "shallow-info" and "packfile").
+type ResponseTap struct {
+	// PackBytes counts packfile bytes (side-band channel 1, or raw pack data)
+	PackBytes int64
+
+	// ProgressBytes counts progress output (side-band channel 2)
+	ProgressBytes int64
+
+	// ErrorMessage holds the message from an "ERR" line or side-band channel 3
+	ErrorMessage string
+
+	// Sections lists the v2 response sections in the order they were seen
+	Sections []string
+
+	// Acks counts ACK lines; Shallows and Unshallows count shallow-info lines
+	Acks       int
+	Shallows   int
+	Unshallows int
+
+	hdr       [4]byte
+	hdrN      int
+	remaining int  // payload bytes left in the current packet
+	first     bool // the next payload byte is the first of the packet
+	band      byte // side-band channel of the current packet, 0 for text
+	text      []byte
+
+	raw    bool // the rest of the stream is a raw packfile
+	broken bool // a framing error stopped the tap
+}
+
+// NewResponseTap returns a tap for an upload-pack response.
+func NewResponseTap() *ResponseTap {
+	return &ResponseTap{}
+}
+
+// Write implements io.Writer. It always consumes all of p.
+func (t *ResponseTap) Write(p []byte) (int, error) {
+	n := len(p)
+	if t.broken {
+		return n, nil
+	}
+
+	for len(p) > 0 {
+		if t.raw {
+			t.PackBytes += int64(len(p))
+			return n, nil
+		}
+
+		// Collect the four-byte length prefix
+		if t.remaining == 0 {
+			c := copy(t.hdr[t.hdrN:], p)
+			t.hdrN += c
+			p = p[c:]
+			if t.hdrN < 4 {
+				return n, nil
+			}
+			t.hdrN = 0
+			t.startPacket()
+			continue
+		}
+
+		// Consume payload bytes
+		c := min(t.remaining, len(p))
+		t.payload(p[:c])
+		t.remaining -= c
+		p = p[c:]
+		if t.remaining == 0 {
+			t.endPacket()
+		}
+	}
+
+	return n, nil
+}
+
+// startPacket interprets a complete length prefix.
+func (t *ResponseTap) startPacket() {
+	// Without side-band, the packfile follows the negotiation lines unframed
+	if bytes.Equal(t.hdr[:], []byte("PACK")) {
+		t.raw = true
+		t.PackBytes += 4
+		return
+	}
+
+	size, err := parseLength(t.hdr[:])
+	if err != nil {
+		t.broken = true
+		return
+	}
+	if size < 4 {
+		// flush, delim and response-end carry no payload
+		return
+	}
+
+	t.remaining = size - 4
+	t.first = true
+	t.band = 0
+	t.text = t.text[:0]
+	if t.remaining == 0 {
+		t.endPacket()
+	}
+}
+
+// payload consumes part of the current packet's payload.
+func (t *ResponseTap) payload(p []byte) {
+	if t.first {
+		t.first = false
+		// Text lines start with a letter; side-band packets with a channel byte
+		if p[0] == BandData || p[0] == BandProgress || p[0] == BandError {
+			t.band = p[0]
+			p = p[1:]
+		}
+	}
+
+	switch t.band {
+	case BandData:
+		t.PackBytes += int64(len(p))
+	case BandProgress:
+		t.ProgressBytes += int64(len(p))
+	default:
+		if room := maxTextPayload - len(t.text); room > 0 {
+			t.text = append(t.text, p[:min(room, len(p))]...)
+		}
+	}
+}
+
+// endPacket interprets a complete text or error packet.
+func (t *ResponseTap) endPacket() {
+	line := strings.TrimSuffix(string(t.text), "\n")
+
+	if t.band == BandError {
+		t.ErrorMessage = strings.TrimSpace(line)
+		return
+	}
+	if t.band != 0 {
+		return
+	}
+
+	cmd, arg, _ := strings.Cut(line, " ")
+	switch cmd {
+	case "ERR":
+		t.ErrorMessage = arg
+	case "ACK":
+		t.Acks++
+	case "shallow":
+		t.Shallows++
+	case "unshallow":
+		t.Unshallows++
+	case "acknowledgments", "shallow-info", "wanted-refs", "packfile-uris", "packfile":
+		if arg == "" {
+			t.Sections = append(t.Sections, cmd)
+		}
+	}
+}
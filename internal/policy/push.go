@@ -0,0 +1,120 @@
+// Package policy contains access policies shared by the HTTP and SSH front ends.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/LZUOSS/gh-proxy/internal/config"
+	"go.uber.org/zap"
+)
+
+// ErrAuthenticationRequired is returned when an anonymous client tries to push.
+var ErrAuthenticationRequired = errors.New("authentication is required to push through this proxy")
+
+// PushAttempt describes a single attempt to push through the proxy.
+type PushAttempt struct {
+	Transport  string // "http" or "ssh"
+	Stage      string // e.g. "info/refs" or "receive-pack"
+	User       string // authenticated GitHub login, empty if anonymous
+	Owner      string
+	Repo       string
+	RemoteAddr string
+}
+
+// PushPolicy decides whether pushes are allowed and audits every attempt.
+// Pushes are denied unless the policy is enabled, the user is authenticated
+// and the repository matches the allowlist.
+type PushPolicy struct {
+	enabled      bool
+	allowedRepos []string
+	allowedUsers []string
+	logger       *zap.Logger
+}
+
+// NewPushPolicy creates a push policy from configuration.
+// A nil cfg yields a policy that denies every push.
+func NewPushPolicy(cfg *config.PushConfig, logger *zap.Logger) *PushPolicy {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	p := &PushPolicy{logger: logger}
+	if cfg != nil {
+		p.enabled = cfg.Enabled
+		for _, repo := range cfg.AllowedRepos {
+			p.allowedRepos = append(p.allowedRepos, strings.ToLower(repo))
+		}
+		for _, user := range cfg.AllowedUsers {
+			p.allowedUsers = append(p.allowedUsers, strings.ToLower(user))
+		}
+	}
+	return p
+}
+
+// Authorize checks a push attempt and records it in the audit log.
+// The returned error message is suitable for showing to the git client.
+func (p *PushPolicy) Authorize(attempt PushAttempt) error {
+	err := p.evaluate(attempt)
+
+	fields := []zap.Field{
+		zap.String("transport", attempt.Transport),
+		zap.String("stage", attempt.Stage),
+		zap.String("user", attempt.User),
+		zap.String("repo", attempt.Owner+"/"+attempt.Repo),
+		zap.String("remote_addr", attempt.RemoteAddr),
+		zap.Bool("allowed", err == nil),
+	}
+	if err != nil {
+		p.logger.Warn("git push denied", append(fields, zap.String("reason", err.Error()))...)
+	} else {
+		p.logger.Info("git push allowed", fields...)
+	}
+
+	return err
+}
+
+// evaluate applies the policy rules in order.
+func (p *PushPolicy) evaluate(attempt PushAttempt) error {
+	if p == nil || !p.enabled {
+		return fmt.Errorf("pushing through this proxy is disabled")
+	}
+
+	if attempt.User == "" {
+		return ErrAuthenticationRequired
+	}
+
+	if len(p.allowedUsers) > 0 && !containsFold(p.allowedUsers, attempt.User) {
+		return fmt.Errorf("user %s is not allowed to push through this proxy", attempt.User)
+	}
+
+	if !p.repoAllowed(attempt.Owner, attempt.Repo) {
+		return fmt.Errorf("pushing to %s/%s through this proxy is not allowed", attempt.Owner, attempt.Repo)
+	}
+
+	return nil
+}
+
+// repoAllowed checks owner/repo against the allowlist patterns.
+func (p *PushPolicy) repoAllowed(owner, repo string) bool {
+	name := strings.ToLower(owner + "/" + repo)
+	for _, pattern := range p.allowedRepos {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold checks if a lowercased slice contains s, ignoring case.
+func containsFold(slice []string, s string) bool {
+	s = strings.ToLower(s)
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
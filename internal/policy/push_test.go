@@ -0,0 +1,47 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/LZUOSS/gh-proxy/internal/config"
+)
+
+func TestPushPolicyAuthorize(t *testing.T) {
+	enabled := NewPushPolicy(&config.PushConfig{
+		Enabled:      true,
+		AllowedRepos: []string{"Org/*", "alice/dotfiles"},
+	}, nil)
+	restricted := NewPushPolicy(&config.PushConfig{
+		Enabled:      true,
+		AllowedRepos: []string{"org/*"},
+		AllowedUsers: []string{"Alice"},
+	}, nil)
+
+	tests := []struct {
+		name    string
+		policy  *PushPolicy
+		attempt PushAttempt
+		wantErr bool
+	}{
+		{name: "disabled by default", policy: NewPushPolicy(nil, nil), attempt: PushAttempt{User: "alice", Owner: "org", Repo: "app"}, wantErr: true},
+		{name: "anonymous denied", policy: enabled, attempt: PushAttempt{Owner: "org", Repo: "app"}, wantErr: true},
+		{name: "allowlisted glob", policy: enabled, attempt: PushAttempt{User: "bob", Owner: "org", Repo: "app"}, wantErr: false},
+		{name: "allowlisted exact", policy: enabled, attempt: PushAttempt{User: "bob", Owner: "Alice", Repo: "Dotfiles"}, wantErr: false},
+		{name: "repo not allowlisted", policy: enabled, attempt: PushAttempt{User: "bob", Owner: "other", Repo: "app"}, wantErr: true},
+		{name: "user allowlisted", policy: restricted, attempt: PushAttempt{User: "alice", Owner: "org", Repo: "app"}, wantErr: false},
+		{name: "user not allowlisted", policy: restricted, attempt: PushAttempt{User: "bob", Owner: "org", Repo: "app"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Authorize(tt.attempt)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Authorize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := enabled.Authorize(PushAttempt{Owner: "org", Repo: "app"}); err != ErrAuthenticationRequired {
+		t.Errorf("anonymous Authorize() error = %v, want ErrAuthenticationRequired", err)
+	}
+}
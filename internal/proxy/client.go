@@ -3,8 +3,8 @@ package proxy
 import (
 	"context"
 	"fmt"
-	"net"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -12,6 +12,9 @@ import (
 type ProxyClient struct {
 	client *http.Client
 	config *ProxyConfig
+	pool   *Pool   // nil unless Upstreams is configured
+	router *router // nil unless Routes is configured
+	dial   dialFunc
 }
 
 // NewProxyClient creates a new proxy client with the given configuration
@@ -25,17 +28,63 @@ func NewProxyClient(cfg *ProxyConfig) (*ProxyClient, error) {
 		return nil, fmt.Errorf("invalid proxy configuration: %w", err)
 	}
 
+	// A pool picks a proxy per connection, tunneling HTTP proxies with CONNECT
+	var pool *Pool
+	transportConfig := cfg
+	if len(cfg.Upstreams) > 0 {
+		var err error
+		if pool, err = newPool(cfg); err != nil {
+			return nil, fmt.Errorf("failed to create proxy pool: %w", err)
+		}
+		if pool.rotating() {
+			transportConfig = pool.direct
+		}
+	}
+
+	// One dialer serves the transport and raw connections such as SSH
+	var dial dialFunc
+	var err error
+	if pool != nil && pool.rotating() {
+		dial = pool.DialContext
+	} else if dial, err = newDialer(cfg); err != nil {
+		return nil, fmt.Errorf("failed to create dialer: %w", err)
+	}
+
 	// Create transport based on proxy type
-	transport, err := createTransport(cfg)
+	transport, err := createTransport(transportConfig, dial)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create transport: %w", err)
 	}
+	fallback := &routeTarget{transport: transport, dial: dial}
+
+	// Routes send some destinations elsewhere, each through its own transport
+	var roundTripper http.RoundTripper = transport
+	var routes *router
+	if len(cfg.Routes) > 0 {
+		routes, err = newRouter(cfg, pool, fallback)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create transport: %w", err)
+		}
+		roundTripper = routes
+	}
+
+	// Failed idempotent requests are retried and interrupted bodies resumed
+	if cfg.Retry.MaxAttempts > 1 {
+		roundTripper = newRetryTransport(roundTripper, cfg.Retry)
+	}
+
+	if pool != nil {
+		pool.start()
+	}
 
 	// Create HTTP client
 	client := &http.Client{
-		Transport: transport,
+		Transport: roundTripper,
 		Timeout:   cfg.Timeout,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if returnsRedirect(req.Context(), req.URL) {
+				return http.ErrUseLastResponse
+			}
 			if len(via) >= 10 {
 				return fmt.Errorf("stopped after 10 redirects")
 			}
@@ -46,17 +95,68 @@ func NewProxyClient(cfg *ProxyConfig) (*ProxyClient, error) {
 	return &ProxyClient{
 		client: client,
 		config: cfg,
+		pool:   pool,
+		router: routes,
+		dial:   fallback.dial,
 	}, nil
 }
 
+// redirectsKey is the context key of the redirect policy
+type redirectsKey struct{}
+
+// redirectPolicy decides which redirects are returned instead of followed
+type redirectPolicy struct {
+	returned func(*url.URL) bool // nil follows every redirect
+}
+
+// ReturnRedirects returns a context whose requests hand a redirect response
+// back to the caller, instead of following it, when returned reports true
+// for the redirect target. Handlers use it to pass redirects on to their
+// clients. It has no effect on contexts from FollowRedirects.
+func ReturnRedirects(ctx context.Context, returned func(*url.URL) bool) context.Context {
+	if _, ok := ctx.Value(redirectsKey{}).(redirectPolicy); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, redirectsKey{}, redirectPolicy{returned: returned})
+}
+
+// FollowRedirects returns a context whose requests follow every redirect,
+// for callers that cannot pass a redirect on, such as the SSH front end.
+func FollowRedirects(ctx context.Context) context.Context {
+	return context.WithValue(ctx, redirectsKey{}, redirectPolicy{})
+}
+
+// returnsRedirect reports whether a redirect to target is returned to the
+// caller of a request made with ctx.
+func returnsRedirect(ctx context.Context, target *url.URL) bool {
+	policy, ok := ctx.Value(redirectsKey{}).(redirectPolicy)
+	return ok && policy.returned != nil && policy.returned(target)
+}
+
 // validateConfig validates the proxy configuration
 func validateConfig(cfg *ProxyConfig) error {
-	if cfg.Type != ProxyTypeSOCKS5 && cfg.Type != ProxyTypeHTTP && cfg.Type != ProxyTypeHTTPS && cfg.Type != ProxyTypeNone {
-		return fmt.Errorf("unsupported proxy type: %s", cfg.Type)
+	// Type and address are used unless a pool takes the unrouted traffic
+	rotating := false
+	for _, upstream := range cfg.Upstreams {
+		rotating = rotating || !upstream.RouteOnly
+	}
+	if len(cfg.Upstreams) > 0 {
+		if err := validatePool(cfg); err != nil {
+			return err
+		}
 	}
+	if !rotating {
+		if !cfg.Type.isSOCKS5() && cfg.Type != ProxyTypeHTTP && cfg.Type != ProxyTypeHTTPS && cfg.Type != ProxyTypeNone {
+			return fmt.Errorf("unsupported proxy type: %s", cfg.Type)
+		}
 
-	if (cfg.Type == ProxyTypeSOCKS5 || cfg.Type == ProxyTypeHTTP || cfg.Type == ProxyTypeHTTPS) && cfg.Address == "" {
-		return fmt.Errorf("proxy address is required for type: %s", cfg.Type)
+		if cfg.Type != ProxyTypeNone && cfg.Address == "" {
+			return fmt.Errorf("proxy address is required for type: %s", cfg.Type)
+		}
+	}
+
+	if err := validateRoutes(cfg); err != nil {
+		return err
 	}
 
 	if cfg.Timeout <= 0 {
@@ -71,23 +171,32 @@ func validateConfig(cfg *ProxyConfig) error {
 		cfg.MaxIdleConnsPerHost = 10
 	}
 
+	if cfg.KeepAlive == 0 {
+		cfg.KeepAlive = 30 * time.Second
+	}
+
+	if cfg.IdleConnTimeout <= 0 {
+		cfg.IdleConnTimeout = 90 * time.Second
+	}
+
 	return nil
 }
 
-// createTransport creates an HTTP transport based on proxy type
-func createTransport(cfg *ProxyConfig) (*http.Transport, error) {
+// createTransport creates an HTTP transport based on proxy type. Direct and
+// SOCKS5 connections are opened with dial; HTTP proxies are dialed directly.
+func createTransport(cfg *ProxyConfig, dial dialFunc) (*http.Transport, error) {
 	baseTransport := &http.Transport{
 		MaxIdleConns:        cfg.MaxIdleConns,
 		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
-		IdleConnTimeout:     90 * time.Second,
+		IdleConnTimeout:     cfg.IdleConnTimeout,
 		TLSHandshakeTimeout: 10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 
 	switch cfg.Type {
-	case ProxyTypeSOCKS5:
-		// Use SOCKS5 proxy
-		baseTransport.DialContext = socks5DialContext(cfg)
+	case ProxyTypeSOCKS5, ProxyTypeSOCKS5H:
+		// Use SOCKS5 proxy, with one dialer for all connections
+		baseTransport.DialContext = dial
 
 	case ProxyTypeHTTP, ProxyTypeHTTPS:
 		// Use HTTP or HTTPS proxy
@@ -96,17 +205,11 @@ func createTransport(cfg *ProxyConfig) (*http.Transport, error) {
 			return nil, err
 		}
 		baseTransport.Proxy = http.ProxyURL(proxyURL)
-		baseTransport.DialContext = (&net.Dialer{
-			Timeout:   cfg.Timeout,
-			KeepAlive: 30 * time.Second,
-		}).DialContext
+		baseTransport.DialContext = cfg.netDialer().DialContext
 
 	case ProxyTypeNone:
-		// Direct connection
-		baseTransport.DialContext = (&net.Dialer{
-			Timeout:   cfg.Timeout,
-			KeepAlive: 30 * time.Second,
-		}).DialContext
+		// Direct connection, or through a pool
+		baseTransport.DialContext = dial
 
 	default:
 		return nil, fmt.Errorf("unsupported proxy type: %s", cfg.Type)
@@ -154,7 +257,15 @@ func (pc *ProxyClient) Config() *ProxyConfig {
 	return pc.config
 }
 
-// Close closes idle connections
+// Pool returns the upstream proxy pool, or nil if a single proxy is used
+func (pc *ProxyClient) Pool() *Pool {
+	return pc.pool
+}
+
+// Close closes idle connections and stops pool health checks
 func (pc *ProxyClient) Close() {
 	pc.client.CloseIdleConnections()
+	if pc.pool != nil {
+		pc.pool.Close()
+	}
 }
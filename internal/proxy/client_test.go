@@ -1,6 +1,11 @@
 package proxy
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
@@ -134,3 +139,77 @@ func TestProxyClient_Client(t *testing.T) {
 		t.Error("Client() returned nil")
 	}
 }
+
+func TestProxyClient_Timeouts(t *testing.T) {
+	client, err := NewProxyClient(&ProxyConfig{
+		Type:            ProxyTypeSOCKS5,
+		Address:         "localhost:1080",
+		Timeout:         30 * time.Second,
+		KeepAlive:       -1,
+		IdleConnTimeout: 5 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewProxyClient() error = %v", err)
+	}
+	defer client.Close()
+
+	transport := client.Client().Transport.(*http.Transport)
+	if transport.IdleConnTimeout != 5*time.Minute {
+		t.Errorf("IdleConnTimeout = %v, want 5m", transport.IdleConnTimeout)
+	}
+	if cfg := client.Config(); cfg.KeepAlive != -1 || cfg.dialTimeout() != 30*time.Second {
+		t.Errorf("KeepAlive = %v, dial timeout = %v; want -1 and 30s", cfg.KeepAlive, cfg.dialTimeout())
+	}
+}
+
+func TestProxyClient_Redirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/served":
+			http.Redirect(w, r, "/proxied/target", http.StatusFound)
+		case "/unserved":
+			http.Redirect(w, r, "/elsewhere/target", http.StatusFound)
+		default:
+			w.Write([]byte("target"))
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewProxyClient(nil)
+	if err != nil {
+		t.Fatalf("NewProxyClient() error = %v", err)
+	}
+	defer client.Close()
+
+	served := func(target *url.URL) bool {
+		return strings.HasPrefix(target.Path, "/proxied/")
+	}
+	returning := ReturnRedirects(context.Background(), served)
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		path       string
+		wantStatus int
+	}{
+		{name: "followed by default", ctx: context.Background(), path: "/served", wantStatus: http.StatusOK},
+		{name: "returned", ctx: returning, path: "/served", wantStatus: http.StatusFound},
+		{name: "target not served", ctx: returning, path: "/unserved", wantStatus: http.StatusOK},
+		{name: "followed explicitly", ctx: FollowRedirects(returning), path: "/served", wantStatus: http.StatusOK},
+		{name: "follow not overridden", ctx: ReturnRedirects(FollowRedirects(context.Background()), served), path: "/served", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequestWithContext(tt.ctx, http.MethodGet, server.URL+tt.path, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
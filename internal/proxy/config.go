@@ -6,15 +6,21 @@ import "time"
 type ProxyType string
 
 const (
-	ProxyTypeSOCKS5 ProxyType = "socks5"
-	ProxyTypeHTTP   ProxyType = "http"
-	ProxyTypeHTTPS  ProxyType = "https"
-	ProxyTypeNone   ProxyType = "none"
+	ProxyTypeSOCKS5  ProxyType = "socks5"
+	ProxyTypeSOCKS5H ProxyType = "socks5h" // Same as socks5; host names are always resolved by the proxy
+	ProxyTypeHTTP    ProxyType = "http"
+	ProxyTypeHTTPS   ProxyType = "https"
+	ProxyTypeNone    ProxyType = "none"
 )
 
+// isSOCKS5 reports whether t is a SOCKS5 proxy type.
+func (t ProxyType) isSOCKS5() bool {
+	return t == ProxyTypeSOCKS5 || t == ProxyTypeSOCKS5H
+}
+
 // ProxyConfig holds the proxy client configuration
 type ProxyConfig struct {
-	// Type is the proxy type (socks5, http, none)
+	// Type is the proxy type (socks5, socks5h, http, https, none)
 	Type ProxyType
 
 	// Address is the proxy server address (host:port)
@@ -26,14 +32,144 @@ type ProxyConfig struct {
 	// Password for proxy authentication (optional)
 	Password string
 
+	// LocalDNS resolves host names locally and asks socks5 proxies,
+	// including pool members, to connect to the IP address. By default the
+	// proxy resolves them; socks5h proxies always do.
+	LocalDNS bool
+
 	// Timeout for proxy connections
 	Timeout time.Duration
 
+	// DialTimeout bounds establishing a connection, including the proxy
+	// handshake (defaults to Timeout)
+	DialTimeout time.Duration
+
+	// KeepAlive is the TCP keep-alive period of connections (defaults to
+	// 30s; negative disables keep-alives)
+	KeepAlive time.Duration
+
+	// IdleConnTimeout is how long an idle connection stays in the pool
+	// (defaults to 90s)
+	IdleConnTimeout time.Duration
+
 	// MaxIdleConns controls the maximum number of idle connections
 	MaxIdleConns int
 
 	// MaxIdleConnsPerHost controls the maximum idle connections per host
 	MaxIdleConnsPerHost int
+
+	// Upstreams is a pool of egress proxies used instead of Type and
+	// Address when not empty
+	Upstreams []UpstreamProxy
+
+	// Strategy selects a pool member for each new connection
+	// (defaults to round robin)
+	Strategy Strategy
+
+	// FallbackDirect connects directly when no pool member is available
+	FallbackDirect bool
+
+	// HealthCheck configures how failed pool members leave the rotation
+	HealthCheck HealthCheckConfig
+
+	// Routes are ordered routing rules; the first match decides where a
+	// connection goes, and unmatched connections use the pool or proxy
+	Routes []Route
+
+	// Retry configures retries of idempotent requests and resuming of
+	// interrupted response bodies
+	Retry RetryConfig
+
+	// Segmented configures parallel ranged downloads of large responses
+	Segmented SegmentConfig
+}
+
+// Strategy selects the upstream proxy for a new connection
+type Strategy string
+
+const (
+	StrategyRoundRobin       Strategy = "round_robin"
+	StrategyLeastConnections Strategy = "least_connections"
+	StrategyLatency          Strategy = "latency"
+)
+
+// UpstreamProxy is a member of an upstream proxy pool
+type UpstreamProxy struct {
+	// Name labels the proxy in metrics (defaults to Address)
+	Name string
+
+	// Type is the proxy type (socks5, socks5h, http, https)
+	Type ProxyType
+
+	// Address is the proxy server address (host:port)
+	Address string
+
+	// Username for proxy authentication (optional)
+	Username string
+
+	// Password for proxy authentication (optional)
+	Password string
+
+	// Weight is the proxy's relative share of new connections (default 1)
+	Weight int
+
+	// RouteOnly keeps the proxy out of the pool rotation; it is only used
+	// by routes naming it
+	RouteOnly bool
+}
+
+// HealthCheckConfig configures active and passive health checks of an
+// upstream proxy pool
+type HealthCheckConfig struct {
+	// Interval between active probes; 0 disables them
+	Interval time.Duration
+
+	// Timeout for a probe (defaults to the dial timeout)
+	Timeout time.Duration
+
+	// Target is the host:port each proxy is asked to connect to when probed
+	Target string
+
+	// MaxFails is the number of consecutive failed connections after which
+	// a proxy is taken out of rotation; 0 disables passive checks
+	MaxFails int
+
+	// FailTimeout is how long a proxy stays out of rotation after MaxFails
+	FailTimeout time.Duration
+}
+
+// RetryConfig configures retries of idempotent upstream requests
+type RetryConfig struct {
+	// MaxAttempts is the number of tries of a request, including the
+	// first, and bounds the resumes of a response body; 0 or 1 disables
+	// retries
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry, doubled for each
+	// further one with jitter (defaults to 100ms)
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the wait between retries (defaults to 5s)
+	MaxBackoff time.Duration
+
+	// Resume continues response bodies interrupted mid-stream with a Range
+	// request, if the upstream supports ranges and sent a strong ETag
+	Resume bool
+}
+
+// SegmentConfig configures downloads split into byte ranges fetched in
+// parallel
+type SegmentConfig struct {
+	// Segments is the number of ranges fetched in parallel; 0 or 1
+	// disables segmented downloads
+	Segments int
+
+	// MinSize is the smallest response in bytes that is split
+	MinSize int64
+
+	// TempDir holds the ranges while they download (defaults to the
+	// system temporary directory)
+	TempDir string
 }
 
 // DefaultProxyConfig returns a ProxyConfig with sensible defaults
@@ -41,6 +177,8 @@ func DefaultProxyConfig() *ProxyConfig {
 	return &ProxyConfig{
 		Type:                ProxyTypeNone,
 		Timeout:             30 * time.Second,
+		KeepAlive:           30 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 10,
 	}
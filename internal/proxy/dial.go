@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DialContext opens a TCP connection to addr through the configured proxy,
+// for protocols other than HTTP such as SSH. SOCKS5 proxies are used
+// directly and HTTP proxies through a CONNECT tunnel. The dial, including
+// the proxy handshake, is bounded by the dial timeout.
+func (pc *ProxyClient) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if pc.router != nil {
+		return pc.router.DialContext(ctx, network, addr)
+	}
+	return pc.dial(ctx, network, addr)
+}
+
+// dialFunc opens a connection to addr, like net.Dialer.DialContext.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newDialer returns a dialFunc connecting through the proxy described by
+// cfg. It is created once per proxy and reused for every connection; each
+// dial, including the proxy handshake, is bounded by the dial timeout and
+// by its context.
+func newDialer(cfg *ProxyConfig) (dialFunc, error) {
+	var dial dialFunc
+	switch {
+	case cfg.Type.isSOCKS5():
+		socks, err := newSOCKS5Dialer(cfg)
+		if err != nil {
+			return nil, err
+		}
+		dial = socks.DialContext
+
+	case cfg.Type == ProxyTypeHTTP || cfg.Type == ProxyTypeHTTPS:
+		proxyURL, err := parseProxyURL(cfg)
+		if err != nil {
+			return nil, err
+		}
+		dialer := cfg.netDialer()
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return httpConnectDial(ctx, dialer, cfg, proxyURL, addr)
+		}
+
+	default:
+		dial = cfg.netDialer().DialContext
+	}
+
+	timeout := cfg.dialTimeout()
+	if timeout <= 0 {
+		return dial, nil
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, network, addr)
+	}, nil
+}
+
+// dialTimeout returns the timeout for establishing connections.
+func (cfg *ProxyConfig) dialTimeout() time.Duration {
+	if cfg.DialTimeout > 0 {
+		return cfg.DialTimeout
+	}
+	return cfg.Timeout
+}
+
+// netDialer returns a dialer for direct connections and connections to the
+// proxy itself.
+func (cfg *ProxyConfig) netDialer() *net.Dialer {
+	return &net.Dialer{Timeout: cfg.dialTimeout(), KeepAlive: cfg.KeepAlive}
+}
+
+// httpConnectDial opens a tunnel to addr with an HTTP CONNECT request to
+// the proxy at proxyURL.
+func httpConnectDial(ctx context.Context, dialer *net.Dialer, cfg *ProxyConfig, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to HTTP proxy: %w", err)
+	}
+
+	// The handshake is bounded by the context as well
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	if cfg.Type == ProxyTypeHTTPS {
+		host, _, _ := net.SplitHostPort(proxyURL.Host)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with HTTP proxy failed: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: proxyURL.Scheme, Host: proxyURL.Host},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	req.URL.Opaque = addr
+	if cfg.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(cfg.Username + ":" + cfg.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+
+	if !stop() {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT to %s: %w", addr, ctx.Err())
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The proxy may already have sent data from the tunnel
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads from the buffer, then from the connection.
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listen starts a TCP listener serving each connection with handle.
+func listen(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// echoTarget starts a server that echoes what it receives.
+func echoTarget(t *testing.T) string {
+	return listen(t, func(conn net.Conn) { io.Copy(conn, conn) })
+}
+
+// tunnel connects conn to target in both directions.
+func tunnel(conn net.Conn, target string) {
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echo = %q, want ping", buf)
+	}
+}
+
+func TestDialContextHTTPConnect(t *testing.T) {
+	target := echoTarget(t)
+	var gotAuth, gotHost string
+	proxyAddr := listen(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		gotAuth = req.Header.Get("Proxy-Authorization")
+		gotHost = req.Host
+		if req.Method != http.MethodConnect || req.Host != target {
+			conn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		tunnel(conn, target)
+	})
+
+	client, err := NewProxyClient(&ProxyConfig{
+		Type:     ProxyTypeHTTP,
+		Address:  proxyAddr,
+		Username: "user",
+		Password: "secret",
+		Timeout:  5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewProxyClient() error = %v", err)
+	}
+
+	conn, err := client.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	assertEcho(t, conn)
+
+	if gotHost != target {
+		t.Errorf("CONNECT host = %q, want %q", gotHost, target)
+	}
+	if gotAuth != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("Proxy-Authorization = %q", gotAuth)
+	}
+
+	if _, err := client.DialContext(context.Background(), "tcp", "127.0.0.1:1"); err == nil {
+		t.Error("expected an error for a refused CONNECT")
+	}
+}
+
+func TestDialContextSOCKS5(t *testing.T) {
+	target := echoTarget(t)
+	var gotUser, gotPassword string
+	proxyAddr := listen(t, func(conn net.Conn) {
+		// Greeting: version, methods; choose username/password
+		head := make([]byte, 2)
+		io.ReadFull(conn, head)
+		io.ReadFull(conn, make([]byte, head[1]))
+		conn.Write([]byte{5, 2})
+
+		// RFC 1929 authentication
+		io.ReadFull(conn, head)
+		user := make([]byte, head[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, head[:1])
+		password := make([]byte, head[0])
+		io.ReadFull(conn, password)
+		gotUser, gotPassword = string(user), string(password)
+		conn.Write([]byte{1, 0})
+
+		// CONNECT request with an IPv4 address
+		req := make([]byte, 10)
+		if _, err := io.ReadFull(conn, req); err != nil || req[3] != 1 {
+			return
+		}
+		addr := net.JoinHostPort(net.IP(req[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(req[8:10]))))
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		tunnel(conn, addr)
+	})
+
+	client, err := NewProxyClient(&ProxyConfig{
+		Type:     ProxyTypeSOCKS5,
+		Address:  proxyAddr,
+		Username: "user",
+		Password: "secret",
+		Timeout:  5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewProxyClient() error = %v", err)
+	}
+
+	conn, err := client.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	assertEcho(t, conn)
+
+	if gotUser != "user" || gotPassword != "secret" {
+		t.Errorf("SOCKS5 credentials = %q/%q, want user/secret", gotUser, gotPassword)
+	}
+}
+
+func TestDialContextTimeout(t *testing.T) {
+	// A proxy that accepts connections but never answers
+	proxyAddr := listen(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+
+	for _, proxyType := range []ProxyType{ProxyTypeHTTP, ProxyTypeSOCKS5} {
+		t.Run(string(proxyType), func(t *testing.T) {
+			client, err := NewProxyClient(&ProxyConfig{
+				Type:        proxyType,
+				Address:     proxyAddr,
+				Timeout:     30 * time.Second,
+				DialTimeout: 100 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewProxyClient() error = %v", err)
+			}
+
+			start := time.Now()
+			if _, err := client.DialContext(context.Background(), "tcp", "127.0.0.1:22"); err == nil {
+				t.Fatal("expected a timeout error")
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("dial took %v, want the dial timeout", elapsed)
+			}
+		})
+	}
+}
+
+// socks5Proxy starts a SOCKS5 proxy without authentication that records the
+// destination of each CONNECT request in hosts.
+func socks5Proxy(t *testing.T, hosts chan<- string) string {
+	t.Helper()
+	return listen(t, func(conn net.Conn) {
+		head := make([]byte, 2)
+		io.ReadFull(conn, head)
+		io.ReadFull(conn, make([]byte, head[1]))
+		conn.Write([]byte{5, 0})
+
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		var host string
+		switch req[3] {
+		case 1, 4: // IPv4, IPv6
+			ip := make([]byte, 4)
+			if req[3] == 4 {
+				ip = make([]byte, 16)
+			}
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 3: // domain name
+			io.ReadFull(conn, head[:1])
+			name := make([]byte, head[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		}
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		hosts <- host
+
+		upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	})
+}
+
+func TestDialContextSOCKS5RemoteDNS(t *testing.T) {
+	_, port, _ := net.SplitHostPort(echoTarget(t))
+	target := net.JoinHostPort("localhost", port)
+
+	remote := func(host string) bool { return host == "localhost" }
+	local := func(host string) bool { return net.ParseIP(host).IsLoopback() }
+	tests := []struct {
+		name      string
+		proxyType ProxyType
+		localDNS  bool
+		wantHost  func(string) bool
+	}{
+		{"socks5", ProxyTypeSOCKS5, false, remote},
+		{"socks5h", ProxyTypeSOCKS5H, false, remote},
+		{"socks5 with local dns", ProxyTypeSOCKS5, true, local},
+		{"socks5h ignores local dns", ProxyTypeSOCKS5H, true, remote},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := make(chan string, 4)
+			client, err := NewProxyClient(&ProxyConfig{
+				Type:     tt.proxyType,
+				Address:  socks5Proxy(t, hosts),
+				LocalDNS: tt.localDNS,
+				Timeout:  5 * time.Second,
+			})
+			if err != nil {
+				t.Fatalf("NewProxyClient() error = %v", err)
+			}
+			defer client.Close()
+
+			conn, err := client.DialContext(context.Background(), "tcp", target)
+			if err != nil {
+				t.Fatalf("DialContext() error = %v", err)
+			}
+			assertEcho(t, conn)
+
+			// Local resolution may try an unreachable address first
+			host := <-hosts
+			for len(hosts) > 0 {
+				host = <-hosts
+			}
+			if !tt.wantHost(host) {
+				t.Errorf("proxy was asked to connect to %q", host)
+			}
+		})
+	}
+}
+
+func TestDialContextSOCKS5Cancel(t *testing.T) {
+	// A proxy that accepts connections but never answers
+	proxyAddr := listen(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+	client, err := NewProxyClient(&ProxyConfig{
+		Type:    ProxyTypeSOCKS5H,
+		Address: proxyAddr,
+		Timeout: 30 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewProxyClient() error = %v", err)
+	}
+	defer client.Close()
+
+	// Both raw dials and HTTP requests give up when their context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.DialContext(ctx, "tcp", "github.com:22"); err == nil {
+		t.Error("expected an error from DialContext")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://github.com/", nil)
+	if _, err := client.Do(req); err == nil {
+		t.Error("expected an error from Do")
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("canceled dials took %v", elapsed)
+	}
+}
@@ -14,12 +14,9 @@ func createHTTPTransport(cfg *ProxyConfig) (*http.Transport, error) {
 	transport := &http.Transport{
 		MaxIdleConns:        cfg.MaxIdleConns,
 		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
-		IdleConnTimeout:     90 * time.Second,
+		IdleConnTimeout:     cfg.IdleConnTimeout,
 		TLSHandshakeTimeout: 10 * time.Second,
-		DialContext: (&net.Dialer{
-			Timeout:   cfg.Timeout,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
+		DialContext:         cfg.netDialer().DialContext,
 	}
 
 	// Configure proxy if HTTP or HTTPS proxy is specified
@@ -69,10 +66,7 @@ func httpProxyDialContext(cfg *ProxyConfig) func(ctx context.Context, network, a
 	transport, _ := createHTTPTransport(cfg)
 	if transport.Proxy == nil {
 		// Fallback to direct connection if no proxy configured
-		return (&net.Dialer{
-			Timeout:   cfg.Timeout,
-			KeepAlive: 30 * time.Second,
-		}).DialContext
+		return cfg.netDialer().DialContext
 	}
 
 	return transport.DialContext
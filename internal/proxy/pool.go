@@ -0,0 +1,444 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/metrics"
+)
+
+// latencyWeight is the weight of a new sample in a member's smoothed latency
+const latencyWeight = 0.3
+
+// Pool spreads connections over several upstream proxies. A member leaves
+// the rotation when an active probe fails, or for FailTimeout after MaxFails
+// consecutive failed connections. A failed connection is retried on the
+// next member, then directly if FallbackDirect is set.
+type Pool struct {
+	members        []*poolMember
+	strategy       Strategy
+	fallbackDirect bool
+	direct         *ProxyConfig // direct connections with the pool's timeouts
+	directDial     dialFunc
+	check          HealthCheckConfig
+
+	mu       sync.Mutex // guards the round-robin state of the members
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// poolMember is a proxy of a pool with its health and load.
+type poolMember struct {
+	name      string
+	weight    int
+	dial      dialFunc
+	routeOnly bool // only used by routes naming it
+	current   int  // smooth weighted round-robin state
+
+	probeUp      atomic.Bool  // result of the last active probe
+	fails        atomic.Int32 // consecutive failed connections
+	ejectedUntil atomic.Int64 // Unix nanoseconds, 0 if not ejected
+	active       atomic.Int64 // open connections
+	latency      atomic.Int64 // smoothed connect time in nanoseconds, 0 if unknown
+}
+
+// ProxyStatus is the state of a pool member
+type ProxyStatus struct {
+	Name              string
+	Up                bool
+	ActiveConnections int64
+	Latency           time.Duration // smoothed connect time, 0 if unknown
+}
+
+// validatePool validates the pool settings of cfg
+func validatePool(cfg *ProxyConfig) error {
+	switch cfg.Strategy {
+	case "", StrategyRoundRobin, StrategyLeastConnections, StrategyLatency:
+	default:
+		return fmt.Errorf("unsupported pool strategy: %s", cfg.Strategy)
+	}
+
+	names := make(map[string]bool)
+	for i, upstream := range cfg.Upstreams {
+		if !upstream.Type.isSOCKS5() && upstream.Type != ProxyTypeHTTP && upstream.Type != ProxyTypeHTTPS {
+			return fmt.Errorf("upstream proxy %d: unsupported proxy type: %s", i, upstream.Type)
+		}
+		if upstream.Address == "" {
+			return fmt.Errorf("upstream proxy %d: proxy address is required", i)
+		}
+		if upstream.Weight < 0 {
+			return fmt.Errorf("upstream proxy %d: weight cannot be negative", i)
+		}
+
+		name := upstream.name()
+		if names[name] {
+			return fmt.Errorf("upstream proxy %d: duplicate name %q", i, name)
+		}
+		names[name] = true
+	}
+
+	return nil
+}
+
+// name returns the name of the proxy in metrics and routes.
+func (u *UpstreamProxy) name() string {
+	if u.Name != "" {
+		return u.Name
+	}
+	return u.Address
+}
+
+// directConfig returns a copy of cfg for direct connections.
+func directConfig(cfg *ProxyConfig) *ProxyConfig {
+	direct := *cfg
+	direct.Type = ProxyTypeNone
+	direct.Address, direct.Username, direct.Password = "", "", ""
+	direct.Upstreams = nil
+	direct.Routes = nil
+	return &direct
+}
+
+// newPool creates a pool of cfg.Upstreams. Active health checks begin with
+// start.
+func newPool(cfg *ProxyConfig) (*Pool, error) {
+	direct := directConfig(cfg)
+	directDial, err := newDialer(direct)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pool{
+		directDial:     directDial,
+		strategy:       cfg.Strategy,
+		fallbackDirect: cfg.FallbackDirect,
+		direct:         direct,
+		check:          cfg.HealthCheck,
+		stop:           make(chan struct{}),
+	}
+	if p.strategy == "" {
+		p.strategy = StrategyRoundRobin
+	}
+	if p.check.Timeout <= 0 {
+		p.check.Timeout = direct.dialTimeout()
+	}
+	if p.check.Target == "" {
+		p.check.Target = "github.com:443"
+	}
+	if p.check.FailTimeout <= 0 {
+		p.check.FailTimeout = 30 * time.Second
+	}
+
+	for _, upstream := range cfg.Upstreams {
+		memberConfig := *direct
+		memberConfig.Type = upstream.Type
+		memberConfig.Address = upstream.Address
+		memberConfig.Username = upstream.Username
+		memberConfig.Password = upstream.Password
+		dial, err := newDialer(&memberConfig)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy %s: %w", upstream.name(), err)
+		}
+
+		m := &poolMember{
+			name:      upstream.name(),
+			weight:    upstream.Weight,
+			dial:      dial,
+			routeOnly: upstream.RouteOnly,
+		}
+		if m.weight <= 0 {
+			m.weight = 1
+		}
+		m.probeUp.Store(true)
+		metrics.SetUpstreamProxyUp(m.name, true)
+		p.members = append(p.members, m)
+	}
+
+	return p, nil
+}
+
+// start starts the active health checks, if enabled.
+func (p *Pool) start() {
+	if p.check.Interval > 0 {
+		go p.healthCheck()
+	}
+}
+
+// Close stops the active health checks.
+func (p *Pool) Close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// rotating reports whether any member takes connections that are not
+// routed to it by name.
+func (p *Pool) rotating() bool {
+	for _, m := range p.members {
+		if !m.routeOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// memberDialer returns a dial function connecting through the member
+// called name only.
+func (p *Pool) memberDialer(name string) dialFunc {
+	for _, m := range p.members {
+		if m.name == name {
+			return func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return p.dial(ctx, m, network, addr)
+			}
+		}
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, fmt.Errorf("unknown upstream proxy %q", name)
+	}
+}
+
+// DialContext connects to addr through the pool's members, in the order of
+// its strategy, until one succeeds. Members out of rotation are only tried
+// if no member is available and there is no direct fallback. Route-only
+// members are never tried.
+func (p *Pool) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var errs []error
+	for _, m := range p.candidates() {
+		conn, err := p.dial(ctx, m, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", m.name, err))
+		if ctx.Err() != nil {
+			return nil, errors.Join(errs...)
+		}
+	}
+
+	if p.fallbackDirect {
+		conn, err := p.directDial(ctx, network, addr)
+		metrics.RecordUpstreamProxyDial("direct", err == nil)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("direct: %w", err))
+	}
+
+	return nil, fmt.Errorf("no upstream proxy could connect to %s: %w", addr, errors.Join(errs...))
+}
+
+// Status returns the state of each member in configuration order.
+func (p *Pool) Status() []ProxyStatus {
+	now := time.Now()
+	status := make([]ProxyStatus, 0, len(p.members))
+	for _, m := range p.members {
+		status = append(status, ProxyStatus{
+			Name:              m.name,
+			Up:                m.available(now),
+			ActiveConnections: m.active.Load(),
+			Latency:           time.Duration(m.latency.Load()),
+		})
+	}
+	return status
+}
+
+// candidates returns the members to try for a new connection, best first.
+func (p *Pool) candidates() []*poolMember {
+	now := time.Now()
+	var members, down []*poolMember
+	for _, m := range p.members {
+		switch {
+		case m.routeOnly:
+		case m.available(now):
+			members = append(members, m)
+		default:
+			down = append(down, m)
+		}
+	}
+	if len(members) == 0 {
+		if p.fallbackDirect || len(down) == 0 {
+			return nil
+		}
+		// Trying the members that are down beats failing outright
+		members = down
+	}
+
+	// Round robin decides the order, and breaks ties of the other strategies
+	first := p.nextRoundRobin(members)
+	ordered := make([]*poolMember, 0, len(members))
+	ordered = append(ordered, members[first:]...)
+	members = append(ordered, members[:first]...)
+
+	if p.strategy != StrategyRoundRobin {
+		// Scores are taken once, as connections open and close meanwhile
+		scores := make(map[*poolMember]float64, len(members))
+		for _, m := range members {
+			scores[m] = m.score(p.strategy)
+		}
+		sort.SliceStable(members, func(i, j int) bool {
+			return scores[members[i]] < scores[members[j]]
+		})
+	}
+
+	return members
+}
+
+// score rates m for a least-connections or latency strategy, lower is
+// better. Weights scale the open connections or latency a member is given.
+func (m *poolMember) score(strategy Strategy) float64 {
+	value := m.active.Load()
+	if strategy == StrategyLatency {
+		value = m.latency.Load()
+	}
+	return float64(value) / float64(m.weight)
+}
+
+// nextRoundRobin picks the index of the next member by smooth weighted
+// round robin.
+func (p *Pool) nextRoundRobin(members []*poolMember) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total, best := 0, 0
+	for i, m := range members {
+		m.current += m.weight
+		total += m.weight
+		if m.current > members[best].current {
+			best = i
+		}
+	}
+	members[best].current -= total
+	return best
+}
+
+// dial connects to addr through m and records the result.
+func (p *Pool) dial(ctx context.Context, m *poolMember, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := m.dial(ctx, network, addr)
+	metrics.RecordUpstreamProxyDial(m.name, err == nil)
+	if err != nil {
+		// A canceled request says nothing about the proxy
+		if ctx.Err() == nil {
+			p.fail(m)
+		}
+		return nil, err
+	}
+
+	m.fails.Store(0)
+	m.observeLatency(time.Since(start))
+	m.active.Add(1)
+	metrics.UpstreamProxyActiveConnections.WithLabelValues(m.name).Inc()
+	return &poolConn{Conn: conn, member: m}, nil
+}
+
+// fail records a failed connection through m, taking it out of rotation
+// after MaxFails consecutive failures.
+func (p *Pool) fail(m *poolMember) {
+	if p.check.MaxFails <= 0 {
+		return
+	}
+	if int(m.fails.Add(1)) >= p.check.MaxFails {
+		m.fails.Store(0)
+		m.ejectedUntil.Store(time.Now().Add(p.check.FailTimeout).UnixNano())
+		metrics.SetUpstreamProxyUp(m.name, false)
+	}
+}
+
+// healthCheck probes all members every interval until the pool is closed.
+func (p *Pool) healthCheck() {
+	ticker := time.NewTicker(p.check.Interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, m := range p.members {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.probe(m)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe connects to the health check target through m. Success also
+// returns a member taken out by passive checks to the rotation.
+func (p *Pool) probe(m *poolMember) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.check.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := m.dial(ctx, "tcp", p.check.Target)
+	if err != nil {
+		m.probeUp.Store(false)
+		metrics.SetUpstreamProxyUp(m.name, false)
+		return
+	}
+	conn.Close()
+
+	m.observeLatency(time.Since(start))
+	m.fails.Store(0)
+	m.ejectedUntil.Store(0)
+	m.probeUp.Store(true)
+	metrics.SetUpstreamProxyUp(m.name, true)
+}
+
+// available reports whether m is in rotation at now.
+func (m *poolMember) available(now time.Time) bool {
+	if !m.probeUp.Load() {
+		return false
+	}
+	until := m.ejectedUntil.Load()
+	if until == 0 {
+		return true
+	}
+	if now.UnixNano() < until {
+		return false
+	}
+	// The fail timeout has passed; give the member another chance
+	if m.ejectedUntil.CompareAndSwap(until, 0) {
+		metrics.SetUpstreamProxyUp(m.name, true)
+	}
+	return true
+}
+
+// observeLatency adds a connect time to the smoothed latency of m.
+func (m *poolMember) observeLatency(d time.Duration) {
+	for {
+		old := m.latency.Load()
+		next := int64(d)
+		if old != 0 {
+			next = int64(float64(old)*(1-latencyWeight) + float64(d)*latencyWeight)
+		}
+		if m.latency.CompareAndSwap(old, next) {
+			metrics.UpstreamProxyLatency.WithLabelValues(m.name).Set(time.Duration(next).Seconds())
+			return
+		}
+	}
+}
+
+// poolConn is a connection through a pool member, counted as active until
+// it is closed.
+type poolConn struct {
+	net.Conn
+	member    *poolMember
+	closeOnce sync.Once
+}
+
+// Close closes the connection and releases it from the member's count.
+func (c *poolConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.member.active.Add(-1)
+		metrics.UpstreamProxyActiveConnections.WithLabelValues(c.member.name).Dec()
+	})
+	return c.Conn.Close()
+}
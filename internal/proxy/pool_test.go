@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// connectProxy starts an HTTP proxy that tunnels CONNECT requests and
+// counts them in hits.
+func connectProxy(t *testing.T, hits *atomic.Int32) string {
+	t.Helper()
+	return listen(t, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		hits.Add(1)
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		tunnel(conn, req.Host)
+	})
+}
+
+// failingProxy starts an HTTP proxy that refuses every CONNECT request and
+// counts them in hits.
+func failingProxy(t *testing.T, hits *atomic.Int32) string {
+	t.Helper()
+	return listen(t, func(conn net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		hits.Add(1)
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+	})
+}
+
+// newTestClient creates a client for cfg with a short timeout, closed when
+// the test ends.
+func newTestClient(t *testing.T, cfg *ProxyConfig) *ProxyClient {
+	t.Helper()
+	cfg.Timeout = 5 * time.Second
+	client, err := NewProxyClient(cfg)
+	if err != nil {
+		t.Fatalf("NewProxyClient() error = %v", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func TestPoolWeightedRoundRobin(t *testing.T) {
+	target := echoTarget(t)
+	var hitsA, hitsB atomic.Int32
+	client := newTestClient(t, &ProxyConfig{
+		Upstreams: []UpstreamProxy{
+			{Name: "a", Type: ProxyTypeHTTP, Address: connectProxy(t, &hitsA), Weight: 2},
+			{Name: "b", Type: ProxyTypeHTTP, Address: connectProxy(t, &hitsB)},
+		},
+	})
+
+	for i := 0; i < 6; i++ {
+		conn, err := client.DialContext(context.Background(), "tcp", target)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		assertEcho(t, conn)
+	}
+
+	if hitsA.Load() != 4 || hitsB.Load() != 2 {
+		t.Errorf("connections = %d/%d, want 4/2", hitsA.Load(), hitsB.Load())
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	target := echoTarget(t)
+	var badHits, goodHits atomic.Int32
+	client := newTestClient(t, &ProxyConfig{
+		Upstreams: []UpstreamProxy{
+			{Name: "bad", Type: ProxyTypeHTTP, Address: failingProxy(t, &badHits)},
+			{Name: "good", Type: ProxyTypeHTTP, Address: connectProxy(t, &goodHits)},
+		},
+		HealthCheck: HealthCheckConfig{MaxFails: 2, FailTimeout: time.Hour},
+	})
+
+	for i := 0; i < 6; i++ {
+		conn, err := client.DialContext(context.Background(), "tcp", target)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		assertEcho(t, conn)
+	}
+
+	// The failing proxy is ejected after two failures
+	if badHits.Load() != 2 || goodHits.Load() != 6 {
+		t.Errorf("connections = %d/%d, want 2/6", badHits.Load(), goodHits.Load())
+	}
+	status := client.Pool().Status()
+	if status[0].Up || !status[1].Up {
+		t.Errorf("status = %+v, want bad down and good up", status)
+	}
+}
+
+func TestPoolLeastConnections(t *testing.T) {
+	target := echoTarget(t)
+	var hitsA, hitsB atomic.Int32
+	client := newTestClient(t, &ProxyConfig{
+		Upstreams: []UpstreamProxy{
+			{Name: "a", Type: ProxyTypeHTTP, Address: connectProxy(t, &hitsA)},
+			{Name: "b", Type: ProxyTypeHTTP, Address: connectProxy(t, &hitsB)},
+		},
+		Strategy: StrategyLeastConnections,
+	})
+
+	// Connections held open steer new ones to the other proxy
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		conn, err := client.DialContext(context.Background(), "tcp", target)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	if hitsA.Load() != 2 || hitsB.Load() != 2 {
+		t.Errorf("connections = %d/%d, want 2/2", hitsA.Load(), hitsB.Load())
+	}
+
+	status := client.Pool().Status()
+	if status[0].ActiveConnections != 2 || status[1].ActiveConnections != 2 {
+		t.Errorf("status = %+v, want 2 active connections each", status)
+	}
+	for _, conn := range conns {
+		conn.Close()
+		conn.Close()
+	}
+	status = client.Pool().Status()
+	if status[0].ActiveConnections != 0 || status[1].ActiveConnections != 0 {
+		t.Errorf("status = %+v, want no active connections", status)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	target := echoTarget(t)
+	var badHits, goodHits atomic.Int32
+
+	// A proxy that is down: its listener is closed
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	dead.Close()
+
+	client := newTestClient(t, &ProxyConfig{
+		Upstreams: []UpstreamProxy{
+			{Name: "dead", Type: ProxyTypeSOCKS5, Address: dead.Addr().String()},
+			{Name: "refusing", Type: ProxyTypeHTTP, Address: failingProxy(t, &badHits)},
+			{Name: "good", Type: ProxyTypeHTTP, Address: connectProxy(t, &goodHits)},
+		},
+		Strategy:    StrategyLatency,
+		HealthCheck: HealthCheckConfig{Interval: 20 * time.Millisecond, Target: target},
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := client.Pool().Status()
+		if !status[0].Up && !status[1].Up && status[2].Up && status[2].Latency > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status = %+v, want only good up", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	probes := badHits.Load()
+	conn, err := client.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	assertEcho(t, conn)
+	if badHits.Load() > probes+1 {
+		t.Error("connection was tried through a proxy that failed its health check")
+	}
+}
+
+func TestPoolFallbackDirect(t *testing.T) {
+	target := echoTarget(t)
+	var hits atomic.Int32
+	proxyAddr := failingProxy(t, &hits)
+
+	for _, fallback := range []bool{false, true} {
+		client := newTestClient(t, &ProxyConfig{
+			Upstreams:      []UpstreamProxy{{Type: ProxyTypeHTTP, Address: proxyAddr}},
+			FallbackDirect: fallback,
+		})
+
+		conn, err := client.DialContext(context.Background(), "tcp", target)
+		if !fallback {
+			if err == nil {
+				conn.Close()
+				t.Error("expected an error without a direct fallback")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("DialContext() with fallback error = %v", err)
+		}
+		assertEcho(t, conn)
+	}
+}
+
+func TestPoolHTTPRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	var hits atomic.Int32
+	client := newTestClient(t, &ProxyConfig{
+		Type:      ProxyTypeSOCKS5, // ignored when a pool is configured
+		Upstreams: []UpstreamProxy{{Type: ProxyTypeHTTP, Address: connectProxy(t, &hits)}},
+	})
+
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" || hits.Load() != 1 {
+		t.Errorf("body = %q, tunnels = %d; want hello through one tunnel", body, hits.Load())
+	}
+}
+
+func TestPoolValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ProxyConfig
+	}{
+		{"unknown strategy", ProxyConfig{Strategy: "random", Upstreams: []UpstreamProxy{{Type: ProxyTypeHTTP, Address: "a:1"}}}},
+		{"unsupported type", ProxyConfig{Upstreams: []UpstreamProxy{{Type: ProxyTypeNone, Address: "a:1"}}}},
+		{"missing address", ProxyConfig{Upstreams: []UpstreamProxy{{Type: ProxyTypeHTTP}}}},
+		{"negative weight", ProxyConfig{Upstreams: []UpstreamProxy{{Type: ProxyTypeHTTP, Address: "a:1", Weight: -1}}}},
+		{"duplicate name", ProxyConfig{Upstreams: []UpstreamProxy{{Type: ProxyTypeHTTP, Address: "a:1"}, {Type: ProxyTypeSOCKS5, Address: "a:1"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewProxyClient(&tt.cfg); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/metrics"
+)
+
+// retryTransport retries idempotent requests that fail or get a 502, 503
+// or 504 response, waiting a jittered, exponentially growing backoff
+// between attempts. Response bodies interrupted mid-stream are resumed with
+// Range requests when the upstream supports them.
+type retryTransport struct {
+	next http.RoundTripper
+	cfg  RetryConfig
+}
+
+// newRetryTransport wraps next with the retry policy of cfg.
+func newRetryTransport(next http.RoundTripper, cfg RetryConfig) *retryTransport {
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.InitialBackoff {
+		cfg.MaxBackoff = max(5*time.Second, cfg.InitialBackoff)
+	}
+	return &retryTransport{next: next, cfg: cfg}
+}
+
+// RoundTrip sends req, retrying it if it can be sent again.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !replayable(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	resp, err := t.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.cfg.Resume && resumable(req, resp) {
+		resp.Body = &resumableBody{
+			t:    t,
+			req:  req,
+			body: resp.Body,
+			etag: resp.Header.Get("ETag"),
+		}
+	}
+	return resp, nil
+}
+
+// roundTrip sends req up to MaxAttempts times, until it gets a response
+// that is not worth retrying.
+func (t *retryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewind request body: %w", err)
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(attemptReq)
+		last := attempt >= t.cfg.MaxAttempts
+		if err != nil {
+			if last || req.Context().Err() != nil || errors.Is(err, ErrRouteRejected) {
+				return nil, err
+			}
+			metrics.RecordUpstreamRetry("error")
+		} else {
+			if last || !retryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+			metrics.RecordUpstreamRetry("status")
+		}
+
+		if err := t.wait(req.Context(), attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait sleeps before retry number n, or until ctx is done. The backoff
+// doubles with each retry up to MaxBackoff; a random half of it is jitter.
+func (t *retryTransport) wait(ctx context.Context, n int) error {
+	backoff := t.cfg.InitialBackoff
+	for i := 1; i < n && backoff < t.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, t.cfg.MaxBackoff)
+	backoff = backoff/2 + rand.N(backoff/2+1)
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport.
+func (t *retryTransport) CloseIdleConnections() {
+	if closer, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// replayable reports whether req is idempotent and can be sent again.
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// retryableStatus reports whether an upstream response with code is
+// retried.
+func retryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// resumable reports whether the body of resp can be resumed with a Range
+// request validated by a strong ETag.
+func resumable(req *http.Request, resp *http.Response) bool {
+	etag := resp.Header.Get("ETag")
+	return req.Method == http.MethodGet &&
+		req.Header.Get("Range") == "" &&
+		resp.StatusCode == http.StatusOK &&
+		!resp.Uncompressed &&
+		strings.Contains(resp.Header.Get("Accept-Ranges"), "bytes") &&
+		etag != "" && !strings.HasPrefix(etag, "W/")
+}
+
+// resumableBody is a response body that continues where it was
+// interrupted with a Range request, so readers see one uninterrupted
+// stream.
+type resumableBody struct {
+	t       *retryTransport
+	req     *http.Request
+	body    io.ReadCloser
+	etag    string
+	offset  int64 // bytes read so far
+	resumes int
+	err     error // error that ended the stream
+}
+
+// Read reads from the current upstream response, resuming it on errors.
+func (b *resumableBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	for {
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		if b.resumes >= b.t.cfg.MaxAttempts-1 || b.req.Context().Err() != nil {
+			b.err = err
+			return n, err
+		}
+		if resumeErr := b.resume(); resumeErr != nil {
+			b.err = fmt.Errorf("%w (resume failed: %v)", err, resumeErr)
+			return n, b.err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume replaces the interrupted body with the rest of the response,
+// requested from the current offset if the ETag still matches.
+func (b *resumableBody) resume() error {
+	b.body.Close()
+	b.resumes++
+	metrics.RecordUpstreamRetry("resume")
+	if err := b.t.wait(b.req.Context(), b.resumes); err != nil {
+		return err
+	}
+
+	req := b.req.Clone(b.req.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+	req.Header.Set("If-Range", b.etag)
+	resp, err := b.t.roundTrip(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent ||
+		!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", b.offset)) {
+		resp.Body.Close()
+		return fmt.Errorf("upstream did not resume at byte %d: %s", b.offset, resp.Status)
+	}
+	b.body = resp.Body
+	return nil
+}
+
+// Close closes the current upstream response body.
+func (b *resumableBody) Close() error {
+	return b.body.Close()
+}
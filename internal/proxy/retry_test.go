@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// retryConfig returns a direct connection config with fast retries.
+func retryConfig(attempts int) *ProxyConfig {
+	return &ProxyConfig{
+		Type:  ProxyTypeNone,
+		Retry: RetryConfig{MaxAttempts: attempts, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond, Resume: true},
+	}
+}
+
+func TestRetryFailures(t *testing.T) {
+	// The first two requests fail: one drops the connection, one gets a 503
+	var requests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			panic(http.ErrAbortHandler)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			io.WriteString(w, "hello")
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name         string
+		method       string
+		attempts     int
+		wantStatus   int
+		wantRequests int32
+	}{
+		{"retried until success", http.MethodGet, 3, http.StatusOK, 3},
+		{"last response returned", http.MethodGet, 2, http.StatusServiceUnavailable, 2},
+		{"not idempotent", http.MethodPost, 3, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			client := newTestClient(t, retryConfig(tt.attempts))
+			req, _ := http.NewRequest(tt.method, backend.URL, strings.NewReader("body"))
+
+			resp, err := client.Do(req)
+			status := 0
+			if err == nil {
+				status = resp.StatusCode
+				resp.Body.Close()
+			}
+			if status != tt.wantStatus || requests.Load() != tt.wantRequests {
+				t.Errorf("status = %d after %d requests (error %v), want %d after %d",
+					status, requests.Load(), err, tt.wantStatus, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	var requests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+
+	client, err := NewProxyClient(&ProxyConfig{
+		Type:    ProxyTypeNone,
+		Timeout: 5 * time.Second,
+		Retry:   RetryConfig{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyClient() error = %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, backend.URL, nil)
+	if _, err := client.Do(req); err == nil {
+		t.Error("expected an error when the backoff outlasts the request")
+	}
+	if requests.Load() != 1 {
+		t.Errorf("requests = %d, want 1", requests.Load())
+	}
+}
+
+// resumingBackend serves content with ETag etag, dropping the connection
+// of full responses after cut bytes. Range requests are recorded in ranges.
+func resumingBackend(t *testing.T, content []byte, cut int, etag *atomic.Value, ranges chan<- string) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag.Load().(string))
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			ranges <- rangeHeader
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+			return
+		}
+
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:cut])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestRetryResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	ranges := make(chan string, 4)
+	backend := resumingBackend(t, content, 300000, &etag, ranges)
+	client := newTestClient(t, retryConfig(3))
+
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(body, content) {
+		t.Errorf("body has %d bytes, want the %d bytes of content", len(body), len(content))
+	}
+	if got := <-ranges; got != "bytes=300000-" {
+		t.Errorf("Range = %q, want bytes=300000-", got)
+	}
+}
+
+func TestRetryResumeChanged(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	ranges := make(chan string, 4)
+	backend := resumingBackend(t, content, 300000, &etag, ranges)
+	client := newTestClient(t, retryConfig(3))
+
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The file changes upstream: If-Range fails and the full file comes back
+	etag.Store(`"v2"`)
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatal("expected an error when the upstream file changed")
+	}
+	if !bytes.Equal(body, content[:len(body)]) || len(body) > 300000 {
+		t.Errorf("read %d bytes, want at most the first 300000 bytes of the old file", len(body))
+	}
+}
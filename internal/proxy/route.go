@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Route targets besides the name of an upstream proxy
+const (
+	RouteDirect = "direct"
+	RouteReject = "reject"
+)
+
+// Handler types that outgoing requests and connections are tagged with
+const (
+	HandlerAPI      = "api"
+	HandlerRaw      = "raw"
+	HandlerArchive  = "archive"
+	HandlerReleases = "releases"
+	HandlerGist     = "gist"
+	HandlerGit      = "git"
+	HandlerLFS      = "lfs"
+	HandlerSSH      = "ssh"
+	HandlerKeys     = "keys"
+)
+
+// Handlers lists the handler types routes can match
+var Handlers = []string{
+	HandlerAPI, HandlerRaw, HandlerArchive, HandlerReleases, HandlerGist,
+	HandlerGit, HandlerLFS, HandlerSSH, HandlerKeys,
+}
+
+// ErrRouteRejected is returned for destinations a route rejects
+var ErrRouteRejected = errors.New("destination rejected by routing rule")
+
+// Route sends matching connections to a target. Each non-empty condition
+// must match; within a condition any entry may match.
+type Route struct {
+	// Hosts are destination host globs, e.g. "*.githubusercontent.com"
+	Hosts []string
+
+	// Paths are URL path prefixes; routes with paths never match raw
+	// connections such as SSH
+	Paths []string
+
+	// Handlers are the handler types set with WithHandler
+	Handlers []string
+
+	// Target is RouteDirect, RouteReject or the name of an upstream proxy
+	Target string
+}
+
+// handlerKey is the context key of the handler type
+type handlerKey struct{}
+
+// WithHandler returns a context tagging requests and connections made with
+// it as coming from handler, for routes matching handler types.
+func WithHandler(ctx context.Context, handler string) context.Context {
+	return context.WithValue(ctx, handlerKey{}, handler)
+}
+
+// handlerFrom returns the handler type of ctx, or "".
+func handlerFrom(ctx context.Context) string {
+	handler, _ := ctx.Value(handlerKey{}).(string)
+	return handler
+}
+
+// matches reports whether the route applies to a connection to host for
+// urlPath, made by handler. urlPath is empty for raw connections.
+func (r *Route) matches(host, urlPath, handler string) bool {
+	if len(r.Hosts) > 0 && !matchAny(r.Hosts, func(pattern string) bool {
+		ok, _ := path.Match(pattern, host)
+		return ok
+	}) {
+		return false
+	}
+	if len(r.Paths) > 0 && (urlPath == "" || !matchAny(r.Paths, func(prefix string) bool {
+		return strings.HasPrefix(urlPath, prefix)
+	})) {
+		return false
+	}
+	if len(r.Handlers) > 0 && !matchAny(r.Handlers, func(h string) bool {
+		return h == handler
+	}) {
+		return false
+	}
+	return true
+}
+
+// matchAny reports whether match is true for any of values.
+func matchAny(values []string, match func(string) bool) bool {
+	for _, value := range values {
+		if match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRoutes validates the routes of cfg against its upstream proxies
+func validateRoutes(cfg *ProxyConfig) error {
+	names := make(map[string]bool)
+	for _, upstream := range cfg.Upstreams {
+		names[upstream.name()] = true
+	}
+
+	for i, route := range cfg.Routes {
+		if route.Target != RouteDirect && route.Target != RouteReject && !names[route.Target] {
+			return fmt.Errorf("route %d: unknown target %q", i, route.Target)
+		}
+		for _, pattern := range route.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("route %d: invalid host pattern %q", i, pattern)
+			}
+		}
+		for _, prefix := range route.Paths {
+			if !strings.HasPrefix(prefix, "/") {
+				return fmt.Errorf("route %d: path prefix %q must start with /", i, prefix)
+			}
+		}
+		for _, handler := range route.Handlers {
+			if !matchAny(Handlers, func(h string) bool { return h == handler }) {
+				return fmt.Errorf("route %d: unknown handler %q", i, handler)
+			}
+		}
+	}
+
+	return nil
+}
+
+// routeTarget is where routed connections go.
+type routeTarget struct {
+	transport *http.Transport
+	dial      dialFunc
+}
+
+// router picks a target for each request and connection by the first
+// matching route. Every target has its own transport, so connections are
+// never shared between routes.
+type router struct {
+	routes   []Route
+	targets  map[string]*routeTarget
+	fallback *routeTarget // no route matched
+}
+
+// newRouter creates a router for cfg.Routes. Unrouted traffic goes to
+// fallback; named targets dial through the members of pool.
+func newRouter(cfg *ProxyConfig, pool *Pool, fallback *routeTarget) (*router, error) {
+	direct := directConfig(cfg)
+	r := &router{
+		targets:  make(map[string]*routeTarget),
+		fallback: fallback,
+	}
+	for _, route := range cfg.Routes {
+		route.Hosts = append([]string(nil), route.Hosts...)
+		for i, pattern := range route.Hosts {
+			route.Hosts[i] = strings.ToLower(pattern)
+		}
+		r.routes = append(r.routes, route)
+
+		if _, ok := r.targets[route.Target]; ok || route.Target == RouteReject {
+			continue
+		}
+
+		var dial dialFunc
+		var err error
+		if route.Target != RouteDirect {
+			// Named proxies are dialed as pool members, tunneling HTTP
+			// proxies with CONNECT
+			dial = pool.memberDialer(route.Target)
+		} else if dial, err = newDialer(direct); err != nil {
+			return nil, err
+		}
+		transport, err := createTransport(direct, dial)
+		if err != nil {
+			return nil, err
+		}
+		r.targets[route.Target] = &routeTarget{transport: transport, dial: dial}
+	}
+	return r, nil
+}
+
+// target returns the target for a connection to host, or ErrRouteRejected.
+func (r *router) target(host, urlPath, handler string) (*routeTarget, error) {
+	host = strings.ToLower(host)
+	for i := range r.routes {
+		route := &r.routes[i]
+		if !route.matches(host, urlPath, handler) {
+			continue
+		}
+		if route.Target == RouteReject {
+			return nil, fmt.Errorf("%s: %w", host, ErrRouteRejected)
+		}
+		return r.targets[route.Target], nil
+	}
+	return r.fallback, nil
+}
+
+// RoundTrip sends req through the transport of its route.
+func (r *router) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, err := r.target(req.URL.Hostname(), req.URL.Path, handlerFrom(req.Context()))
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return target.transport.RoundTrip(req)
+}
+
+// DialContext connects to addr through the target of its route.
+func (r *router) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	target, err := r.target(host, "", handlerFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return target.dial(ctx, network, addr)
+}
+
+// CloseIdleConnections closes the idle connections of every target.
+func (r *router) CloseIdleConnections() {
+	r.fallback.transport.CloseIdleConnections()
+	for _, target := range r.targets {
+		target.transport.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// localhost returns addr with its host replaced by "localhost", a second
+// name for local test servers.
+func localhost(t *testing.T, addr string) string {
+	t.Helper()
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("SplitHostPort() error = %v", err)
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+func TestRouteHosts(t *testing.T) {
+	target := echoTarget(t)
+	var routedHits, poolHits atomic.Int32
+	client := newTestClient(t, &ProxyConfig{
+		Upstreams: []UpstreamProxy{
+			{Name: "routed", Type: ProxyTypeHTTP, Address: connectProxy(t, &routedHits), RouteOnly: true},
+			{Name: "pool", Type: ProxyTypeHTTP, Address: connectProxy(t, &poolHits)},
+		},
+		Routes: []Route{
+			{Hosts: []string{"LOCALHOST"}, Target: "routed"},
+			{Hosts: []string{"10.*"}, Target: RouteReject},
+		},
+	})
+
+	for _, addr := range []string{localhost(t, target), target, target} {
+		conn, err := client.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("DialContext(%s) error = %v", addr, err)
+		}
+		assertEcho(t, conn)
+	}
+
+	// Unrouted connections never use the route-only proxy
+	if routedHits.Load() != 1 || poolHits.Load() != 2 {
+		t.Errorf("connections = %d/%d, want 1/2", routedHits.Load(), poolHits.Load())
+	}
+}
+
+func TestRoutePaths(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	var hits atomic.Int32
+	client := newTestClient(t, &ProxyConfig{
+		Type:      ProxyTypeNone,
+		Upstreams: []UpstreamProxy{{Name: "bulk", Type: ProxyTypeHTTP, Address: connectProxy(t, &hits), RouteOnly: true}},
+		Routes:    []Route{{Paths: []string{"/archive/"}, Target: "bulk"}},
+	})
+
+	tests := []struct {
+		path     string
+		wantHits int32
+	}{
+		{"/archive/main.zip", 1},
+		{"/repos/owner/repo", 1},
+		{"/archive/v1.tar.gz", 1}, // reuses the tunnel
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(backend.URL + tt.path)
+		if err != nil {
+			t.Fatalf("Get(%s) error = %v", tt.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tt.path || hits.Load() != tt.wantHits {
+			t.Errorf("Get(%s) = %q with %d tunnels, want %d", tt.path, body, hits.Load(), tt.wantHits)
+		}
+	}
+
+	// Routes with paths never match raw connections
+	conn, err := client.DialContext(context.Background(), "tcp", echoTarget(t))
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	assertEcho(t, conn)
+	if hits.Load() != 1 {
+		t.Errorf("tunnels = %d, want the raw connection to go direct", hits.Load())
+	}
+}
+
+func TestRouteHandlers(t *testing.T) {
+	target := echoTarget(t)
+	var sshHits, apiHits atomic.Int32
+	client := newTestClient(t, &ProxyConfig{
+		Type: ProxyTypeNone,
+		Upstreams: []UpstreamProxy{
+			{Name: "ssh", Type: ProxyTypeHTTP, Address: connectProxy(t, &sshHits), RouteOnly: true},
+			{Name: "api", Type: ProxyTypeHTTP, Address: connectProxy(t, &apiHits), RouteOnly: true},
+		},
+		Routes: []Route{
+			{Handlers: []string{HandlerSSH}, Target: "ssh"},
+			{Handlers: []string{HandlerAPI, HandlerKeys}, Target: "api"},
+		},
+	})
+
+	for _, handler := range []string{HandlerSSH, HandlerKeys, HandlerGit, ""} {
+		conn, err := client.DialContext(WithHandler(context.Background(), handler), "tcp", target)
+		if err != nil {
+			t.Fatalf("DialContext(%q) error = %v", handler, err)
+		}
+		assertEcho(t, conn)
+	}
+
+	if sshHits.Load() != 1 || apiHits.Load() != 1 {
+		t.Errorf("connections = %d/%d, want 1/1", sshHits.Load(), apiHits.Load())
+	}
+}
+
+func TestRouteReject(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("rejected request reached the backend")
+	}))
+	defer backend.Close()
+
+	client := newTestClient(t, &ProxyConfig{
+		Type:   ProxyTypeNone,
+		Routes: []Route{{Hosts: []string{"127.0.0.1"}, Handlers: []string{HandlerGist}, Target: RouteReject}},
+	})
+
+	req, err := http.NewRequestWithContext(WithHandler(context.Background(), HandlerGist), http.MethodGet, backend.URL, nil)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	if _, err := client.Do(req); !errors.Is(err, ErrRouteRejected) {
+		t.Errorf("Do() error = %v, want ErrRouteRejected", err)
+	}
+
+	_, err = client.DialContext(WithHandler(context.Background(), HandlerGist), "tcp", backend.Listener.Addr().String())
+	if !errors.Is(err, ErrRouteRejected) {
+		t.Errorf("DialContext() error = %v, want ErrRouteRejected", err)
+	}
+}
+
+func TestRouteDirect(t *testing.T) {
+	target := echoTarget(t)
+	var hits atomic.Int32
+	client := newTestClient(t, &ProxyConfig{
+		Upstreams: []UpstreamProxy{{Name: "pool", Type: ProxyTypeHTTP, Address: connectProxy(t, &hits)}},
+		Routes:    []Route{{Hosts: []string{"localhost"}, Target: RouteDirect}},
+	})
+
+	conn, err := client.DialContext(context.Background(), "tcp", localhost(t, target))
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	assertEcho(t, conn)
+	if hits.Load() != 0 {
+		t.Errorf("tunnels = %d, want a direct connection", hits.Load())
+	}
+}
+
+func TestRouteValidation(t *testing.T) {
+	upstreams := []UpstreamProxy{{Name: "a", Type: ProxyTypeHTTP, Address: "a:1"}}
+	tests := []struct {
+		name string
+		cfg  ProxyConfig
+	}{
+		{"unknown target", ProxyConfig{Upstreams: upstreams, Routes: []Route{{Target: "b"}}}},
+		{"named target without pool", ProxyConfig{Type: ProxyTypeNone, Routes: []Route{{Target: "a"}}}},
+		{"invalid host pattern", ProxyConfig{Upstreams: upstreams, Routes: []Route{{Hosts: []string{"["}, Target: "a"}}}},
+		{"relative path", ProxyConfig{Upstreams: upstreams, Routes: []Route{{Paths: []string{"repos"}, Target: "a"}}}},
+		{"unknown handler", ProxyConfig{Upstreams: upstreams, Routes: []Route{{Handlers: []string{"web"}, Target: "a"}}}},
+		{"route-only pool without endpoint", ProxyConfig{Type: ProxyTypeHTTP, Upstreams: []UpstreamProxy{{Name: "a", Type: ProxyTypeHTTP, Address: "a:1", RouteOnly: true}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewProxyClient(&tt.cfg); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// segmentAttempts is how often a range is requested before its download
+// fails.
+const segmentAttempts = 3
+
+// segment is a byte range of a segmented download.
+type segment struct {
+	start, end int64 // inclusive
+	done       int64 // bytes downloaded, guarded by segmentedBody.mu
+	err        error // why the download stopped short, guarded by segmentedBody.mu
+}
+
+// segmentedBody is a response body downloaded in parallel byte ranges.
+// The ranges are written to a file as they arrive, and reads return bytes
+// in order as soon as they are contiguous.
+type segmentedBody struct {
+	file        *os.File
+	path        string // where the complete file is kept, or "" to remove it
+	size        int64
+	segmentSize int64
+	segments    []*segment
+	pos         int64 // next byte to read
+
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+
+	mu   sync.Mutex
+	cond *sync.Cond // signaled when a segment progresses or ends
+}
+
+// SegmentedBody returns a body that downloads the rest of resp in parallel
+// byte ranges, or nil if resp is not split: segmented downloads must be
+// enabled, and resp must be a complete, uncompressed 200 response to a GET
+// of at least MinSize bytes that accepts byte ranges and has an ETag or
+// Last-Modified date to validate them. The first range is read from resp
+// itself, which the returned body takes over. Downloads stop when ctx is
+// done or the body is closed.
+//
+// If path is not empty, the ranges are written next to it and the file is
+// moved to path when the body is closed after being read to the end, so a
+// file store can adopt it without another copy. Otherwise they are written
+// to a temporary file in TempDir that is removed on Close.
+func (pc *ProxyClient) SegmentedBody(ctx context.Context, resp *http.Response, path string) io.ReadCloser {
+	cfg := pc.config.Segmented
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if cfg.Segments <= 1 || validator == "" ||
+		resp.ContentLength < max(cfg.MinSize, int64(cfg.Segments)) ||
+		resp.StatusCode != http.StatusOK || resp.Uncompressed ||
+		resp.Request == nil || resp.Request.Method != http.MethodGet ||
+		!strings.Contains(resp.Header.Get("Accept-Ranges"), "bytes") {
+		return nil
+	}
+
+	// Without a file to assemble the ranges in the response is streamed
+	// as usual
+	file, err := createSegmentFile(cfg.TempDir, path)
+	if err != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	b := &segmentedBody{
+		file:        file,
+		path:        path,
+		size:        resp.ContentLength,
+		segmentSize: (resp.ContentLength + int64(cfg.Segments) - 1) / int64(cfg.Segments),
+		cancel:      cancel,
+	}
+	b.cond = sync.NewCond(&b.mu)
+	for start := int64(0); start < b.size; start += b.segmentSize {
+		b.segments = append(b.segments, &segment{start: start, end: min(start+b.segmentSize, b.size) - 1})
+	}
+
+	// The first range continues the response; the others are requested
+	// from where the response was redirected to
+	b.wg.Add(len(b.segments))
+	go b.download(ctx, pc.client, resp.Request, validator, b.segments[0], resp.Body)
+	for _, seg := range b.segments[1:] {
+		go b.download(ctx, pc.client, resp.Request, validator, seg, nil)
+	}
+	return b
+}
+
+// createSegmentFile creates the file ranges are assembled in: a partial
+// file in the directory of path, or a temporary file in tempDir if path is
+// empty. Partial files are unique, so concurrent downloads of the same path
+// do not mix.
+func createSegmentFile(tempDir, path string) (*os.File, error) {
+	if path == "" {
+		return os.CreateTemp(tempDir, "gh-proxy-segments-*")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.part")
+}
+
+// download fetches seg, starting with body if not nil. An interrupted
+// range is requested again from where it stopped.
+func (b *segmentedBody) download(ctx context.Context, client *http.Client, orig *http.Request, validator string, seg *segment, body io.ReadCloser) {
+	defer b.wg.Done()
+
+	var err error
+	for attempt := 0; attempt < segmentAttempts && ctx.Err() == nil; attempt++ {
+		if body == nil {
+			if body, err = b.request(ctx, client, orig, validator, seg); err != nil {
+				continue
+			}
+		}
+		// Bodies of requests made with other contexts stop with ctx too
+		stop := context.AfterFunc(ctx, func() { body.Close() })
+		err = b.fill(seg, body)
+		stop()
+		body.Close()
+		body = nil
+		if err == nil {
+			return
+		}
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	b.mu.Lock()
+	seg.err = fmt.Errorf("bytes %d-%d: %w", seg.start, seg.end, err)
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// request requests the part of seg not downloaded yet. The validator makes
+// sure the range comes from the same version of the resource.
+func (b *segmentedBody) request(ctx context.Context, client *http.Client, orig *http.Request, validator string, seg *segment) (io.ReadCloser, error) {
+	offset := seg.start + seg.done
+	req := orig.Clone(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, seg.end))
+	req.Header.Set("If-Range", validator)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent ||
+		!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", offset, seg.end)) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream did not return bytes %d-%d: %s", offset, seg.end, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// fill writes body to the file at the position of seg until seg is
+// complete.
+func (b *segmentedBody) fill(seg *segment, body io.Reader) error {
+	buf := make([]byte, StreamingBufferSize)
+	for {
+		// Only this goroutine changes seg.done
+		offset := seg.start + seg.done
+		remaining := seg.end + 1 - offset
+		if remaining == 0 {
+			return nil
+		}
+
+		n, err := body.Read(buf[:min(int64(len(buf)), remaining)])
+		if n > 0 {
+			if _, err := b.file.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+			b.mu.Lock()
+			seg.done += int64(n)
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		}
+		if int64(n) == remaining {
+			return nil
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Read reads the next downloaded bytes, waiting for them if necessary.
+func (b *segmentedBody) Read(p []byte) (int, error) {
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	seg := b.segments[b.pos/b.segmentSize]
+	b.mu.Lock()
+	for seg.start+seg.done <= b.pos && seg.err == nil {
+		b.cond.Wait()
+	}
+	available := seg.start + seg.done - b.pos
+	err := seg.err
+	b.mu.Unlock()
+	if available <= 0 {
+		return 0, err
+	}
+
+	n, err := b.file.ReadAt(p[:min(int64(len(p)), available)], b.pos)
+	b.pos += int64(n)
+	return n, err
+}
+
+// Close stops the downloads. A body that was read to the end is moved to
+// its path, if it has one; otherwise the file is removed. Close returns an
+// error if the complete file could not be moved.
+func (b *segmentedBody) Close() error {
+	b.closeOnce.Do(func() {
+		b.cancel()
+		b.wg.Wait()
+		b.closeErr = b.file.Close()
+		if b.path != "" && b.pos == b.size && b.closeErr == nil {
+			if b.closeErr = os.Rename(b.file.Name(), b.path); b.closeErr == nil {
+				return
+			}
+		}
+		os.Remove(b.file.Name())
+	})
+	return b.closeErr
+}
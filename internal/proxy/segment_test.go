@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rangeBackend serves content with ranges, recording the Range header of
+// each request. The first range request is cut off halfway if interrupt is
+// set.
+type rangeBackend struct {
+	content   []byte
+	etag      atomic.Value
+	interrupt atomic.Bool
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (b *rangeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", b.etag.Load().(string))
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader != "" {
+		b.mu.Lock()
+		b.ranges = append(b.ranges, rangeHeader)
+		b.mu.Unlock()
+	}
+
+	var start, end int
+	if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end); err == nil && b.interrupt.CompareAndSwap(true, false) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(b.content)))
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(b.content[start : start+(end-start+1)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b.content))
+}
+
+func (b *rangeBackend) requestedRanges() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ranges := append([]string(nil), b.ranges...)
+	sort.Strings(ranges)
+	return ranges
+}
+
+func newRangeBackend(t *testing.T, size int) (*rangeBackend, *httptest.Server) {
+	t.Helper()
+	b := &rangeBackend{content: make([]byte, size)}
+	for i := range b.content {
+		b.content[i] = byte(i * 7)
+	}
+	b.etag.Store(`"v1"`)
+	server := httptest.NewServer(b)
+	t.Cleanup(server.Close)
+	return b, server
+}
+
+// getSegmented requests url and returns its segmented body, or nil.
+func getSegmented(t *testing.T, client *ProxyClient, url string) (*http.Response, io.ReadCloser) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp, client.SegmentedBody(context.Background(), resp, "")
+}
+
+func TestSegmentedBody(t *testing.T) {
+	backend, server := newRangeBackend(t, 1000000)
+	tempDir := t.TempDir()
+	client := newTestClient(t, &ProxyConfig{Type: ProxyTypeNone, Segmented: SegmentConfig{Segments: 4, MinSize: 1000, TempDir: tempDir}})
+
+	_, body := getSegmented(t, client, server.URL)
+	if body == nil {
+		t.Fatal("SegmentedBody() = nil, want a segmented body")
+	}
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	body.Close()
+
+	if !bytes.Equal(got, backend.content) {
+		t.Errorf("body has %d bytes, want the %d bytes of content in order", len(got), len(backend.content))
+	}
+	want := []string{"bytes=250000-499999", "bytes=500000-749999", "bytes=750000-999999"}
+	if ranges := backend.requestedRanges(); fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Errorf("ranges = %v, want %v", ranges, want)
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestSegmentedBodyToPath(t *testing.T) {
+	backend, server := newRangeBackend(t, 300000)
+	dir := t.TempDir()
+	client := newTestClient(t, &ProxyConfig{Type: ProxyTypeNone, Segmented: SegmentConfig{Segments: 3, MinSize: 1000}})
+
+	tests := []struct {
+		name     string
+		read     int64
+		wantFile bool
+	}{
+		{name: "read to the end", read: 300000, wantFile: true},
+		{name: "closed early", read: 1000, wantFile: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name, "data")
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			defer resp.Body.Close()
+			body := client.SegmentedBody(context.Background(), resp, path)
+			if body == nil {
+				t.Fatal("SegmentedBody() = nil, want a segmented body")
+			}
+			if _, err := io.CopyN(io.Discard, body, tt.read); err != nil {
+				t.Fatalf("CopyN() error = %v", err)
+			}
+			if err := body.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			data, err := os.ReadFile(path)
+			if tt.wantFile && !bytes.Equal(data, backend.content) {
+				t.Errorf("file has %d bytes (error %v), want the %d bytes of content", len(data), err, len(backend.content))
+			}
+			if !tt.wantFile && err == nil {
+				t.Error("file of an incomplete download was kept")
+			}
+			if parts, _ := filepath.Glob(path + ".*.part"); len(parts) != 0 {
+				t.Errorf("partial files left behind: %v", parts)
+			}
+		})
+	}
+}
+
+func TestSegmentedBodyInterrupted(t *testing.T) {
+	backend, server := newRangeBackend(t, 300000)
+	backend.interrupt.Store(true)
+	client := newTestClient(t, &ProxyConfig{Type: ProxyTypeNone, Segmented: SegmentConfig{Segments: 2, MinSize: 1000, TempDir: t.TempDir()}})
+
+	_, body := getSegmented(t, client, server.URL)
+	if body == nil {
+		t.Fatal("SegmentedBody() = nil, want a segmented body")
+	}
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, backend.content) {
+		t.Errorf("body has %d bytes, want the %d bytes of content in order", len(got), len(backend.content))
+	}
+
+	// The cut-off range is requested again from where it stopped
+	want := []string{"bytes=150000-299999", "bytes=225000-299999"}
+	if ranges := backend.requestedRanges(); fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Errorf("ranges = %v, want %v", ranges, want)
+	}
+}
+
+func TestSegmentedBodyChanged(t *testing.T) {
+	backend, server := newRangeBackend(t, 300000)
+	client := newTestClient(t, &ProxyConfig{Type: ProxyTypeNone, Segmented: SegmentConfig{Segments: 3, MinSize: 1000, TempDir: t.TempDir()}})
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The file changes before the ranges are requested
+	backend.etag.Store(`"v2"`)
+	body := client.SegmentedBody(context.Background(), resp, "")
+	if body == nil {
+		t.Fatal("SegmentedBody() = nil, want a segmented body")
+	}
+	defer body.Close()
+	if _, err := io.ReadAll(body); err == nil {
+		t.Error("expected an error when the ranges come from a different version")
+	}
+}
+
+func TestSegmentedBodyNotSplit(t *testing.T) {
+	_, server := newRangeBackend(t, 10000)
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(make([]byte, 10000))
+	}))
+	defer plain.Close()
+	weak := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `W/"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(make([]byte, 10000)))
+	}))
+	defer weak.Close()
+
+	tests := []struct {
+		name string
+		cfg  SegmentConfig
+		url  string
+	}{
+		{"disabled", SegmentConfig{Segments: 1}, server.URL},
+		{"too small", SegmentConfig{Segments: 4, MinSize: 20000}, server.URL},
+		{"no ranges", SegmentConfig{Segments: 4}, plain.URL},
+		{"no validator", SegmentConfig{Segments: 4}, weak.URL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, &ProxyConfig{Type: ProxyTypeNone, Segmented: tt.cfg})
+			if _, body := getSegmented(t, client, tt.url); body != nil {
+				body.Close()
+				t.Error("SegmentedBody() returned a segmented body")
+			}
+		})
+	}
+}
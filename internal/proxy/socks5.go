@@ -2,15 +2,26 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
-	"time"
 
 	"golang.org/x/net/proxy"
 )
 
-// createSOCKS5Dialer creates a SOCKS5 proxy dialer
-func createSOCKS5Dialer(cfg *ProxyConfig) (proxy.Dialer, error) {
+// socks5Dialer connects through a SOCKS5 proxy. It is created once per
+// proxy and shared by all connections.
+type socks5Dialer struct {
+	dialer proxy.ContextDialer
+
+	// localDNS resolves host names locally and gives the proxy an IP;
+	// otherwise the proxy resolves them
+	localDNS bool
+}
+
+// newSOCKS5Dialer creates a SOCKS5 dialer for cfg. The connection to the
+// proxy uses the dial timeout and keep-alive of cfg.
+func newSOCKS5Dialer(cfg *ProxyConfig) (*socks5Dialer, error) {
 	if cfg.Address == "" {
 		return nil, fmt.Errorf("SOCKS5 proxy address is required")
 	}
@@ -24,35 +35,48 @@ func createSOCKS5Dialer(cfg *ProxyConfig) (proxy.Dialer, error) {
 		}
 	}
 
-	// Create base dialer with timeout
-	baseDialer := &net.Dialer{
-		Timeout:   cfg.Timeout,
-		KeepAlive: 30 * time.Second,
-	}
-
 	// Create SOCKS5 dialer
-	dialer, err := proxy.SOCKS5("tcp", cfg.Address, auth, baseDialer)
+	dialer, err := proxy.SOCKS5("tcp", cfg.Address, auth, cfg.netDialer())
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
 	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("SOCKS5 dialer does not support contexts")
+	}
 
-	return dialer, nil
+	return &socks5Dialer{dialer: contextDialer, localDNS: cfg.LocalDNS && cfg.Type == ProxyTypeSOCKS5}, nil
 }
 
-// socks5DialContext creates a DialContext function for SOCKS5 proxy
-func socks5DialContext(cfg *ProxyConfig) func(ctx context.Context, network, addr string) (net.Conn, error) {
-	return func(ctx context.Context, network, addr string) (net.Conn, error) {
-		dialer, err := createSOCKS5Dialer(cfg)
-		if err != nil {
-			return nil, err
-		}
-
-		// Use the SOCKS5 dialer
-		conn, err := dialer.Dial(network, addr)
+// DialContext connects to addr through the proxy. Canceling ctx aborts the
+// dial, including the SOCKS5 handshake.
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 dial failed: %w", err)
+	}
+	if !d.localDNS || net.ParseIP(host) != nil {
+		conn, err := d.dialer.DialContext(ctx, network, addr)
 		if err != nil {
 			return nil, fmt.Errorf("SOCKS5 dial failed: %w", err)
 		}
-
 		return conn, nil
 	}
+
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 dial failed: %w", err)
+	}
+	var errs []error
+	for _, ip := range ips {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("SOCKS5 dial failed: %w", errors.Join(errs...))
 }
@@ -0,0 +1,138 @@
+package rewrite
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+)
+
+// maxURLLength is the longest URL the content rewriter waits for. Longer
+// runs of URL characters are passed through unchanged.
+const maxURLLength = 4096
+
+// urlPattern matches an absolute http(s) URL up to the first character that
+// cannot be part of a URL in typical scripts, markup and prose.
+var urlPattern = regexp.MustCompile("https?://[^\\s\"'<>`(){}\\[\\],;|\\\\]+")
+
+// textTypes are non-text/* media types treated as text.
+var textTypes = map[string]bool{
+	"application/javascript":    true,
+	"application/x-sh":          true,
+	"application/x-shellscript": true,
+	"application/x-yaml":        true,
+	"application/yaml":          true,
+	"application/toml":          true,
+	"application/xml":           true,
+}
+
+// Writer rewrites GitHub URLs in text written to it and streams the result
+// to the underlying writer. Only a possibly incomplete URL at the end of a
+// write is held back until the next write or Close.
+type Writer struct {
+	w       io.Writer
+	rw      *Rewriter
+	base    string
+	pending []byte
+}
+
+// NewWriter returns a Writer that rewrites URLs relative to base, as
+// returned by ProxyBase. Close must be called to flush the remaining input.
+func (rw *Rewriter) NewWriter(w io.Writer, base string) *Writer {
+	return &Writer{w: w, rw: rw, base: base}
+}
+
+// Write rewrites and forwards everything up to the last URL delimiter in p.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+
+	// URLs never contain delimiters, so none can span the last one
+	safe := lastDelimiter(w.pending) + 1
+	final := true
+	if len(w.pending)-safe > maxURLLength {
+		safe = len(w.pending) - maxURLLength
+		final = false
+	}
+	if safe == 0 {
+		return len(p), nil
+	}
+
+	if _, err := w.w.Write(w.rewrite(w.pending[:safe], final)); err != nil {
+		return 0, err
+	}
+	w.pending = append(w.pending[:0], w.pending[safe:]...)
+	return len(p), nil
+}
+
+// Close rewrites and forwards the remaining input.
+func (w *Writer) Close() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	_, err := w.w.Write(w.rewrite(w.pending, true))
+	w.pending = nil
+	return err
+}
+
+// rewrite replaces the GitHub URLs in chunk. If final is false, a URL that
+// runs to the end of chunk may be incomplete and is left alone.
+func (w *Writer) rewrite(chunk []byte, final bool) []byte {
+	matches := urlPattern.FindAllIndex(chunk, -1)
+	if len(matches) == 0 {
+		return chunk
+	}
+
+	out := make([]byte, 0, len(chunk)+len(matches)*len(w.base))
+	last := 0
+	for _, m := range matches {
+		if !final && m[1] == len(chunk) {
+			break
+		}
+		rewritten, ok := w.rw.Rewrite(string(chunk[m[0]:m[1]]), w.base)
+		if !ok {
+			continue
+		}
+		out = append(out, chunk[last:m[0]]...)
+		out = append(out, rewritten...)
+		last = m[1]
+	}
+	return append(out, chunk[last:]...)
+}
+
+// lastDelimiter returns the index of the last byte in p that cannot be part
+// of a URL, or -1.
+func lastDelimiter(p []byte) int {
+	for i := len(p) - 1; i >= 0; i-- {
+		switch p[i] {
+		case ' ', '\t', '\n', '\r', '"', '\'', '<', '>', '`', '(', ')', '{', '}', '[', ']', ',', ';', '|', '\\':
+			return i
+		}
+	}
+	return -1
+}
+
+// IsText reports whether a Content-Type header value describes text that the
+// content rewriter may modify. JSON is excluded; API responses are rewritten
+// field by field instead.
+func IsText(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || textTypes[mediaType]
+}
+
+// ETag derives the entity tag of rewritten content from the upstream tag and
+// the proxy base URL, since both determine the rewritten bytes.
+func ETag(etag, base string) string {
+	if etag == "" {
+		return ""
+	}
+	tag := strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+
+	h := fnv.New32a()
+	h.Write([]byte(base))
+	return fmt.Sprintf(`W/"%s-rw%08x"`, tag, h.Sum32())
+}
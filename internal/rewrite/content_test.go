@@ -0,0 +1,90 @@
+package rewrite
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	rw := New("", GitHubHosts, nil)
+	base := "https://proxy.example.com"
+
+	input := "#!/bin/sh\n" +
+		"URL=\"https://github.com/owner/tool/releases/download/v1.2.3/tool-linux-amd64.tar.gz\"\n" +
+		"curl -fsSL https://raw.githubusercontent.com/owner/tool/main/lib.sh | sh\n" +
+		"curl https://example.com/other.sh\n" +
+		"see (https://api.github.com/repos/owner/tool/releases/latest)"
+
+	want := "#!/bin/sh\n" +
+		"URL=\"https://proxy.example.com/https://github.com/owner/tool/releases/download/v1.2.3/tool-linux-amd64.tar.gz\"\n" +
+		"curl -fsSL https://proxy.example.com/https://raw.githubusercontent.com/owner/tool/main/lib.sh | sh\n" +
+		"curl https://example.com/other.sh\n" +
+		"see (https://proxy.example.com/api/repos/owner/tool/releases/latest)"
+
+	// URLs split across writes must still be rewritten
+	for _, size := range []int{1, 7, 64, len(input)} {
+		var out bytes.Buffer
+		w := rw.NewWriter(&out, base)
+		for i := 0; i < len(input); i += size {
+			end := min(i+size, len(input))
+			if _, err := w.Write([]byte(input[i:end])); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+		if out.String() != want {
+			t.Errorf("write size %d:\ngot  %q\nwant %q", size, out.String(), want)
+		}
+	}
+}
+
+func TestWriterLongRun(t *testing.T) {
+	rw := New("", GitHubHosts, nil)
+
+	// A run of URL characters longer than maxURLLength is streamed unchanged
+	input := "https://github.com/" + strings.Repeat("a", 3*maxURLLength) + " https://github.com/x"
+	var out bytes.Buffer
+	w := rw.NewWriter(&out, "http://p")
+	for i := 0; i < len(input); i += 1000 {
+		w.Write([]byte(input[i:min(i+1000, len(input))]))
+	}
+	w.Close()
+
+	want := "https://github.com/" + strings.Repeat("a", 3*maxURLLength) + " http://p/https://github.com/x"
+	if out.String() != want {
+		t.Errorf("long run was modified or trailing URL not rewritten")
+	}
+}
+
+func TestIsText(t *testing.T) {
+	tests := map[string]bool{
+		"text/plain; charset=utf-8": true,
+		"text/x-shellscript":        true,
+		"application/x-sh":          true,
+		"application/json":          false,
+		"application/octet-stream":  false,
+		"":                          false,
+	}
+	for contentType, want := range tests {
+		if got := IsText(contentType); got != want {
+			t.Errorf("IsText(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	a := ETag(`"abc123"`, "http://a")
+	b := ETag(`W/"abc123"`, "http://b")
+	if !strings.HasPrefix(a, `W/"abc123-rw`) {
+		t.Errorf("ETag() = %q, want a weak tag derived from the original", a)
+	}
+	if a == b {
+		t.Error("ETag() must differ for different proxy base URLs")
+	}
+	if ETag("", "http://a") != "" {
+		t.Error("ETag() of an empty tag must be empty")
+	}
+}
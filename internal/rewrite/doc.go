@@ -0,0 +1,19 @@
+// Package rewrite maps GitHub URLs found in proxied responses to URLs on the
+// proxy, so clients that follow them keep going through gh-proxy.
+//
+// API URLs (api.github.com) map to the /api route; URLs on the other
+// supported GitHub hosts map to the full URL form, e.g.
+//
+//	https://github.com/owner/repo/releases/download/v1/app.tar.gz
+//	  -> https://proxy.example.com/ghproxy/https://github.com/owner/repo/releases/download/v1/app.tar.gz
+//
+// The proxy's own scheme and host come from the incoming request, honouring
+// X-Forwarded-Proto and X-Forwarded-Host when the request comes from a
+// trusted proxy, and the configured base path is prepended.
+//
+// Example usage:
+//
+//	rw := rewrite.New(cfg.Server.BasePath, rewrite.GitHubHosts, trusted)
+//	base := rw.ProxyBase(c.Request)
+//	rw.RewriteHeaders(c.Writer.Header(), base)
+package rewrite
@@ -0,0 +1,100 @@
+package rewrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// RewriteJSON rewrites the string values of the named fields, at any depth
+// of a JSON document, into proxy URLs relative to base. Member order and
+// all other values are preserved; insignificant whitespace is dropped.
+func (rw *Rewriter) RewriteJSON(data []byte, base string, fields []string) ([]byte, error) {
+	names := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		names[field] = true
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var out bytes.Buffer
+	out.Grow(len(data))
+
+	// Each open container records whether it is an object and how many
+	// tokens it has seen, which tells keys from values and where commas go.
+	type frame struct {
+		object bool
+		count  int
+	}
+	var stack []frame
+	var key string
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF && len(stack) == 0 {
+			break
+		}
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if delim, ok := tok.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			out.WriteByte(byte(delim))
+			continue
+		}
+
+		isKey := false
+		if len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if top.object {
+				isKey = top.count%2 == 0
+				switch {
+				case isKey && top.count > 0:
+					out.WriteByte(',')
+				case !isKey:
+					out.WriteByte(':')
+				}
+			} else if top.count > 0 {
+				out.WriteByte(',')
+			}
+			top.count++
+		}
+
+		switch v := tok.(type) {
+		case json.Delim:
+			stack = append(stack, frame{object: v == '{'})
+			out.WriteByte(byte(v))
+			key = ""
+			continue
+		case string:
+			if isKey {
+				key = v
+			} else if names[key] {
+				v, _ = rw.Rewrite(v, base)
+			}
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(encoded)
+		case json.Number:
+			out.WriteString(v.String())
+		case bool:
+			fmt.Fprintf(&out, "%t", v)
+		case nil:
+			out.WriteString("null")
+		}
+
+		if !isKey {
+			key = ""
+		}
+	}
+
+	return out.Bytes(), nil
+}
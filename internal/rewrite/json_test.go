@@ -0,0 +1,59 @@
+package rewrite
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRewriteJSON(t *testing.T) {
+	rw := New("/gh", GitHubHosts, nil)
+	base := "https://proxy.example.com/gh"
+
+	input := `[{
+		"url": "https://api.github.com/repos/o/r/releases/1",
+		"tag_name": "v1.0.0",
+		"draft": false,
+		"id": 12345678901234567890,
+		"body": null,
+		"tarball_url": "https://api.github.com/repos/o/r/tarball/v1.0.0",
+		"zipball_url": "https://api.github.com/repos/o/r/zipball/v1.0.0",
+		"assets": [
+			{"name": "app.tar.gz", "size": 1024, "browser_download_url": "https://github.com/o/r/releases/download/v1.0.0/app.tar.gz"}
+		],
+		"author": {"login": "o", "html_url": "https://github.com/o"},
+		"download_url": "https://example.com/elsewhere"
+	}]`
+
+	fields := []string{"browser_download_url", "tarball_url", "zipball_url", "download_url"}
+	out, err := rw.RewriteJSON([]byte(input), base, fields)
+	if err != nil {
+		t.Fatalf("RewriteJSON() error = %v", err)
+	}
+
+	want := `[{"url":"https://api.github.com/repos/o/r/releases/1","tag_name":"v1.0.0","draft":false,"id":12345678901234567890,"body":null,` +
+		`"tarball_url":"https://proxy.example.com/gh/api/repos/o/r/tarball/v1.0.0",` +
+		`"zipball_url":"https://proxy.example.com/gh/api/repos/o/r/zipball/v1.0.0",` +
+		`"assets":[{"name":"app.tar.gz","size":1024,"browser_download_url":"https://proxy.example.com/gh/https://github.com/o/r/releases/download/v1.0.0/app.tar.gz"}],` +
+		`"author":{"login":"o","html_url":"https://github.com/o"},` +
+		`"download_url":"https://example.com/elsewhere"}]`
+	if string(out) != want {
+		t.Errorf("RewriteJSON() =\n%s\nwant\n%s", out, want)
+	}
+
+	// Without matching fields the document is semantically unchanged
+	out, err = rw.RewriteJSON([]byte(input), base, nil)
+	if err != nil {
+		t.Fatalf("RewriteJSON() error = %v", err)
+	}
+	var got, orig any
+	json.Unmarshal(out, &got)
+	json.Unmarshal([]byte(input), &orig)
+	if !reflect.DeepEqual(got, orig) {
+		t.Errorf("RewriteJSON() changed the document: %s", out)
+	}
+
+	if _, err := rw.RewriteJSON([]byte(`{"a":`), base, nil); err == nil {
+		t.Error("RewriteJSON() accepted truncated JSON")
+	}
+}
@@ -0,0 +1,201 @@
+package rewrite
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// GitHubHosts are the GitHub hosts the proxy can serve in full URL mode.
+var GitHubHosts = []string{
+	"github.com",
+	"raw.githubusercontent.com",
+	"api.github.com",
+	"gist.github.com",
+	"codeload.github.com",           // archive downloads redirected from github.com
+	"objects.githubusercontent.com", // release assets redirected from github.com
+}
+
+// Rewriter maps URLs on a set of GitHub hosts to proxy URLs.
+type Rewriter struct {
+	hosts    map[string]bool
+	basePath string
+	trusted  []netip.Prefix
+}
+
+// New creates a rewriter for the given hosts. basePath is the configured
+// server base path; trusted are the fronting proxies whose forwarded
+// headers are honoured, as returned by ParseTrustedProxies.
+func New(basePath string, hosts []string, trusted []netip.Prefix) *Rewriter {
+	rw := &Rewriter{
+		hosts:    make(map[string]bool, len(hosts)),
+		basePath: NormalizeBasePath(basePath),
+		trusted:  trusted,
+	}
+	for _, host := range hosts {
+		rw.hosts[strings.ToLower(host)] = true
+	}
+	return rw
+}
+
+// BasePath returns the normalized base path of the proxy.
+func (rw *Rewriter) BasePath() string {
+	return rw.basePath
+}
+
+// ProxyBase returns the externally visible base URL of the proxy for a request.
+func (rw *Rewriter) ProxyBase(r *http.Request) string {
+	return BaseURL(r, rw.basePath, rw.trusted)
+}
+
+// Matches reports whether raw is an absolute URL on one of the rewriter's hosts.
+func (rw *Rewriter) Matches(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return rw.hosts[strings.ToLower(u.Hostname())]
+}
+
+// Rewrite returns the proxy URL for raw, relative to base as returned by
+// ProxyBase. It returns raw unchanged and false if raw is not a URL on one
+// of the rewriter's hosts.
+func (rw *Rewriter) Rewrite(raw, base string) (string, bool) {
+	if !rw.Matches(raw) {
+		return raw, false
+	}
+
+	// Work on the original text so the rest of the URL is kept byte for byte
+	_, rest, _ := strings.Cut(raw, "://")
+	host, tail := rest, ""
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		host, tail = rest[:i], rest[i:]
+	}
+
+	if strings.EqualFold(host, "api.github.com") {
+		if !strings.HasPrefix(tail, "/") {
+			tail = "/" + tail
+		}
+		return base + "/api" + tail, true
+	}
+
+	return base + "/https://" + strings.ToLower(host) + tail, true
+}
+
+// RewriteHeaders rewrites the Location and Link headers of a response.
+func (rw *Rewriter) RewriteHeaders(h http.Header, base string) {
+	if location := h.Get("Location"); location != "" {
+		if rewritten, ok := rw.Rewrite(location, base); ok {
+			h.Set("Location", rewritten)
+		}
+	}
+
+	if links := h.Values("Link"); len(links) > 0 {
+		rewritten := make([]string, len(links))
+		for i, link := range links {
+			rewritten[i] = rw.rewriteLink(link, base)
+		}
+		h["Link"] = rewritten
+	}
+}
+
+// rewriteLink rewrites the URI references of a Link header value,
+// e.g. `<https://api.github.com/repositories/1/issues?page=2>; rel="next"`.
+func (rw *Rewriter) rewriteLink(value, base string) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		target, _ := rw.Rewrite(value[start+1:end], base)
+		b.WriteString(value[:start+1])
+		b.WriteString(target)
+		b.WriteByte('>')
+		value = value[end+1:]
+	}
+	b.WriteString(value)
+	return b.String()
+}
+
+// BaseURL returns the externally visible base URL of the proxy for a
+// request, e.g. "https://proxy.example.com/ghproxy". The scheme and host
+// honour X-Forwarded-Proto and X-Forwarded-Host, but only on requests from
+// one of the trusted proxies; anyone else could set them to anything.
+func BaseURL(r *http.Request, basePath string, trusted []netip.Prefix) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+
+	if fromTrustedProxy(r, trusted) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			scheme, _, _ = strings.Cut(proto, ",")
+			scheme = strings.TrimSpace(scheme)
+		}
+		if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+			host, _, _ = strings.Cut(fwd, ",")
+			host = strings.TrimSpace(host)
+		}
+	}
+
+	return scheme + "://" + host + NormalizeBasePath(basePath)
+}
+
+// ParseTrustedProxies parses IP addresses and CIDR ranges of trusted
+// fronting proxies.
+func ParseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// fromTrustedProxy reports whether the peer of r is one of the trusted
+// proxies.
+func fromTrustedProxy(r *http.Request, trusted []netip.Prefix) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeBasePath returns basePath with a leading slash and no trailing
+// slash, or an empty string for the root path.
+func NormalizeBasePath(basePath string) string {
+	basePath = strings.TrimSuffix(basePath, "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	return basePath
+}
@@ -0,0 +1,129 @@
+package rewrite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	rw := New("/ghproxy/", GitHubHosts, nil)
+	base := "https://proxy.example.com/ghproxy"
+
+	tests := []struct {
+		name   string
+		raw    string
+		want   string
+		wantOK bool
+	}{
+		{
+			name:   "github release",
+			raw:    "https://github.com/owner/repo/releases/download/v1/app.tar.gz",
+			want:   base + "/https://github.com/owner/repo/releases/download/v1/app.tar.gz",
+			wantOK: true,
+		},
+		{
+			name:   "renamed repository",
+			raw:    "https://github.com/new-owner/repo.git/info/refs?service=git-upload-pack",
+			want:   base + "/https://github.com/new-owner/repo.git/info/refs?service=git-upload-pack",
+			wantOK: true,
+		},
+		{
+			name:   "raw file",
+			raw:    "https://raw.githubusercontent.com/owner/repo/main/install.sh",
+			want:   base + "/https://raw.githubusercontent.com/owner/repo/main/install.sh",
+			wantOK: true,
+		},
+		{
+			name:   "api pagination",
+			raw:    "https://api.github.com/repositories/1/issues?page=2",
+			want:   base + "/api/repositories/1/issues?page=2",
+			wantOK: true,
+		},
+		{
+			name:   "release asset storage",
+			raw:    "https://objects.githubusercontent.com/github-production-release-asset-2e65be/1/abc?X-Amz-Signature=s",
+			want:   base + "/https://objects.githubusercontent.com/github-production-release-asset-2e65be/1/abc?X-Amz-Signature=s",
+			wantOK: true,
+		},
+		{name: "other host", raw: "https://example.com/x", want: "https://example.com/x"},
+		{name: "relative", raw: "/owner/repo", want: "/owner/repo"},
+		{name: "lookalike host", raw: "https://github.com.evil.example/x", want: "https://github.com.evil.example/x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rw.Rewrite(tt.raw, base)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Rewrite() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRewriteHeaders(t *testing.T) {
+	rw := New("", GitHubHosts, nil)
+	base := "http://proxy.local"
+
+	h := http.Header{}
+	h.Set("Location", "https://github.com/owner/new-name")
+	h.Add("Link", `<https://api.github.com/repos/o/r/releases?page=2>; rel="next", <https://api.github.com/repos/o/r/releases?page=5>; rel="last"`)
+
+	rw.RewriteHeaders(h, base)
+
+	if got, want := h.Get("Location"), "http://proxy.local/https://github.com/owner/new-name"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+	wantLink := `<http://proxy.local/api/repos/o/r/releases?page=2>; rel="next", <http://proxy.local/api/repos/o/r/releases?page=5>; rel="last"`
+	if got := h.Get("Link"); got != wantLink {
+		t.Errorf("Link = %q, want %q", got, wantLink)
+	}
+}
+
+func TestRewriteArchiveRedirect(t *testing.T) {
+	rw := New("", GitHubHosts, nil)
+
+	// github.com archive downloads redirect to codeload.github.com
+	h := http.Header{}
+	h.Set("Location", "https://codeload.github.com/owner/repo/tar.gz/refs/tags/v1.0.0")
+	rw.RewriteHeaders(h, "http://proxy.local")
+
+	if got, want := h.Get("Location"), "http://proxy.local/https://codeload.github.com/owner/repo/tar.gz/refs/tags/v1.0.0"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	forwarded := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "gh.example.com, internal"}
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		basePath string
+		trusted  []string
+		want     string
+	}{
+		{name: "plain", want: "http://proxy.local"},
+		{name: "base path", basePath: "ghproxy/", want: "http://proxy.local/ghproxy"},
+		{name: "forwarded", headers: forwarded, trusted: []string{"192.0.2.0/24"}, want: "https://gh.example.com"},
+		{name: "forwarded by single address", headers: forwarded, trusted: []string{"192.0.2.1"}, want: "https://gh.example.com"},
+		{name: "forwarded by untrusted peer", headers: forwarded, trusted: []string{"127.0.0.1"}, want: "http://proxy.local"},
+		{name: "forwarded without trusted proxies", headers: forwarded, want: "http://proxy.local"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := ParseTrustedProxies(tt.trusted)
+			if err != nil {
+				t.Fatalf("ParseTrustedProxies() error = %v", err)
+			}
+			// httptest requests come from 192.0.2.1
+			r := httptest.NewRequest("GET", "http://proxy.local/x", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := BaseURL(r, tt.basePath, trusted); got != tt.want {
+				t.Errorf("BaseURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
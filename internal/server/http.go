@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -11,11 +12,15 @@ import (
 	"github.com/LZUOSS/gh-proxy/internal/auth"
 	"github.com/LZUOSS/gh-proxy/internal/cache"
 	"github.com/LZUOSS/gh-proxy/internal/config"
+	"github.com/LZUOSS/gh-proxy/internal/filestore"
 	"github.com/LZUOSS/gh-proxy/internal/handler"
 	"github.com/LZUOSS/gh-proxy/internal/metrics"
 	"github.com/LZUOSS/gh-proxy/internal/middleware"
+	"github.com/LZUOSS/gh-proxy/internal/mirror"
+	"github.com/LZUOSS/gh-proxy/internal/policy"
 	"github.com/LZUOSS/gh-proxy/internal/proxy"
 	"github.com/LZUOSS/gh-proxy/internal/ratelimit"
+	"github.com/LZUOSS/gh-proxy/internal/rewrite"
 	"go.uber.org/zap"
 	"golang.org/x/time/rate"
 )
@@ -27,8 +32,14 @@ type HTTPServer struct {
 	config       *config.Config
 	proxyClient  *proxy.ProxyClient
 	cache        *cache.Cache
+	files        *filestore.Store // nil without a disk cache
 	rateLimiter  *ratelimit.RateLimiter
 	authCache    *auth.Cache
+	mirrors      *mirror.Manager
+	rewriter     *rewrite.Rewriter
+	gitHandler   *handler.GitHandler
+	lfsHandler   *handler.LFSHandler
+	apiHandler   *handler.APIHandler
 	logger       *zap.Logger
 }
 
@@ -46,14 +57,58 @@ func NewHTTPServer(cfg *config.Config) (*HTTPServer, error) {
 		Address:             cfg.Proxy.Address,
 		Username:            cfg.Proxy.Username,
 		Password:            cfg.Proxy.Password,
+		LocalDNS:            cfg.Proxy.LocalDNS,
 		Timeout:             cfg.Proxy.Timeout,
+		DialTimeout:         cfg.Proxy.DialTimeout,
+		KeepAlive:           cfg.Proxy.KeepAlive,
+		IdleConnTimeout:     cfg.Proxy.IdleConnTimeout,
 		MaxIdleConns:        cfg.Proxy.MaxIdleConns,
 		MaxIdleConnsPerHost: cfg.Proxy.MaxIdleConnsPerHost,
+		Retry: proxy.RetryConfig{
+			MaxAttempts:    cfg.Proxy.Retry.MaxAttempts,
+			InitialBackoff: cfg.Proxy.Retry.InitialBackoff,
+			MaxBackoff:     cfg.Proxy.Retry.MaxBackoff,
+			Resume:         cfg.Proxy.Retry.Resume,
+		},
+		Segmented: proxy.SegmentConfig{
+			Segments: cfg.Proxy.Segmented.Segments,
+			MinSize:  cfg.Proxy.Segmented.MinSize,
+			TempDir:  cfg.Proxy.Segmented.TempDir,
+		},
 	}
 
 	// If proxy is not enabled, use direct connection
 	if !cfg.Proxy.Enabled {
 		proxyConfig.Type = proxy.ProxyTypeNone
+	} else {
+		proxyConfig.Strategy = proxy.Strategy(cfg.Proxy.Strategy)
+		proxyConfig.FallbackDirect = cfg.Proxy.FallbackDirect
+		proxyConfig.HealthCheck = proxy.HealthCheckConfig{
+			Interval:    cfg.Proxy.HealthCheck.Interval,
+			Timeout:     cfg.Proxy.HealthCheck.Timeout,
+			Target:      cfg.Proxy.HealthCheck.Target,
+			MaxFails:    cfg.Proxy.HealthCheck.MaxFails,
+			FailTimeout: cfg.Proxy.HealthCheck.FailTimeout,
+		}
+		for _, upstream := range cfg.Proxy.Upstreams {
+			proxyConfig.Upstreams = append(proxyConfig.Upstreams, proxy.UpstreamProxy{
+				Name:      upstream.Name,
+				Type:      proxy.ProxyType(upstream.Type),
+				Address:   upstream.Address,
+				Username:  upstream.Username,
+				Password:  upstream.Password,
+				Weight:    upstream.Weight,
+				RouteOnly: upstream.RouteOnly,
+			})
+		}
+		for _, route := range cfg.Proxy.Routes {
+			proxyConfig.Routes = append(proxyConfig.Routes, proxy.Route{
+				Hosts:    route.Hosts,
+				Paths:    route.Paths,
+				Handlers: route.Handlers,
+				Target:   route.Target,
+			})
+		}
 	}
 
 	proxyClient, err := proxy.NewProxyClient(proxyConfig)
@@ -83,6 +138,16 @@ func NewHTTPServer(cfg *config.Config) (*HTTPServer, error) {
 		return nil, fmt.Errorf("failed to create cache: %w", err)
 	}
 
+	// Files too large to hold in memory, such as LFS objects, are cached
+	// next to the disk cache
+	var files *filestore.Store
+	if cacheConfig.EnableDisk {
+		files, err = filestore.New(filepath.Join(cfg.Cache.DiskPath, "files"), cfg.Cache.MaxDiskSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create file store: %w", err)
+		}
+	}
+
 	// Initialize rate limiter
 	var rateLimiter *ratelimit.RateLimiter
 	if cfg.RateLimit.Enabled {
@@ -92,12 +157,19 @@ func NewHTTPServer(cfg *config.Config) (*HTTPServer, error) {
 		)
 	}
 
-	// Initialize auth cache
-	var authCache *auth.Cache
-	if cfg.Auth.Enabled {
-		authCache = auth.NewCache(1 * time.Hour)
-		// Start cleanup task
-		authCache.StartCleanupTask(10 * time.Minute)
+	// Initialize auth cache. The Git handlers also use it to identify
+	// pushing clients when authentication is disabled.
+	authCache := auth.NewCache(1 * time.Hour)
+	// Start cleanup task
+	authCache.StartCleanupTask(10 * time.Minute)
+
+	// Initialize local Git mirrors
+	var mirrors *mirror.Manager
+	if cfg.Git.Mirror.Enabled {
+		mirrors, err = mirror.NewManager(&cfg.Git.Mirror, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create mirror manager: %w", err)
+		}
 	}
 
 	// Initialize Prometheus metrics if enabled
@@ -105,13 +177,22 @@ func NewHTTPServer(cfg *config.Config) (*HTTPServer, error) {
 		metrics.InitPrometheus()
 	}
 
+	// GitHub URLs in responses are mapped to proxy URLs under the base path
+	trustedProxies, err := rewrite.ParseTrustedProxies(cfg.Server.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trusted proxies: %w", err)
+	}
+
 	// Create HTTP server instance
 	httpServer := &HTTPServer{
 		config:      cfg,
 		proxyClient: proxyClient,
 		cache:       cacheSystem,
+		files:       files,
 		rateLimiter: rateLimiter,
 		authCache:   authCache,
+		mirrors:     mirrors,
+		rewriter:    rewrite.New(cfg.Server.BasePath, rewrite.GitHubHosts, trustedProxies),
 		logger:      logger,
 	}
 
@@ -133,6 +214,16 @@ func (s *HTTPServer) setupRouter() {
 	// Create router
 	router := gin.New()
 
+	// The Git, LFS and API handlers are shared by path-based routes and full URL mode
+	s.gitHandler = handler.NewGitHandler(s.proxyClient, "", &s.config.Git, s.mirrors,
+		policy.NewPushPolicy(&s.config.Git.Push, s.logger), s.authCache)
+	s.lfsHandler = handler.NewLFSHandler(s.files, s.proxyClient, s.gitHandler, s.rewriter)
+	if s.config.Rewrite.API.Enabled {
+		s.apiHandler = handler.NewAPIHandler(s.cache, s.proxyClient, "", s.rewriter, s.config.Rewrite.API.Fields)
+	} else {
+		s.apiHandler = handler.NewAPIHandler(s.cache, s.proxyClient, "", nil, nil)
+	}
+
 	// Setup middleware in order
 	router.Use(middleware.Recovery(s.logger))
 	router.Use(middleware.Logging(s.logger))
@@ -148,10 +239,19 @@ func (s *HTTPServer) setupRouter() {
 		router.Use(middleware.RateLimit(s.rateLimiter))
 	}
 
+	router.Use(middleware.ContextAuth())
 	if s.config.Auth.Enabled && s.authCache != nil {
 		router.Use(middleware.Auth(&s.config.Auth, s.authCache, s.logger))
 	}
 
+	// Response rewriting must wrap both full URL mode and the routes
+	if s.config.Server.RewriteRedirects {
+		router.Use(middleware.RewriteRedirects(s.rewriter))
+	}
+	if s.config.Rewrite.Content.Enabled {
+		router.Use(middleware.RewriteContent(s.rewriter, &s.config.Rewrite.Content))
+	}
+
 	// Full URL handler middleware - must be before routing
 	// Handles paths containing :// (full URLs with schemes)
 	router.Use(s.fullURLMiddleware())
@@ -165,7 +265,7 @@ func (s *HTTPServer) setupRouter() {
 // fullURLMiddleware handles requests with full GitHub URLs (containing ://)
 // This must run before routing to avoid conflicts with :owner/:repo routes
 func (s *HTTPServer) fullURLMiddleware() gin.HandlerFunc {
-	urlHandler := handler.NewURLHandler(s.cache, s.proxyClient)
+	urlHandler := handler.NewURLHandler(s.cache, s.files, s.proxyClient, s.gitHandler, s.lfsHandler, s.apiHandler)
 
 	return func(c *gin.Context) {
 		path := c.Request.URL.Path
@@ -222,13 +322,14 @@ func (s *HTTPServer) fullURLMiddleware() gin.HandlerFunc {
 // setupRoutes defines all HTTP routes.
 func (s *HTTPServer) setupRoutes(router *gin.Engine) {
 	// Initialize handlers
-	releasesHandler := handler.NewReleasesHandler(s.cache, s.proxyClient)
+	releasesHandler := handler.NewReleasesHandler(s.cache, s.files, s.proxyClient)
 	rawHandler := handler.NewRawHandler(s.cache, s.proxyClient)
 	archiveHandler := handler.NewArchiveHandler(s.cache, s.proxyClient)
-	gitHandler := handler.NewGitHandler(s.proxyClient, "")
+	gitHandler := s.gitHandler
 	gistHandler := handler.NewGistHandler(s.cache, s.proxyClient)
-	apiHandler := handler.NewAPIHandler(s.cache, s.proxyClient, "")
-	urlHandler := handler.NewURLHandler(s.cache, s.proxyClient)
+	apiHandler := s.apiHandler
+	lfsHandler := s.lfsHandler
+	urlHandler := handler.NewURLHandler(s.cache, s.files, s.proxyClient, s.gitHandler, s.lfsHandler, s.apiHandler)
 
 	// Determine the base path
 	basePath := s.config.Server.BasePath
@@ -263,6 +364,13 @@ func (s *HTTPServer) setupRoutes(router *gin.Engine) {
 	routeGroup.GET("/:owner/:repo/info/refs", gitHandler.HandleInfoRefs)
 	routeGroup.POST("/:owner/:repo/git-upload-pack", gitHandler.HandleUploadPack)
 	routeGroup.POST("/:owner/:repo/git-receive-pack", gitHandler.HandleReceivePack)
+	if s.mirrors != nil {
+		routeGroup.POST("/:owner/:repo/mirror/refresh", gitHandler.HandleMirrorRefresh)
+	}
+
+	// Git LFS routes
+	routeGroup.POST("/:owner/:repo/info/lfs/objects/batch", lfsHandler.HandleBatch)
+	routeGroup.GET("/:owner/:repo/info/lfs/objects/:oid", lfsHandler.HandleObject)
 
 	// Gist routes
 	routeGroup.GET("/gist/:user/:gist_id/raw/:file", gistHandler.Handle)
@@ -277,6 +385,8 @@ func (s *HTTPServer) setupRoutes(router *gin.Engine) {
 	routeGroup.GET("/raw.githubusercontent.com/*url", urlHandler.Handle)
 	routeGroup.GET("/api.github.com/*url", urlHandler.Handle)
 	routeGroup.GET("/gist.github.com/*url", urlHandler.Handle)
+	routeGroup.GET("/codeload.github.com/*url", urlHandler.Handle)
+	routeGroup.GET("/objects.githubusercontent.com/*url", urlHandler.Handle)
 
 	// Health check endpoint (always at root + base path)
 	if basePath != "" {
@@ -304,7 +414,13 @@ func isGitHubURL(path string) bool {
 		strings.HasPrefix(path, "api.github.com/") ||
 		strings.HasPrefix(path, "http://gist.github.com/") ||
 		strings.HasPrefix(path, "https://gist.github.com/") ||
-		strings.HasPrefix(path, "gist.github.com/")
+		strings.HasPrefix(path, "gist.github.com/") ||
+		strings.HasPrefix(path, "http://codeload.github.com/") ||
+		strings.HasPrefix(path, "https://codeload.github.com/") ||
+		strings.HasPrefix(path, "codeload.github.com/") ||
+		strings.HasPrefix(path, "http://objects.githubusercontent.com/") ||
+		strings.HasPrefix(path, "https://objects.githubusercontent.com/") ||
+		strings.HasPrefix(path, "objects.githubusercontent.com/")
 }
 
 // handleHealth handles health check requests.
@@ -315,6 +431,23 @@ func (s *HTTPServer) handleHealth(c *gin.Context) {
 	})
 }
 
+// Logger returns the server's structured logger so other subsystems can share it.
+func (s *HTTPServer) Logger() *zap.Logger {
+	return s.logger
+}
+
+// ProxyClient returns the server's outbound client so other subsystems reach
+// GitHub through the same proxy settings.
+func (s *HTTPServer) ProxyClient() *proxy.ProxyClient {
+	return s.proxyClient
+}
+
+// Handler returns the server's router, which the SSH bridge serves
+// in-process.
+func (s *HTTPServer) Handler() http.Handler {
+	return s.router
+}
+
 // Start starts the HTTP server.
 func (s *HTTPServer) Start() error {
 	// Create HTTP server
@@ -342,6 +475,11 @@ func (s *HTTPServer) Start() error {
 		zap.Duration("write_timeout", s.config.Server.WriteTimeout),
 	)
 
+	// Start refreshing local Git mirrors
+	if s.mirrors != nil {
+		s.mirrors.Start()
+	}
+
 	// Start server
 	if s.config.Server.EnableHTTPS {
 		return s.server.ListenAndServeTLS(
@@ -367,6 +505,11 @@ func (s *HTTPServer) Shutdown(ctx context.Context) error {
 		return err
 	}
 
+	// Stop mirror refreshes
+	if s.mirrors != nil {
+		s.mirrors.Stop()
+	}
+
 	// Close proxy client connections
 	if s.proxyClient != nil {
 		s.proxyClient.Close()
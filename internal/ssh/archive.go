@@ -0,0 +1,427 @@
+package ssh
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/LZUOSS/gh-proxy/internal/auth"
+	"github.com/LZUOSS/gh-proxy/internal/pktline"
+	"github.com/LZUOSS/gh-proxy/internal/proxy"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxArchiveArgs limits the arguments a client may send, as git does.
+const maxArchiveArgs = 64
+
+// archiveFormats are the formats offered to remote clients.
+var archiveFormats = []string{"tar", "tgz", "tar.gz", "zip"}
+
+// archiveRefPattern matches the refs the archive endpoint can serve.
+var archiveRefPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// Archiver serves git-upload-archive from the HTTP archive endpoint. The
+// GitHub tarball is fetched through the proxy's own handler, sharing its
+// cache and ProxyClient, and converted to the format and prefix requested
+// by `git archive --remote`. A token given as the SSH password is passed
+// to the handler, which fetches archives of private repositories with it.
+type Archiver struct {
+	handler  http.Handler
+	basePath string
+	logger   *zap.Logger
+}
+
+// NewArchiver creates an archiver using handler, the HTTP server's router
+// mounted at basePath. Failed requests are logged to logger if it is not
+// nil.
+func NewArchiver(handler http.Handler, basePath string, logger *zap.Logger) *Archiver {
+	basePath = strings.TrimSuffix(basePath, "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &Archiver{handler: handler, basePath: basePath, logger: logger}
+}
+
+// archiveOptions are the parsed git-upload-archive arguments.
+type archiveOptions struct {
+	format string
+	prefix string
+	level  int // compression level, -1 for the default
+	ref    string
+	paths  []string
+	list   bool
+}
+
+// Serve runs git-upload-archive for the session's identity and returns the
+// exit status. token is the identity established by SSH authentication, or
+// nil. The archive request is cancelled with ctx.
+func (a *Archiver) Serve(ctx context.Context, channel ssh.Channel, gitCmd *GitCommand, token *auth.Token, remoteAddr string) int {
+	out := bufio.NewWriterSize(channel, pktline.MaxPacketSize)
+	defer out.Flush()
+	enc := pktline.NewEncoder(out)
+	logger := a.logger.With(
+		zap.String("remote_addr", remoteAddr),
+		zap.String("command", gitCmd.String()),
+	)
+
+	args, err := readArchiveArgs(pktline.NewDecoder(channel))
+	if err != nil {
+		logger.Info("failed to read git-upload-archive arguments", zap.Error(err))
+		return 1
+	}
+
+	opts, err := parseArchiveArgs(args)
+	if err != nil {
+		nack(enc, err)
+		return 1
+	}
+
+	if opts.list {
+		enc.EncodeString("ACK\n")
+		enc.Flush()
+		enc.Sideband(pktline.BandData, []byte(strings.Join(archiveFormats, "\n")+"\n"))
+		enc.Flush()
+		return 0
+	}
+
+	body, err := a.fetch(ctx, gitCmd, opts.ref, token, remoteAddr)
+	if err != nil {
+		logger.Info("failed to fetch archive", zap.String("ref", opts.ref), zap.Error(err))
+		nack(enc, err)
+		return 1
+	}
+	defer body.Close()
+
+	enc.EncodeString("ACK\n")
+	enc.Flush()
+
+	data := &sidebandWriter{enc: enc, band: pktline.BandData}
+	if err := convertArchive(data, body, opts); err != nil {
+		logger.Info("failed to convert archive", zap.String("ref", opts.ref), zap.Error(err))
+		enc.Sideband(pktline.BandError, []byte("fatal: "+err.Error()+"\n"))
+		enc.Flush()
+		return 1
+	}
+	enc.Flush()
+	return 0
+}
+
+// nack rejects the request with a message the client prints.
+func nack(enc *pktline.Encoder, err error) {
+	enc.EncodeString("NACK " + err.Error() + "\n")
+	enc.Flush()
+}
+
+// readArchiveArgs reads the "argument" pkt-lines up to the flush-pkt.
+func readArchiveArgs(dec *pktline.Decoder) ([]string, error) {
+	var args []string
+	for {
+		pkt, err := dec.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read arguments: %w", err)
+		}
+		if pkt.Type == pktline.Flush {
+			return args, nil
+		}
+
+		arg, ok := strings.CutPrefix(strings.TrimSuffix(string(pkt.Payload), "\n"), "argument ")
+		if !ok {
+			return nil, fmt.Errorf("expected an argument, got %q", pkt.Payload)
+		}
+		if len(args) >= maxArchiveArgs {
+			return nil, fmt.Errorf("too many arguments")
+		}
+		args = append(args, arg)
+	}
+}
+
+// parseArchiveArgs parses the options of `git archive` that apply to a
+// remote archive.
+func parseArchiveArgs(args []string) (*archiveOptions, error) {
+	opts := &archiveOptions{format: "tar", level: -1}
+	positional := false
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if positional || !strings.HasPrefix(arg, "-") {
+			if opts.ref == "" {
+				opts.ref = arg
+			} else {
+				opts.paths = append(opts.paths, strings.Trim(arg, "/"))
+			}
+			continue
+		}
+
+		// Options with a separate value
+		if (arg == "--format" || arg == "--prefix") && i+1 < len(args) {
+			i++
+			arg += "=" + args[i]
+		}
+
+		switch {
+		case arg == "--":
+			positional = true
+		case strings.HasPrefix(arg, "--format="):
+			opts.format = strings.TrimPrefix(arg, "--format=")
+			if !isArchiveFormat(opts.format) {
+				return nil, fmt.Errorf("unsupported archive format %q (supported: %s)", opts.format, strings.Join(archiveFormats, ", "))
+			}
+		case strings.HasPrefix(arg, "--prefix="):
+			opts.prefix = strings.TrimPrefix(arg, "--prefix=")
+		case len(arg) == 2 && arg[1] >= '0' && arg[1] <= '9':
+			opts.level = int(arg[1] - '0')
+		case arg == "-l" || arg == "--list":
+			opts.list = true
+		case arg == "-v" || arg == "--verbose" || arg == "--worktree-attributes":
+			// No effect on the generated archive
+		default:
+			return nil, fmt.Errorf("unsupported option %s", arg)
+		}
+	}
+
+	if opts.list {
+		return opts, nil
+	}
+	if opts.ref == "" {
+		return nil, fmt.Errorf("a tree-ish is required")
+	}
+
+	ref := opts.ref
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		ref = strings.TrimPrefix(ref, prefix)
+	}
+	if !archiveRefPattern.MatchString(ref) || strings.Contains(ref, "..") {
+		return nil, fmt.Errorf("unsupported tree-ish %q (use a branch, tag or commit without '/')", opts.ref)
+	}
+	opts.ref = ref
+
+	return opts, nil
+}
+
+// isArchiveFormat reports whether format is offered to remote clients.
+func isArchiveFormat(format string) bool {
+	for _, f := range archiveFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch requests the tarball of ref from the archive endpoint. It returns
+// the response body once the endpoint answered successfully.
+func (a *Archiver) fetch(ctx context.Context, gitCmd *GitCommand, ref string, token *auth.Token, remoteAddr string) (io.ReadCloser, error) {
+	target := fmt.Sprintf("http://ssh-archive%s/%s/%s/archive/%s.tar.gz", a.basePath, gitCmd.Owner, gitCmd.Repo, ref)
+
+	// SSH clients cannot follow a redirect, so the proxy does
+	ctx = proxy.FollowRedirects(ctx)
+	if token != nil {
+		ctx = auth.NewContext(ctx, token)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("User-Agent", "git/github-reverse-proxy-ssh")
+
+	pr, pw := io.Pipe()
+	w := &bridgeResponseWriter{header: make(http.Header), out: pw, started: make(chan struct{})}
+	go func() {
+		a.handler.ServeHTTP(w, req)
+		w.WriteHeader(http.StatusOK)
+		w.start()
+		pw.Close()
+	}()
+
+	<-w.started
+	if w.status != http.StatusOK {
+		pr.Close()
+		return nil, bridgeError(w.status, w.errBody.Bytes())
+	}
+	return pr, nil
+}
+
+// sidebandWriter writes to a side-band channel.
+type sidebandWriter struct {
+	enc  *pktline.Encoder
+	band byte
+}
+
+// Write writes p on the side-band channel.
+func (w *sidebandWriter) Write(p []byte) (int, error) {
+	if err := w.enc.Sideband(w.band, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// archiveEntry is a tarball entry renamed for the requested archive.
+type archiveEntry struct {
+	header *tar.Header
+	name   string
+}
+
+// convertArchive converts a GitHub tar.gz archive to the requested format.
+// GitHub puts all files below a "<repo>-<sha>/" directory; it is replaced
+// by the requested prefix, and entries outside the requested paths are
+// skipped. The commit id GitHub stores in the global header is kept.
+func convertArchive(dst io.Writer, src io.Reader, opts *archiveOptions) error {
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	next := func() (*archiveEntry, error) {
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				return nil, err
+			}
+			if hdr.Typeflag == tar.TypeXGlobalHeader {
+				return &archiveEntry{header: hdr}, nil
+			}
+
+			_, rest, _ := strings.Cut(hdr.Name, "/")
+			if rest == "" || !inArchivePaths(strings.TrimSuffix(rest, "/"), opts.paths) {
+				continue
+			}
+			return &archiveEntry{header: hdr, name: opts.prefix + rest}, nil
+		}
+	}
+
+	switch opts.format {
+	case "zip":
+		return writeZip(dst, tr, next, opts.level)
+	case "tgz", "tar.gz":
+		level := opts.level
+		if level < 0 {
+			level = gzip.DefaultCompression
+		}
+		zw, err := gzip.NewWriterLevel(dst, level)
+		if err != nil {
+			return err
+		}
+		if err := writeTar(zw, tr, next); err != nil {
+			return err
+		}
+		return zw.Close()
+	default:
+		return writeTar(dst, tr, next)
+	}
+}
+
+// inArchivePaths reports whether name is one of paths or below one of them.
+// No paths include everything.
+func inArchivePaths(name string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		if name == p || strings.HasPrefix(name, p+"/") || strings.HasPrefix(p, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTar writes the entries as a tar archive.
+func writeTar(dst io.Writer, src io.Reader, next func() (*archiveEntry, error)) error {
+	tw := tar.NewWriter(dst)
+	for {
+		entry, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		hdr := *entry.header
+		if hdr.Typeflag != tar.TypeXGlobalHeader {
+			hdr.Name = entry.name
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, src); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeZip writes the entries as a zip archive, compressed at level.
+func writeZip(dst io.Writer, src io.Reader, next func() (*archiveEntry, error), level int) error {
+	zw := zip.NewWriter(dst)
+	if level > 0 {
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+	}
+
+	for {
+		entry, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		hdr := entry.header
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			// git stores the commit id as the zip comment
+			if comment := hdr.PAXRecords["comment"]; comment != "" {
+				zw.SetComment(comment)
+			}
+			continue
+		}
+
+		zh := &zip.FileHeader{Name: entry.name, Modified: hdr.ModTime, Method: zip.Deflate}
+		if level == 0 {
+			zh.Method = zip.Store
+		}
+
+		var content io.Reader = src
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			zh.Method = zip.Store
+			zh.SetMode(os.ModeDir | 0o755)
+		case tar.TypeSymlink:
+			zh.Method = zip.Store
+			zh.SetMode(os.ModeSymlink | 0o777)
+			content = strings.NewReader(hdr.Linkname)
+		case tar.TypeReg:
+			zh.SetMode(os.FileMode(hdr.Mode) & 0o777)
+		default:
+			continue
+		}
+
+		w, err := zw.CreateHeader(zh)
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			if _, err := io.Copy(w, content); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,219 @@
+package ssh
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/pktline"
+)
+
+// githubTarball builds a tar.gz laid out like GitHub's archive downloads.
+func githubTarball(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	entries := []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "0123456789abcdef0123456789abcdef01234567"}},
+		{Typeflag: tar.TypeDir, Name: "repo-0123456/", Mode: 0o775, ModTime: mtime},
+		{Typeflag: tar.TypeReg, Name: "repo-0123456/README.md", Mode: 0o664, ModTime: mtime, Size: 6},
+		{Typeflag: tar.TypeDir, Name: "repo-0123456/src/", Mode: 0o775, ModTime: mtime},
+		{Typeflag: tar.TypeReg, Name: "repo-0123456/src/main.go", Mode: 0o664, ModTime: mtime, Size: 13},
+		{Typeflag: tar.TypeSymlink, Name: "repo-0123456/link", Linkname: "README.md", Mode: 0o777, ModTime: mtime},
+	}
+	contents := map[string]string{
+		"repo-0123456/README.md":   "hello\n",
+		"repo-0123456/src/main.go": "package main\n",
+	}
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() error = %v", err)
+		}
+		io.WriteString(tw, contents[hdr.Name])
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// archiveBackend serves the tarball of owner/repo at ref v1.0.
+func archiveBackend(t *testing.T) http.Handler {
+	tarball := githubTarball(t)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gh/owner/repo/archive/v1.0.tar.gz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(tarball)
+	})
+}
+
+// readArchiveResponse decodes a git-upload-archive response into the
+// ACK/NACK line, the archive data and the error message, if any.
+func readArchiveResponse(t *testing.T, out []byte) (string, []byte, string) {
+	t.Helper()
+	dec := pktline.NewDecoder(bytes.NewReader(out))
+
+	pkt, err := dec.Next()
+	if err != nil {
+		t.Fatalf("reading ACK: %v", err)
+	}
+	status := strings.TrimSuffix(string(pkt.Payload), "\n")
+	if pkt, err := dec.Next(); err != nil || pkt.Type != pktline.Flush {
+		t.Fatalf("expected a flush after %q", status)
+	}
+	if status != "ACK" {
+		return status, nil, ""
+	}
+
+	var data bytes.Buffer
+	var errMsg string
+	for {
+		pkt, err := dec.Next()
+		if err != nil {
+			t.Fatalf("reading side-band: %v", err)
+		}
+		if pkt.Type == pktline.Flush {
+			return status, data.Bytes(), errMsg
+		}
+		switch pkt.Payload[0] {
+		case pktline.BandData:
+			data.Write(pkt.Payload[1:])
+		case pktline.BandError:
+			errMsg += string(pkt.Payload[1:])
+		}
+	}
+}
+
+func runArchive(t *testing.T, args ...string) (int, string, []byte, string) {
+	t.Helper()
+	var lines []string
+	for _, arg := range args {
+		lines = append(lines, "argument "+arg+"\n")
+	}
+	channel := &testChannel{in: strings.NewReader(pkts(append(lines, "")...))}
+
+	gitCmd := &GitCommand{Operation: "git-upload-archive", Owner: "owner", Repo: "repo"}
+	code := NewArchiver(archiveBackend(t), "gh", nil).Serve(context.Background(), channel, gitCmd, nil, "192.0.2.1:1234")
+	status, data, errMsg := readArchiveResponse(t, channel.out.Bytes())
+	return code, status, data, errMsg
+}
+
+func TestArchiverTar(t *testing.T) {
+	code, status, data, errMsg := runArchive(t, "--format=tar", "--prefix=project/", "refs/tags/v1.0")
+	if code != 0 || status != "ACK" || errMsg != "" {
+		t.Fatalf("Serve() = %d, %q, error %q", code, status, errMsg)
+	}
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	var names []string
+	files := make(map[string]string)
+	comment := ""
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			comment = hdr.PAXRecords["comment"]
+			continue
+		}
+		names = append(names, hdr.Name)
+		content, _ := io.ReadAll(tr)
+		files[hdr.Name] = string(content)
+	}
+
+	want := []string{"project/README.md", "project/link", "project/src/", "project/src/main.go"}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("entries = %v, want %v", names, want)
+	}
+	if files["project/src/main.go"] != "package main\n" {
+		t.Errorf("main.go = %q", files["project/src/main.go"])
+	}
+	if comment != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("commit comment = %q", comment)
+	}
+}
+
+func TestArchiverZipWithPaths(t *testing.T) {
+	code, status, data, errMsg := runArchive(t, "--format=zip", "-9", "v1.0", "src")
+	if code != 0 || status != "ACK" || errMsg != "" {
+		t.Fatalf("Serve() = %d, %q, error %q", code, status, errMsg)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if want := []string{"src/", "src/main.go"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("entries = %v, want %v", names, want)
+	}
+	if zr.Comment != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("zip comment = %q", zr.Comment)
+	}
+}
+
+func TestArchiverTgz(t *testing.T) {
+	code, status, data, _ := runArchive(t, "--format", "tgz", "v1.0")
+	if code != 0 || status != "ACK" {
+		t.Fatalf("Serve() = %d, %q", code, status)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	tr := tar.NewReader(gz)
+	if _, err := tr.Next(); err != nil {
+		t.Errorf("reading tgz: %v", err)
+	}
+}
+
+func TestArchiverRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "unknown format", args: []string{"--format=7z", "v1.0"}, want: "unsupported archive format"},
+		{name: "unsupported option", args: []string{"--remote=other", "v1.0"}, want: "unsupported option"},
+		{name: "missing tree-ish", args: []string{"--format=tar"}, want: "tree-ish is required"},
+		{name: "tree-ish with path", args: []string{"HEAD:src"}, want: "unsupported tree-ish"},
+		{name: "unknown ref", args: []string{"v2.0"}, want: "repository not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, status, _, _ := runArchive(t, tt.args...)
+			if code == 0 || !strings.HasPrefix(status, "NACK ") || !strings.Contains(status, tt.want) {
+				t.Errorf("Serve() = %d, %q, want NACK containing %q", code, status, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchiverList(t *testing.T) {
+	code, status, data, _ := runArchive(t, "--list")
+	if code != 0 || status != "ACK" || string(data) != "tar\ntgz\ntar.gz\nzip\n" {
+		t.Errorf("Serve() = %d, %q, %q", code, status, data)
+	}
+}
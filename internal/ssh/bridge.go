@@ -0,0 +1,402 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/LZUOSS/gh-proxy/internal/auth"
+	"github.com/LZUOSS/gh-proxy/internal/pktline"
+	"github.com/LZUOSS/gh-proxy/internal/proxy"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxBridgeErrorBody limits how much of an error response is read.
+const maxBridgeErrorBody = 4096
+
+// commandPattern matches a receive-pack update command "<old> <new> <ref>".
+var commandPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64}) ([0-9a-f]{40}|[0-9a-f]{64}) `)
+
+// Bridge serves git commands received over SSH as smart HTTP requests to
+// the proxy's own HTTP handler. They go through ProxyClient and share the
+// Git handler's mirrors, fetch limits, push policy and credentials, for
+// networks where outbound SSH is blocked.
+//
+// Smart HTTP is stateless, so git-upload-pack is only bridged for clients
+// speaking protocol v2; git-receive-pack works with every version.
+type Bridge struct {
+	handler  http.Handler
+	basePath string
+	logger   *zap.Logger
+}
+
+// NewBridge creates a bridge to handler, the HTTP server's router mounted
+// at basePath. Failed commands are logged to logger if it is not nil.
+func NewBridge(handler http.Handler, basePath string, logger *zap.Logger) *Bridge {
+	basePath = strings.TrimSuffix(basePath, "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &Bridge{handler: handler, basePath: basePath, logger: logger}
+}
+
+// bridgeCall is one git command bridged for an SSH session.
+type bridgeCall struct {
+	ctx         context.Context // Cancelled when the SSH channel closes
+	bridge      *Bridge
+	channel     ssh.Channel
+	gitCmd      *GitCommand
+	token       *auth.Token
+	remoteAddr  string
+	gitProtocol string
+}
+
+// Serve runs gitCmd for the session's identity and returns the exit status.
+// token is the identity established by SSH authentication, or nil. The
+// bridged requests are cancelled with ctx.
+func (b *Bridge) Serve(ctx context.Context, channel ssh.Channel, gitCmd *GitCommand, token *auth.Token, remoteAddr, gitProtocol string) int {
+	call := &bridgeCall{
+		ctx:         ctx,
+		bridge:      b,
+		channel:     channel,
+		gitCmd:      gitCmd,
+		token:       token,
+		remoteAddr:  remoteAddr,
+		gitProtocol: gitProtocol,
+	}
+
+	err := gitCmd.Validate()
+	switch {
+	case err != nil:
+	case gitCmd.IsUpload():
+		err = call.uploadPack()
+	case gitCmd.IsReceive():
+		err = call.receivePack()
+	default:
+		err = fmt.Errorf("invalid operation: %s", gitCmd.Operation)
+	}
+	if err != nil {
+		b.logger.Info("SSH bridge command failed",
+			zap.String("remote_addr", remoteAddr),
+			zap.String("command", gitCmd.String()),
+			zap.Error(err),
+		)
+		pktline.NewEncoder(channel).Error(err.Error())
+		return 1
+	}
+	return 0
+}
+
+// uploadPack bridges a protocol v2 git-upload-pack session: the capability
+// advertisement, then one POST per command request until the client ends
+// the session with a flush-pkt or EOF.
+func (c *bridgeCall) uploadPack() error {
+	if pktline.ProtocolVersion(c.gitProtocol) != 2 {
+		return fmt.Errorf("fetching over this SSH server requires git protocol v2; run: git config --global protocol.version 2")
+	}
+
+	if err := c.advertise(); err != nil {
+		return err
+	}
+
+	dec := pktline.NewDecoder(c.channel)
+	for {
+		request, err := readSection(dec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read request: %w", err)
+		}
+		// A lone flush-pkt ends the session
+		if len(request) == 4 {
+			return nil
+		}
+
+		if err := c.post(bytes.NewReader(request)); err != nil {
+			return err
+		}
+	}
+}
+
+// errPushNeedsToken refuses bridged pushes that would reach GitHub without
+// credentials.
+var errPushNeedsToken = errors.New("pushing over this SSH server requires a GitHub token: log in with a token as the SSH password instead of a public key")
+
+// receivePack bridges git-receive-pack: the reference advertisement, then
+// the client's update commands and packfile in a single POST. Identities
+// without a token, such as public key logins, are refused: GitHub would see
+// the push as anonymous.
+func (c *bridgeCall) receivePack() error {
+	if c.token == nil || c.token.Value == "" {
+		err := errPushNeedsToken
+		fmt.Fprintf(c.channel.Stderr(), "Error: %v\n", err)
+		return err
+	}
+
+	if err := c.advertise(); err != nil {
+		return err
+	}
+
+	dec := pktline.NewDecoder(c.channel)
+	commands, err := readSection(dec)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read commands: %w", err)
+	}
+	// Nothing to update
+	if len(commands) == 4 {
+		return nil
+	}
+
+	capabilities, needsPack := inspectCommands(commands)
+	if capabilities["push-options"] {
+		options, err := readSection(dec)
+		if err != nil {
+			return fmt.Errorf("failed to read push options: %w", err)
+		}
+		commands = append(commands, options...)
+	}
+
+	// The packfile follows until the client closes its side of the channel
+	var body io.Reader = bytes.NewReader(commands)
+	if needsPack {
+		body = io.MultiReader(body, c.channel)
+	}
+	return c.post(body)
+}
+
+// advertise fetches the reference or capability advertisement and sends it
+// to the client without the "# service=" preamble, which SSH does not use.
+func (c *bridgeCall) advertise() error {
+	var buf bytes.Buffer
+	service := c.gitCmd.Operation
+	if err := c.do(http.MethodGet, "/info/refs?service="+service, http.NoBody, &buf); err != nil {
+		return err
+	}
+
+	advertisement := buf.Bytes()
+	dec := pktline.NewDecoder(bytes.NewReader(advertisement))
+	pkt, err := dec.Next()
+	if err == nil && pkt.Type == pktline.Data && bytes.HasPrefix(pkt.Payload, []byte("# service=")) {
+		// Skip the preamble line and the flush-pkt after it
+		skip := 4 + len(pkt.Payload)
+		if next, err := dec.Next(); err == nil && next.Type == pktline.Flush {
+			skip += 4
+		}
+		advertisement = advertisement[skip:]
+	}
+
+	_, err = c.channel.Write(advertisement)
+	return err
+}
+
+// post sends a service request and streams the result to the client.
+func (c *bridgeCall) post(body io.Reader) error {
+	return c.do(http.MethodPost, "/"+c.gitCmd.Operation, body, c.channel)
+}
+
+// do runs a smart HTTP request against the bridged handler and writes a
+// successful response body to out.
+func (c *bridgeCall) do(method, endpoint string, body io.Reader, out io.Writer) error {
+	target := fmt.Sprintf("http://ssh-bridge%s/%s/%s.git%s", c.bridge.basePath, c.gitCmd.Owner, c.gitCmd.Repo, endpoint)
+
+	// SSH clients cannot follow a redirect, so the proxy does
+	ctx := proxy.FollowRedirects(c.ctx)
+	if c.token != nil {
+		ctx = auth.NewContext(ctx, c.token)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.RemoteAddr = c.remoteAddr
+	req.Header.Set("User-Agent", "git/github-reverse-proxy-ssh")
+	if c.gitProtocol != "" {
+		req.Header.Set("Git-Protocol", c.gitProtocol)
+	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-"+c.gitCmd.Operation+"-request")
+		req.Header.Set("Accept", "application/x-"+c.gitCmd.Operation+"-result")
+	}
+
+	w := &bridgeResponseWriter{header: make(http.Header), out: out}
+	c.bridge.handler.ServeHTTP(w, req)
+
+	if w.status != 0 && w.status != http.StatusOK {
+		return bridgeError(w.status, w.errBody.Bytes())
+	}
+	return w.err
+}
+
+// bridgeError turns an HTTP error response into a message for the client.
+func bridgeError(status int, body []byte) error {
+	var resp struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	detail := ""
+	if json.Unmarshal(body, &resp) == nil {
+		detail = resp.Message
+		if detail == "" {
+			detail = resp.Error
+		}
+	}
+
+	switch status {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("authentication required: log in with a GitHub token as the SSH password")
+	case http.StatusForbidden:
+		if detail != "" {
+			return fmt.Errorf("access denied: %s", detail)
+		}
+		return fmt.Errorf("access denied")
+	case http.StatusNotFound:
+		return fmt.Errorf("repository not found")
+	}
+	if detail != "" {
+		return fmt.Errorf("upstream request failed with HTTP %d: %s", status, detail)
+	}
+	return fmt.Errorf("upstream request failed with HTTP %d", status)
+}
+
+// readSection reads pkt-lines up to and including the next flush-pkt and
+// returns them encoded. Delim-pkts are kept, as protocol v2 requests use
+// them to separate capabilities from arguments.
+func readSection(dec *pktline.Decoder) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := pktline.NewEncoder(&buf)
+	for {
+		pkt, err := dec.Next()
+		if err != nil {
+			if err == io.EOF && buf.Len() > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		switch pkt.Type {
+		case pktline.Flush:
+			enc.Flush()
+			return buf.Bytes(), nil
+		case pktline.Delim:
+			enc.Delim()
+		case pktline.ResponseEnd:
+			enc.ResponseEnd()
+		default:
+			enc.Encode(pkt.Payload)
+		}
+	}
+}
+
+// inspectCommands returns the capabilities requested on the first
+// receive-pack command and whether any command needs a packfile, i.e. is not
+// a deletion.
+func inspectCommands(section []byte) (map[string]bool, bool) {
+	capabilities := make(map[string]bool)
+	needsPack := false
+	first := true
+
+	dec := pktline.NewDecoder(bytes.NewReader(section))
+	for {
+		pkt, err := dec.Next()
+		if err != nil || pkt.Type == pktline.Flush {
+			break
+		}
+		if pkt.Type != pktline.Data {
+			continue
+		}
+
+		line := strings.TrimSuffix(string(pkt.Payload), "\n")
+		line, caps, found := strings.Cut(line, "\x00")
+		if found && first {
+			for _, capability := range strings.Fields(caps) {
+				name, _, _ := strings.Cut(capability, "=")
+				capabilities[name] = true
+			}
+		}
+
+		m := commandPattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		first = false
+		if strings.Trim(m[2], "0") != "" {
+			needsPack = true
+		}
+	}
+	return capabilities, needsPack
+}
+
+// bridgeResponseWriter streams a successful response to out and keeps the
+// start of an error response for the client message.
+type bridgeResponseWriter struct {
+	header  http.Header
+	status  int
+	out     io.Writer
+	errBody bytes.Buffer
+	err     error
+
+	// started, if not nil, is closed once the status is known: on a 200
+	// status, or when the caller calls start after the handler returned
+	started   chan struct{}
+	startOnce sync.Once
+}
+
+// Header returns the response headers.
+func (w *bridgeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader records the response status.
+func (w *bridgeResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status == http.StatusOK {
+		w.start()
+	}
+}
+
+// Write streams the body, or buffers it for an error response.
+func (w *bridgeResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.status != http.StatusOK {
+		if room := maxBridgeErrorBody - w.errBody.Len(); room > 0 {
+			w.errBody.Write(p[:min(len(p), room)])
+		}
+		return len(p), nil
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.out.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Flush is a no-op; writes go straight to out.
+func (w *bridgeResponseWriter) Flush() {}
+
+// start signals that the status is known, if anyone is waiting for it.
+func (w *bridgeResponseWriter) start() {
+	if w.started != nil {
+		w.startOnce.Do(func() { close(w.started) })
+	}
+}
@@ -0,0 +1,238 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/LZUOSS/gh-proxy/internal/auth"
+	"github.com/LZUOSS/gh-proxy/internal/pktline"
+)
+
+// testChannel is an ssh.Channel reading client input from a fixed buffer
+// and recording everything written to the client.
+type testChannel struct {
+	in     io.Reader
+	out    bytes.Buffer
+	stderr bytes.Buffer
+}
+
+func (c *testChannel) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *testChannel) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *testChannel) Close() error                { return nil }
+func (c *testChannel) CloseWrite() error           { return nil }
+func (c *testChannel) Stderr() io.ReadWriter       { return &c.stderr }
+func (c *testChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return true, nil
+}
+
+func pkts(lines ...string) string {
+	var buf bytes.Buffer
+	enc := pktline.NewEncoder(&buf)
+	for _, line := range lines {
+		switch line {
+		case "":
+			enc.Flush()
+		case "|":
+			enc.Delim()
+		default:
+			enc.EncodeString(line)
+		}
+	}
+	return buf.String()
+}
+
+// gitBackend is a smart HTTP handler that records the requests it serves.
+type gitBackend struct {
+	status  int
+	bodies  []string
+	headers []http.Header
+	tokens  []*auth.Token
+}
+
+func (b *gitBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if b.status != 0 {
+		w.WriteHeader(b.status)
+		w.Write([]byte(`{"error":"Forbidden","message":"push denied by policy"}`))
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	b.bodies = append(b.bodies, string(body))
+	b.headers = append(b.headers, r.Header)
+	token, _ := auth.FromContext(r.Context())
+	b.tokens = append(b.tokens, token)
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/gh/owner/repo.git/info/refs":
+		service := r.URL.Query().Get("service")
+		w.Write([]byte(pkts("# service="+service+"\n", "", "advertisement\n", "")))
+	case r.Method == http.MethodPost && (r.URL.Path == "/gh/owner/repo.git/git-upload-pack" || r.URL.Path == "/gh/owner/repo.git/git-receive-pack"):
+		w.Write([]byte(pkts("result\n", "")))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestBridgeUploadPackV2(t *testing.T) {
+	backend := &gitBackend{}
+	bridge := NewBridge(backend, "gh/", nil)
+
+	input := pkts("command=ls-refs\n", "|", "peel\n", "") + pkts("command=fetch\n", "|", "done\n", "") + pkts("")
+	channel := &testChannel{in: strings.NewReader(input)}
+	token := &auth.Token{Value: "ghp_test", Login: "octocat"}
+
+	gitCmd := &GitCommand{Operation: "git-upload-pack", Owner: "owner", Repo: "repo"}
+	if code := bridge.Serve(context.Background(), channel, gitCmd, token, "192.0.2.1:1234", "version=2"); code != 0 {
+		t.Fatalf("Serve() = %d, output %q", code, channel.out.String())
+	}
+
+	want := pkts("advertisement\n", "") + pkts("result\n", "") + pkts("result\n", "")
+	if channel.out.String() != want {
+		t.Errorf("output = %q, want %q", channel.out.String(), want)
+	}
+	if len(backend.bodies) != 3 {
+		t.Fatalf("backend requests = %d, want 3", len(backend.bodies))
+	}
+	if backend.bodies[2] != pkts("command=fetch\n", "|", "done\n", "") {
+		t.Errorf("fetch request = %q", backend.bodies[2])
+	}
+	if got := backend.headers[1].Get("Git-Protocol"); got != "version=2" {
+		t.Errorf("Git-Protocol = %q, want version=2", got)
+	}
+	if backend.tokens[1] != token {
+		t.Errorf("request identity = %v, want the SSH identity", backend.tokens[1])
+	}
+}
+
+func TestBridgeCancelledWithSession(t *testing.T) {
+	var ctxErr error
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxErr = r.Context().Err()
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	gitCmd := &GitCommand{Operation: "git-upload-pack", Owner: "owner", Repo: "repo"}
+	channel := &testChannel{in: strings.NewReader("")}
+	if code := NewBridge(backend, "/gh", nil).Serve(ctx, channel, gitCmd, nil, "192.0.2.1:1234", "version=2"); code == 0 {
+		t.Fatal("Serve() succeeded for a closed session")
+	}
+	if ctxErr != context.Canceled {
+		t.Errorf("request context error = %v, want context.Canceled", ctxErr)
+	}
+}
+
+func TestBridgeUploadPackRequiresV2(t *testing.T) {
+	backend := &gitBackend{}
+	channel := &testChannel{in: strings.NewReader("")}
+
+	gitCmd := &GitCommand{Operation: "git-upload-pack", Owner: "owner", Repo: "repo"}
+	if code := NewBridge(backend, "/gh", nil).Serve(context.Background(), channel, gitCmd, nil, "192.0.2.1:1234", ""); code == 0 {
+		t.Fatal("Serve() succeeded for a protocol v0 client")
+	}
+	if !strings.Contains(channel.out.String(), "ERR ") || !strings.Contains(channel.out.String(), "protocol v2") {
+		t.Errorf("output = %q, want an ERR pkt-line about protocol v2", channel.out.String())
+	}
+	if len(backend.bodies) != 0 {
+		t.Errorf("backend requests = %d, want none", len(backend.bodies))
+	}
+}
+
+func TestBridgeReceivePack(t *testing.T) {
+	zero := strings.Repeat("0", 40)
+	old := strings.Repeat("a", 40)
+	updated := strings.Repeat("b", 40)
+
+	tests := []struct {
+		name     string
+		input    string
+		wantBody string
+	}{
+		{
+			name:     "update with pack",
+			input:    pkts(old+" "+updated+" refs/heads/main\x00report-status side-band-64k\n", "") + "PACKDATA",
+			wantBody: pkts(old+" "+updated+" refs/heads/main\x00report-status side-band-64k\n", "") + "PACKDATA",
+		},
+		{
+			name:     "delete without pack",
+			input:    pkts(old+" "+zero+" refs/heads/old\x00report-status\n", "") + "IGNORED",
+			wantBody: pkts(old+" "+zero+" refs/heads/old\x00report-status\n", ""),
+		},
+		{
+			name:     "push options",
+			input:    pkts(old+" "+zero+" refs/heads/old\x00report-status push-options\n", "") + pkts("ci.skip\n", ""),
+			wantBody: pkts(old+" "+zero+" refs/heads/old\x00report-status push-options\n", "") + pkts("ci.skip\n", ""),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &gitBackend{}
+			channel := &testChannel{in: strings.NewReader(tt.input)}
+
+			gitCmd := &GitCommand{Operation: "git-receive-pack", Owner: "owner", Repo: "repo"}
+			token := &auth.Token{Value: "ghp_test", Login: "octocat"}
+			if code := NewBridge(backend, "/gh", nil).Serve(context.Background(), channel, gitCmd, token, "192.0.2.1:1234", ""); code != 0 {
+				t.Fatalf("Serve() = %d, output %q", code, channel.out.String())
+			}
+
+			if len(backend.bodies) != 2 || backend.bodies[1] != tt.wantBody {
+				t.Errorf("receive-pack body = %q, want %q", backend.bodies[1:], tt.wantBody)
+			}
+			if want := pkts("advertisement\n", "") + pkts("result\n", ""); channel.out.String() != want {
+				t.Errorf("output = %q, want %q", channel.out.String(), want)
+			}
+		})
+	}
+}
+
+func TestBridgeHTTPError(t *testing.T) {
+	backend := &gitBackend{status: http.StatusForbidden}
+	channel := &testChannel{in: strings.NewReader("")}
+
+	gitCmd := &GitCommand{Operation: "git-receive-pack", Owner: "owner", Repo: "repo"}
+	token := &auth.Token{Value: "ghp_test", Login: "octocat"}
+	if code := NewBridge(backend, "/gh", nil).Serve(context.Background(), channel, gitCmd, token, "192.0.2.1:1234", ""); code == 0 {
+		t.Fatal("Serve() succeeded for a forbidden request")
+	}
+	want := pkts("ERR access denied: push denied by policy\n")
+	if channel.out.String() != want {
+		t.Errorf("output = %q, want %q", channel.out.String(), want)
+	}
+}
+
+func TestBridgeReceivePackRequiresToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		token *auth.Token
+	}{
+		{"anonymous", nil},
+		{"public key login", &auth.Token{Username: "octocat", Login: "octocat"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &gitBackend{}
+			channel := &testChannel{in: strings.NewReader(pkts(strings.Repeat("a", 40)+" "+strings.Repeat("b", 40)+" refs/heads/main\n", "") + "PACKDATA")}
+
+			gitCmd := &GitCommand{Operation: "git-receive-pack", Owner: "owner", Repo: "repo"}
+			if code := NewBridge(backend, "/gh", nil).Serve(context.Background(), channel, gitCmd, tt.token, "192.0.2.1:1234", ""); code == 0 {
+				t.Fatal("Serve() succeeded for a push without a token")
+			}
+			if len(backend.bodies) != 0 {
+				t.Errorf("backend requests = %d, want the push refused before any request", len(backend.bodies))
+			}
+			if !strings.Contains(channel.stderr.String(), "requires a GitHub token") {
+				t.Errorf("stderr = %q, want a message asking for a token", channel.stderr.String())
+			}
+			if want := pkts("ERR " + errPushNeedsToken.Error() + "\n"); channel.out.String() != want {
+				t.Errorf("output = %q, want %q", channel.out.String(), want)
+			}
+		})
+	}
+}
@@ -7,7 +7,7 @@ import (
 
 // GitCommand represents a parsed Git command.
 type GitCommand struct {
-	Operation string // "git-upload-pack" or "git-receive-pack"
+	Operation string // "git-upload-pack", "git-receive-pack" or "git-upload-archive"
 	Owner     string // GitHub repository owner
 	Repo      string // GitHub repository name
 	RepoPath  string // Full repository path (e.g., "/owner/repo.git")
@@ -23,6 +23,11 @@ func (g *GitCommand) IsReceive() bool {
 	return g.Operation == "git-receive-pack"
 }
 
+// IsArchive returns true if this is a git-upload-archive command (git archive --remote).
+func (g *GitCommand) IsArchive() bool {
+	return g.Operation == "git-upload-archive"
+}
+
 // GitHubRepoURL returns the GitHub SSH URL for this repository.
 func (g *GitCommand) GitHubRepoURL() string {
 	return fmt.Sprintf("%s/%s", g.Owner, g.Repo)
@@ -39,7 +44,7 @@ func (g *GitCommand) Validate() error {
 		return fmt.Errorf("operation cannot be empty")
 	}
 
-	if !g.IsUpload() && !g.IsReceive() {
+	if !g.IsUpload() && !g.IsReceive() && !g.IsArchive() {
 		return fmt.Errorf("invalid operation: %s", g.Operation)
 	}
 
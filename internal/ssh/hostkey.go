@@ -0,0 +1,164 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Host key types that can be generated.
+const (
+	KeyTypeEd25519 = "ed25519"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeRSA     = "rsa"
+)
+
+// rsaKeyBits is the size of generated RSA host keys.
+const rsaKeyBits = 3072
+
+// HostKeyType infers the key type to generate for a host key file from its
+// name, e.g. "ssh_host_ed25519_key". It returns an empty string if the name
+// does not mention a known type.
+func HostKeyType(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	for _, keyType := range []string{KeyTypeEd25519, KeyTypeECDSA, KeyTypeRSA} {
+		if strings.Contains(name, keyType) {
+			return keyType
+		}
+	}
+	return ""
+}
+
+// LoadOrCreateHostKey loads the host key at path. If the file does not
+// exist, a key of the type named by the file is generated and written to
+// path, with its public key next to it in path + ".pub".
+func LoadOrCreateHostKey(path string) (ssh.Signer, bool, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to parse host key %s: %w", path, err)
+		}
+		return signer, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, fmt.Errorf("failed to read host key %s: %w", path, err)
+	}
+
+	signer, err := writeHostKey(path)
+	if err != nil {
+		return nil, false, err
+	}
+	return signer, true, nil
+}
+
+// RotateHostKey replaces the host key at path with a newly generated key of
+// the same type. The previous key, if any, is kept as path + ".old" (and its
+// public key as path + ".old.pub") so it can be restored or announced to
+// clients out of band. The new key takes effect on the next server start;
+// the old key is not offered alongside it.
+func RotateHostKey(path string) (ssh.Signer, error) {
+	for _, suffix := range []string{"", ".pub"} {
+		err := os.Rename(path+suffix, path+".old"+suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to retire host key %s: %w", path+suffix, err)
+		}
+	}
+	return writeHostKey(path)
+}
+
+// writeHostKey generates a host key of the type named by path and writes
+// the private key (mode 0600) and public key files.
+func writeHostKey(path string) (ssh.Signer, error) {
+	keyType := HostKeyType(path)
+	if keyType == "" {
+		return nil, fmt.Errorf("cannot generate host key %s: file name must contain %s, %s or %s",
+			path, KeyTypeEd25519, KeyTypeECDSA, KeyTypeRSA)
+	}
+
+	key, err := generateHostKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signer: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	block, err := ssh.MarshalPrivateKey(key, "gh-proxy@"+hostname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode host key: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create host key directory: %w", err)
+	}
+	// Never overwrite a key another process wrote in the meantime
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host key %s: %w", path, err)
+	}
+	if _, err := f.Write(pem.EncodeToMemory(block)); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write host key %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write host key %s: %w", path, err)
+	}
+
+	if err := os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write public key %s.pub: %w", path, err)
+	}
+
+	return signer, nil
+}
+
+// generateHostKey generates a private key of the given type.
+func generateHostKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ed25519 key: %w", err)
+		}
+		return key, nil
+	case KeyTypeECDSA:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ECDSA key: %w", err)
+		}
+		return key, nil
+	case KeyTypeRSA:
+		key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate RSA key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported host key type %q", keyType)
+	}
+}
+
+// ephemeralHostKey generates an ed25519 host key that is not persisted.
+func ephemeralHostKey() (ssh.Signer, error) {
+	key, err := generateHostKey(KeyTypeEd25519)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
@@ -0,0 +1,102 @@
+package ssh
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateHostKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		wantType string
+	}{
+		{"ed25519", "ssh_host_ed25519_key", "ssh-ed25519"},
+		{"ecdsa", "ssh_host_ecdsa_key", "ecdsa-sha2-nistp256"},
+		{"rsa", "ssh_host_rsa_key", "ssh-rsa"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys", tt.file)
+
+			created, generated, err := LoadOrCreateHostKey(path)
+			if err != nil {
+				t.Fatalf("LoadOrCreateHostKey() error = %v", err)
+			}
+			if !generated {
+				t.Error("expected a new key to be generated")
+			}
+			if got := created.PublicKey().Type(); got != tt.wantType {
+				t.Errorf("key type = %q, want %q", got, tt.wantType)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("host key was not persisted: %v", err)
+			}
+			if perm := info.Mode().Perm(); perm != 0o600 {
+				t.Errorf("host key mode = %o, want 600", perm)
+			}
+			if _, err := os.Stat(path + ".pub"); err != nil {
+				t.Errorf("public key was not written: %v", err)
+			}
+
+			loaded, generated, err := LoadOrCreateHostKey(path)
+			if err != nil {
+				t.Fatalf("LoadOrCreateHostKey() reload error = %v", err)
+			}
+			if generated {
+				t.Error("existing key was regenerated")
+			}
+			if !bytes.Equal(loaded.PublicKey().Marshal(), created.PublicKey().Marshal()) {
+				t.Error("reloaded key differs from the persisted key")
+			}
+		})
+	}
+}
+
+func TestLoadOrCreateHostKeyUnknownType(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "host_key")
+	if _, _, err := LoadOrCreateHostKey(path); err == nil {
+		t.Error("expected an error for a file name without a key type")
+	}
+}
+
+func TestRotateHostKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh_host_ed25519_key")
+
+	original, _, err := LoadOrCreateHostKey(path)
+	if err != nil {
+		t.Fatalf("LoadOrCreateHostKey() error = %v", err)
+	}
+
+	rotated, err := RotateHostKey(path)
+	if err != nil {
+		t.Fatalf("RotateHostKey() error = %v", err)
+	}
+	if bytes.Equal(rotated.PublicKey().Marshal(), original.PublicKey().Marshal()) {
+		t.Error("rotation did not generate a new key")
+	}
+
+	retired, generated, err := LoadOrCreateHostKey(path + ".old")
+	if err != nil || generated {
+		t.Fatalf("previous key was not kept: %v", err)
+	}
+	if !bytes.Equal(retired.PublicKey().Marshal(), original.PublicKey().Marshal()) {
+		t.Error("previous key was not kept")
+	}
+	if _, err := os.Stat(path + ".old.pub"); err != nil {
+		t.Errorf("previous public key was not kept: %v", err)
+	}
+
+	current, generated, err := LoadOrCreateHostKey(path)
+	if err != nil || generated {
+		t.Fatalf("LoadOrCreateHostKey() after rotation = %v, generated %v", err, generated)
+	}
+	if !bytes.Equal(current.PublicKey().Marshal(), rotated.PublicKey().Marshal()) {
+		t.Error("rotated key was not persisted")
+	}
+}
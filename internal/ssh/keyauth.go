@@ -0,0 +1,377 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/proxy"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+// ErrKeyNotAuthorized is returned when no key source accepts a public key.
+var ErrKeyNotAuthorized = errors.New("public key not authorized")
+
+// Identity is the user a public key was authorized for.
+type Identity struct {
+	Login  string // GitHub login used for per-user policies
+	Source string // Key source that authorized the key, e.g. "authorized_keys"
+}
+
+// KeyAuthorizer maps a public key offered by a client on conn to an
+// identity. It returns ErrKeyNotAuthorized if the key is unknown.
+type KeyAuthorizer interface {
+	AuthorizeKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*Identity, error)
+}
+
+// KeyAuthorizers tries each authorizer in order and returns the first
+// identity found.
+type KeyAuthorizers []KeyAuthorizer
+
+// AuthorizeKey implements KeyAuthorizer.
+func (a KeyAuthorizers) AuthorizeKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*Identity, error) {
+	for _, authorizer := range a {
+		identity, err := authorizer.AuthorizeKey(conn, key)
+		if err == nil {
+			return identity, nil
+		}
+		if !errors.Is(err, ErrKeyNotAuthorized) {
+			return nil, err
+		}
+	}
+	return nil, ErrKeyNotAuthorized
+}
+
+// AuthorizedKeysFile authorizes keys listed in an authorized_keys-style
+// file. The identity of a key is taken from a login="..." option or, if
+// there is none, from the key comment:
+//
+//	login="octocat" ssh-ed25519 AAAAC3Nza... laptop
+//	ssh-ed25519 AAAAC3Nza... octocat
+//
+// The file is reloaded when it changes.
+type AuthorizedKeysFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	keys    map[string]string // marshaled public key -> login
+}
+
+// NewAuthorizedKeysFile loads the authorized keys file at path.
+func NewAuthorizedKeysFile(path string) (*AuthorizedKeysFile, error) {
+	f := &AuthorizedKeysFile{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// AuthorizeKey implements KeyAuthorizer.
+func (f *AuthorizedKeysFile) AuthorizeKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*Identity, error) {
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	login, ok := f.keys[string(key.Marshal())]
+	f.mu.Unlock()
+	if !ok {
+		return nil, ErrKeyNotAuthorized
+	}
+	return &Identity{Login: login, Source: "authorized_keys"}, nil
+}
+
+// reload parses the file again if its size or modification time changed.
+func (f *AuthorizedKeysFile) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read authorized keys %s: %w", f.path, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.keys != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read authorized keys %s: %w", f.path, err)
+	}
+	keys, err := parseAuthorizedKeys(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse authorized keys %s: %w", f.path, err)
+	}
+
+	f.keys = keys
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
+}
+
+// parseAuthorizedKeys maps the keys of an authorized_keys file to logins.
+func parseAuthorizedKeys(data []byte) (map[string]string, error) {
+	keys := make(map[string]string)
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		key, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		login := comment
+		for _, option := range options {
+			if value, ok := cutOption(option, "login"); ok {
+				login = value
+			}
+		}
+		if !isLogin(login) {
+			return nil, fmt.Errorf("line %d: key has no valid login", i+1)
+		}
+		keys[string(key.Marshal())] = login
+	}
+	return keys, nil
+}
+
+// cutOption returns the value of an authorized_keys option name="value".
+func cutOption(option, name string) (string, bool) {
+	prefix := name + `="`
+	if len(option) < len(prefix)+1 || option[:len(prefix)] != prefix || option[len(option)-1] != '"' {
+		return "", false
+	}
+	return option[len(prefix) : len(option)-1], true
+}
+
+// loginPattern matches valid GitHub logins.
+var loginPattern = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9]|-[A-Za-z0-9]){0,38}$`)
+
+// isLogin reports whether s is a valid GitHub login.
+func isLogin(s string) bool {
+	return loginPattern.MatchString(s)
+}
+
+// maxKeysSize limits the size of a published keys response.
+const maxKeysSize = 1 << 20
+
+const (
+	// maxGitHubKeysEntries bounds the number of logins whose keys are cached.
+	maxGitHubKeysEntries = 10000
+
+	// githubKeysLookupRate and githubKeysLookupBurst limit how often one
+	// source IP may make the proxy fetch keys it has not cached.
+	githubKeysLookupRate  = rate.Limit(1)
+	githubKeysLookupBurst = 10
+
+	// maxGitHubKeysClients bounds the number of source IPs tracked.
+	maxGitHubKeysClients = 4096
+)
+
+// ErrKeyLookupLimited is returned when a source IP made too many lookups of
+// keys that were not cached.
+var ErrKeyLookupLimited = errors.New("too many GitHub key lookups")
+
+// GitHubKeys authorizes a key if it is one of the keys the SSH user name
+// publishes on GitHub (https://github.com/{login}.keys). Published keys are
+// cached for the configured TTL, including logins without keys. Every login
+// tried costs an upstream request on a cache miss, so the cache is bounded,
+// concurrent lookups of one login share a request and each source IP may
+// only cause a few lookups per second.
+type GitHubKeys struct {
+	client  *proxy.ProxyClient
+	baseURL string
+	ttl     time.Duration
+
+	mu       sync.Mutex
+	cache    map[string]githubKeysEntry
+	inflight map[string]*githubKeysLookup
+	lookups  map[string]*rate.Limiter // source IP -> limiter of its lookups
+}
+
+// githubKeysEntry is the cached set of published keys of a login.
+type githubKeysEntry struct {
+	keys    map[string]bool
+	expires time.Time
+}
+
+// githubKeysLookup is a fetch of a login's keys that other connections
+// asking for the same login wait for.
+type githubKeysLookup struct {
+	done chan struct{}
+	keys map[string]bool
+	err  error
+}
+
+// NewGitHubKeys creates a GitHub published keys authorizer that fetches keys
+// through client.
+func NewGitHubKeys(client *proxy.ProxyClient, ttl time.Duration) *GitHubKeys {
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+	return &GitHubKeys{
+		client:   client,
+		baseURL:  "https://github.com",
+		ttl:      ttl,
+		cache:    make(map[string]githubKeysEntry),
+		inflight: make(map[string]*githubKeysLookup),
+		lookups:  make(map[string]*rate.Limiter),
+	}
+}
+
+// AuthorizeKey implements KeyAuthorizer. The SSH user name is the login.
+func (g *GitHubKeys) AuthorizeKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*Identity, error) {
+	user := conn.User()
+	if !isLogin(user) || user == "git" {
+		return nil, ErrKeyNotAuthorized
+	}
+
+	keys, err := g.keys(user, remoteIP(conn.RemoteAddr()))
+	if err != nil {
+		return nil, err
+	}
+	if !keys[string(key.Marshal())] {
+		return nil, ErrKeyNotAuthorized
+	}
+	return &Identity{Login: user, Source: "github"}, nil
+}
+
+// keys returns the published keys of login, from the cache if fresh. A
+// lookup already in progress for login is waited for; otherwise ip must be
+// allowed another lookup.
+func (g *GitHubKeys) keys(login, ip string) (map[string]bool, error) {
+	g.mu.Lock()
+	if entry, ok := g.cache[login]; ok && time.Now().Before(entry.expires) {
+		g.mu.Unlock()
+		return entry.keys, nil
+	}
+	if lookup, ok := g.inflight[login]; ok {
+		g.mu.Unlock()
+		<-lookup.done
+		return lookup.keys, lookup.err
+	}
+	if !g.limiterLocked(ip).Allow() {
+		g.mu.Unlock()
+		return nil, fmt.Errorf("%w from %s", ErrKeyLookupLimited, ip)
+	}
+	lookup := &githubKeysLookup{done: make(chan struct{})}
+	g.inflight[login] = lookup
+	g.mu.Unlock()
+
+	lookup.keys, lookup.err = g.fetch(login)
+
+	g.mu.Lock()
+	delete(g.inflight, login)
+	if lookup.err == nil {
+		g.storeLocked(login, lookup.keys)
+	}
+	g.mu.Unlock()
+	close(lookup.done)
+	return lookup.keys, lookup.err
+}
+
+// storeLocked caches the keys of login. When the cache is full, expired
+// entries are dropped and, if that is not enough, the entry closest to
+// expiry. g.mu must be held.
+func (g *GitHubKeys) storeLocked(login string, keys map[string]bool) {
+	now := time.Now()
+	if _, ok := g.cache[login]; !ok && len(g.cache) >= maxGitHubKeysEntries {
+		oldest := ""
+		for name, entry := range g.cache {
+			if !now.Before(entry.expires) {
+				delete(g.cache, name)
+			} else if oldest == "" || entry.expires.Before(g.cache[oldest].expires) {
+				oldest = name
+			}
+		}
+		if len(g.cache) >= maxGitHubKeysEntries {
+			delete(g.cache, oldest)
+		}
+	}
+	g.cache[login] = githubKeysEntry{keys: keys, expires: now.Add(g.ttl)}
+}
+
+// limiterLocked returns the lookup limiter of ip. Limiters that have
+// refilled are forgotten when too many IPs are tracked. g.mu must be held.
+func (g *GitHubKeys) limiterLocked(ip string) *rate.Limiter {
+	if limiter, ok := g.lookups[ip]; ok {
+		return limiter
+	}
+	if len(g.lookups) >= maxGitHubKeysClients {
+		for addr, limiter := range g.lookups {
+			if limiter.Tokens() >= githubKeysLookupBurst {
+				delete(g.lookups, addr)
+			}
+		}
+		// Every tracked IP is busy; forget one rather than grow
+		for addr := range g.lookups {
+			if len(g.lookups) < maxGitHubKeysClients {
+				break
+			}
+			delete(g.lookups, addr)
+		}
+	}
+	limiter := rate.NewLimiter(githubKeysLookupRate, githubKeysLookupBurst)
+	g.lookups[ip] = limiter
+	return limiter
+}
+
+// remoteIP returns the IP of a connection's remote address.
+func remoteIP(addr net.Addr) string {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// fetch downloads the published keys of login. Unknown logins have no keys.
+func (g *GitHubKeys) fetch(login string) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(proxy.WithHandler(context.Background(), proxy.HandlerKeys), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.baseURL+"/"+login+".keys", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch GitHub keys for %s: %w", login, err)
+	}
+	defer resp.Body.Close()
+
+	keys := make(map[string]bool)
+	if resp.StatusCode == http.StatusNotFound {
+		return keys, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch GitHub keys for %s: status %d", login, resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxKeysSize))
+	for scanner.Scan() {
+		key, _, _, _, err := ssh.ParseAuthorizedKey(scanner.Bytes())
+		if err != nil {
+			continue
+		}
+		keys[string(key.Marshal())] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read GitHub keys for %s: %w", login, err)
+	}
+	return keys, nil
+}
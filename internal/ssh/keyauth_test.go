@@ -0,0 +1,251 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/proxy"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestPublicKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("NewPublicKey() error = %v", err)
+	}
+	return key
+}
+
+// testConn is the metadata of a connection by user from addr.
+type testConn struct {
+	ssh.ConnMetadata
+	user string
+	addr string
+}
+
+func (c testConn) User() string { return c.user }
+
+func (c testConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+// connAs returns the metadata of a connection by user from a fixed address.
+func connAs(user string) ssh.ConnMetadata {
+	return testConn{user: user, addr: "192.0.2.1:50000"}
+}
+
+func authorizedKeyLine(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestAuthorizedKeysFile(t *testing.T) {
+	alice, bob, unknown := newTestPublicKey(t), newTestPublicKey(t), newTestPublicKey(t)
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	content := "# proxy users\n" +
+		`login="alice" ` + authorizedKeyLine(alice) + " laptop\n" +
+		"\n" +
+		authorizedKeyLine(bob) + " bob\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	f, err := NewAuthorizedKeysFile(path)
+	if err != nil {
+		t.Fatalf("NewAuthorizedKeysFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		key       ssh.PublicKey
+		wantLogin string
+		wantErr   error
+	}{
+		{"login option", alice, "alice", nil},
+		{"comment", bob, "bob", nil},
+		{"unknown key", unknown, "", ErrKeyNotAuthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := f.AuthorizeKey(connAs("git"), tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AuthorizeKey() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && identity.Login != tt.wantLogin {
+				t.Errorf("login = %q, want %q", identity.Login, tt.wantLogin)
+			}
+		})
+	}
+}
+
+func TestAuthorizedKeysFileInvalidLogin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	line := authorizedKeyLine(newTestPublicKey(t)) + " alice@laptop\n"
+	if err := os.WriteFile(path, []byte(line), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if _, err := NewAuthorizedKeysFile(path); err == nil {
+		t.Error("expected an error for a key without a valid login")
+	}
+}
+
+func TestGitHubKeys(t *testing.T) {
+	published, other := newTestPublicKey(t), newTestPublicKey(t)
+
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/octocat.keys" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(authorizedKeyLine(published) + "\n"))
+	}))
+	defer upstream.Close()
+
+	client, err := proxy.NewProxyClient(nil)
+	if err != nil {
+		t.Fatalf("NewProxyClient() error = %v", err)
+	}
+	g := NewGitHubKeys(client, 0)
+	g.baseURL = upstream.URL
+
+	identity, err := g.AuthorizeKey(connAs("octocat"), published)
+	if err != nil {
+		t.Fatalf("AuthorizeKey() error = %v", err)
+	}
+	if identity.Login != "octocat" || identity.Source != "github" {
+		t.Errorf("identity = %+v, want octocat from github", identity)
+	}
+
+	if _, err := g.AuthorizeKey(connAs("octocat"), other); !errors.Is(err, ErrKeyNotAuthorized) {
+		t.Errorf("AuthorizeKey() with another key error = %v, want ErrKeyNotAuthorized", err)
+	}
+	if requests != 1 {
+		t.Errorf("upstream requests = %d, want published keys to be cached", requests)
+	}
+
+	if _, err := g.AuthorizeKey(connAs("ghost"), published); !errors.Is(err, ErrKeyNotAuthorized) {
+		t.Errorf("AuthorizeKey() for unknown login error = %v, want ErrKeyNotAuthorized", err)
+	}
+	if _, err := g.AuthorizeKey(connAs("git"), published); !errors.Is(err, ErrKeyNotAuthorized) {
+		t.Errorf("AuthorizeKey() for git user error = %v, want ErrKeyNotAuthorized", err)
+	}
+}
+
+func TestGitHubKeysLookups(t *testing.T) {
+	key := newTestPublicKey(t)
+
+	var requests atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/slow.keys" {
+			<-release
+		}
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	client, err := proxy.NewProxyClient(nil)
+	if err != nil {
+		t.Fatalf("NewProxyClient() error = %v", err)
+	}
+	g := NewGitHubKeys(client, 0)
+	g.baseURL = upstream.URL
+
+	// Concurrent lookups of one login share a request
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn := testConn{user: "slow", addr: fmt.Sprintf("192.0.2.%d:50000", i+1)}
+			if _, err := g.AuthorizeKey(conn, key); !errors.Is(err, ErrKeyNotAuthorized) {
+				t.Errorf("AuthorizeKey() error = %v, want ErrKeyNotAuthorized", err)
+			}
+		}(i)
+	}
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if got := requests.Load(); got != 1 {
+		t.Errorf("upstream requests = %d, want concurrent lookups to share one", got)
+	}
+
+	// Each source IP may only cause a burst of lookups
+	requests.Store(0)
+	limited := 0
+	for i := 0; i < 2*githubKeysLookupBurst; i++ {
+		conn := testConn{user: fmt.Sprintf("user%d", i), addr: "198.51.100.1:50000"}
+		if _, err := g.AuthorizeKey(conn, key); errors.Is(err, ErrKeyLookupLimited) {
+			limited++
+		}
+	}
+	if got := requests.Load(); got > githubKeysLookupBurst+1 {
+		t.Errorf("upstream requests = %d, want at most %d", got, githubKeysLookupBurst+1)
+	}
+	if limited == 0 {
+		t.Error("expected lookups beyond the burst to be limited")
+	}
+
+	// Cached logins are served without a lookup
+	if _, err := g.AuthorizeKey(testConn{user: "user0", addr: "198.51.100.1:50000"}, key); !errors.Is(err, ErrKeyNotAuthorized) {
+		t.Errorf("AuthorizeKey() for a cached login error = %v, want ErrKeyNotAuthorized", err)
+	}
+
+	// Another source IP is not affected
+	if _, err := g.AuthorizeKey(testConn{user: "someone", addr: "198.51.100.2:50000"}, key); !errors.Is(err, ErrKeyNotAuthorized) {
+		t.Errorf("AuthorizeKey() from another IP error = %v, want ErrKeyNotAuthorized", err)
+	}
+}
+
+func TestGitHubKeysCacheBound(t *testing.T) {
+	g := NewGitHubKeys(nil, time.Minute)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cache["expired"] = githubKeysEntry{expires: time.Now().Add(-time.Second)}
+	for i := 1; i < maxGitHubKeysEntries; i++ {
+		g.cache[fmt.Sprintf("user%d", i)] = githubKeysEntry{expires: time.Now().Add(time.Duration(i) * time.Second)}
+	}
+
+	g.storeLocked("first", nil)
+	if _, ok := g.cache["expired"]; ok {
+		t.Error("expected the expired entry to be dropped")
+	}
+	if len(g.cache) != maxGitHubKeysEntries {
+		t.Errorf("cache size = %d, want %d", len(g.cache), maxGitHubKeysEntries)
+	}
+
+	g.storeLocked("second", nil)
+	if _, ok := g.cache["user1"]; ok {
+		t.Error("expected the entry closest to expiry to be evicted")
+	}
+	if _, ok := g.cache["second"]; !ok || len(g.cache) != maxGitHubKeysEntries {
+		t.Errorf("cache size = %d with second cached = %v, want %d entries", len(g.cache), ok, maxGitHubKeysEntries)
+	}
+}
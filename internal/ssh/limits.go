@@ -0,0 +1,188 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// connLimiter bounds the number of concurrent connections, in total and per
+// source IP. A limit of 0 means unlimited.
+type connLimiter struct {
+	max      int
+	maxPerIP int
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// newConnLimiter creates a connection limiter.
+func newConnLimiter(max, maxPerIP int) *connLimiter {
+	return &connLimiter{max: max, maxPerIP: maxPerIP, perIP: make(map[string]int)}
+}
+
+// acquire reserves a connection slot for addr. The returned function
+// releases it.
+func (l *connLimiter) acquire(addr net.Addr) (func(), error) {
+	ip := remoteIP(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return nil, fmt.Errorf("too many connections (limit %d)", l.max)
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return nil, fmt.Errorf("too many connections from %s (limit %d)", ip, l.maxPerIP)
+	}
+	l.total++
+	l.perIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.perIP[ip]--; l.perIP[ip] <= 0 {
+				delete(l.perIP, ip)
+			}
+		})
+	}, nil
+}
+
+// connWatch closes an authenticated connection when it has been idle, has
+// run for too long or stops answering keepalives. Only channel traffic
+// counts as activity, so keepalives do not keep an idle connection open.
+type connWatch struct {
+	conn        *ssh.ServerConn
+	logger      *zap.Logger
+	idleTimeout time.Duration
+
+	lastActive atomic.Int64 // Unix nanoseconds
+	missed     atomic.Int32 // keepalives sent without a reply
+
+	done      chan struct{}
+	closeOnce sync.Once
+	timers    []*time.Timer
+}
+
+// watchConnection starts watching conn. A zero duration disables the
+// corresponding check. Stop must be called when the connection ends.
+func watchConnection(conn *ssh.ServerConn, logger *zap.Logger, idleTimeout, maxDuration, keepaliveInterval time.Duration, keepaliveCountMax int) *connWatch {
+	w := &connWatch{
+		conn:        conn,
+		logger:      logger,
+		idleTimeout: idleTimeout,
+		done:        make(chan struct{}),
+	}
+	w.touch()
+
+	if idleTimeout > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(idleTimeout, func() { w.checkIdle(timer) })
+		w.timers = append(w.timers, timer)
+	}
+	if maxDuration > 0 {
+		w.timers = append(w.timers, time.AfterFunc(maxDuration, func() {
+			w.close(fmt.Sprintf("session exceeded %v", maxDuration))
+		}))
+	}
+	if keepaliveInterval > 0 {
+		go w.keepalive(keepaliveInterval, keepaliveCountMax)
+	}
+	return w
+}
+
+// touch records channel activity.
+func (w *connWatch) touch() {
+	w.lastActive.Store(time.Now().UnixNano())
+}
+
+// checkIdle closes the connection if it has been idle for the timeout, or
+// re-arms timer for the remaining time.
+func (w *connWatch) checkIdle(timer *time.Timer) {
+	idle := time.Since(time.Unix(0, w.lastActive.Load()))
+	if idle >= w.idleTimeout {
+		w.close(fmt.Sprintf("idle for %v", idle.Round(time.Second)))
+		return
+	}
+	select {
+	case <-w.done:
+	default:
+		timer.Reset(w.idleTimeout - idle)
+	}
+}
+
+// keepalive sends keepalive requests and closes the connection after
+// countMax consecutive requests went unanswered.
+func (w *connWatch) keepalive(interval time.Duration, countMax int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		if int(w.missed.Load()) >= countMax {
+			w.close(fmt.Sprintf("no reply to %d keepalives", countMax))
+			return
+		}
+		w.missed.Add(1)
+		go func() {
+			// Any reply, even a refusal, shows the client is alive
+			if _, _, err := w.conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+				w.missed.Store(0)
+			}
+		}()
+	}
+}
+
+// close closes the connection for reason.
+func (w *connWatch) close(reason string) {
+	w.closeOnce.Do(func() {
+		w.logger.Info("closing SSH connection",
+			zap.String("remote_addr", w.conn.RemoteAddr().String()),
+			zap.String("user", w.conn.User()),
+			zap.String("reason", reason),
+		)
+		w.conn.Close()
+	})
+}
+
+// Stop stops watching the connection.
+func (w *connWatch) Stop() {
+	w.closeOnce.Do(func() {})
+	close(w.done)
+	for _, timer := range w.timers {
+		timer.Stop()
+	}
+}
+
+// activityChannel is a channel that reports its traffic to a connWatch.
+type activityChannel struct {
+	ssh.Channel
+	watch *connWatch
+}
+
+// Read reads from the channel and records activity.
+func (c *activityChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.watch.touch()
+	return n, err
+}
+
+// Write writes to the channel and records activity.
+func (c *activityChannel) Write(p []byte) (int, error) {
+	c.watch.touch()
+	return c.Channel.Write(p)
+}
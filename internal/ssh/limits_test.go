@@ -0,0 +1,220 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(3, 2)
+	a := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	b := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}
+
+	releaseA1, err := l.acquire(a)
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if _, err := l.acquire(a); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if _, err := l.acquire(a); err == nil {
+		t.Error("expected the per-IP limit to reject a third connection")
+	}
+	if _, err := l.acquire(b); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if _, err := l.acquire(b); err == nil {
+		t.Error("expected the global limit to reject a fourth connection")
+	}
+
+	// Releasing twice frees a single slot
+	releaseA1()
+	releaseA1()
+	if _, err := l.acquire(b); err != nil {
+		t.Errorf("acquire() after release error = %v", err)
+	}
+	if _, err := l.acquire(b); err == nil {
+		t.Error("expected the global limit after one release")
+	}
+}
+
+// testKeyAuthorizer accepts every public key.
+type testKeyAuthorizer struct{}
+
+func (testKeyAuthorizer) AuthorizeKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*Identity, error) {
+	return &Identity{Login: conn.User(), Source: "test"}, nil
+}
+
+// startTestServer starts an SSH server on a local port and returns it with
+// a client config that can log in.
+func startTestServer(t *testing.T, cfg *Config) (*Server, *ssh.ClientConfig) {
+	t.Helper()
+	cfg.Address = "127.0.0.1:0"
+	cfg.EnablePubKey = true
+	cfg.KeyAuthorizer = testKeyAuthorizer{}
+
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Stop(ctx)
+	})
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey() error = %v", err)
+	}
+	client := &ssh.ClientConfig{
+		User:            "octocat",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+	return server, client
+}
+
+// waitClosed returns how long it took the server to close client, failing
+// the test if it stays open longer than limit.
+func waitClosed(t *testing.T, client *ssh.Client, limit time.Duration) time.Duration {
+	t.Helper()
+	start := time.Now()
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return time.Since(start)
+	case <-time.After(limit):
+		client.Close()
+		t.Fatalf("connection still open after %v", limit)
+		return 0
+	}
+}
+
+func TestServerIdleTimeoutIgnoresKeepalives(t *testing.T) {
+	server, config := startTestServer(t, &Config{
+		LoginTimeout:      5 * time.Second,
+		IdleTimeout:       200 * time.Millisecond,
+		KeepaliveInterval: 20 * time.Millisecond,
+	})
+
+	client, err := ssh.Dial("tcp", server.listener.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	waitClosed(t, client, 3*time.Second)
+}
+
+func TestServerMaxDuration(t *testing.T) {
+	server, config := startTestServer(t, &Config{
+		LoginTimeout: 5 * time.Second,
+		MaxDuration:  200 * time.Millisecond,
+	})
+
+	client, err := ssh.Dial("tcp", server.listener.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	// Traffic does not extend the session
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession() error = %v", err)
+	}
+	defer session.Close()
+	if elapsed := waitClosed(t, client, 3*time.Second); elapsed < 100*time.Millisecond {
+		t.Errorf("connection closed after %v, want the session duration", elapsed)
+	}
+}
+
+func TestServerKeepalivesKeepLiveClients(t *testing.T) {
+	server, config := startTestServer(t, &Config{
+		LoginTimeout:      5 * time.Second,
+		KeepaliveInterval: 20 * time.Millisecond,
+		KeepaliveCountMax: 2,
+	})
+
+	client, err := ssh.Dial("tcp", server.listener.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := client.NewSession(); err != nil {
+		t.Errorf("NewSession() after keepalives error = %v", err)
+	}
+}
+
+func TestServerMaxConnectionsPerIP(t *testing.T) {
+	server, config := startTestServer(t, &Config{
+		LoginTimeout:        5 * time.Second,
+		MaxConnectionsPerIP: 1,
+	})
+	addr := server.listener.Addr().String()
+
+	first, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	if second, err := ssh.Dial("tcp", addr, config); err == nil {
+		second.Close()
+		t.Fatal("expected the second connection to be rejected")
+	}
+
+	// The slot is released when the first connection ends
+	first.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		third, err := ssh.Dial("tcp", addr, config)
+		if err == nil {
+			third.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Dial() after release error = %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestServerStopForceClosesAfterDeadline(t *testing.T) {
+	server, config := startTestServer(t, &Config{LoginTimeout: 5 * time.Second})
+
+	client, err := ssh.Dial("tcp", server.listener.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = server.Stop(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Stop() error = %v, want a drain timeout", err)
+	}
+	// Stop returns at the deadline, not after the connections unwound
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stop() took %v", elapsed)
+	}
+	waitClosed(t, client, 3*time.Second)
+}
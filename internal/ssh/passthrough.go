@@ -1,11 +1,15 @@
 package ssh
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"sync"
+	"time"
 
+	"github.com/LZUOSS/gh-proxy/internal/proxy"
+	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -15,85 +19,120 @@ const (
 )
 
 // handleGitPassthrough handles bidirectional streaming between client and GitHub.
-func handleGitPassthrough(clientChannel ssh.Channel, gitCmd *GitCommand) int {
+// login is the authenticated GitHub login, which selects the upstream key,
+// and gitProtocol the client's GIT_PROTOCOL. Connecting upstream is
+// abandoned when ctx is done. It returns the upstream exit status, or the
+// signal that terminated the upstream command.
+func handleGitPassthrough(ctx context.Context, clientChannel ssh.Channel, gitCmd *GitCommand, upstream *Upstream, login, gitProtocol string, logger *zap.Logger) (int, *exitSignal) {
+	logger = logger.With(zap.String("command", gitCmd.String()))
+
 	// Validate command
 	if err := gitCmd.Validate(); err != nil {
-		log.Printf("invalid git command: %v", err)
-		clientChannel.Write([]byte(fmt.Sprintf("Error: %v\r\n", err)))
-		return 1
+		logger.Info("invalid git command", zap.Error(err))
+		fmt.Fprintf(clientChannel.Stderr(), "Error: %v\r\n", err)
+		return 1, nil
 	}
 
 	// Connect to GitHub's SSH server
-	githubConn, err := connectToGitHub(gitCmd)
+	githubConn, err := upstream.Connect(ctx, gitCmd, login, gitProtocol)
 	if err != nil {
-		log.Printf("failed to connect to GitHub: %v", err)
-		clientChannel.Write([]byte(fmt.Sprintf("Error connecting to GitHub: %v\r\n", err)))
-		return 1
+		logger.Warn("failed to connect to upstream SSH server", zap.Error(err))
+		// The error may name key files and sockets; keep those in the log
+		if errors.Is(err, errNoUpstreamKey) {
+			fmt.Fprintf(clientChannel.Stderr(), "Error: no upstream SSH key for %s/%s\r\n", gitCmd.Owner, gitCmd.Repo)
+		} else {
+			fmt.Fprint(clientChannel.Stderr(), "Error: failed to connect to GitHub\r\n")
+		}
+		return 1, nil
 	}
 	defer githubConn.Close()
 
-	// Create bidirectional streaming
-	var wg sync.WaitGroup
-	errChan := make(chan error, 2)
-
-	// Client -> GitHub
-	wg.Add(1)
+	// Client -> GitHub. The client keeps its side open until it has seen
+	// the exit status, so this copy is not waited for.
 	go func() {
-		defer wg.Done()
 		_, err := io.Copy(githubConn, clientChannel)
 		if err != nil && err != io.EOF {
-			errChan <- fmt.Errorf("client to GitHub copy error: %w", err)
+			logger.Debug("client to upstream copy failed", zap.Error(err))
 		}
 		// Close write side to signal EOF to GitHub
-		if closer, ok := githubConn.(interface{ CloseWrite() error }); ok {
-			closer.CloseWrite()
-		}
+		githubConn.CloseWrite()
 	}()
 
-	// GitHub -> Client
-	wg.Add(1)
+	// GitHub stdout and stderr -> client
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(clientChannel, githubConn)
-		if err != nil && err != io.EOF {
-			errChan <- fmt.Errorf("GitHub to client copy error: %w", err)
+		if _, err := io.Copy(clientChannel, githubConn); err != nil {
+			logger.Debug("upstream to client copy failed", zap.Error(err))
+			// The client is gone; do not keep the upstream command running
+			githubConn.Close()
 		}
-		// Close write side to signal EOF to client
-		if closer, ok := clientChannel.(interface{ CloseWrite() error }); ok {
-			closer.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(clientChannel.Stderr(), githubConn.Stderr()); err != nil {
+			logger.Debug("upstream stderr copy failed", zap.Error(err))
 		}
 	}()
-
-	// Wait for both goroutines to complete
 	wg.Wait()
-	close(errChan)
 
-	// Check for errors
-	for err := range errChan {
-		log.Printf("passthrough error: %v", err)
-		return 1
+	// Close write side to signal EOF to client
+	clientChannel.CloseWrite()
+
+	code, signal, err := upstreamExit(githubConn.Wait())
+	if err != nil {
+		logger.Warn("upstream command failed", zap.Error(err))
+	}
+	return code, signal
+}
+
+// upstreamExit converts the result of an upstream command into the exit
+// status or signal reported to the client, and returns err if the command
+// did not exit normally.
+func upstreamExit(err error) (int, *exitSignal, error) {
+	if err == nil {
+		return 0, nil, nil
 	}
 
-	return 0
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		if exitErr.Signal() != "" {
+			return 0, &exitSignal{Signal: exitErr.Signal(), Error: exitErr.Msg(), Lang: exitErr.Lang()}, nil
+		}
+		return exitErr.ExitStatus(), nil, nil
+	}
+	return 1, nil, err
 }
 
-// connectToGitHub establishes an SSH connection to GitHub's SSH server.
-func connectToGitHub(gitCmd *GitCommand) (ssh.Channel, error) {
+// Connect establishes an SSH connection to the upstream SSH server and
+// starts the Git command on it. It authenticates with the key mapped to
+// login, or with the deploy key of the repository. A non-empty gitProtocol
+// is passed on as GIT_PROTOCOL, so protocol v2 can be negotiated. The dial
+// and handshake are abandoned when ctx is done.
+func (u *Upstream) Connect(ctx context.Context, gitCmd *GitCommand, login, gitProtocol string) (*UpstreamChannel, error) {
+	key, err := u.keys.keyFor(login, gitCmd.Owner, gitCmd.Repo)
+	if err != nil {
+		return nil, err
+	}
+	auth, release, err := key.authMethod()
+	if err != nil {
+		return nil, err
+	}
+
 	// Create SSH client config for connecting to GitHub
 	config := &ssh.ClientConfig{
-		User: githubSSHUser,
-		Auth: []ssh.AuthMethod{
-			// GitHub doesn't actually check authentication for public repos via SSH protocol
-			// The authentication happens at the Git protocol level
-			ssh.Password(""),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // In production, verify GitHub's host key
+		User:              u.user,
+		Auth:              []ssh.AuthMethod{auth},
+		HostKeyCallback:   u.hostKey,
+		HostKeyAlgorithms: u.hostKeyAlgorithms,
 	}
 
-	// Connect to GitHub's SSH server
-	conn, err := ssh.Dial("tcp", githubSSHHost, config)
+	// Connect to GitHub's SSH server, through the egress proxy if configured
+	conn, err := u.dialSSH(ctx, config)
+	release()
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial GitHub SSH: %w", err)
+		return nil, fmt.Errorf("failed to dial GitHub SSH with key %s: %w", key.name, err)
 	}
 
 	// Open a session channel
@@ -125,6 +164,13 @@ func connectToGitHub(gitCmd *GitCommand) (ssh.Channel, error) {
 		return nil, fmt.Errorf("failed to get stderr pipe: %w", err)
 	}
 
+	if gitProtocol != "" {
+		// Servers that do not accept the variable fall back to protocol v0
+		if err := session.Setenv("GIT_PROTOCOL", gitProtocol); err != nil {
+			u.logger.Debug("upstream did not accept GIT_PROTOCOL", zap.Error(err))
+		}
+	}
+
 	// Start the Git command on GitHub's SSH server
 	gitCommand := gitCmd.FormatGitHubCommand()
 	if err := session.Start(gitCommand); err != nil {
@@ -134,7 +180,7 @@ func connectToGitHub(gitCmd *GitCommand) (ssh.Channel, error) {
 	}
 
 	// Create a wrapper that implements ssh.Channel interface
-	wrapper := &githubChannelWrapper{
+	wrapper := &UpstreamChannel{
 		session: session,
 		conn:    conn,
 		stdin:   stdin,
@@ -145,49 +191,85 @@ func connectToGitHub(gitCmd *GitCommand) (ssh.Channel, error) {
 	return wrapper, nil
 }
 
-// githubChannelWrapper wraps an SSH session to GitHub to implement ssh.Channel.
-type githubChannelWrapper struct {
+// dialSSH opens the transport connection with the upstream dialer and
+// performs the SSH handshake on it.
+func (u *Upstream) dialSSH(ctx context.Context, config *ssh.ClientConfig) (*ssh.Client, error) {
+	netConn, err := u.dial(proxy.WithHandler(ctx, proxy.HandlerSSH), "tcp", u.address)
+	if err != nil {
+		return nil, err
+	}
+
+	// A server that stalls the handshake must not hold the session forever
+	if u.handshakeTimeout > 0 {
+		netConn.SetDeadline(time.Now().Add(u.handshakeTimeout))
+	}
+	stop := context.AfterFunc(ctx, func() { netConn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(netConn, u.address, config)
+	stop()
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// UpstreamChannel wraps an SSH session to GitHub to implement ssh.Channel.
+type UpstreamChannel struct {
 	session *ssh.Session
 	conn    *ssh.Client
 	stdin   io.WriteCloser
 	stdout  io.Reader
 	stderr  io.Reader
+
+	// stdin may be closed by the copy from the client and by Close at once
+	closeStdin sync.Once
+	stdinErr   error
 }
 
 // Read reads from GitHub's stdout.
-func (w *githubChannelWrapper) Read(data []byte) (int, error) {
+func (w *UpstreamChannel) Read(data []byte) (int, error) {
 	return w.stdout.Read(data)
 }
 
 // Write writes to GitHub's stdin.
-func (w *githubChannelWrapper) Write(data []byte) (int, error) {
+func (w *UpstreamChannel) Write(data []byte) (int, error) {
 	return w.stdin.Write(data)
 }
 
+// Wait waits for the Git command to exit. It returns an *ssh.ExitError if
+// the command exited with a non-zero status or was killed by a signal.
+func (w *UpstreamChannel) Wait() error {
+	return w.session.Wait()
+}
+
 // Close closes the session and connection.
-func (w *githubChannelWrapper) Close() error {
-	w.stdin.Close()
+func (w *UpstreamChannel) Close() error {
+	w.CloseWrite()
 	w.session.Close()
 	return w.conn.Close()
 }
 
 // CloseWrite closes the write side (stdin).
-func (w *githubChannelWrapper) CloseWrite() error {
-	return w.stdin.Close()
+func (w *UpstreamChannel) CloseWrite() error {
+	w.closeStdin.Do(func() {
+		w.stdinErr = w.stdin.Close()
+	})
+	return w.stdinErr
 }
 
 // CloseRead is not implemented but required for ssh.Channel interface.
-func (w *githubChannelWrapper) CloseRead() error {
+func (w *UpstreamChannel) CloseRead() error {
 	return nil
 }
 
 // SendRequest is not implemented but required for ssh.Channel interface.
-func (w *githubChannelWrapper) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+func (w *UpstreamChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
 	return false, fmt.Errorf("SendRequest not supported")
 }
 
 // Stderr returns the stderr reader.
-func (w *githubChannelWrapper) Stderr() io.ReadWriter {
+func (w *UpstreamChannel) Stderr() io.ReadWriter {
 	return &stderrWrapper{w.stderr}
 }
 
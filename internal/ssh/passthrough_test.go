@@ -0,0 +1,177 @@
+package ssh
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/crypto/ssh"
+)
+
+// newPassthroughUpstream starts a test upstream server and returns an
+// upstream with a deploy key for owner/*.
+func newPassthroughUpstream(t *testing.T) *Upstream {
+	t.Helper()
+	dir := t.TempDir()
+	keyFile := writeTestKey(t, dir, "deploy_key")
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		t.Fatalf("ParsePrivateKey() error = %v", err)
+	}
+	server := newTestUpstream(t, signer.PublicKey())
+
+	u, err := NewUpstream(&UpstreamConfig{
+		Address:        server.addr,
+		User:           "git",
+		KnownHostsFile: server.knownHosts,
+		DeployKeys:     []DeployKey{{Repo: "owner/*", Logins: []string{"*"}, KeySource: KeySource{KeyFile: keyFile}}},
+	})
+	if err != nil {
+		t.Fatalf("NewUpstream() error = %v", err)
+	}
+	return u
+}
+
+func TestGitPassthroughRelaysExit(t *testing.T) {
+	u := newPassthroughUpstream(t)
+
+	tests := []struct {
+		name        string
+		repo        string
+		gitProtocol string
+		wantStatus  int
+		wantSignal  string
+		wantStdout  string
+		wantStderr  string
+	}{
+		{
+			name:        "success with protocol v2",
+			repo:        "repo",
+			gitProtocol: "version=2",
+			wantStdout:  "git-upload-pack 'owner/repo.git'",
+			wantStderr:  "GIT_PROTOCOL=version=2\n",
+		},
+		{
+			name:       "repository not found",
+			repo:       "missing",
+			wantStatus: 128,
+			wantStderr: "ERROR: Repository not found.\n",
+		},
+		{
+			name:       "killed by signal",
+			repo:       "killed",
+			wantSignal: "TERM",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			channel := &testChannel{in: strings.NewReader("")}
+			gitCmd := &GitCommand{Operation: "git-upload-pack", Owner: "owner", Repo: tt.repo}
+
+			status, signal := handleGitPassthrough(context.Background(), channel, gitCmd, u, "", tt.gitProtocol, zap.NewNop())
+
+			if status != tt.wantStatus {
+				t.Errorf("exit status = %d, want %d", status, tt.wantStatus)
+			}
+			gotSignal := ""
+			if signal != nil {
+				gotSignal = signal.Signal
+			}
+			if gotSignal != tt.wantSignal {
+				t.Errorf("exit signal = %q, want %q", gotSignal, tt.wantSignal)
+			}
+			if channel.out.String() != tt.wantStdout {
+				t.Errorf("stdout = %q, want %q", channel.out.String(), tt.wantStdout)
+			}
+			if channel.stderr.String() != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", channel.stderr.String(), tt.wantStderr)
+			}
+		})
+	}
+
+	// Local failures are reported on stderr, keeping stdout clean for git
+	channel := &testChannel{in: strings.NewReader("")}
+	status, _ := handleGitPassthrough(context.Background(), channel, &GitCommand{Operation: "git-upload-pack", Owner: "other", Repo: "repo"}, u, "", "", zap.NewNop())
+	if status != 1 || channel.out.Len() != 0 || !strings.Contains(channel.stderr.String(), "no upstream SSH key") {
+		t.Errorf("status = %d, stdout = %q, stderr = %q", status, channel.out.String(), channel.stderr.String())
+	}
+}
+
+func TestServerLogsCommands(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	server, config := startTestServer(t, &Config{
+		LoginTimeout: 5 * time.Second,
+		Upstream:     newPassthroughUpstream(t),
+		Logger:       zap.New(core),
+	})
+
+	client, err := ssh.Dial("tcp", server.listener.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession() error = %v", err)
+	}
+	output, err := session.Output("git-upload-pack '/owner/repo.git'")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	client.Close()
+
+	// The connection is logged as closed after the command
+	deadline := time.Now().Add(5 * time.Second)
+	for logs.FilterMessage("SSH connection closed").Len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	opened := logs.FilterMessage("SSH connection opened").All()
+	if len(opened) != 1 {
+		t.Fatalf("got %d connection opened entries, want 1", len(opened))
+	}
+	fields := opened[0].ContextMap()
+	if fields["login"] != "octocat" || fields["auth_method"] != "publickey" || fields["key_source"] != "test" {
+		t.Errorf("connection fields = %v", fields)
+	}
+	if fingerprint, _ := fields["key_fingerprint"].(string); !strings.HasPrefix(fingerprint, "SHA256:") {
+		t.Errorf("key_fingerprint = %q", fingerprint)
+	}
+
+	commands := logs.FilterMessage("SSH command").All()
+	if len(commands) != 1 {
+		t.Fatalf("got %d command entries, want 1", len(commands))
+	}
+	fields = commands[0].ContextMap()
+	want := map[string]interface{}{
+		"login":       "octocat",
+		"operation":   "git-upload-pack",
+		"owner":       "owner",
+		"repo":        "repo",
+		"transport":   "passthrough",
+		"bytes_in":    int64(0),
+		"bytes_out":   int64(len(output)),
+		"exit_status": int64(0),
+	}
+	for key, value := range want {
+		if fields[key] != value {
+			t.Errorf("%s = %v (%T), want %v", key, fields[key], fields[key], value)
+		}
+	}
+	if _, ok := fields["duration"]; !ok {
+		t.Error("command entry has no duration")
+	}
+
+	if logs.FilterMessage("SSH connection closed").Len() != 1 {
+		t.Error("connection closed was not logged")
+	}
+}
@@ -2,16 +2,15 @@ package ssh
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
-	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/LZUOSS/gh-proxy/internal/auth"
+	"github.com/LZUOSS/gh-proxy/internal/metrics"
+	"github.com/LZUOSS/gh-proxy/internal/policy"
+	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -20,18 +19,51 @@ type Server struct {
 	config   *ssh.ServerConfig
 	listener net.Listener
 	addr     string
-	wg       sync.WaitGroup
-	ctx      context.Context
-	cancel   context.CancelFunc
+	push     *policy.PushPolicy
+	upstream *Upstream
+	bridge   *Bridge
+	archiver *Archiver
+	logger   *zap.Logger
+
+	loginTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxDuration       time.Duration
+	keepaliveInterval time.Duration
+	keepaliveCountMax int
+	limiter           *connLimiter
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{} // open connections, closed on forced shutdown
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // Config contains SSH server configuration.
 type Config struct {
-	Address        string // Address to listen on (e.g., ":2222")
-	HostKeyPath    string // Path to host private key
-	HostKey        []byte // Raw host private key (alternative to HostKeyPath)
-	EnablePassword bool   // Enable password authentication
-	EnablePubKey   bool   // Enable public key authentication
+	Address        string   // Address to listen on (e.g., ":2222")
+	HostKeyPaths   []string // Host private key files, generated if missing
+	HostKey        []byte   // Raw host private key (alternative to HostKeyPaths)
+	EnablePassword bool     // Enable password authentication
+	EnablePubKey   bool     // Enable public key authentication
+
+	LoginTimeout time.Duration // Maximum time to complete the handshake (0 = no limit)
+	IdleTimeout  time.Duration // Close connections without channel traffic for this long (0 = never)
+	MaxDuration  time.Duration // Close connections open for this long (0 = never)
+
+	KeepaliveInterval time.Duration // Send keepalives this often (0 = never)
+	KeepaliveCountMax int           // Close connections after this many unanswered keepalives
+
+	MaxConnections      int // Concurrent connections (0 = unlimited)
+	MaxConnectionsPerIP int // Concurrent connections per source IP (0 = unlimited)
+
+	KeyAuthorizer KeyAuthorizer      // Maps public keys to identities; nil rejects all keys
+	PushPolicy    *policy.PushPolicy // Push policy; nil denies all pushes
+	Upstream      *Upstream          // Upstream SSH server; nil connects to github.com
+	Bridge        *Bridge            // Bridge git commands to smart HTTP instead of Upstream
+	Archiver      *Archiver          // Serves git-upload-archive; nil disables it
+	Logger        *zap.Logger        // Audit and error log; nil discards it
 }
 
 // NewServer creates a new SSH server.
@@ -44,52 +76,102 @@ func NewServer(cfg *Config) (*Server, error) {
 		cfg.Address = ":2222"
 	}
 
-	// Parse or generate host key
-	var hostKey ssh.Signer
-	var err error
+	logger := cfg.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	// Load, parse or generate host keys
+	var hostKeys []ssh.Signer
 
 	if len(cfg.HostKey) > 0 {
-		hostKey, err = ssh.ParsePrivateKey(cfg.HostKey)
+		hostKey, err := ssh.ParsePrivateKey(cfg.HostKey)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse host key: %w", err)
 		}
-	} else {
-		// Generate a temporary host key for testing
-		// In production, you should load a persistent key
-		hostKey, err = generateHostKey()
+		hostKeys = append(hostKeys, hostKey)
+	}
+
+	for _, path := range cfg.HostKeyPaths {
+		hostKey, created, err := LoadOrCreateHostKey(path)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("loaded SSH host key",
+			zap.String("path", path),
+			zap.String("fingerprint", ssh.FingerprintSHA256(hostKey.PublicKey())),
+			zap.Bool("generated", created),
+		)
+		hostKeys = append(hostKeys, hostKey)
+	}
+
+	if len(hostKeys) == 0 {
+		// Without configured keys clients see a new host key on every start
+		hostKey, err := ephemeralHostKey()
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate host key: %w", err)
 		}
+		logger.Warn("generated temporary SSH host key; configure host_key_paths to persist it",
+			zap.String("fingerprint", ssh.FingerprintSHA256(hostKey.PublicKey())),
+		)
+		hostKeys = append(hostKeys, hostKey)
+	}
+
+	upstream := cfg.Upstream
+	if upstream == nil {
+		var err error
+		if upstream, err = NewUpstream(nil); err != nil {
+			return nil, err
+		}
 	}
 
-	// Create SSH server config
+	// Create SSH server config; disabled methods are not offered to clients
 	sshConfig := &ssh.ServerConfig{
-		// Configure authentication callbacks
-		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-			if !cfg.EnablePassword {
-				return nil, fmt.Errorf("password authentication disabled")
-			}
-			return handlePasswordAuth(conn.User(), string(password))
-		},
-		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			if !cfg.EnablePubKey {
-				return nil, fmt.Errorf("public key authentication disabled")
-			}
-			// For now, accept any public key (in production, validate against authorized keys)
-			return &ssh.Permissions{}, nil
-		},
 		ServerVersion: "SSH-2.0-github-reverse-proxy",
 	}
+	if cfg.EnablePassword {
+		sshConfig.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			perms, err := handlePasswordAuth(conn.User(), string(password))
+			logAuthAttempt(logger, conn, "password", "", err)
+			return perms, err
+		}
+	}
+	if cfg.EnablePubKey {
+		sshConfig.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			perms, err := handlePublicKeyAuth(cfg.KeyAuthorizer, conn, key)
+			logAuthAttempt(logger, conn, "publickey", ssh.FingerprintSHA256(key), err)
+			return perms, err
+		}
+	}
 
-	sshConfig.AddHostKey(hostKey)
+	for _, hostKey := range hostKeys {
+		sshConfig.AddHostKey(hostKey)
+	}
+
+	if cfg.KeepaliveInterval > 0 && cfg.KeepaliveCountMax <= 0 {
+		cfg.KeepaliveCountMax = 3
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Server{
-		config: sshConfig,
-		addr:   cfg.Address,
-		ctx:    ctx,
-		cancel: cancel,
+		config:   sshConfig,
+		addr:     cfg.Address,
+		push:     cfg.PushPolicy,
+		upstream: upstream,
+		bridge:   cfg.Bridge,
+		archiver: cfg.Archiver,
+		logger:   logger,
+		ctx:      ctx,
+		cancel:   cancel,
+
+		loginTimeout:      cfg.LoginTimeout,
+		idleTimeout:       cfg.IdleTimeout,
+		maxDuration:       cfg.MaxDuration,
+		keepaliveInterval: cfg.KeepaliveInterval,
+		keepaliveCountMax: cfg.KeepaliveCountMax,
+		limiter:           newConnLimiter(cfg.MaxConnections, cfg.MaxConnectionsPerIP),
+		conns:             make(map[net.Conn]struct{}),
 	}, nil
 }
 
@@ -101,7 +183,7 @@ func (s *Server) Start() error {
 	}
 
 	s.listener = listener
-	log.Printf("SSH server listening on %s", s.addr)
+	s.logger.Info("SSH server listening", zap.String("address", s.addr))
 
 	s.wg.Add(1)
 	go s.acceptLoop()
@@ -109,8 +191,10 @@ func (s *Server) Start() error {
 	return nil
 }
 
-// Stop gracefully stops the SSH server.
-func (s *Server) Stop() error {
+// Stop stops accepting connections and waits for open ones to finish.
+// When ctx is done first, the remaining connections are closed and Stop
+// returns without waiting for them.
+func (s *Server) Stop(ctx context.Context) error {
 	if s.cancel != nil {
 		s.cancel()
 	}
@@ -121,9 +205,29 @@ func (s *Server) Stop() error {
 		}
 	}
 
-	s.wg.Wait()
-	log.Println("SSH server stopped")
-	return nil
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.logger.Info("SSH server stopped")
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	n := len(s.conns)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	// The closed connections unwind in the background; waiting for them
+	// would overrun the caller's deadline
+	return fmt.Errorf("closed %d SSH connections after drain timeout: %w", n, ctx.Err())
 }
 
 // acceptLoop continuously accepts incoming SSH connections.
@@ -143,43 +247,108 @@ func (s *Server) acceptLoop() {
 			case <-s.ctx.Done():
 				return
 			default:
-				log.Printf("failed to accept connection: %v", err)
+				s.logger.Warn("failed to accept SSH connection", zap.Error(err))
 				continue
 			}
 		}
 
+		release, err := s.limiter.acquire(conn.RemoteAddr())
+		if err != nil {
+			s.logger.Warn("SSH connection rejected",
+				zap.String("remote_addr", conn.RemoteAddr().String()),
+				zap.String("reason", err.Error()),
+			)
+			metrics.RecordSSHConnection("rejected")
+			conn.Close()
+			continue
+		}
+
 		s.wg.Add(1)
-		go s.handleConnection(conn)
+		go func() {
+			defer release()
+			s.handleConnection(conn)
+		}()
 	}
 }
 
+// track adds conn to the open connections, or removes it when done. It
+// returns false if the server is shutting down.
+func (s *Server) track(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
 // handleConnection handles a single SSH connection.
 func (s *Server) handleConnection(netConn net.Conn) {
 	defer s.wg.Done()
 	defer netConn.Close()
 
+	if !s.track(netConn, true) {
+		return
+	}
+	defer s.track(netConn, false)
+
+	// Bound the handshake so unauthenticated clients cannot hold connections
+	if s.loginTimeout > 0 {
+		netConn.SetDeadline(time.Now().Add(s.loginTimeout))
+	}
+
 	// Perform SSH handshake
 	sshConn, chans, reqs, err := ssh.NewServerConn(netConn, s.config)
 	if err != nil {
-		log.Printf("failed to handshake: %v", err)
+		s.logger.Info("SSH handshake failed",
+			zap.String("remote_addr", netConn.RemoteAddr().String()),
+			zap.Error(err),
+		)
+		metrics.RecordSSHConnection("handshake_failed")
 		return
 	}
 	defer sshConn.Close()
 
-	log.Printf("new SSH connection from %s (user: %s)", sshConn.RemoteAddr(), sshConn.User())
+	if s.loginTimeout > 0 {
+		netConn.SetDeadline(time.Time{})
+	}
+
+	start := time.Now()
+	fields := connectionFields(sshConn)
+	s.logger.Info("SSH connection opened", fields...)
+	metrics.RecordSSHConnection("accepted")
+	metrics.SSHActiveConnections.Inc()
+	defer func() {
+		metrics.SSHActiveConnections.Dec()
+		s.logger.Info("SSH connection closed", append(fields, zap.Duration("duration", time.Since(start)))...)
+	}()
+
+	watch := watchConnection(sshConn, s.logger, s.idleTimeout, s.maxDuration, s.keepaliveInterval, s.keepaliveCountMax)
+	defer watch.Stop()
 
 	// Discard global requests
 	go ssh.DiscardRequests(reqs)
 
 	// Handle channels
+	var channels sync.WaitGroup
 	for newChannel := range chans {
 		s.wg.Add(1)
-		go s.handleChannel(sshConn, newChannel)
+		channels.Add(1)
+		go func() {
+			defer channels.Done()
+			s.handleChannel(sshConn, newChannel, watch)
+		}()
 	}
+	channels.Wait()
 }
 
 // handleChannel handles a single SSH channel.
-func (s *Server) handleChannel(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+func (s *Server) handleChannel(conn *ssh.ServerConn, newChannel ssh.NewChannel, watch *connWatch) {
 	defer s.wg.Done()
 
 	// Only accept "session" channels
@@ -190,61 +359,95 @@ func (s *Server) handleChannel(conn *ssh.ServerConn, newChannel ssh.NewChannel)
 
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
-		log.Printf("failed to accept channel: %v", err)
+		s.logger.Warn("failed to accept SSH channel", zap.Error(err))
 		return
 	}
 
 	// Handle session
-	session := NewSession(channel, conn.User())
+	session := NewSession(&activityChannel{Channel: channel, watch: watch}, conn, s.push, s.upstream, s.bridge, s.archiver, s.logger)
 	session.Handle(requests)
 }
 
-// handlePasswordAuth validates password authentication using GitHub PAT.
-func handlePasswordAuth(username, password string) (*ssh.Permissions, error) {
-	// Validate credentials against GitHub API
-	token, err := auth.ValidateBasicAuth(username, password)
+// connectionFields returns the audit log fields identifying an
+// authenticated connection.
+func connectionFields(conn *ssh.ServerConn) []zap.Field {
+	fields := []zap.Field{
+		zap.String("remote_addr", conn.RemoteAddr().String()),
+		zap.String("user", conn.User()),
+	}
+	if conn.Permissions != nil {
+		ext := conn.Permissions.Extensions
+		fields = append(fields,
+			zap.String("login", ext["login"]),
+			zap.String("auth_method", ext["auth-method"]),
+		)
+		if fingerprint := ext["key-fingerprint"]; fingerprint != "" {
+			fields = append(fields,
+				zap.String("key_fingerprint", fingerprint),
+				zap.String("key_source", ext["key-source"]),
+			)
+		}
+	}
+	return fields
+}
+
+// logAuthAttempt records an authentication attempt. fingerprint is the
+// offered public key, if any.
+func logAuthAttempt(logger *zap.Logger, conn ssh.ConnMetadata, method, fingerprint string, err error) {
+	metrics.RecordSSHAuth(method, err == nil)
+	if err == nil {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("remote_addr", conn.RemoteAddr().String()),
+		zap.String("user", conn.User()),
+		zap.String("method", method),
+		zap.Error(err),
+	}
+	if fingerprint != "" {
+		fields = append(fields, zap.String("key_fingerprint", fingerprint))
+	}
+	logger.Info("SSH authentication failed", fields...)
+}
+
+// handlePublicKeyAuth authorizes a public key and records the identity it
+// belongs to for the session.
+func handlePublicKeyAuth(authorizer KeyAuthorizer, conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if authorizer == nil {
+		return nil, ErrKeyNotAuthorized
+	}
+
+	identity, err := authorizer.AuthorizeKey(conn, key)
 	if err != nil {
 		return nil, fmt.Errorf("authentication failed: %w", err)
 	}
 
-	// Return permissions with token metadata
 	return &ssh.Permissions{
 		Extensions: map[string]string{
-			"token":    token.Value,
-			"username": token.Username,
-			"login":    token.Login,
+			"auth-method":     "publickey",
+			"login":           identity.Login,
+			"key-source":      identity.Source,
+			"key-fingerprint": ssh.FingerprintSHA256(key),
 		},
 	}, nil
 }
 
-// generateHostKey generates a temporary RSA host key.
-// In production, you should generate and persist a key to maintain
-// consistent host key across restarts.
-func generateHostKey() (ssh.Signer, error) {
-	// Generate RSA private key
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate RSA key: %w", err)
-	}
-
-	// Convert to SSH signer
-	signer, err := ssh.NewSignerFromKey(privateKey)
+// handlePasswordAuth validates password authentication using GitHub PAT.
+func handlePasswordAuth(username, password string) (*ssh.Permissions, error) {
+	// Validate credentials against GitHub API
+	token, err := auth.ValidateBasicAuth(username, password)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create signer: %w", err)
+		return nil, fmt.Errorf("authentication failed: %w", err)
 	}
 
-	// Log the public key for debugging
-	publicKey := signer.PublicKey()
-	log.Printf("Generated SSH host key: %s", ssh.FingerprintSHA256(publicKey))
-
-	return signer, nil
-}
-
-// SaveHostKey saves a host key to PEM format (for future use).
-func SaveHostKey(key *rsa.PrivateKey) []byte {
-	privateKeyPEM := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	}
-	return pem.EncodeToMemory(privateKeyPEM)
+	// Return permissions with token metadata
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"auth-method": "password",
+			"token":       token.Value,
+			"username":    token.Username,
+			"login":       token.Login,
+		},
+	}, nil
 }
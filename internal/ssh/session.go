@@ -1,36 +1,93 @@
 package ssh
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/LZUOSS/gh-proxy/internal/auth"
+	"github.com/LZUOSS/gh-proxy/internal/metrics"
+	"github.com/LZUOSS/gh-proxy/internal/pktline"
+	"github.com/LZUOSS/gh-proxy/internal/policy"
+	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
 
 // Session represents an SSH session handling Git operations.
 type Session struct {
-	channel  ssh.Channel
-	username string
+	channel    *countingChannel
+	username   string
+	login      string // GitHub login established during authentication
+	token      string // GitHub token from password authentication
+	remoteAddr string
+	push       *policy.PushPolicy
+	upstream   *Upstream
+	bridge     *Bridge
+	archiver   *Archiver
+	logger     *zap.Logger // carries the connection's identity fields
+
+	gitProtocol string // GIT_PROTOCOL sent by the client, e.g. "version=2"
 }
 
-// NewSession creates a new SSH session.
-func NewSession(channel ssh.Channel, username string) *Session {
-	return &Session{
-		channel:  channel,
-		username: username,
+// NewSession creates a new SSH session for an authenticated connection.
+// A nil push policy denies all pushes. If bridge is not nil, git commands
+// are bridged to smart HTTP instead of the upstream SSH server. A nil
+// archiver disables git-upload-archive. Commands are logged to logger if it
+// is not nil.
+func NewSession(channel ssh.Channel, conn *ssh.ServerConn, push *policy.PushPolicy, upstream *Upstream, bridge *Bridge, archiver *Archiver, logger *zap.Logger) *Session {
+	if push == nil {
+		push = policy.NewPushPolicy(nil, nil)
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	s := &Session{
+		channel:    &countingChannel{Channel: channel},
+		username:   conn.User(),
+		remoteAddr: conn.RemoteAddr().String(),
+		push:       push,
+		upstream:   upstream,
+		bridge:     bridge,
+		archiver:   archiver,
+		logger:     logger.With(connectionFields(conn)...),
 	}
+	if conn.Permissions != nil {
+		s.login = conn.Permissions.Extensions["login"]
+		s.token = conn.Permissions.Extensions["token"]
+	}
+	return s
 }
 
 // Handle processes SSH session requests.
 func (s *Session) Handle(requests <-chan *ssh.Request) {
 	defer s.channel.Close()
 
+	// requests is closed when the client closes the channel or the
+	// connection drops, which cancels the running command
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var running chan struct{}
+
 	for req := range requests {
+		// Only one command runs per session; later requests are refused
+		if running != nil {
+			req.Reply(false, nil)
+			continue
+		}
+
 		switch req.Type {
 		case "exec":
-			// Git commands come as "exec" requests
-			s.handleExec(req)
+			// Git commands come as "exec" requests; the channel is closed
+			// after the exit status, so clients waiting for it finish
+			running = make(chan struct{})
+			go func() {
+				defer close(running)
+				s.handleExec(ctx, req)
+				s.channel.Close()
+			}()
 		case "shell":
 			// Reject shell requests - we only support Git operations
 			req.Reply(false, nil)
@@ -39,26 +96,31 @@ func (s *Session) Handle(requests <-chan *ssh.Request) {
 			// Reject PTY requests
 			req.Reply(false, nil)
 		case "env":
-			// Accept but ignore environment variables
-			req.Reply(true, nil)
+			// Only GIT_PROTOCOL is used; other variables are accepted and ignored
+			s.handleEnv(req)
 		default:
 			// Reject unknown request types
-			log.Printf("unknown request type: %s", req.Type)
+			s.logger.Debug("rejected SSH request", zap.String("type", req.Type))
 			req.Reply(false, nil)
 		}
 	}
+
+	if running != nil {
+		cancel()
+		<-running
+	}
 }
 
-// handleExec handles the "exec" request for Git commands.
-func (s *Session) handleExec(req *ssh.Request) {
+// handleExec handles the "exec" request for Git commands. Upstream
+// connections and requests are cancelled with ctx.
+func (s *Session) handleExec(ctx context.Context, req *ssh.Request) {
 	// Parse the command from the request payload
 	command := string(req.Payload[4:]) // Skip the first 4 bytes (length prefix)
 
-	log.Printf("exec command from %s: %s", s.username, command)
-
 	// Parse Git command
 	gitCmd, err := parseGitCommand(command)
 	if err != nil {
+		s.logger.Info("SSH command rejected", zap.String("command", command), zap.Error(err))
 		req.Reply(false, nil)
 		s.channel.Write([]byte(fmt.Sprintf("Error: %v\r\n", err)))
 		s.channel.SendRequest("exit-status", false, ssh.Marshal(exitStatus{Status: 1}))
@@ -68,19 +130,147 @@ func (s *Session) handleExec(req *ssh.Request) {
 	// Reply to the exec request
 	req.Reply(true, nil)
 
-	// Execute the Git command through passthrough
-	exitCode := handleGitPassthrough(s.channel, gitCmd)
+	cmd := &commandAudit{
+		gitCmd:   gitCmd,
+		start:    time.Now(),
+		bytesIn:  s.channel.in.Load(),
+		bytesOut: s.channel.out.Load(),
+	}
+
+	// Pushes must pass the push policy before connecting upstream
+	if gitCmd.IsReceive() {
+		if err := s.authorizePush(gitCmd); err != nil {
+			s.rejectPush(err)
+			cmd.transport = "policy"
+			s.audit(cmd, 1, nil)
+			return
+		}
+	}
+
+	// Execute the Git command through the archiver, bridge or passthrough
+	var exitCode int
+	var signal *exitSignal
+	if gitCmd.IsArchive() {
+		cmd.transport = "archive"
+		exitCode = s.serveArchive(ctx, gitCmd)
+	} else if s.bridge != nil {
+		cmd.transport = "bridge"
+		exitCode = s.bridge.Serve(ctx, s.channel, gitCmd, s.identity(), s.remoteAddr, s.gitProtocol)
+	} else {
+		cmd.transport = "passthrough"
+		exitCode, signal = handleGitPassthrough(ctx, s.channel, gitCmd, s.upstream, s.login, s.gitProtocol, s.logger)
+	}
+	s.audit(cmd, exitCode, signal)
 
-	// Send exit status
+	// Send exit status, or the signal that ended the upstream command
+	if signal != nil {
+		s.channel.SendRequest("exit-signal", false, ssh.Marshal(signal))
+		return
+	}
 	s.channel.SendRequest("exit-status", false, ssh.Marshal(exitStatus{Status: uint32(exitCode)}))
 }
 
+// commandAudit tracks a git command for the audit log.
+type commandAudit struct {
+	gitCmd    *GitCommand
+	transport string // "passthrough", "bridge", "archive" or "policy"
+	start     time.Time
+	bytesIn   int64 // channel counters when the command started
+	bytesOut  int64
+}
+
+// audit logs a finished command with the bytes it transferred and records
+// it in the SSH metrics.
+func (s *Session) audit(cmd *commandAudit, exitCode int, signal *exitSignal) {
+	duration := time.Since(cmd.start)
+	bytesIn := s.channel.in.Load() - cmd.bytesIn
+	bytesOut := s.channel.out.Load() - cmd.bytesOut
+	success := exitCode == 0 && signal == nil
+
+	fields := []zap.Field{
+		zap.String("operation", cmd.gitCmd.Operation),
+		zap.String("owner", cmd.gitCmd.Owner),
+		zap.String("repo", cmd.gitCmd.Repo),
+		zap.String("transport", cmd.transport),
+		zap.Int64("bytes_in", bytesIn),
+		zap.Int64("bytes_out", bytesOut),
+		zap.Duration("duration", duration),
+		zap.Int("exit_status", exitCode),
+	}
+	if signal != nil {
+		fields = append(fields, zap.String("exit_signal", signal.Signal))
+	}
+	s.logger.Info("SSH command", fields...)
+
+	metrics.RecordSSHCommand(cmd.gitCmd.Operation, success, duration.Seconds(), bytesIn, bytesOut)
+}
+
+// serveArchive runs git-upload-archive, which GitHub does not offer over
+// SSH, from the HTTP archive endpoint.
+func (s *Session) serveArchive(ctx context.Context, gitCmd *GitCommand) int {
+	if s.archiver == nil {
+		pktline.NewEncoder(s.channel).EncodeString("NACK git-upload-archive is not enabled on this server\n")
+		return 1
+	}
+	return s.archiver.Serve(ctx, s.channel, gitCmd, s.identity(), s.remoteAddr)
+}
+
+// handleEnv records the GIT_PROTOCOL environment variable.
+func (s *Session) handleEnv(req *ssh.Request) {
+	var env struct {
+		Name  string
+		Value string
+	}
+	if err := ssh.Unmarshal(req.Payload, &env); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	if env.Name == "GIT_PROTOCOL" {
+		s.gitProtocol = env.Value
+	}
+	req.Reply(true, nil)
+}
+
+// identity returns the authenticated user as a token for bridged requests,
+// or nil for anonymous sessions.
+func (s *Session) identity() *auth.Token {
+	if s.token == "" && s.login == "" {
+		return nil
+	}
+	return &auth.Token{
+		Value:    s.token,
+		Username: s.login,
+		Login:    s.login,
+	}
+}
+
+// authorizePush applies the push policy to a git-receive-pack command.
+func (s *Session) authorizePush(gitCmd *GitCommand) error {
+	return s.push.Authorize(policy.PushAttempt{
+		Transport:  "ssh",
+		Stage:      gitCmd.Operation,
+		User:       s.login,
+		Owner:      gitCmd.Owner,
+		Repo:       gitCmd.Repo,
+		RemoteAddr: s.remoteAddr,
+	})
+}
+
+// rejectPush reports a denied push to the client. The ERR pkt-line makes git
+// print the reason as a remote error; the stderr copy covers other clients.
+func (s *Session) rejectPush(err error) {
+	pktline.NewEncoder(s.channel).Error(err.Error())
+	fmt.Fprintf(s.channel.Stderr(), "Error: %v\n", err)
+	s.channel.SendRequest("exit-status", false, ssh.Marshal(exitStatus{Status: 1}))
+}
+
 // parseGitCommand parses a Git command and extracts owner and repo.
 func parseGitCommand(command string) (*GitCommand, error) {
 	// Trim whitespace
 	command = strings.TrimSpace(command)
 
-	// Expected format: "git-upload-pack '/owner/repo.git'" or "git-receive-pack '/owner/repo.git'"
+	// Expected format: "git-upload-pack '/owner/repo.git'", "git-receive-pack '/owner/repo.git'"
+	// or "git-upload-archive '/owner/repo.git'"
 	parts := strings.Fields(command)
 	if len(parts) < 2 {
 		return nil, fmt.Errorf("invalid git command format: %s", command)
@@ -90,8 +280,8 @@ func parseGitCommand(command string) (*GitCommand, error) {
 	repoPath := strings.Trim(parts[1], "'\"")
 
 	// Validate Git operation
-	if gitOp != "git-upload-pack" && gitOp != "git-receive-pack" {
-		return nil, fmt.Errorf("unsupported git operation: %s (only git-upload-pack and git-receive-pack are supported)", gitOp)
+	if gitOp != "git-upload-pack" && gitOp != "git-receive-pack" && gitOp != "git-upload-archive" {
+		return nil, fmt.Errorf("unsupported git operation: %s (only git-upload-pack, git-receive-pack and git-upload-archive are supported)", gitOp)
 	}
 
 	// Parse repository path
@@ -161,7 +351,38 @@ func isValidGitHubName(name string) bool {
 	return true
 }
 
+// countingChannel is a channel that counts the bytes read from and written
+// to the client. Stderr is not counted.
+type countingChannel struct {
+	ssh.Channel
+	in  atomic.Int64
+	out atomic.Int64
+}
+
+// Read reads from the channel and counts the bytes.
+func (c *countingChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+// Write writes to the channel and counts the bytes.
+func (c *countingChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	c.out.Add(int64(n))
+	return n, err
+}
+
 // exitStatus is used for sending exit status over SSH.
 type exitStatus struct {
 	Status uint32
 }
+
+// exitSignal is used for sending the signal that terminated a command over
+// SSH (RFC 4254, section 6.10).
+type exitSignal struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
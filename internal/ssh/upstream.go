@@ -0,0 +1,196 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/LZUOSS/gh-proxy/internal/metrics"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// githubKnownHosts are GitHub's published SSH host keys, see
+// https://docs.github.com/en/authentication/keeping-your-account-and-data-secure/githubs-ssh-key-fingerprints
+const githubKnownHosts = `github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+github.com ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBEmKSENjQEezOmxkZMy7opKgwFB9nkt5YRrYMjNuG5N87uRgg6CLrbo5wAdT/y6v0mKV0U2w0WZ2YB/++Tpockg=
+github.com ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQCj7ndNxQowgcQnjshcLrqPEiiphnt+VTTvDP6mHBL9j1aNUkY4Ue1gvwnGLVlOhGeYrnZaMgRK6+PKCUXaDbC7qtbW8gIkhL7aGCsOr/C56SJMy/BCZfxd1nWzAOxSDPgVsmerOBYfNqltV9/hWCqBywINIR+5dIg6JTJ72pcEpEjcYgXkE2YEFXV1JHnsKgbLWNlhScqb2UmyRkQyytRLtL+38TGxkxCflmO+5Z8CSSNY7GidjMIZ7Q4zMjA2n1nGrlTDkzwDCsw+wqFPGQA179cnfGWOWRVruj16z6XyvxvjJwbz0wQZ75XK5tKSb7FNyeIEs4TT4jk+S4dhPeAUC5y+bDYirYgM4GC7uEnztnZyaVWQ7B381AK4Qdrwt51ZqExKbQpTUNn+EjqoTwvqNj4kqx5QUCI0ThS/YkOxJCXmPUWZbhjpCg56i+2aB6CmK2JGhn57K5mj0MNdBXA4/WnwH6XoPWJzK5Nyu2zB3nAZp+S5hpQs+p1vN1/wsjk=
+`
+
+// ErrHostKeyMismatch is returned when the upstream SSH server presents a
+// host key that is not pinned for it.
+var ErrHostKeyMismatch = errors.New("upstream host key mismatch")
+
+// UpstreamConfig configures the SSH connection to GitHub.
+type UpstreamConfig struct {
+	Address        string // SSH server address (e.g., "github.com:22" or "ssh.github.com:443")
+	User           string // SSH user name (e.g., "git")
+	KnownHostsFile string // known_hosts file with the pinned host keys; GitHub's published keys if empty
+
+	UserKeys   []UserKey   // Keys used on behalf of authenticated users, tried first
+	DeployKeys []DeployKey // Keys used per repository, first match wins
+
+	HandshakeTimeout time.Duration // Maximum time for the SSH handshake (default 30s)
+
+	// Dial opens the TCP connection, e.g. through the egress proxy
+	// (proxy.ProxyClient.DialContext). Connections are direct if nil.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	Logger *zap.Logger // Error log; nil discards it
+}
+
+// Upstream dials the upstream SSH server and verifies its host key.
+type Upstream struct {
+	address string
+	user    string
+	hostKey ssh.HostKeyCallback
+	keys    *upstreamKeys
+	dial    func(ctx context.Context, network, addr string) (net.Conn, error)
+	logger  *zap.Logger
+
+	handshakeTimeout time.Duration
+
+	// hostKeyAlgorithms restricts negotiation to the pinned key types, so a
+	// server with several keys presents one that can be verified
+	hostKeyAlgorithms []string
+}
+
+// NewUpstream creates an upstream for cfg. A nil cfg connects to
+// github.com:22 as "git" and pins GitHub's published host keys.
+func NewUpstream(cfg *UpstreamConfig) (*Upstream, error) {
+	if cfg == nil {
+		cfg = &UpstreamConfig{}
+	}
+
+	u := &Upstream{
+		address: cfg.Address,
+		user:    cfg.User,
+		dial:    cfg.Dial,
+		logger:  cfg.Logger,
+
+		handshakeTimeout: cfg.HandshakeTimeout,
+	}
+	if u.address == "" {
+		u.address = githubSSHHost
+	}
+	if u.user == "" {
+		u.user = githubSSHUser
+	}
+	if u.handshakeTimeout <= 0 {
+		u.handshakeTimeout = 30 * time.Second
+	}
+	if u.logger == nil {
+		u.logger = zap.NewNop()
+	}
+	if u.dial == nil {
+		u.dial = (&net.Dialer{Timeout: 30 * time.Second}).DialContext
+	}
+
+	var callback ssh.HostKeyCallback
+	if cfg.KnownHostsFile != "" {
+		var err error
+		callback, err = knownhosts.New(cfg.KnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known hosts %s: %w", cfg.KnownHostsFile, err)
+		}
+		u.hostKeyAlgorithms, err = knownKeyAlgorithms(callback, u.address)
+		if err != nil {
+			return nil, fmt.Errorf("known hosts %s: %w", cfg.KnownHostsFile, err)
+		}
+	} else {
+		keys, err := parsePinnedKeys([]byte(githubKnownHosts))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse GitHub host keys: %w", err)
+		}
+		callback = pinnedHostKeys(keys)
+	}
+	u.hostKey = verifyHostKey(callback)
+
+	keys, err := newUpstreamKeys(cfg.UserKeys, cfg.DeployKeys)
+	if err != nil {
+		return nil, err
+	}
+	u.keys = keys
+
+	return u, nil
+}
+
+// Address returns the upstream SSH server address.
+func (u *Upstream) Address() string {
+	return u.address
+}
+
+// knownKeyAlgorithms returns the host key algorithms of the keys a known
+// hosts callback has for address. The callback only lists them in the error
+// for a key it does not know, so it is probed with a throwaway key.
+func knownKeyAlgorithms(callback ssh.HostKeyCallback, address string) ([]string, error) {
+	probe, err := ephemeralHostKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var keyErr *knownhosts.KeyError
+	err = callback(address, &net.TCPAddr{IP: net.IPv4zero}, probe.PublicKey())
+	if !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		return nil, fmt.Errorf("no host keys for %s", address)
+	}
+
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch keyType := known.Key.Type(); keyType {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, keyType)
+		}
+	}
+	return algorithms, nil
+}
+
+// parsePinnedKeys returns the keys of a known_hosts document.
+func parsePinnedKeys(data []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		_, _, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys, nil
+}
+
+// pinnedHostKeys accepts exactly the given keys, whatever the host name.
+func pinnedHostKeys(keys []ssh.PublicKey) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		for _, pinned := range keys {
+			if bytes.Equal(pinned.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		return ErrHostKeyMismatch
+	}
+}
+
+// verifyHostKey wraps a host key callback so rejected keys are counted and
+// reported with the presented fingerprint.
+func verifyHostKey(callback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		metrics.RecordSSHHostKeyMismatch(hostname)
+		if !errors.Is(err, ErrHostKeyMismatch) {
+			err = fmt.Errorf("%w: %v", ErrHostKeyMismatch, err)
+		}
+		return fmt.Errorf("refusing to connect to %s, it presented %s key %s: %w",
+			hostname, key.Type(), ssh.FingerprintSHA256(key), err)
+	}
+}
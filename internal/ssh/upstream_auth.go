@@ -0,0 +1,147 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// KeySource provides the keys the proxy authenticates with upstream: a
+// private key file or an ssh-agent socket. Exactly one of the fields is set.
+type KeySource struct {
+	KeyFile     string // Unencrypted private key file
+	AgentSocket string // ssh-agent socket offering the keys
+}
+
+// UserKey maps an authenticated GitHub login to its upstream keys.
+type UserKey struct {
+	Login string
+	KeySource
+}
+
+// DeployKey maps repositories to upstream deploy keys.
+type DeployKey struct {
+	Repo   string   // "owner/repo", or a glob such as "owner/*"
+	Logins []string // Logins allowed to use the key; "*" allows every session
+	KeySource
+}
+
+// errNoUpstreamKey is returned when no upstream key may be used for a
+// connection.
+var errNoUpstreamKey = errors.New("no upstream SSH key configured")
+
+// upstreamKey is a loaded key source. File keys are parsed once; agent
+// keys are listed on every connection, so keys added later are picked up.
+type upstreamKey struct {
+	name   string
+	signer ssh.Signer
+	socket string
+}
+
+// loadKeySource loads the key file of source, or records its agent socket.
+func loadKeySource(source KeySource) (*upstreamKey, error) {
+	if source.AgentSocket != "" {
+		return &upstreamKey{name: "agent " + source.AgentSocket, socket: source.AgentSocket}, nil
+	}
+
+	data, err := os.ReadFile(source.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream key %s: %w", source.KeyFile, err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstream key %s: %w", source.KeyFile, err)
+	}
+	return &upstreamKey{name: source.KeyFile, signer: signer}, nil
+}
+
+// authMethod returns the SSH auth method for the key and a function that
+// releases its resources once the handshake is done.
+func (k *upstreamKey) authMethod() (ssh.AuthMethod, func(), error) {
+	if k.signer != nil {
+		return ssh.PublicKeys(k.signer), func() {}, nil
+	}
+
+	conn, err := net.Dial("unix", k.socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to ssh-agent %s: %w", k.socket, err)
+	}
+	client := agent.NewClient(conn)
+	return ssh.PublicKeysCallback(client.Signers), func() { conn.Close() }, nil
+}
+
+// upstreamKeys selects the key the proxy authenticates with upstream.
+type upstreamKeys struct {
+	users   map[string]*upstreamKey // lower-case login -> key
+	deploys []deployKey
+}
+
+// deployKey is a loaded deploy key with its lower-case repo pattern and
+// allowed logins.
+type deployKey struct {
+	pattern string
+	logins  []string
+	key     *upstreamKey
+}
+
+// allows reports whether login may use the deploy key.
+func (d *deployKey) allows(login string) bool {
+	for _, allowed := range d.logins {
+		if allowed == "*" || strings.EqualFold(allowed, login) {
+			return true
+		}
+	}
+	return false
+}
+
+// newUpstreamKeys loads the configured user and deploy keys.
+func newUpstreamKeys(users []UserKey, deploys []DeployKey) (*upstreamKeys, error) {
+	k := &upstreamKeys{users: make(map[string]*upstreamKey, len(users))}
+
+	for _, user := range users {
+		key, err := loadKeySource(user.KeySource)
+		if err != nil {
+			return nil, fmt.Errorf("user key for %s: %w", user.Login, err)
+		}
+		login := strings.ToLower(user.Login)
+		if _, ok := k.users[login]; !ok {
+			k.users[login] = key
+		}
+	}
+
+	for _, deploy := range deploys {
+		key, err := loadKeySource(deploy.KeySource)
+		if err != nil {
+			return nil, fmt.Errorf("deploy key for %s: %w", deploy.Repo, err)
+		}
+		k.deploys = append(k.deploys, deployKey{pattern: strings.ToLower(deploy.Repo), logins: deploy.Logins, key: key})
+	}
+
+	return k, nil
+}
+
+// keyFor returns the key for a connection: the authenticated user's own key
+// if one is mapped, otherwise the first deploy key matching the repository
+// that login is allowed to use.
+func (k *upstreamKeys) keyFor(login, owner, repo string) (*upstreamKey, error) {
+	if login != "" {
+		if key, ok := k.users[strings.ToLower(login)]; ok {
+			return key, nil
+		}
+	}
+
+	name := strings.ToLower(owner + "/" + repo)
+	for _, deploy := range k.deploys {
+		if matched, _ := path.Match(deploy.pattern, name); matched && deploy.allows(login) {
+			return deploy.key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w for %s/%s", errNoUpstreamKey, owner, repo)
+}
@@ -0,0 +1,154 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func writeTestKey(t *testing.T, dir, name string) string {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, name)
+	if err != nil {
+		t.Fatalf("MarshalPrivateKey() error = %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return path
+}
+
+func TestUpstreamKeysSelection(t *testing.T) {
+	dir := t.TempDir()
+	octocat := writeTestKey(t, dir, "octocat")
+	repo := writeTestKey(t, dir, "repo")
+	owner := writeTestKey(t, dir, "owner")
+
+	keys, err := newUpstreamKeys(
+		[]UserKey{{Login: "Octocat", KeySource: KeySource{KeyFile: octocat}}},
+		[]DeployKey{
+			{Repo: "myorg/special", Logins: []string{"*"}, KeySource: KeySource{KeyFile: repo}},
+			{Repo: "myorg/*", Logins: []string{"Hubot"}, KeySource: KeySource{KeyFile: owner}},
+		},
+	)
+	if err != nil {
+		t.Fatalf("newUpstreamKeys() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		login   string
+		owner   string
+		repo    string
+		want    string
+		wantErr bool
+	}{
+		{"user key wins", "octocat", "myorg", "special", octocat, false},
+		{"repo deploy key", "", "myorg", "special", repo, false},
+		{"owner deploy key", "hubot", "MyOrg", "Other", owner, false},
+		{"deploy key for unlisted login", "mallory", "myorg", "other", "", true},
+		{"no key", "hubot", "elsewhere", "repo", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := keys.keyFor(tt.login, tt.owner, tt.repo)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("keyFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && key.name != tt.want {
+				t.Errorf("keyFor() = %s, want %s", key.name, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamKeysInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deploy_key")
+	if err := os.WriteFile(path, []byte("not a key"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if _, err := newUpstreamKeys(nil, []DeployKey{{Repo: "owner/repo", Logins: []string{"*"}, KeySource: KeySource{KeyFile: path}}}); err == nil {
+		t.Error("expected an error for an invalid key file")
+	}
+}
+
+func TestUpstreamConnectWithAgentKey(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: private}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey() error = %v", err)
+	}
+	server := newTestUpstream(t, signer.PublicKey())
+
+	u, err := NewUpstream(&UpstreamConfig{
+		Address:        server.addr,
+		User:           "git",
+		KnownHostsFile: server.knownHosts,
+		DeployKeys:     []DeployKey{{Repo: "owner/*", Logins: []string{"*"}, KeySource: KeySource{AgentSocket: socket}}},
+	})
+	if err != nil {
+		t.Fatalf("NewUpstream() error = %v", err)
+	}
+
+	gitCmd := &GitCommand{Operation: "git-upload-pack", Owner: "owner", Repo: "repo"}
+	channel, err := u.Connect(context.Background(), gitCmd, "", "")
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer channel.Close()
+
+	out, err := io.ReadAll(channel)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if string(out) != gitCmd.FormatGitHubCommand() {
+		t.Errorf("upstream ran %q, want %q", out, gitCmd.FormatGitHubCommand())
+	}
+
+	if _, err := u.Connect(context.Background(), &GitCommand{Operation: "git-upload-pack", Owner: "other", Repo: "repo"}, "", ""); err == nil {
+		t.Error("expected an error for a repository without a key")
+	}
+}
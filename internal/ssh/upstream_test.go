@@ -0,0 +1,289 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestUpstreamGitHubHostKeys(t *testing.T) {
+	u, err := NewUpstream(nil)
+	if err != nil {
+		t.Fatalf("NewUpstream() error = %v", err)
+	}
+	if u.Address() != "github.com:22" {
+		t.Errorf("Address() = %q, want github.com:22", u.Address())
+	}
+
+	github, _, _, _, err := ssh.ParseAuthorizedKey([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"))
+	if err != nil {
+		t.Fatalf("ParseAuthorizedKey() error = %v", err)
+	}
+	remote := &net.TCPAddr{IP: net.IPv4(140, 82, 121, 3), Port: 22}
+
+	if err := u.hostKey("github.com:22", remote, github); err != nil {
+		t.Errorf("GitHub's published key was rejected: %v", err)
+	}
+	if err := u.hostKey("github.com:22", remote, newTestPublicKey(t)); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("unknown key error = %v, want ErrHostKeyMismatch", err)
+	}
+}
+
+func TestUpstreamKnownHostsFile(t *testing.T) {
+	pinned, other := newTestPublicKey(t), newTestPublicKey(t)
+
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{"ghe.example.com:2222"}, pinned) + "\n"
+	if err := os.WriteFile(path, []byte(line), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	u, err := NewUpstream(&UpstreamConfig{Address: "ghe.example.com:2222", User: "git", KnownHostsFile: path})
+	if err != nil {
+		t.Fatalf("NewUpstream() error = %v", err)
+	}
+	if len(u.hostKeyAlgorithms) != 1 || u.hostKeyAlgorithms[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("hostKeyAlgorithms = %v, want [%s]", u.hostKeyAlgorithms, ssh.KeyAlgoED25519)
+	}
+
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2222}
+	if err := u.hostKey("ghe.example.com:2222", remote, pinned); err != nil {
+		t.Errorf("pinned key was rejected: %v", err)
+	}
+	if err := u.hostKey("ghe.example.com:2222", remote, other); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("unknown key error = %v, want ErrHostKeyMismatch", err)
+	}
+
+	if _, err := NewUpstream(&UpstreamConfig{Address: "other.example.com:22", KnownHostsFile: path}); err == nil {
+		t.Error("expected an error for a host without pinned keys")
+	}
+}
+
+func TestUpstreamConnectRefusesUnpinnedHost(t *testing.T) {
+	keyFile := writeTestKey(t, t.TempDir(), "deploy_key")
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		t.Fatalf("ParsePrivateKey() error = %v", err)
+	}
+	server := newTestUpstream(t, signer.PublicKey())
+
+	// GitHub's pinned keys do not match the test server's host key
+	u, err := NewUpstream(&UpstreamConfig{
+		Address:    server.addr,
+		DeployKeys: []DeployKey{{Repo: "owner/repo", Logins: []string{"*"}, KeySource: KeySource{KeyFile: keyFile}}},
+	})
+	if err != nil {
+		t.Fatalf("NewUpstream() error = %v", err)
+	}
+
+	_, err = u.Connect(context.Background(), &GitCommand{Operation: "git-upload-pack", Owner: "owner", Repo: "repo"}, "", "")
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("Connect() error = %v, want ErrHostKeyMismatch", err)
+	}
+}
+
+func TestUpstreamConnectCancelled(t *testing.T) {
+	// A server that accepts connections but never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	keyFile := writeTestKey(t, t.TempDir(), "deploy_key")
+	u, err := NewUpstream(&UpstreamConfig{
+		Address:    listener.Addr().String(),
+		DeployKeys: []DeployKey{{Repo: "owner/repo", Logins: []string{"*"}, KeySource: KeySource{KeyFile: keyFile}}},
+	})
+	if err != nil {
+		t.Fatalf("NewUpstream() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := u.Connect(ctx, &GitCommand{Operation: "git-upload-pack", Owner: "owner", Repo: "repo"}, "", ""); err == nil {
+		t.Fatal("Connect() succeeded without a handshake")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Connect() took %v after the session ended", elapsed)
+	}
+}
+
+// testUpstream is a minimal SSH server standing in for GitHub. It accepts
+// one public key and answers every exec request with the command it ran.
+type testUpstream struct {
+	addr       string
+	hostKey    ssh.Signer
+	knownHosts string // known_hosts file pinning hostKey for addr
+}
+
+func newTestUpstream(t *testing.T, authorized ssh.PublicKey) *testUpstream {
+	t.Helper()
+
+	hostKey, err := ephemeralHostKey()
+	if err != nil {
+		t.Fatalf("ephemeralHostKey() error = %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return &ssh.Permissions{}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestUpstream(conn, config)
+		}
+	}()
+
+	u := &testUpstream{addr: listener.Addr().String(), hostKey: hostKey}
+	u.knownHosts = filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{u.addr}, hostKey.PublicKey()) + "\n"
+	if err := os.WriteFile(u.knownHosts, []byte(line), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return u
+}
+
+// serveTestUpstream handles one connection to the test upstream.
+func serveTestUpstream(netConn net.Conn, config *ssh.ServerConfig) {
+	defer netConn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(netConn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer channel.Close()
+			gitProtocol := ""
+			for req := range requests {
+				if req.Type == "env" {
+					var env struct{ Name, Value string }
+					ssh.Unmarshal(req.Payload, &env)
+					if env.Name == "GIT_PROTOCOL" {
+						gitProtocol = env.Value
+					}
+					req.Reply(true, nil)
+					continue
+				}
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				var payload struct{ Command string }
+				ssh.Unmarshal(req.Payload, &payload)
+				runTestCommand(channel, payload.Command, gitProtocol)
+				return
+			}
+		}()
+	}
+}
+
+// runTestCommand answers an exec request on the test upstream. Commands for
+// repositories named "missing" and "killed" fail like GitHub would.
+func runTestCommand(channel ssh.Channel, command, gitProtocol string) {
+	switch {
+	case strings.Contains(command, "/missing"):
+		fmt.Fprint(channel.Stderr(), "ERROR: Repository not found.\n")
+		channel.SendRequest("exit-status", false, ssh.Marshal(exitStatus{Status: 128}))
+	case strings.Contains(command, "/killed"):
+		channel.SendRequest("exit-signal", false, ssh.Marshal(exitSignal{Signal: "TERM", Error: "terminated"}))
+	default:
+		channel.Write([]byte(command))
+		if gitProtocol != "" {
+			fmt.Fprintf(channel.Stderr(), "GIT_PROTOCOL=%s\n", gitProtocol)
+		}
+		channel.SendRequest("exit-status", false, ssh.Marshal(exitStatus{Status: 0}))
+	}
+}
+
+func TestUpstreamConnectUsesDialer(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := writeTestKey(t, dir, "deploy_key")
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		t.Fatalf("ParsePrivateKey() error = %v", err)
+	}
+	server := newTestUpstream(t, signer.PublicKey())
+
+	// The upstream name only resolves through the dialer, as with a proxy
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{"github.example.com:22"}, server.hostKey.PublicKey()) + "\n"
+	if err := os.WriteFile(knownHosts, []byte(line), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	var dialed []string
+	u, err := NewUpstream(&UpstreamConfig{
+		Address:        "github.example.com:22",
+		User:           "git",
+		KnownHostsFile: knownHosts,
+		DeployKeys:     []DeployKey{{Repo: "owner/repo", Logins: []string{"*"}, KeySource: KeySource{KeyFile: keyFile}}},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return (&net.Dialer{}).DialContext(ctx, network, server.addr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewUpstream() error = %v", err)
+	}
+
+	channel, err := u.Connect(context.Background(), &GitCommand{Operation: "git-upload-pack", Owner: "owner", Repo: "repo"}, "", "")
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	channel.Close()
+
+	if len(dialed) != 1 || dialed[0] != "github.example.com:22" {
+		t.Errorf("dialed %v, want [github.example.com:22]", dialed)
+	}
+}